@@ -0,0 +1,353 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The operations of the traffic mix, one for each of the four RPC types
+const (
+	OpCreate = "create" // CreateLaptop: unary
+	OpSearch = "search" // SearchLaptop: server streaming
+	OpUpload = "upload" // UploadImage: client streaming
+	OpRate   = "rate"   // RateLaptop: bidirectional streaming
+)
+
+// OpTotal is the operation of the report of all operations
+const OpTotal = "total"
+
+var operations = []string{OpCreate, OpSearch, OpUpload, OpRate}
+
+// searchFilter is the filter of the search operations, it matches about half of the sample laptops
+var searchFilter = &pb.Filter{
+	MaxPriceUsd: 3000,
+	MinCpuCores: 4,
+	MinCpuGhz:   2.5,
+	MinRam:      &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE},
+}
+
+// Config configures a benchmark
+type Config struct {
+	QPS         float64        // 每秒开始的操作数
+	Duration    time.Duration  // 持续开始新操作的时间
+	Concurrency int            // 同时进行的操作数上限，达到上限时新的操作等待
+	Mix         map[string]int // 每种操作的权重
+	Laptops     int            // 开始前创建的laptop数，作为上传图片和打分的目标
+	ImageSize   int            // 上传图片的字节数
+	Ratings     int            // 每个RateLaptop stream发送的评分数
+}
+
+// DefaultConfig returns the config that runs an equal mix of the operations at 100 QPS for 10 seconds
+func DefaultConfig() Config {
+	return Config{
+		QPS:         100,
+		Duration:    10 * time.Second,
+		Concurrency: 100,
+		Mix:         map[string]int{OpCreate: 1, OpSearch: 1, OpUpload: 1, OpRate: 1},
+		Laptops:     10,
+		ImageSize:   64 << 10,
+		Ratings:     5,
+	}
+}
+
+func (config Config) validate() error {
+	switch {
+	case config.QPS <= 0:
+		return fmt.Errorf("QPS must be positive")
+	case config.Duration <= 0:
+		return fmt.Errorf("duration must be positive")
+	case config.Concurrency <= 0:
+		return fmt.Errorf("concurrency must be positive")
+	case config.Laptops <= 0 && (config.Mix[OpUpload] > 0 || config.Mix[OpRate] > 0):
+		return fmt.Errorf("laptops are required to upload images and rate")
+	case config.ImageSize <= 0 && config.Mix[OpUpload] > 0:
+		return fmt.Errorf("image size must be positive")
+	case config.Ratings <= 0 && config.Mix[OpRate] > 0:
+		return fmt.Errorf("ratings must be positive")
+	}
+
+	total := 0
+	for operation, weight := range config.Mix {
+		if !knownOperation(operation) || weight < 0 {
+			return fmt.Errorf("invalid weight %d of operation %q", weight, operation)
+		}
+		total += weight
+	}
+	if total == 0 {
+		return fmt.Errorf("the mix has no operations")
+	}
+	return nil
+}
+
+// ParseMix parses the weights of the operations such as "create=4,search=1,upload=2,rate=3",
+// the operations that are not listed are not run
+func ParseMix(text string) (map[string]int, error) {
+	mix := make(map[string]int)
+	for _, part := range strings.Split(text, ",") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid mix %q, must be operation=weight", part)
+		}
+		operation := strings.TrimSpace(pair[0])
+		if !knownOperation(operation) {
+			return nil, fmt.Errorf("unknown operation %q, must be one of %s", operation, strings.Join(operations, ", "))
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(pair[1]))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight of %s: %q", operation, pair[1])
+		}
+		mix[operation] = weight
+	}
+	return mix, nil
+}
+
+func knownOperation(operation string) bool {
+	for _, known := range operations {
+		if operation == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Report is the result of an operation, or of all operations
+type Report struct {
+	Operation  string           `json:"operation"`
+	Count      int64            `json:"count"`      // 完成的操作数，包括失败的操作
+	Codes      map[string]int64 `json:"codes"`      // 按gRPC状态码统计的操作数，成功为OK
+	Throughput float64          `json:"throughput"` // 每秒成功的操作数
+	Latency    Latency          `json:"latency_ms"` // 成功的操作的延迟
+}
+
+// Latency is the distribution of the latencies in milliseconds
+type Latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99_9"`
+	Max  float64 `json:"max"`
+}
+
+// Run starts the operations of the mix at the target QPS for the duration of the config, waits for them to finish
+// and returns the report of each operation followed by the total. The latency of an operation is measured from
+// its scheduled start time, so that the time waiting for an overloaded server is not hidden. When ctx is canceled,
+// no more operations are started and the reports of the finished operations are returned
+func Run(ctx context.Context, laptopClient *client.LaptopClient, config Config) ([]*Report, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	runner := &runner{
+		laptopClient: laptopClient,
+		config:       config,
+		histograms:   make(map[string]*Histogram),
+		codes:        make(map[string]map[string]int64),
+	}
+	err = runner.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var weighted []string
+	for _, operation := range operations {
+		for i := 0; i < config.Mix[operation]; i++ {
+			weighted = append(weighted, operation)
+		}
+	}
+
+	slots := make(chan struct{}, config.Concurrency)
+	interval := time.Duration(float64(time.Second) / config.QPS)
+	start := time.Now()
+	end := start.Add(config.Duration)
+	var wg sync.WaitGroup
+
+schedule:
+	for i := 0; ; i++ {
+		// 按固定的间隔安排操作，不受之前的操作是否完成影响
+		scheduled := start.Add(time.Duration(i) * interval)
+		if !scheduled.Before(end) {
+			break
+		}
+
+		timer := time.NewTimer(time.Until(scheduled))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			break schedule
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			break schedule
+		}
+
+		operation := weighted[rand.Intn(len(weighted))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := runner.run(ctx, operation)
+			runner.record(operation, time.Since(scheduled), err)
+			<-slots
+		}()
+	}
+
+	wg.Wait()
+	return runner.reports(time.Since(start)), nil
+}
+
+type runner struct {
+	laptopClient *client.LaptopClient
+	config       Config
+	targets      []string
+	image        []byte
+
+	mutex      sync.Mutex
+	histograms map[string]*Histogram
+	codes      map[string]map[string]int64
+}
+
+// prepare creates the laptops to upload images and rate
+func (runner *runner) prepare(ctx context.Context) error {
+	if runner.config.Mix[OpUpload] == 0 && runner.config.Mix[OpRate] == 0 {
+		return nil
+	}
+
+	for i := 0; i < runner.config.Laptops; i++ {
+		id, err := runner.laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+		if err != nil {
+			return fmt.Errorf("cannot create the laptops to upload images and rate: %w", err)
+		}
+		runner.targets = append(runner.targets, id)
+	}
+
+	runner.image = make([]byte, runner.config.ImageSize)
+	rand.Read(runner.image)
+	return nil
+}
+
+func (runner *runner) run(ctx context.Context, operation string) error {
+	switch operation {
+	case OpCreate:
+		_, err := runner.laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+		return err
+	case OpSearch:
+		it, err := runner.laptopClient.SearchLaptop(ctx, searchFilter)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		for it.Next() {
+		}
+		return it.Err()
+	case OpUpload:
+		_, err := runner.laptopClient.UploadImage(ctx, runner.target(), ".jpg", bytes.NewReader(runner.image), nil)
+		return err
+	case OpRate:
+		laptopIDs := make([]string, runner.config.Ratings)
+		scores := make([]float64, runner.config.Ratings)
+		for i := range laptopIDs {
+			laptopIDs[i] = runner.target()
+			scores[i] = sample.RandomLaptopScore()
+		}
+		_, err := runner.laptopClient.RateLaptop(ctx, laptopIDs, scores)
+		return err
+	default:
+		return fmt.Errorf("unknown operation %q", operation)
+	}
+}
+
+func (runner *runner) target() string {
+	return runner.targets[rand.Intn(len(runner.targets))]
+}
+
+func (runner *runner) record(operation string, latency time.Duration, err error) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	if runner.codes[operation] == nil {
+		runner.codes[operation] = make(map[string]int64)
+		runner.histograms[operation] = NewHistogram()
+	}
+	runner.codes[operation][status.Code(err).String()]++
+	if err == nil {
+		runner.histograms[operation].Record(latency)
+	}
+}
+
+func (runner *runner) reports(elapsed time.Duration) []*Report {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+
+	var reports []*Report
+	total := NewHistogram()
+	totalCodes := make(map[string]int64)
+	for _, operation := range operations {
+		if runner.config.Mix[operation] == 0 {
+			continue
+		}
+		histogram := runner.histograms[operation]
+		if histogram == nil {
+			histogram = NewHistogram()
+		}
+		reports = append(reports, newReport(operation, histogram, runner.codes[operation], elapsed))
+
+		total.Merge(histogram)
+		for code, count := range runner.codes[operation] {
+			totalCodes[code] += count
+		}
+	}
+	return append(reports, newReport(OpTotal, total, totalCodes, elapsed))
+}
+
+func newReport(operation string, histogram *Histogram, codes map[string]int64, elapsed time.Duration) *Report {
+	report := &Report{Operation: operation, Codes: make(map[string]int64)}
+	for code, count := range codes {
+		report.Codes[code] = count
+		report.Count += count
+	}
+	if elapsed > 0 {
+		report.Throughput = float64(histogram.Count()) / elapsed.Seconds()
+	}
+
+	report.Latency = Latency{
+		Min:  milliseconds(histogram.Min()),
+		Mean: milliseconds(histogram.Mean()),
+		P50:  milliseconds(histogram.Percentile(50)),
+		P90:  milliseconds(histogram.Percentile(90)),
+		P99:  milliseconds(histogram.Percentile(99)),
+		P999: milliseconds(histogram.Percentile(99.9)),
+		Max:  milliseconds(histogram.Max()),
+	}
+	return report
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+// ErrorCodes returns the codes of the failed operations in the report, sorted by name
+func (report *Report) ErrorCodes() []string {
+	var codes []string
+	for code := range report.Codes {
+		if code != "OK" {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
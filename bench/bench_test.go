@@ -0,0 +1,63 @@
+package bench_test
+
+import (
+	"context"
+	"github.com/Ruadgedy/pcbook-go/bench"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	server, err := bench.StartServer()
+	require.NoError(t, err)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(server.Address, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	config := bench.DefaultConfig()
+	config.QPS = 200
+	config.Duration = 500 * time.Millisecond
+	config.ImageSize = 1024
+	reports, err := bench.Run(context.Background(), client.NewLaptopClient(conn), config)
+	require.NoError(t, err)
+
+	require.Len(t, reports, 5)
+	operations := []string{bench.OpCreate, bench.OpSearch, bench.OpUpload, bench.OpRate, bench.OpTotal}
+	for i, report := range reports {
+		require.Equal(t, operations[i], report.Operation)
+		require.Empty(t, report.ErrorCodes())
+		require.Equal(t, report.Count, report.Codes["OK"])
+	}
+
+	total := reports[len(reports)-1]
+	require.Equal(t, int64(100), total.Count)
+	require.Greater(t, total.Throughput, 0.0)
+	require.Greater(t, total.Latency.P99, 0.0)
+	require.LessOrEqual(t, total.Latency.P50, total.Latency.P99)
+	require.LessOrEqual(t, total.Latency.P99, total.Latency.Max)
+}
+
+func TestParseMix(t *testing.T) {
+	t.Parallel()
+
+	mix, err := bench.ParseMix("create=4, rate=1")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{bench.OpCreate: 4, bench.OpRate: 1}, mix)
+
+	_, err = bench.ParseMix("delete=1")
+	require.Error(t, err)
+	_, err = bench.ParseMix("create=-1")
+	require.Error(t, err)
+
+	config := bench.DefaultConfig()
+	config.Mix = map[string]int{bench.OpCreate: 0}
+	_, err = bench.Run(context.Background(), nil, config)
+	require.Error(t, err)
+}
@@ -0,0 +1,152 @@
+package bench
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	// subBucketCount is the number of linear sub-buckets of each power of two, values are recorded
+	// with a relative error below 1/1024, which is 3 significant decimal digits
+	subBucketCount = 2048
+	subBucketHalf  = subBucketCount / 2
+	subBucketBits  = 11 // bits.Len64(subBucketCount - 1)
+)
+
+// Histogram is an HDR histogram of latencies: values below subBucketCount nanoseconds are counted exactly,
+// larger values are counted in log-linear buckets, so that the percentiles keep 3 significant digits
+// from nanoseconds to hours with a small fixed memory. It is not safe for concurrent use
+type Histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+// NewHistogram returns an empty histogram
+func NewHistogram() *Histogram {
+	return &Histogram{min: math.MaxInt64}
+}
+
+// Record records a latency, negative values are recorded as 0
+func (h *Histogram) Record(latency time.Duration) {
+	value := int64(latency)
+	if value < 0 {
+		value = 0
+	}
+
+	index := bucketIndex(value)
+	if index >= len(h.counts) {
+		// 按需增加桶，只记录较小的值时占用的内存很少
+		counts := make([]int64, index+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[index]++
+	h.count++
+	h.sum += float64(value)
+	if value < h.min {
+		h.min = value
+	}
+	if value > h.max {
+		h.max = value
+	}
+}
+
+// Merge adds the values recorded by other to h
+func (h *Histogram) Merge(other *Histogram) {
+	if len(other.counts) > len(h.counts) {
+		counts := make([]int64, len(other.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	h.count += other.count
+	h.sum += other.sum
+	if other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Count returns the number of recorded values
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+// Min returns the smallest recorded value, or 0 when nothing is recorded
+func (h *Histogram) Min() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.min)
+}
+
+// Max returns the largest recorded value
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max)
+}
+
+// Mean returns the mean of the recorded values
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / float64(h.count))
+}
+
+// Percentile returns the value below which the percent of the recorded values fall, such as 99.9.
+// The value is the highest value of its bucket, but never larger than the max recorded value
+func (h *Histogram) Percentile(percent float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(percent / 100 * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	total := int64(0)
+	for index, count := range h.counts {
+		total += count
+		if total >= rank {
+			value := highestValue(index)
+			if value > h.max {
+				value = h.max
+			}
+			return time.Duration(value)
+		}
+	}
+	return time.Duration(h.max)
+}
+
+// bucketIndex returns the index of the bucket of the value, the first subBucketCount buckets have the exact
+// values, each following power of two is split into subBucketHalf buckets
+func bucketIndex(value int64) int {
+	if value < subBucketCount {
+		return int(value)
+	}
+	shift := bits.Len64(uint64(value)) - subBucketBits
+	return subBucketCount + (shift-1)*subBucketHalf + int(value>>uint(shift)) - subBucketHalf
+}
+
+// lowestValue returns the smallest value in the bucket
+func lowestValue(index int) int64 {
+	if index < subBucketCount {
+		return int64(index)
+	}
+	shift := (index-subBucketCount)/subBucketHalf + 1
+	subBucket := (index-subBucketCount)%subBucketHalf + subBucketHalf
+	return int64(subBucket) << uint(shift)
+}
+
+// highestValue returns the largest value in the bucket
+func highestValue(index int) int64 {
+	return lowestValue(index+1) - 1
+}
@@ -0,0 +1,48 @@
+package bench_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/bench"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+
+	histogram := bench.NewHistogram()
+	require.Equal(t, time.Duration(0), histogram.Percentile(99))
+
+	for i := 1; i <= 10000; i++ {
+		histogram.Record(time.Duration(i) * time.Microsecond)
+	}
+	require.Equal(t, int64(10000), histogram.Count())
+	require.Equal(t, time.Microsecond, histogram.Min())
+	require.Equal(t, 10*time.Millisecond, histogram.Max())
+	require.InDelta(t, float64(5000500*time.Nanosecond), float64(histogram.Mean()), 1)
+
+	// 百分位数保留3位有效数字
+	for _, percentile := range []struct {
+		percent  float64
+		expected time.Duration
+	}{
+		{50, 5 * time.Millisecond},
+		{90, 9 * time.Millisecond},
+		{99, 9900 * time.Microsecond},
+		{99.9, 9990 * time.Microsecond},
+		{100, 10 * time.Millisecond},
+	} {
+		value := histogram.Percentile(percentile.percent)
+		require.GreaterOrEqual(t, int64(value), int64(percentile.expected))
+		require.InEpsilon(t, float64(percentile.expected), float64(value), 0.001)
+	}
+
+	other := bench.NewHistogram()
+	other.Record(time.Hour)
+	other.Record(500 * time.Nanosecond)
+	histogram.Merge(other)
+	require.Equal(t, int64(10002), histogram.Count())
+	require.Equal(t, 500*time.Nanosecond, histogram.Min())
+	require.Equal(t, time.Hour, histogram.Max())
+	require.Equal(t, time.Hour, histogram.Percentile(100))
+}
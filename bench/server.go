@@ -0,0 +1,60 @@
+package bench
+
+import (
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+// Server is an in-process laptop server with in-memory stores and without authentication,
+// it is used to benchmark the client and the services in CI without a deployed server
+type Server struct {
+	Address string
+
+	grpcServer  *grpc.Server
+	imageFolder string
+}
+
+// StartServer starts an in-process server on a random local port. The search of the laptop store has no simulated
+// delay, so that the latencies are of the services themselves
+func StartServer() (*Server, error) {
+	imageFolder, err := ioutil.TempDir("", "pcbook-bench-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create image folder: %w", err)
+	}
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptopStore.SetSearchDelay(0)
+	laptopServer := service.NewLaptopServer(
+		laptopStore,
+		service.NewDiskImageStore(imageFolder),
+		service.NewInMemoryRatingStore(),
+		service.NewRatingBroker(100, service.DropUpdates),
+	)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(imageFolder)
+		return nil, fmt.Errorf("cannot start server: %w", err)
+	}
+	go grpcServer.Serve(listener)
+
+	return &Server{
+		Address:     listener.Addr().String(),
+		grpcServer:  grpcServer,
+		imageFolder: imageFolder,
+	}, nil
+}
+
+// Stop stops the server and removes the uploaded images
+func (server *Server) Stop() {
+	server.grpcServer.Stop()
+	os.RemoveAll(server.imageFolder)
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// APIKeyCredentials attaches an API key to every RPC, it is used by service-to-service clients
+// instead of logging in with a username and password
+type APIKeyCredentials struct {
+	key string
+}
+
+// NewAPIKeyCredentials returns credentials that send the API key in the x-api-key header
+func NewAPIKeyCredentials(key string) *APIKeyCredentials {
+	return &APIKeyCredentials{key: key}
+}
+
+// WithAPIKey returns a dial option that authenticates every RPC with the API key
+func WithAPIKey(key string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(NewAPIKeyCredentials(key))
+}
+
+func (creds *APIKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"x-api-key": creds.key}, nil
+}
+
+// RequireTransportSecurity returns false so that the key can also be used with insecure connections in development
+func (creds *APIKeyCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+var _ credentials.PerRPCCredentials = (*APIKeyCredentials)(nil)
@@ -2,9 +2,14 @@ package client
 
 import (
 	"context"
+	"fmt"
 	"github.com/Ruadgedy/pcbook-go/pb"
 	"google.golang.org/grpc"
-	"time"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+	"sync"
 )
 
 // AuthClient is a client to call authentication RPC
@@ -12,17 +17,42 @@ type AuthClient struct {
 	service pb.AuthServiceClient
 	username string
 	password string
+	options *options
+
+	mutex sync.Mutex
+	refreshToken string // 最近一次登录或刷新得到的refresh token
+	accessToken string // 从缓存中读取的access token
 }
 
-// NewAuthClient returns a new auth client
-func NewAuthClient(cc *grpc.ClientConn,username,password string) *AuthClient {
+// NewAuthClient returns a new auth client. With a token cache, the cached tokens are used if they belong to
+// the user, or to any user when the username is empty
+func NewAuthClient(cc grpc.ClientConnInterface, username, password string, opts ...Option) *AuthClient {
 	service := pb.NewAuthServiceClient(cc)
-	return &AuthClient{service,username,password}
+	client := &AuthClient{service: service, username: username, password: password, options: newOptions(opts)}
+
+	if client.options.tokenCache != nil {
+		// 缓存无法读取时重新登录
+		token, err := client.options.tokenCache.Load()
+		if err != nil {
+			log.Print(err)
+		}
+		if token != nil && (username == "" || username == token.Username) {
+			client.username = token.Username
+			client.accessToken = token.AccessToken
+			client.refreshToken = token.RefreshToken
+		}
+	}
+	return client
+}
+
+// Username returns the username of the client, which is the user of the cached tokens if no username is given
+func (client *AuthClient) Username() string {
+	return client.username
 }
 
 // Login login user and returns the access token
-func (client *AuthClient) Login() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (client *AuthClient) Login(ctx context.Context) (string, error) {
+	ctx, cancel := withTimeout(ctx, client.options.timeout)
 	defer cancel()
 
 	req := &pb.LoginRequest{
@@ -34,6 +64,120 @@ func (client *AuthClient) Login() (string, error) {
 	if err != nil {
 		return "",err
 	}
+	if res.GetTwoFactorRequired() {
+		return client.verifyTwoFactor(ctx, res.GetChallengeToken())
+	}
 
+	client.setTokens(res.GetAccessToken(), res.GetRefreshToken())
 	return res.GetAccessToken(),nil
-}
\ No newline at end of file
+}
+
+// verifyTwoFactor exchanges the challenge token and the code for the tokens
+func (client *AuthClient) verifyTwoFactor(ctx context.Context, challengeToken string) (string, error) {
+	if client.options.twoFactorCode == nil {
+		return "", fmt.Errorf("user %s requires two-factor authentication", client.username)
+	}
+
+	code, err := client.options.twoFactorCode()
+	if err != nil {
+		return "", fmt.Errorf("cannot get two-factor code: %w", err)
+	}
+
+	req := &pb.VerifyTwoFactorRequest{
+		ChallengeToken: challengeToken,
+		Code:           code,
+	}
+	res, err := client.service.VerifyTwoFactor(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	client.setTokens(res.GetAccessToken(), res.GetRefreshToken())
+	return res.GetAccessToken(), nil
+}
+
+// Refresh exchanges the refresh token for a new access token,
+// and falls back to login with the password if there is no valid refresh token
+func (client *AuthClient) Refresh(ctx context.Context) (string, error) {
+	refreshToken := client.getRefreshToken()
+	if refreshToken == "" {
+		return client.Login(ctx)
+	}
+
+	refreshCtx, cancel := withTimeout(ctx, client.options.timeout)
+	defer cancel()
+
+	res, err := client.service.RefreshToken(refreshCtx, &pb.RefreshTokenRequest{RefreshToken: refreshToken})
+	if status.Code(err) == codes.Unauthenticated {
+		// refresh token过期或者被吊销，重新登录
+		client.setRefreshToken("")
+		return client.Login(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	client.setTokens(res.GetAccessToken(), res.GetRefreshToken())
+	return res.GetAccessToken(), nil
+}
+
+// Logout revokes the access token and the refresh token of the user
+func (client *AuthClient) Logout(ctx context.Context, accessToken string) error {
+	ctx, cancel := withTimeout(ctx, client.options.timeout)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", accessToken)
+	req := &pb.LogoutRequest{RefreshToken: client.getRefreshToken()}
+
+	_, err := client.service.Logout(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	client.setRefreshToken("")
+	if client.options.tokenCache != nil {
+		return client.options.tokenCache.Clear()
+	}
+	return nil
+}
+
+// cachedAccessToken returns the access token loaded from the token cache
+func (client *AuthClient) cachedAccessToken() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.accessToken
+}
+
+func (client *AuthClient) getRefreshToken() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.refreshToken
+}
+
+func (client *AuthClient) setRefreshToken(refreshToken string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.refreshToken = refreshToken
+}
+
+// setTokens saves the new tokens, and writes them to the token cache if there is one
+func (client *AuthClient) setTokens(accessToken, refreshToken string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.accessToken = accessToken
+	client.refreshToken = refreshToken
+
+	if client.options.tokenCache == nil {
+		return
+	}
+	token := &Token{
+		Username:     client.username,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}
+	// 缓存失败不影响本次使用，下次运行时重新登录
+	err := client.options.tokenCache.Save(token)
+	if err != nil {
+		log.Printf("cannot cache token: %v", err)
+	}
+}
@@ -2,19 +2,44 @@ package client
 
 import (
 	"context"
+	"github.com/dgrijalva/jwt-go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"log"
+	"sync"
 	"time"
 )
 
 // 我们向server发送请求之前，拦截下所有请求，舔加上access token再放行
 
-//AuthInterceptor is a client interceptor for authentication
+const (
+	// defaultTokenLifetime is assumed when the access token has no expiration time
+	defaultTokenLifetime = 30 * time.Second
+	// maxRefreshLeeway is the max time before the expiration that the token is refreshed
+	maxRefreshLeeway = time.Minute
+	// refreshRetryInterval is the time to wait before retrying a failed refresh
+	refreshRetryInterval = time.Second
+	// minCachedTokenLifetime is the min remaining lifetime of a cached access token to use it without refreshing
+	minCachedTokenLifetime = 10 * time.Second
+)
+
+//AuthInterceptor is a client interceptor for authentication. It refreshes the access token shortly before
+// it expires, and when the server rejects the token, it refreshes the token and retries the RPC once
 type AuthInterceptor struct {
 	authClient *AuthClient
 	authMethods map[string]bool
+
+	mutex sync.RWMutex
 	accessToken string
+	obtainedAt time.Time
+	expiresAt time.Time
+
+	refreshMutex sync.Mutex // 串行刷新，每个refresh token只能使用一次
+	ctx context.Context // 关闭后停止刷新
+	cancel context.CancelFunc
+	done chan struct{}
 }
 
 // Unary returns a client interceptor to authenticate unary RPC
@@ -29,14 +54,27 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
 	) error {
 		log.Printf("--> unary interceptor: %s", method)
 
-		if interceptor.authMethods[method] {
-			return invoker(interceptor.attachToken(ctx),method,req,reply,cc,opts...)
+		if !interceptor.authMethods[method] {
+			return invoker(ctx,method,req,reply,cc,opts...)
+		}
+
+		accessToken := interceptor.AccessToken()
+		err := invoker(attachToken(ctx, accessToken),method,req,reply,cc,opts...)
+		if status.Code(err) != codes.Unauthenticated {
+			return err
 		}
-		return invoker(ctx,method,req,reply,cc,opts...)
+
+		// token可能已经被吊销，或者服务端轮换了签名key，刷新后重试一次
+		if refreshErr := interceptor.refreshIfStale(ctx, accessToken); refreshErr != nil {
+			log.Printf("cannot refresh token: %v", refreshErr)
+			return err
+		}
+		return invoker(attachToken(ctx, interceptor.AccessToken()),method,req,reply,cc,opts...)
 	}
 }
 
-// Stream returns a client interceptor to authenticate stream RPC
+// Stream returns a client interceptor to authenticate stream RPC. A stream cannot be retried after
+// its messages are sent, so when the server rejects the token, only the following RPCs use the new token
 func (interceptor *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
 	return func(
 		ctx context.Context,
@@ -48,71 +86,179 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
 	) (stream grpc.ClientStream, err error) {
 		log.Printf("--> stream interceptor: %s",method)
 
-		if interceptor.authMethods[method] {
-			return streamer(interceptor.attachToken(ctx),desc,cc,method,opts...)
+		if !interceptor.authMethods[method] {
+			return streamer(ctx,desc,cc,method,opts...)
 		}
 
-		return streamer(ctx,desc,cc,method,opts...)
+		accessToken := interceptor.AccessToken()
+		stream, err = streamer(attachToken(ctx, accessToken),desc,cc,method,opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &authClientStream{ClientStream: stream, interceptor: interceptor, accessToken: accessToken}, nil
 	}
 }
 
+// AccessToken returns the current access token
+func (interceptor *AuthInterceptor) AccessToken() string {
+	interceptor.mutex.RLock()
+	defer interceptor.mutex.RUnlock()
+	return interceptor.accessToken
+}
 
-// 定时刷新token
-func (interceptor *AuthInterceptor) scheduleRefreshToken(refreshDuration time.Duration) error{
-	err := interceptor.refreshToken()
-	if err != nil {
-		return err
-	}
+// Close stops refreshing the token, it is safe to call it more than once
+func (interceptor *AuthInterceptor) Close() {
+	interceptor.cancel()
+	<-interceptor.done
+}
+
+// 在token过期之前刷新，直到interceptor被关闭
+func (interceptor *AuthInterceptor) refreshLoop() {
+	defer close(interceptor.done)
 
-	go func() {
-		wait := refreshDuration
-		for {
-			time.Sleep(wait)
-			err := interceptor.refreshToken()
-			if err != nil {
-				wait = time.Second
-			}else {
-				wait = refreshDuration
+	wait := interceptor.refreshWait()
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-interceptor.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := interceptor.refreshIfStale(interceptor.ctx, interceptor.AccessToken())
+		if err != nil {
+			if interceptor.ctx.Err() != nil {
+				return
 			}
+			log.Printf("cannot refresh token: %v", err)
+			wait = refreshRetryInterval
+		} else {
+			wait = interceptor.refreshWait()
 		}
-	}()
+	}
+}
 
-	return nil
+// refreshWait returns the time to wait before refreshing the current token, which is a tenth of
+// its lifetime before its expiration and at most maxRefreshLeeway
+func (interceptor *AuthInterceptor) refreshWait() time.Duration {
+	interceptor.mutex.RLock()
+	defer interceptor.mutex.RUnlock()
+
+	leeway := interceptor.expiresAt.Sub(interceptor.obtainedAt) / 10
+	if leeway > maxRefreshLeeway {
+		leeway = maxRefreshLeeway
+	}
+
+	wait := time.Until(interceptor.expiresAt) - leeway
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// refreshIfStale refreshes the token unless another caller has already replaced the stale token
+func (interceptor *AuthInterceptor) refreshIfStale(ctx context.Context, staleToken string) error {
+	interceptor.refreshMutex.Lock()
+	defer interceptor.refreshMutex.Unlock()
+
+	if interceptor.AccessToken() != staleToken {
+		return nil
+	}
+	return interceptor.refreshToken(ctx)
 }
 
-// 执行刷新token操作
-func (interceptor *AuthInterceptor) refreshToken() error{
-	accessToken, err := interceptor.authClient.Login()
+// 执行刷新token操作，优先使用refresh token，不再每次都发送用户名和密码，调用方需要持有refreshMutex
+func (interceptor *AuthInterceptor) refreshToken(ctx context.Context) error{
+	accessToken, err := interceptor.authClient.Refresh(ctx)
 	if err != nil {
 		return err
 	}
 
+	now := time.Now()
+	expiresAt := tokenExpiresAt(accessToken)
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(defaultTokenLifetime)
+	}
+
+	interceptor.mutex.Lock()
 	interceptor.accessToken = accessToken
-	log.Printf("token refreshed: %v\n",accessToken)
+	interceptor.obtainedAt = now
+	interceptor.expiresAt = expiresAt
+	interceptor.mutex.Unlock()
 
+	log.Printf("token refreshed, expires at %v", expiresAt.Format(time.RFC3339))
 	return nil
 }
 
+// tokenExpiresAt returns the expiration time of the access token, or zero if it is unknown.
+// The token is verified by the server, the client only reads its claims
+func tokenExpiresAt(accessToken string) time.Time {
+	claims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(accessToken, claims)
+	if err != nil {
+		return time.Time{}
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(exp), 0)
+}
+
 // 将accessToken 附加到context
-func (interceptor *AuthInterceptor) attachToken(ctx context.Context) context.Context {
-	return metadata.AppendToOutgoingContext(ctx,"authorization",interceptor.accessToken)
+func attachToken(ctx context.Context, accessToken string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx,"authorization",accessToken)
+}
+
+// authClientStream refreshes the token when the server rejects it during the stream
+type authClientStream struct {
+	grpc.ClientStream
+	interceptor *AuthInterceptor
+	accessToken string
 }
 
-//NewAuthInterceptor creates a new auth interceptor
+func (stream *authClientStream) RecvMsg(m interface{}) error {
+	err := stream.ClientStream.RecvMsg(m)
+	if status.Code(err) == codes.Unauthenticated {
+		if refreshErr := stream.interceptor.refreshIfStale(stream.interceptor.ctx, stream.accessToken); refreshErr != nil {
+			log.Printf("cannot refresh token: %v", refreshErr)
+		}
+	}
+	return err
+}
+
+//NewAuthInterceptor logs in and creates a new auth interceptor that attaches the access token to the methods,
+// the token is refreshed in the background until ctx is done or the interceptor is closed.
+// A cached access token that is still valid is used without logging in
 func NewAuthInterceptor(
+	ctx context.Context,
 	authClient *AuthClient,
 	authMethods map[string]bool,
-	refreshDuration time.Duration,
 ) (*AuthInterceptor,error){
 	interceptor := &AuthInterceptor{
 		authClient:  authClient,
 		authMethods: authMethods,
+		done:        make(chan struct{}),
 	}
 
-	err := interceptor.scheduleRefreshToken(refreshDuration)
-	if err != nil {
-		return nil, err
+	// 缓存中的token还没有过期时直接使用，不需要登录
+	accessToken := authClient.cachedAccessToken()
+	expiresAt := tokenExpiresAt(accessToken)
+	if time.Until(expiresAt) > minCachedTokenLifetime {
+		interceptor.accessToken = accessToken
+		interceptor.obtainedAt = time.Now()
+		interceptor.expiresAt = expiresAt
+	} else {
+		err := interceptor.refreshToken(ctx)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	interceptor.ctx, interceptor.cancel = context.WithCancel(ctx)
+	go interceptor.refreshLoop()
+
 	return interceptor,nil
 }
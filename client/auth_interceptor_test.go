@@ -0,0 +1,96 @@
+package client_test
+
+import (
+	"context"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuthInterceptor(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("user1", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	jwtManager := service.NewJWTManager("secret", 2*time.Second, time.Hour)
+	revokedTokenStore := service.NewInMemoryRevokedTokenStore()
+	serverInterceptor := service.NewAuthInterceptor(jwtManager, revokedTokenStore, nil, userStore, service.NewRolePolicy(map[string][]string{
+		"/techschool.pcbook.LaptopService/CreateLaptop": {service.RoleUser},
+	}))
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(serverInterceptor.Unary()),
+		grpc.StreamInterceptor(serverInterceptor.Stream()),
+	)
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(userStore, jwtManager, service.NewInMemoryRefreshTokenStore(), revokedTokenStore, nil, nil, nil, nil))
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil, nil))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	authConn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { authConn.Close() })
+
+	interceptor, err := client.NewAuthInterceptor(context.Background(), client.NewAuthClient(authConn, "user1", "secret"), map[string]bool{
+		"/techschool.pcbook.LaptopService/CreateLaptop": true,
+	})
+	require.NoError(t, err)
+	defer interceptor.Close()
+
+	conn, err := grpc.Dial(
+		listener.Addr().String(),
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(interceptor.Unary()),
+		grpc.WithStreamInterceptor(interceptor.Stream()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	laptopClient := client.NewLaptopClient(conn)
+
+	// 并发请求和后台刷新同时读写token
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// 服务端吊销token后，刷新token并重试一次
+	accessToken := interceptor.AccessToken()
+	claims, err := jwtManager.Verify(accessToken)
+	require.NoError(t, err)
+	require.NoError(t, revokedTokenStore.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0)))
+
+	_, err = laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+	require.NoError(t, err)
+	require.NotEqual(t, accessToken, interceptor.AccessToken())
+
+	// 在token过期之前自动刷新
+	accessToken = interceptor.AccessToken()
+	claims, err = jwtManager.Verify(accessToken)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return interceptor.AccessToken() != accessToken
+	}, 3*time.Second, 10*time.Millisecond)
+	require.True(t, time.Now().Before(time.Unix(claims.ExpiresAt, 0)), "token is refreshed after it expired")
+
+	interceptor.Close()
+	interceptor.Close()
+}
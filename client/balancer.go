@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	_ "google.golang.org/grpc/health" // 客户端健康检查，不健康的服务器不参与负载均衡
+	"google.golang.org/grpc/resolver"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The load balancing policies of WithLoadBalancing. Both policies only pick the servers that pass the
+// health checks, and route the calls with a sticky key to the same server while it is healthy
+const (
+	// RoundRobin picks the healthy servers in turn
+	RoundRobin = "pcbook_round_robin"
+	// LeastLoaded picks the healthy server with the fewest calls in progress on this connection
+	LeastLoaded = "pcbook_least_loaded"
+)
+
+// StaticScheme is the scheme of the targets that list the addresses of the servers,
+// such as pcbook:///host1:50051,host2:50052
+const StaticScheme = "pcbook"
+
+func init() {
+	resolver.Register(staticResolverBuilder{})
+	balancer.Register(base.NewBalancerBuilder(RoundRobin, &pickerBuilder{}, base.Config{HealthCheck: true}))
+	balancer.Register(base.NewBalancerBuilder(LeastLoaded, &pickerBuilder{leastLoaded: true}, base.Config{HealthCheck: true}))
+}
+
+// Target returns the dial target of the address. An address with a scheme such as dns:///pcbook.local:8080
+// is resolved by the gRPC resolver of the scheme, a comma separated list such as host1:50051,host2:50052
+// is resolved by the static resolver, and a single address is dialed directly
+func Target(address string) string {
+	if strings.Contains(address, "://") || !strings.Contains(address, ",") {
+		return address
+	}
+	return StaticScheme + ":///" + address
+}
+
+// WithLoadBalancing returns the dial option that balances the calls across the servers of the target with
+// the policy, RoundRobin or LeastLoaded. The servers are checked with the standard gRPC health service,
+// a server that does not implement it is considered healthy
+func WithLoadBalancing(policy string) grpc.DialOption {
+	return grpc.WithDefaultServiceConfig(fmt.Sprintf(
+		`{"loadBalancingConfig": [{%q: {}}], "healthCheckConfig": {"serviceName": ""}}`,
+		policy,
+	))
+}
+
+type stickyKey struct{}
+
+// WithStickyKey returns a context whose calls are routed to the same server as the other calls with the key,
+// as long as that server is healthy. When the server goes away, the calls with the key move to another server
+func WithStickyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, stickyKey{}, key)
+}
+
+// withDefaultStickyKey sets the key unless ctx already has a sticky key
+func withDefaultStickyKey(ctx context.Context, key string) context.Context {
+	if _, ok := ctx.Value(stickyKey{}).(string); ok {
+		return ctx
+	}
+	return WithStickyKey(ctx, key)
+}
+
+// staticResolverBuilder resolves the targets of StaticScheme to the listed addresses
+type staticResolverBuilder struct{}
+
+func (staticResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	var addresses []resolver.Address
+	for _, address := range strings.Split(target.Endpoint, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", address, err)
+		}
+		// 每个服务器的证书按自己的主机名验证，而不是整个target
+		addresses = append(addresses, resolver.Address{Addr: address, ServerName: host})
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no address in target %q", target.Endpoint)
+	}
+
+	err := cc.UpdateState(resolver.State{Addresses: addresses})
+	if err != nil {
+		return nil, err
+	}
+	return staticResolver{}, nil
+}
+
+func (staticResolverBuilder) Scheme() string {
+	return StaticScheme
+}
+
+// staticResolver has nothing to resolve again, the unreachable servers are reconnected by the balancer
+type staticResolver struct{}
+
+func (staticResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (staticResolver) Close() {}
+
+// pickerBuilder builds a picker of the healthy servers each time a server becomes ready or goes away
+type pickerBuilder struct {
+	leastLoaded bool
+}
+
+func (builder *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	picker := &picker{leastLoaded: builder.leastLoaded}
+	for subConn, subConnInfo := range info.ReadySCs {
+		picker.servers = append(picker.servers, &server{subConn: subConn, address: subConnInfo.Address.Addr})
+	}
+	// 从随机的服务器开始，避免所有客户端都先访问同一个服务器
+	picker.next = uint32(rand.Intn(len(picker.servers)))
+	return picker
+}
+
+// server is a healthy server of the picker. The calls in progress are counted by each picker, so the counts
+// start from 0 when a server becomes ready or goes away, which only affects the calls already in progress
+type server struct {
+	subConn  balancer.SubConn
+	address  string
+	inFlight int64
+}
+
+type picker struct {
+	leastLoaded bool
+	servers     []*server
+
+	mutex sync.Mutex
+	next  uint32
+}
+
+func (picker *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var picked *server
+	if key, ok := info.Ctx.Value(stickyKey{}).(string); ok {
+		picked = picker.sticky(key)
+	} else {
+		picked = picker.pick()
+	}
+
+	atomic.AddInt64(&picked.inFlight, 1)
+	return balancer.PickResult{
+		SubConn: picked.subConn,
+		Done: func(balancer.DoneInfo) {
+			atomic.AddInt64(&picked.inFlight, -1)
+		},
+	}, nil
+}
+
+// pick returns the next server, or the server with the fewest calls in progress starting from the next server
+func (picker *picker) pick() *server {
+	picker.mutex.Lock()
+	start := int(picker.next % uint32(len(picker.servers)))
+	picker.next++
+	picker.mutex.Unlock()
+
+	picked := picker.servers[start]
+	if !picker.leastLoaded {
+		return picked
+	}
+	for i := 1; i < len(picker.servers); i++ {
+		server := picker.servers[(start+i)%len(picker.servers)]
+		if atomic.LoadInt64(&server.inFlight) < atomic.LoadInt64(&picked.inFlight) {
+			picked = server
+		}
+	}
+	return picked
+}
+
+// sticky returns the server of the key by rendezvous hashing, so that a key only moves to another server
+// when its server goes away, and moves back when the server is healthy again
+func (picker *picker) sticky(key string) *server {
+	var picked *server
+	var highest uint64
+	for _, server := range picker.servers {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(server.address))
+		if score := hash.Sum64(); picked == nil || score > highest {
+			picked = server
+			highest = score
+		}
+	}
+	return picked
+}
@@ -0,0 +1,260 @@
+package client_test
+
+import (
+	"context"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadBalancingFailover(t *testing.T) {
+	t.Parallel()
+
+	servers := []*testBalancedServer{startTestBalancedServer(t), startTestBalancedServer(t)}
+	laptopClient := client.NewLaptopClient(dialBalanced(t, servers, client.RoundRobin))
+	ctx := context.Background()
+	waitForServers(t, laptopClient, servers)
+
+	// 轮流访问两个服务器
+	created, err := createLaptops(laptopClient, 10)
+	require.NoError(t, err)
+	require.Len(t, servers[0].laptops(created), 5)
+	require.Len(t, servers[1].laptops(created), 5)
+
+	// 不健康的服务器不再被访问
+	servers[0].health.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	require.Eventually(t, func() bool {
+		created, err := createLaptops(laptopClient, 4)
+		return err == nil && len(servers[1].laptops(created)) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 恢复健康之后重新参与负载均衡，另一个服务器停止后所有的调用都切换过来
+	servers[0].health.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	servers[1].grpcServer.Stop()
+	require.Eventually(t, func() bool {
+		id, err := laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+		return err == nil && len(servers[0].laptops([]string{id})) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	created, err = createLaptops(laptopClient, 5)
+	require.NoError(t, err)
+	require.Len(t, servers[0].laptops(created), 5)
+}
+
+func TestLoadBalancingLeastLoaded(t *testing.T) {
+	t.Parallel()
+
+	servers := []*testBalancedServer{startTestBalancedServer(t), startTestBalancedServer(t)}
+	conn := dialBalanced(t, servers, client.LeastLoaded)
+	laptopClient := client.NewLaptopClient(conn)
+	waitForServers(t, laptopClient, servers)
+
+	laptop := sample.NewLaptop()
+	for _, server := range servers {
+		require.NoError(t, server.laptopStore.Save(laptop))
+	}
+
+	// 没有sticky key的watch stream占用一个服务器，之后的调用都访问另一个服务器
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := pb.NewLaptopServiceClient(conn).WatchRatings(ctx, &pb.WatchRatingsRequest{LaptopIds: []string{laptop.GetId()}})
+	require.NoError(t, err)
+	_, err = stream.Header()
+	require.NoError(t, err)
+
+	created, err := createLaptops(laptopClient, 10)
+	require.NoError(t, err)
+	counts := []int{len(servers[0].laptops(created)), len(servers[1].laptops(created))}
+	require.ElementsMatch(t, []int{0, 10}, counts)
+}
+
+func TestLoadBalancingStickyRating(t *testing.T) {
+	t.Parallel()
+
+	servers := []*testBalancedServer{startTestBalancedServer(t), startTestBalancedServer(t)}
+	conn := dialBalanced(t, servers, client.RoundRobin)
+	laptopClient := client.NewLaptopClient(conn)
+	ctx := context.Background()
+	waitForServers(t, laptopClient, servers)
+
+	laptop := sample.NewLaptop()
+	for _, server := range servers {
+		require.NoError(t, server.laptopStore.Save(laptop))
+	}
+
+	// 所有的打分都发送到同一个服务器，评分次数连续增加
+	for i := 1; i <= 4; i++ {
+		responses, err := laptopClient.RateLaptop(ctx, []string{laptop.GetId()}, []float64{8})
+		require.NoError(t, err)
+		require.Len(t, responses, 1)
+		require.EqualValues(t, i, responses[0].GetRatedCount())
+	}
+	sticky, other := servers[0], servers[1]
+	if other.rated(laptop.GetId()) > 0 {
+		sticky, other = other, sticky
+	}
+	require.Equal(t, 4, sticky.rated(laptop.GetId()))
+
+	// 其他的key可以被路由到另一个服务器
+	for i := 0; i < 20; i++ {
+		_, err := laptopClient.RateLaptop(client.WithStickyKey(ctx, sample.NewLaptop().GetId()), []string{laptop.GetId()}, []float64{8})
+		require.NoError(t, err)
+	}
+	require.Greater(t, other.rated(laptop.GetId()), 0)
+
+	// 每个客户端有自己的key，不同客户端的打分分散到所有服务器
+	ratedCounts := []int{sticky.rated(laptop.GetId()), other.rated(laptop.GetId())}
+	for i := 0; i < 20; i++ {
+		_, err := client.NewLaptopClient(conn).RateLaptop(ctx, []string{laptop.GetId()}, []float64{8})
+		require.NoError(t, err)
+	}
+	require.Greater(t, sticky.rated(laptop.GetId()), ratedCounts[0])
+	require.Greater(t, other.rated(laptop.GetId()), ratedCounts[1])
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	updates := make(chan *pb.RateLaptopResponse, 100)
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- laptopClient.WatchRatings(watchCtx, []string{laptop.GetId()}, func(res *pb.RateLaptopResponse) error {
+			updates <- res
+			return nil
+		})
+	}()
+	require.Eventually(t, func() bool {
+		_, err := laptopClient.RateLaptop(ctx, []string{laptop.GetId()}, []float64{8})
+		return err == nil && len(updates) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 服务器停止后打分和watch都切换到另一个服务器
+	sticky.grpcServer.Stop()
+	before := other.rated(laptop.GetId())
+	require.Eventually(t, func() bool {
+		responses, err := laptopClient.RateLaptop(ctx, []string{laptop.GetId()}, []float64{8})
+		return err == nil && int(responses[0].GetRatedCount()) > before
+	}, 5*time.Second, 10*time.Millisecond)
+	// 之前的评分都是8，只有另一个服务器推送的更新平均分低于8
+	require.Eventually(t, func() bool {
+		_, err := laptopClient.RateLaptop(ctx, []string{laptop.GetId()}, []float64{1})
+		for err == nil && len(updates) > 0 {
+			if res := <-updates; res.GetAverageScore() < 8 {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-watchDone)
+}
+
+func TestTarget(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "localhost:8080", client.Target("localhost:8080"))
+	require.Equal(t, "pcbook:///host1:50051,host2:50052", client.Target("host1:50051,host2:50052"))
+	require.Equal(t, "dns:///pcbook.local:8080", client.Target("dns:///pcbook.local:8080"))
+}
+
+type testBalancedServer struct {
+	address     string
+	grpcServer  *grpc.Server
+	health      *health.Server
+	laptopStore service.LaptopStore
+	ratingStore service.RatingStore
+}
+
+// startTestBalancedServer starts a laptop server with its own stores and the health service
+func startTestBalancedServer(t *testing.T) *testBalancedServer {
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	laptopServer := service.NewLaptopServer(laptopStore, nil, ratingStore, service.NewRatingBroker(10, service.DropUpdates))
+	healthServer := health.NewServer()
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return &testBalancedServer{
+		address:     listener.Addr().String(),
+		grpcServer:  grpcServer,
+		health:      healthServer,
+		laptopStore: laptopStore,
+		ratingStore: ratingStore,
+	}
+}
+
+// laptops returns the ids of the laptops saved in the store of the server
+func (server *testBalancedServer) laptops(ids []string) []string {
+	var found []string
+	for _, id := range ids {
+		laptop, err := server.laptopStore.Find(id)
+		if err == nil && laptop != nil {
+			found = append(found, id)
+		}
+	}
+	return found
+}
+
+// rated returns the number of times the laptop is rated on the server
+func (server *testBalancedServer) rated(laptopID string) int {
+	rating, err := server.ratingStore.Find(laptopID)
+	if err != nil || rating == nil {
+		return 0
+	}
+	return int(rating.Count)
+}
+
+func dialBalanced(t *testing.T, servers []*testBalancedServer, policy string) *grpc.ClientConn {
+	var addresses []string
+	for _, server := range servers {
+		addresses = append(addresses, server.address)
+	}
+
+	conn, err := grpc.Dial(client.Target(strings.Join(addresses, ",")), grpc.WithInsecure(), client.WithLoadBalancing(policy))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitForServers waits until the calls are balanced across all the servers
+func waitForServers(t *testing.T, laptopClient *client.LaptopClient, servers []*testBalancedServer) {
+	require.Eventually(t, func() bool {
+		created, err := createLaptops(laptopClient, 2*len(servers))
+		if err != nil {
+			return false
+		}
+		for _, server := range servers {
+			if len(server.laptops(created)) == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func createLaptops(laptopClient *client.LaptopClient, count int) ([]string, error) {
+	var ids []string
+	for i := 0; i < count; i++ {
+		id, err := laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
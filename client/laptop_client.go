@@ -1,177 +1,360 @@
 package client
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
 )
 
-// LaptopClient is a client to call laptop service RPCs
+// imageChunkSize is the size of the image data sent in each upload request
+const imageChunkSize = 32 * 1024
+
+// LaptopClient is a client to call laptop service RPCs. The errors returned by the server are gRPC status errors,
+// so callers can check them with status.Code, for example codes.AlreadyExists when creating a laptop
 type LaptopClient struct {
 	service pb.LaptopServiceClient
+	options *options
+	// ratingStickyKey routes the rating and the watching of this client to the same server, so that the ratings
+	// are aggregated by one server and the watchers see them, unless the caller sets another key with WithStickyKey.
+	// Each client has a random key, so that the clients of the fleet spread over the servers
+	ratingStickyKey string
 }
 
 // NewLaptopClient returns a new laptop client
-func NewLaptopClient(cc *grpc.ClientConn) *LaptopClient {
+func NewLaptopClient(cc grpc.ClientConnInterface, opts ...Option) *LaptopClient {
 	service := pb.NewLaptopServiceClient(cc)
-	return &LaptopClient{service}
+	return &LaptopClient{service: service, options: newOptions(opts), ratingStickyKey: "ratings-" + uuid.New().String()}
 }
 
-// CreateLaptop calls create laptop RPC
-func (laptopClient *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
-	req := &pb.CreateLaptopRequest{
-		Laptop: laptop,
+// CreateLaptop calls create laptop RPC and returns the id of the new laptop. If the laptop has no id,
+// a copy with a new id is sent, so that retries of the call cannot create the laptop twice, and a retry
+// rejected because an earlier attempt created it returns the id
+func (laptopClient *LaptopClient) CreateLaptop(ctx context.Context, laptop *pb.Laptop) (string, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.options.timeout)
+	defer cancel()
+
+	if laptop.GetId() == "" {
+		laptop = proto.Clone(laptop).(*pb.Laptop)
+		laptop.Id = uuid.New().String()
+		ctx = withGeneratedID(ctx, laptop.Id)
+	}
+
+	req := &pb.CreateLaptopRequest{Laptop: laptop}
+	res, err := laptopClient.service.CreateLaptop(ctx, req)
+	if err != nil {
+		return "", err
 	}
+	return res.GetId(), nil
+}
 
-	// set timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// BulkCreateLaptops calls bulk create laptops RPC and returns the result of each laptop in the same order.
+// In dry run the laptops are only validated. The laptops are created after all of them are sent, so nothing
+// is created when ctx is canceled before that
+func (laptopClient *LaptopClient) BulkCreateLaptops(ctx context.Context, laptops []*pb.Laptop, dryRun bool) (*pb.BulkCreateLaptopsResponse, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.options.streamTimeout)
 	defer cancel()
 
-	res, err := laptopClient.service.CreateLaptop(ctx, req)
+	stream, err := laptopClient.service.BulkCreateLaptops(ctx)
 	if err != nil {
-		st, ok := status.FromError(err)
-		if ok && st.Code() == codes.AlreadyExists {
-			// not a big deal
-			log.Print("laptop already exists")
-		} else {
-			log.Fatal("cannot create laptop: ", err)
-		}
-		return
+		return nil, err
 	}
 
-	log.Printf("created laptop with id: %s", res.Id)
+	for _, laptop := range laptops {
+		err := stream.Send(&pb.BulkCreateLaptopsRequest{Laptop: laptop, DryRun: dryRun})
+		if err != nil {
+			// Send失败时服务端已经返回了错误，通过CloseAndRecv获取真正的原因
+			_, err = stream.CloseAndRecv()
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
 }
 
-// SearchLaptop calls search laptop RPC
-func (laptopClient *LaptopClient) SearchLaptop(filter *pb.Filter) {
-	log.Print("search filter: ", filter)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// GetLaptop calls get laptop RPC and returns the laptop of the id
+func (laptopClient *LaptopClient) GetLaptop(ctx context.Context, id string) (*pb.Laptop, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.options.timeout)
 	defer cancel()
 
+	res, err := laptopClient.service.GetLaptop(ctx, &pb.GetLaptopRequest{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	return res.GetLaptop(), nil
+}
+
+// SearchLaptop calls search laptop RPC and returns an iterator of the found laptops,
+// the iterator must be closed when the caller stops early
+func (laptopClient *LaptopClient) SearchLaptop(ctx context.Context, filter *pb.Filter) (*LaptopIterator, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.options.streamTimeout)
+
 	req := &pb.SearchLaptopRequest{Filter: filter}
 	stream, err := laptopClient.service.SearchLaptop(ctx, req)
 	if err != nil {
-		log.Fatal("cannot search laptop: ", err)
+		cancel()
+		return nil, err
 	}
+	return &LaptopIterator{stream: stream, cancel: cancel}, nil
+}
 
-	for {
-		res, err := stream.Recv()
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
-			log.Fatal("cannot receive response: ", err)
-		}
+// LaptopIterator iterates the laptops found by SearchLaptop:
+//
+//	for it.Next() {
+//		laptop := it.Laptop()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type LaptopIterator struct {
+	stream pb.LaptopService_SearchLaptopClient
+	cancel context.CancelFunc
+	laptop *pb.Laptop
+	err    error
+}
 
-		laptop := res.GetLaptop()
-		log.Print("- found: ", laptop.GetId())
-		log.Print("  + brand: ", laptop.GetBrand())
-		log.Print("  + name: ", laptop.GetName())
-		log.Print("  + cpu cores: ", laptop.GetCpu().GetNumberCores())
-		log.Print("  + cpu min ghz: ", laptop.GetCpu().GetMinGhz())
-		log.Print("  + ram: ", laptop.GetRam())
-		log.Print("  + price: ", laptop.GetPriceUsd())
+// Next receives the next laptop, it returns false when there are no more laptops or an error occurs
+func (it *LaptopIterator) Next() bool {
+	if it.err != nil {
+		return false
 	}
-}
 
-// UploadImage calls upload image RPC
-func (laptopClient *LaptopClient) UploadImage(laptopID string, imagePath string) {
-	file, err := os.Open(imagePath)
+	res, err := it.stream.Recv()
 	if err != nil {
-		log.Fatal("cannot open image file: ", err)
+		if err != io.EOF {
+			it.err = err
+		}
+		it.laptop = nil
+		it.Close()
+		return false
 	}
-	defer file.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	it.laptop = res.GetLaptop()
+	return true
+}
+
+// Laptop returns the laptop received by the last call to Next
+func (it *LaptopIterator) Laptop() *pb.Laptop {
+	return it.laptop
+}
+
+// Err returns the error that stopped the iteration, nil if all laptops are received
+func (it *LaptopIterator) Err() error {
+	return it.err
+}
+
+// Close cancels the search, it is safe to call it more than once
+func (it *LaptopIterator) Close() {
+	it.cancel()
+}
+
+// UploadImage calls upload image RPC to upload the image data read from the reader, imageType is the
+// file extension such as ".jpg". If progress is not nil, it is called with the total bytes sent after each chunk
+func (laptopClient *LaptopClient) UploadImage(
+	ctx context.Context,
+	laptopID string,
+	imageType string,
+	image io.Reader,
+	progress func(sent int64),
+) (*pb.UploadImageResponse, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.options.streamTimeout)
 	defer cancel()
 
 	stream, err := laptopClient.service.UploadImage(ctx)
 	if err != nil {
-		log.Fatal("cannot upload image: ", err)
+		return nil, err
 	}
 
 	req := &pb.UploadImageRequest{
 		Data: &pb.UploadImageRequest_Info{
 			Info: &pb.ImageInfo{
 				LaptopId:  laptopID,
-				ImageType: filepath.Ext(imagePath),
+				ImageType: imageType,
 			},
 		},
 	}
 
 	err = stream.Send(req)
 	if err != nil {
-		log.Fatal("cannot send image info to server: ", err, stream.RecvMsg(nil))
+		// Send失败时服务端已经返回了错误，通过CloseAndRecv获取真正的原因
+		_, err = stream.CloseAndRecv()
+		return nil, err
 	}
 
-	reader := bufio.NewReader(file)
-	buffer := make([]byte, 1024)
-
+	buffer := make([]byte, imageChunkSize)
+	sent := int64(0)
 	for {
-		n, err := reader.Read(buffer)
+		n, err := image.Read(buffer)
+		if n > 0 {
+			req := &pb.UploadImageRequest{
+				Data: &pb.UploadImageRequest_ChunkData{
+					ChunkData: buffer[:n],
+				},
+			}
+
+			err := stream.Send(req)
+			if err != nil {
+				_, err = stream.CloseAndRecv()
+				return nil, err
+			}
+
+			sent += int64(n)
+			if progress != nil {
+				progress(sent)
+			}
+		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatal("cannot read chunk to buffer: ", err)
+			return nil, fmt.Errorf("cannot read image data: %w", err)
 		}
+	}
 
-		req := &pb.UploadImageRequest{
-			Data: &pb.UploadImageRequest_ChunkData{
-				ChunkData: buffer[:n],
-			},
+	return stream.CloseAndRecv()
+}
+
+// UploadImageFile uploads the image file of the path, the image type is the extension of the file
+func (laptopClient *LaptopClient) UploadImageFile(
+	ctx context.Context,
+	laptopID string,
+	imagePath string,
+	progress func(sent int64),
+) (*pb.UploadImageResponse, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+	defer file.Close()
+
+	return laptopClient.UploadImage(ctx, laptopID, filepath.Ext(imagePath), file, progress)
+}
+
+// DownloadImage calls download image RPC to write the image data to the writer, and returns the image info.
+// If progress is not nil, it is called with the total bytes received after each chunk
+func (laptopClient *LaptopClient) DownloadImage(
+	ctx context.Context,
+	imageID string,
+	image io.Writer,
+	progress func(received int64),
+) (*pb.ImageInfo, error) {
+	ctx, cancel := withTimeout(ctx, laptopClient.options.streamTimeout)
+	defer cancel()
+
+	stream, err := laptopClient.service.DownloadImage(ctx, &pb.DownloadImageRequest{Id: imageID})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	info := res.GetInfo()
+	if info == nil {
+		return nil, fmt.Errorf("the first response is not the image info")
+	}
+
+	received := int64(0)
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
 		}
 
-		err = stream.Send(req)
+		chunk := res.GetChunkData()
+		_, err = image.Write(chunk)
 		if err != nil {
-			log.Fatal("cannot send chunk to server: ", err, stream.RecvMsg(nil))
+			return nil, fmt.Errorf("cannot write image data: %w", err)
+		}
+
+		received += int64(len(chunk))
+		if progress != nil {
+			progress(received)
 		}
 	}
 
-	res, err := stream.CloseAndRecv()
+	return info, nil
+}
+
+// DownloadImageFile downloads the image to a file in the folder, named by the image id and type,
+// and returns the path of the file
+func (laptopClient *LaptopClient) DownloadImageFile(
+	ctx context.Context,
+	imageID string,
+	folder string,
+	progress func(received int64),
+) (string, error) {
+	file, err := ioutil.TempFile(folder, "."+filepath.Base(imageID)+"-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create image file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	info, err := laptopClient.DownloadImage(ctx, imageID, file, progress)
 	if err != nil {
-		log.Fatal("cannot receive response: ", err)
+		return "", err
+	}
+	err = file.Close()
+	if err != nil {
+		return "", fmt.Errorf("cannot write image file: %w", err)
 	}
 
-	log.Printf("image uploaded with id: %s, size: %d", res.GetId(), res.GetSize())
+	// 下载完成后再重命名，中断时不会留下不完整的图片；图片类型由上传者提供，只保留扩展名
+	imagePath := filepath.Join(folder, filepath.Base(imageID)+filepath.Ext(info.GetImageType()))
+	err = os.Rename(file.Name(), imagePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot save image file: %w", err)
+	}
+	return imagePath, nil
 }
 
-// RateLaptop calls rate laptop RPC
-func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// RateLaptop calls rate laptop RPC to rate each laptop with the score of the same index,
+// and returns the updated rating of each laptop
+func (laptopClient *LaptopClient) RateLaptop(ctx context.Context, laptopIDs []string, scores []float64) ([]*pb.RateLaptopResponse, error) {
+	if len(laptopIDs) != len(scores) {
+		return nil, fmt.Errorf("got %d laptops but %d scores", len(laptopIDs), len(scores))
+	}
+
+	ctx = withDefaultStickyKey(ctx, laptopClient.ratingStickyKey)
+	ctx, cancel := withTimeout(ctx, laptopClient.options.streamTimeout)
 	defer cancel()
 
 	stream, err := laptopClient.service.RateLaptop(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot rate laptop: %v", err)
+		return nil, err
 	}
 
-	waitResponse := make(chan error)
+	type result struct {
+		responses []*pb.RateLaptopResponse
+		err       error
+	}
+	waitResponse := make(chan result, 1)
 	// go routine to receive responses
 	go func() {
+		var responses []*pb.RateLaptopResponse
 		for {
 			res, err := stream.Recv()
 			if err == io.EOF {
-				log.Print("no more responses")
-				waitResponse <- nil
+				waitResponse <- result{responses: responses}
 				return
 			}
 			if err != nil {
-				waitResponse <- fmt.Errorf("cannot receive stream response: %v", err)
+				waitResponse <- result{err: err}
 				return
 			}
-
-			log.Print("received response: ", res)
+			responses = append(responses, res)
 		}
 	}()
 
@@ -184,17 +367,77 @@ func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float6
 
 		err := stream.Send(req)
 		if err != nil {
-			return fmt.Errorf("cannot send stream request: %v - %v", err, stream.RecvMsg(nil))
+			// 服务端返回错误后Send失败，真正的原因由接收的go routine得到
+			break
 		}
-
-		log.Print("sent request: ", req)
 	}
 
 	err = stream.CloseSend()
 	if err != nil {
-		return fmt.Errorf("cannot close send: %v", err)
+		return nil, fmt.Errorf("cannot close send: %w", err)
 	}
 
-	err = <-waitResponse
-	return err
-}
\ No newline at end of file
+	res := <-waitResponse
+	return res.responses, res.err
+}
+
+// WatchRatings calls watch ratings RPC and calls updated with every rating update of the laptops until
+// the context is done or updated returns an error. Canceling the context is not reported as an error.
+// When the server goes away, the ratings are watched again on another server, the updates in between are lost
+func (laptopClient *LaptopClient) WatchRatings(ctx context.Context, laptopIDs []string, updated func(res *pb.RateLaptopResponse) error) error {
+	ctx, cancel := context.WithCancel(withDefaultStickyKey(ctx, laptopClient.ratingStickyKey))
+	defer cancel()
+
+	req := &pb.WatchRatingsRequest{LaptopIds: laptopIDs}
+	for attempt := 1; ; attempt++ {
+		received, err := laptopClient.watchRatings(ctx, req, updated, attempt > 1)
+		if received {
+			attempt = 1
+		}
+		if status.Code(err) != codes.Unavailable || ctx.Err() != nil {
+			if status.Code(err) == codes.Canceled && ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		timer := time.NewTimer(DefaultRetryPolicy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// watchRatings watches the ratings until the stream ends, and reports whether any update is received.
+// A watch again waits for a healthy server instead of failing at once
+func (laptopClient *LaptopClient) watchRatings(
+	ctx context.Context,
+	req *pb.WatchRatingsRequest,
+	updated func(res *pb.RateLaptopResponse) error,
+	waitForReady bool,
+) (bool, error) {
+	stream, err := laptopClient.service.WatchRatings(ctx, req, grpc.WaitForReady(waitForReady))
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return received, nil
+		}
+		if err != nil {
+			return received, err
+		}
+		received = true
+
+		err = updated(res)
+		if err != nil {
+			return received, err
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLaptopClient(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewDiskImageStore(t.TempDir())
+	ratingStore := service.NewInMemoryRatingStore()
+	ratingBroker := service.NewRatingBroker(10, service.DropUpdates)
+	laptopClient := client.NewLaptopClient(startTestLaptopServer(t, laptopStore, imageStore, ratingStore, ratingBroker))
+	ctx := context.Background()
+
+	laptop := sample.NewLaptop()
+	id, err := laptopClient.CreateLaptop(ctx, laptop)
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetId(), id)
+
+	// 服务端的错误是gRPC status，可以判断错误码
+	_, err = laptopClient.CreateLaptop(ctx, laptop)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	other, err := laptopClient.GetLaptop(ctx, laptop.GetId())
+	require.NoError(t, err)
+	require.True(t, proto.Equal(laptop, other))
+
+	_, err = laptopClient.GetLaptop(ctx, "unknown")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	it, err := laptopClient.SearchLaptop(ctx, &pb.Filter{MaxPriceUsd: laptop.GetPriceUsd()})
+	require.NoError(t, err)
+	var found []string
+	for it.Next() {
+		found = append(found, it.Laptop().GetId())
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []string{laptop.GetId()}, found)
+
+	image := bytes.Repeat([]byte{1}, 100*1024)
+	var progress []int64
+	res, err := laptopClient.UploadImage(ctx, laptop.GetId(), ".jpg", bytes.NewReader(image), func(sent int64) {
+		progress = append(progress, sent)
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetId())
+	require.EqualValues(t, len(image), res.GetSize())
+	require.Equal(t, int64(len(image)), progress[len(progress)-1])
+
+	_, err = laptopClient.UploadImage(ctx, "unknown", ".jpg", bytes.NewReader(image), nil)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	var downloaded bytes.Buffer
+	info, err := laptopClient.DownloadImage(ctx, res.GetId(), &downloaded, nil)
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetId(), info.GetLaptopId())
+	require.Equal(t, image, downloaded.Bytes())
+
+	folder := t.TempDir()
+	imagePath, err := laptopClient.DownloadImageFile(ctx, res.GetId(), folder, nil)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(folder, res.GetId()+".jpg"), imagePath)
+	require.FileExists(t, imagePath)
+
+	_, err = laptopClient.DownloadImageFile(ctx, "unknown", folder, nil)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	files, err := ioutil.ReadDir(folder)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	ratings, err := laptopClient.RateLaptop(ctx, []string{laptop.GetId(), laptop.GetId()}, []float64{8, 10})
+	require.NoError(t, err)
+	require.Len(t, ratings, 2)
+	require.Equal(t, uint32(2), ratings[1].GetRatedCount())
+	require.Equal(t, 9.0, ratings[1].GetAverageScore())
+
+	_, err = laptopClient.RateLaptop(ctx, []string{laptop.GetId()}, nil)
+	require.Error(t, err)
+
+	laptops := []*pb.Laptop{sample.NewLaptop(), laptop}
+	bulkRes, err := laptopClient.BulkCreateLaptops(ctx, laptops, true)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), bulkRes.GetCreatedCount())
+	bulkRes, err = laptopClient.BulkCreateLaptops(ctx, laptops, false)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), bulkRes.GetCreatedCount())
+	require.Equal(t, laptops[0].GetId(), bulkRes.GetResults()[0].GetId())
+	require.Equal(t, codes.AlreadyExists.String(), bulkRes.GetResults()[1].GetErrorCode())
+}
+
+func TestLaptopClientTimeout(t *testing.T) {
+	t.Parallel()
+
+	laptopClient := client.NewLaptopClient(startTestLaptopServer(t, service.NewInMemoryLaptopStore(), nil, nil, nil), client.WithTimeout(time.Nanosecond))
+
+	_, err := laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func startTestLaptopServer(t *testing.T, laptopStore service.LaptopStore, imageStore service.ImageStore, ratingStore service.RatingStore, ratingBroker *service.RatingBroker) *grpc.ClientConn {
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopServer(laptopStore, imageStore, ratingStore, ratingBroker))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the default timeout of unary RPCs
+	DefaultTimeout = 5 * time.Second
+	// DefaultStreamTimeout is the default timeout of streaming RPCs that end by themselves,
+	// such as searching laptops, uploading an image and rating laptops
+	DefaultStreamTimeout = 30 * time.Second
+)
+
+// Option configures a client
+type Option func(*options)
+
+type options struct {
+	timeout       time.Duration
+	streamTimeout time.Duration
+	tokenCache    *FileTokenCache
+	twoFactorCode func() (string, error)
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		timeout:       DefaultTimeout,
+		streamTimeout: DefaultStreamTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithTimeout sets the timeout of each unary RPC, 0 to only use the deadline of the caller's context
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithStreamTimeout sets the timeout of each streaming RPC that ends by itself,
+// 0 to only use the deadline of the caller's context. Watching ratings is never limited by this timeout
+func WithStreamTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.streamTimeout = timeout
+	}
+}
+
+// WithTokenCache makes the auth client load the tokens from the cache and save them after each login or refresh
+func WithTokenCache(cache *FileTokenCache) Option {
+	return func(o *options) {
+		o.tokenCache = cache
+	}
+}
+
+// WithTwoFactorCode makes the auth client call code to get the TOTP code or a recovery code
+// when the user requires two-factor authentication
+func WithTwoFactorCode(code func() (string, error)) Option {
+	return func(o *options) {
+		o.twoFactorCode = code
+	}
+}
+
+// withTimeout returns a context that is done after the timeout, the earlier deadline of ctx still applies
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,514 @@
+package client
+
+import (
+	"context"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"math"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures how the calls of a method are retried, only idempotent methods should be retried
+type RetryPolicy struct {
+	MaxAttempts       int           // 包括第一次调用，1表示不重试
+	InitialBackoff    time.Duration // 第一次重试之前的最大等待时间
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	RetryableCodes    []codes.Code
+	// HedgingDelay大于0时，上一次调用在这个时间内没有返回就并发发起下一次调用，使用最先成功的结果。
+	// 只用于unary方法，stream方法仍然在失败后重试
+	HedgingDelay time.Duration
+	// Idempotent不为nil时，只重试返回true的请求，例如带有id的创建请求
+	Idempotent func(req interface{}) bool
+	// Applied不为nil时，重试或对冲的调用失败后检查之前的调用是否已经在服务端执行，返回true时填充reply并当作成功
+	Applied func(ctx context.Context, req, reply interface{}, err error) bool
+}
+
+// DefaultRetryPolicy retries an unavailable server up to 3 times with exponential backoff
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:       4,
+	InitialBackoff:    100 * time.Millisecond,
+	MaxBackoff:        5 * time.Second,
+	BackoffMultiplier: 2,
+	RetryableCodes:    []codes.Code{codes.Unavailable},
+}
+
+// DefaultRetryPolicies returns the retry policies of the idempotent methods. CreateLaptop is only retried when
+// the request carries the laptop id, so that a retry after a lost response cannot create the laptop twice.
+// The server rejects that retry with codes.AlreadyExists, which is reported as success when LaptopClient
+// generated the id, since no one else can have created a laptop with it
+func DefaultRetryPolicies() map[string]*RetryPolicy {
+	policy := DefaultRetryPolicy
+	createPolicy := DefaultRetryPolicy
+	createPolicy.Idempotent = hasLaptopID
+	createPolicy.Applied = createdByEarlierAttempt
+	return map[string]*RetryPolicy{
+		"/techschool.pcbook.LaptopService/CreateLaptop": &createPolicy,
+		"/techschool.pcbook.LaptopService/SearchLaptop": &policy,
+		"/techschool.pcbook.*/Get*":                     &policy,
+		"/techschool.pcbook.*/List*":                    &policy,
+	}
+}
+
+// hasLaptopID checks if the create laptop request carries the id, without it the server generates a new id
+// on every attempt
+func hasLaptopID(req interface{}) bool {
+	createReq, ok := req.(*pb.CreateLaptopRequest)
+	return ok && createReq.GetLaptop().GetId() != ""
+}
+
+// generatedIDKey is the context key of the laptop id generated by LaptopClient for a create laptop call
+type generatedIDKey struct{}
+
+func withGeneratedID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, generatedIDKey{}, id)
+}
+
+// createdByEarlierAttempt checks if a retried create laptop request failed because an earlier attempt
+// created the laptop, and sets the id of the response. Only ids generated by LaptopClient are trusted,
+// an id given by the caller may belong to another laptop
+func createdByEarlierAttempt(ctx context.Context, req, reply interface{}, err error) bool {
+	createReq, ok := req.(*pb.CreateLaptopRequest)
+	if !ok || status.Code(err) != codes.AlreadyExists {
+		return false
+	}
+	res, ok := reply.(*pb.CreateLaptopResponse)
+	if !ok {
+		return false
+	}
+
+	id, _ := ctx.Value(generatedIDKey{}).(string)
+	if id == "" || id != createReq.GetLaptop().GetId() {
+		return false
+	}
+	res.Id = id
+	return true
+}
+
+// applied checks if the failed request was executed by an earlier attempt, and fills the reply if so
+func (policy *RetryPolicy) applied(ctx context.Context, req, reply interface{}, err error) bool {
+	return policy.Applied != nil && policy.Applied(ctx, req, reply, err)
+}
+
+func (policy *RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	for _, other := range policy.RetryableCodes {
+		if code == other {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns a random delay before the retry after the attempt, the upper bound grows exponentially
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	limit := float64(policy.InitialBackoff) * math.Pow(policy.BackoffMultiplier, float64(attempt-1))
+	if limit > float64(policy.MaxBackoff) {
+		limit = float64(policy.MaxBackoff)
+	}
+	if limit < 1 {
+		return 0
+	}
+	// full jitter，避免大量客户端同时重试
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// RetryBudget limits the retries when most calls fail, so that retries do not overload a struggling server.
+// Each failure takes a token and each success returns tokenRatio of a token, retries are allowed only while
+// more than half of the tokens are left
+type RetryBudget struct {
+	mutex      sync.Mutex
+	maxTokens  float64
+	tokenRatio float64
+	tokens     float64
+}
+
+// NewRetryBudget returns a retry budget with the max tokens and the tokens returned by each success
+func NewRetryBudget(maxTokens float64, tokenRatio float64) *RetryBudget {
+	return &RetryBudget{
+		maxTokens:  maxTokens,
+		tokenRatio: tokenRatio,
+		tokens:     maxTokens,
+	}
+}
+
+func (budget *RetryBudget) succeed() {
+	if budget == nil {
+		return
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.tokens = math.Min(budget.maxTokens, budget.tokens+budget.tokenRatio)
+}
+
+// fail takes a token for a failure and reports if a retry is still allowed
+func (budget *RetryBudget) fail() bool {
+	if budget == nil {
+		return true
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.tokens = math.Max(0, budget.tokens-1)
+	return budget.tokens > budget.maxTokens/2
+}
+
+// RetryInterceptor is a client interceptor that retries the calls of the methods with a retry policy.
+// It should be the first interceptor, so that each attempt passes the other interceptors again
+type RetryInterceptor struct {
+	policies map[string]*RetryPolicy // key是方法名，支持path.Match的通配符
+	budget   *RetryBudget
+}
+
+// NewRetryInterceptor returns a new retry interceptor, budget may be nil to allow unlimited retries
+func NewRetryInterceptor(policies map[string]*RetryPolicy, budget *RetryBudget) *RetryInterceptor {
+	return &RetryInterceptor{policies: policies, budget: budget}
+}
+
+// Unary returns a client interceptor to retry unary RPC
+func (interceptor *RetryInterceptor) Unary() grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		policy := interceptor.policy(method)
+		if policy == nil || (policy.Idempotent != nil && !policy.Idempotent(req)) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		if policy.HedgingDelay > 0 {
+			return interceptor.hedge(ctx, policy, method, req, reply, cc, invoker, opts)
+		}
+
+		for attempt := 1; ; attempt++ {
+			var trailer metadata.MD
+			err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Trailer(&trailer))...)
+			if err == nil {
+				interceptor.budget.succeed()
+				return nil
+			}
+			// 之前的调用已经执行，只是没有收到响应
+			if attempt > 1 && policy.applied(ctx, req, reply, err) {
+				interceptor.budget.succeed()
+				return nil
+			}
+
+			delay, ok := interceptor.retryDelay(ctx, policy, attempt, err, trailer)
+			if !ok || sleep(ctx, delay) != nil {
+				return err
+			}
+		}
+	}
+}
+
+// hedge sends a new attempt whenever the previous ones do not respond within the hedging delay or fail,
+// and returns the first successful response. Every attempt after the first one takes a token of the budget,
+// so that slow servers are not flooded with hedged attempts
+func (interceptor *RetryInterceptor) hedge(
+	ctx context.Context,
+	policy *RetryPolicy,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts []grpc.CallOption,
+) error {
+	replyMessage, ok := reply.(proto.Message)
+	if !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	// 返回时取消其他还没有完成的调用
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		reply proto.Message
+		err   error
+	}
+	results := make(chan result, policy.MaxAttempts)
+	started, pending := 0, 0
+	start := func() {
+		started++
+		pending++
+		// 每次调用使用单独的reply，避免并发写入
+		attemptReply := replyMessage.ProtoReflect().New().Interface()
+		go func() {
+			err := invoker(ctx, method, req, attemptReply, cc, opts...)
+			results <- result{attemptReply, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(policy.HedgingDelay)
+	defer timer.Stop()
+
+	// failed是不可重试的错误，不再发起新的调用，但是仍然等待已经发出的调用
+	var lastErr, failed error
+	for {
+		select {
+		case res := <-results:
+			pending--
+			// 对冲的调用之间，先执行的调用可能已经创建了资源
+			if res.err == nil || (started > 1 && policy.applied(ctx, req, res.reply, res.err)) {
+				interceptor.budget.succeed()
+				proto.Reset(replyMessage)
+				proto.Merge(replyMessage, res.reply)
+				return nil
+			}
+
+			lastErr = res.err
+			if failed == nil && !policy.retryable(res.err) {
+				failed = res.err
+			}
+			if failed == nil && interceptor.budget.fail() && started < policy.MaxAttempts {
+				start()
+				timer.Reset(policy.HedgingDelay)
+			} else if pending == 0 {
+				if failed != nil {
+					return failed
+				}
+				return lastErr
+			}
+		case <-timer.C:
+			// 预算不足时不再对冲，只等待已经发出的调用
+			if failed == nil && started < policy.MaxAttempts && interceptor.budget.fail() {
+				start()
+				timer.Reset(policy.HedgingDelay)
+			}
+		case <-ctx.Done():
+			if failed != nil {
+				return failed
+			}
+			if lastErr != nil {
+				return lastErr
+			}
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// Stream returns a client interceptor to retry server-streaming RPC until the first response is received,
+// streams that send more than one request are never retried
+func (interceptor *RetryInterceptor) Stream() grpc.StreamClientInterceptor {
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		policy := interceptor.policy(method)
+		if policy == nil || desc.ClientStreams {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		stream := &retryClientStream{
+			interceptor: interceptor,
+			policy:      policy,
+			ctx:         ctx,
+			newStream: func() (grpc.ClientStream, error) {
+				return streamer(ctx, desc, cc, method, opts...)
+			},
+		}
+		err := stream.start()
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+}
+
+// policy returns the retry policy of the method, exact names have priority over wildcards.
+// When several wildcards match, the one with the longest literal prefix is used, then the longest one
+func (interceptor *RetryInterceptor) policy(method string) *RetryPolicy {
+	if policy, ok := interceptor.policies[method]; ok {
+		return policy
+	}
+
+	var best *RetryPolicy
+	bestPattern, bestPrefix := "", -1
+	for pattern, policy := range interceptor.policies {
+		if ok, _ := path.Match(pattern, method); !ok {
+			continue
+		}
+
+		prefix := strings.IndexAny(pattern, `*?[\`)
+		if prefix < 0 {
+			prefix = len(pattern)
+		}
+		// map的遍历顺序是随机的，长度相同时按字典序选择，保证结果确定
+		if prefix > bestPrefix ||
+			(prefix == bestPrefix && len(pattern) > len(bestPattern)) ||
+			(prefix == bestPrefix && len(pattern) == len(bestPattern) && pattern < bestPattern) {
+			best, bestPattern, bestPrefix = policy, pattern, prefix
+		}
+	}
+	return best
+}
+
+// retryDelay returns the time to wait before retrying the failed attempt, or false if it cannot be retried.
+// The delay provided by the server has priority over the backoff of the policy
+func (interceptor *RetryInterceptor) retryDelay(
+	ctx context.Context,
+	policy *RetryPolicy,
+	attempt int,
+	err error,
+	trailer metadata.MD,
+) (time.Duration, bool) {
+	if !policy.retryable(err) {
+		return 0, false
+	}
+	if !interceptor.budget.fail() || attempt >= policy.MaxAttempts {
+		return 0, false
+	}
+
+	delay, ok := retryPushback(err, trailer)
+	if !ok {
+		delay = policy.backoff(attempt)
+	}
+	if delay < 0 {
+		return 0, false
+	}
+
+	// 等待之后已经超过deadline，没有必要重试
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		return 0, false
+	}
+	return delay, true
+}
+
+// retryPushback returns the delay that the server asks the client to wait, a negative delay means
+// the client should not retry. It is read from the RetryInfo error detail, the grpc-retry-pushback-ms
+// trailer or the retry-after trailer in seconds
+func retryPushback(err error, trailer metadata.MD) (time.Duration, bool) {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+
+	if values := trailer.Get("grpc-retry-pushback-ms"); len(values) > 0 {
+		ms, err := strconv.Atoi(values[0])
+		if err != nil || ms < 0 {
+			return -1, true
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	if values := trailer.Get("retry-after"); len(values) > 0 {
+		seconds, err := strconv.Atoi(values[0])
+		if err != nil || seconds < 0 {
+			return -1, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// sleep waits for the delay or until the context is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryClientStream replays the request on a new stream when the stream fails before the first response
+type retryClientStream struct {
+	grpc.ClientStream // 当前的调用
+	interceptor       *RetryInterceptor
+	policy            *RetryPolicy
+	ctx               context.Context
+	newStream         func() (grpc.ClientStream, error)
+
+	attempt   int
+	req       interface{} // server streaming只有一个请求
+	closeSend bool
+	received  bool
+}
+
+// start creates a new stream and replays the request, retrying while the stream cannot be created
+func (stream *retryClientStream) start() error {
+	for {
+		stream.attempt++
+		clientStream, err := stream.newStream()
+		if err == nil {
+			stream.ClientStream = clientStream
+			return stream.replay()
+		}
+
+		delay, ok := stream.interceptor.retryDelay(stream.ctx, stream.policy, stream.attempt, err, nil)
+		if !ok || sleep(stream.ctx, delay) != nil {
+			return err
+		}
+	}
+}
+
+func (stream *retryClientStream) replay() error {
+	if stream.req != nil {
+		err := stream.ClientStream.SendMsg(stream.req)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	if stream.closeSend {
+		return stream.ClientStream.CloseSend()
+	}
+	return nil
+}
+
+func (stream *retryClientStream) SendMsg(m interface{}) error {
+	stream.req = m
+	return stream.ClientStream.SendMsg(m)
+}
+
+func (stream *retryClientStream) CloseSend() error {
+	stream.closeSend = true
+	return stream.ClientStream.CloseSend()
+}
+
+func (stream *retryClientStream) RecvMsg(m interface{}) error {
+	for {
+		err := stream.ClientStream.RecvMsg(m)
+		if err == nil || err == io.EOF {
+			if !stream.received {
+				stream.received = true
+				stream.interceptor.budget.succeed()
+			}
+			return err
+		}
+		// 已经收到过响应时重试会重复返回结果
+		if stream.received {
+			return err
+		}
+
+		delay, ok := stream.interceptor.retryDelay(stream.ctx, stream.policy, stream.attempt, err, stream.ClientStream.Trailer())
+		if !ok || sleep(stream.ctx, delay) != nil {
+			return err
+		}
+		if startErr := stream.start(); startErr != nil {
+			return startErr
+		}
+	}
+}
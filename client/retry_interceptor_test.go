@@ -0,0 +1,387 @@
+package client_test
+
+import (
+	"context"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryInterceptor(t *testing.T) {
+	t.Parallel()
+
+	faults := &faultInjector{}
+	laptopClient := newRetryTestClient(t, faults, client.NewRetryInterceptor(testRetryPolicies(), nil))
+	ctx := context.Background()
+
+	// server streaming在收到第一条响应之前可以重试
+	faults.Set("SearchLaptop", codes.Unavailable, 2, nil)
+	it, err := laptopClient.SearchLaptop(ctx, &pb.Filter{MaxPriceUsd: 1e6})
+	require.NoError(t, err)
+	found := 0
+	for it.Next() {
+		found++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, 1, found)
+	require.Equal(t, 3, faults.Calls("SearchLaptop"))
+
+	// 两次Unavailable之后成功
+	faults.Set("CreateLaptop", codes.Unavailable, 2, nil)
+	_, err = laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+	require.NoError(t, err)
+	require.Equal(t, 3, faults.Calls("CreateLaptop"))
+
+	// 超过最大次数后返回最后一次的错误
+	faults.Set("CreateLaptop", codes.Unavailable, 10, nil)
+	_, err = laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 4, faults.Calls("CreateLaptop"))
+
+	// 不可重试的错误码
+	faults.Set("CreateLaptop", codes.InvalidArgument, 1, nil)
+	_, err = laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, 1, faults.Calls("CreateLaptop"))
+
+	// 服务端通过trailer要求等待一段时间再重试
+	faults.Set("CreateLaptop", codes.Unavailable, 1, metadata.Pairs("grpc-retry-pushback-ms", "300"))
+	start := time.Now()
+	_, err = laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(300*time.Millisecond))
+
+	// 负数表示不要重试
+	faults.Set("CreateLaptop", codes.Unavailable, 1, metadata.Pairs("grpc-retry-pushback-ms", "-1"))
+	_, err = laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, faults.Calls("CreateLaptop"))
+
+	// 没有配置重试策略的方法
+	faults.Set("RateLaptop", codes.Unavailable, 1, nil)
+	_, err = laptopClient.RateLaptop(ctx, []string{"id"}, []float64{5})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, faults.Calls("RateLaptop"))
+}
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	faults := &faultInjector{}
+	// 每次失败消耗一个token，剩余不超过一半时不再重试
+	laptopClient := newRetryTestClient(t, faults, client.NewRetryInterceptor(testRetryPolicies(), client.NewRetryBudget(4, 0.5)))
+
+	faults.Set("CreateLaptop", codes.Unavailable, 10, nil)
+	_, err := laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+
+	// 成功的调用逐渐恢复token
+	faults.Set("CreateLaptop", codes.Unavailable, 0, nil)
+	for i := 0; i < 4; i++ {
+		_, err = laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+		require.NoError(t, err)
+	}
+	faults.Set("CreateLaptop", codes.Unavailable, 1, nil)
+	_, err = laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+	require.NoError(t, err)
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+}
+
+func TestRetryHedging(t *testing.T) {
+	t.Parallel()
+
+	policy := client.DefaultRetryPolicy
+	policy.HedgingDelay = 50 * time.Millisecond
+	faults := &faultInjector{}
+	laptopClient := newRetryTestClient(t, faults, client.NewRetryInterceptor(map[string]*client.RetryPolicy{
+		"/techschool.pcbook.LaptopService/CreateLaptop": &policy,
+	}, nil))
+
+	// 第一次调用很慢，没有等它返回就发起了第二次调用
+	faults.SetDelay("CreateLaptop", time.Second, 1)
+	laptop := sample.NewLaptop()
+	start := time.Now()
+	id, err := laptopClient.CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetId(), id)
+	require.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+
+	// 对冲的调用也消耗重试预算，预算不足时只等待第一次调用
+	laptopClient = newRetryTestClient(t, faults, client.NewRetryInterceptor(map[string]*client.RetryPolicy{
+		"/techschool.pcbook.LaptopService/CreateLaptop": &policy,
+	}, client.NewRetryBudget(2, 0.1)))
+	faults.SetDelay("CreateLaptop", 200*time.Millisecond, 1)
+	_, err = laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+	require.NoError(t, err)
+	require.Equal(t, 1, faults.Calls("CreateLaptop"))
+
+	// 第一次调用保存之后才变慢，对冲的调用返回AlreadyExists，id是客户端生成的，当作创建成功
+	createPolicy := *client.DefaultRetryPolicies()["/techschool.pcbook.LaptopService/CreateLaptop"]
+	createPolicy.HedgingDelay = 50 * time.Millisecond
+	laptopClient = newRetryTestClient(t, faults, client.NewRetryInterceptor(map[string]*client.RetryPolicy{
+		"/techschool.pcbook.LaptopService/CreateLaptop": &createPolicy,
+	}, nil))
+	faults.SetDelay("CreateLaptop", 200*time.Millisecond, 1)
+	faults.SetAfterHandler("CreateLaptop")
+	laptop = sample.NewLaptop()
+	laptop.Id = ""
+	start = time.Now()
+	id, err = laptopClient.CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+	require.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+	found, err := laptopClient.GetLaptop(context.Background(), id)
+	require.NoError(t, err)
+	require.Equal(t, id, found.GetId())
+
+	// 调用方给出的id可能属于其他笔记本，不可重试的AlreadyExists不会马上返回，而是等待之前的调用成功
+	faults.SetDelay("CreateLaptop", 200*time.Millisecond, 1)
+	faults.SetAfterHandler("CreateLaptop")
+	laptop = sample.NewLaptop()
+	id, err = laptopClient.CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetId(), id)
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+
+	// 没有调用成功时返回不可重试的错误
+	faults.SetDelay("CreateLaptop", 200*time.Millisecond, 1)
+	_, err = laptopClient.CreateLaptop(context.Background(), laptop)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+}
+
+func TestDefaultRetryPolicies(t *testing.T) {
+	t.Parallel()
+
+	faults := &faultInjector{}
+	retryInterceptor := client.NewRetryInterceptor(client.DefaultRetryPolicies(), nil)
+	conn := newRetryTestConn(t, faults, retryInterceptor)
+	laptopClient := client.NewLaptopClient(conn)
+	ctx := context.Background()
+
+	// LaptopClient在第一次调用之前生成id，重试不会重复创建
+	laptop := sample.NewLaptop()
+	laptop.Id = ""
+	faults.Set("CreateLaptop", codes.Unavailable, 1, nil)
+	id, err := laptopClient.CreateLaptop(ctx, laptop)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+	require.Empty(t, laptop.GetId())
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+
+	// 第一次调用已经保存，只是响应丢失了，重试返回AlreadyExists时使用生成的id
+	faults.Set("CreateLaptop", codes.Unavailable, 1, nil)
+	faults.SetAfterHandler("CreateLaptop")
+	id, err = laptopClient.CreateLaptop(ctx, laptop)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+	found, err := laptopClient.GetLaptop(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, id, found.GetId())
+
+	// 调用方给出的id不能确定是这次调用创建的，仍然返回AlreadyExists
+	faults.Set("CreateLaptop", codes.Unavailable, 1, nil)
+	faults.SetAfterHandler("CreateLaptop")
+	_, err = laptopClient.CreateLaptop(ctx, sample.NewLaptop())
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	require.Equal(t, 2, faults.Calls("CreateLaptop"))
+
+	// 没有id的请求每次调用都会生成新的id，不能重试
+	faults.Set("CreateLaptop", codes.Unavailable, 1, nil)
+	_, err = pb.NewLaptopServiceClient(conn).CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, faults.Calls("CreateLaptop"))
+}
+
+func TestRetryPolicyWildcards(t *testing.T) {
+	t.Parallel()
+
+	noRetry := client.DefaultRetryPolicy
+	noRetry.MaxAttempts = 1
+	retry := testRetryPolicies()["/techschool.pcbook.LaptopService/CreateLaptop"]
+	faults := &faultInjector{}
+	laptopClient := newRetryTestClient(t, faults, client.NewRetryInterceptor(map[string]*client.RetryPolicy{
+		"/techschool.pcbook.*/Create*":       &noRetry,
+		"/techschool.pcbook.LaptopService/*": retry,
+		"/*/*":                               &noRetry,
+	}, nil))
+
+	// 多个通配符匹配时使用前缀最长的，和map的遍历顺序无关
+	for i := 0; i < 10; i++ {
+		faults.Set("CreateLaptop", codes.Unavailable, 1, nil)
+		_, err := laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+		require.NoError(t, err)
+		require.Equal(t, 2, faults.Calls("CreateLaptop"))
+	}
+}
+
+func testRetryPolicies() map[string]*client.RetryPolicy {
+	policy := client.DefaultRetryPolicy
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxBackoff = 10 * time.Millisecond
+	return map[string]*client.RetryPolicy{
+		"/techschool.pcbook.LaptopService/CreateLaptop": &policy,
+		"/techschool.pcbook.LaptopService/Search*":      &policy,
+	}
+}
+
+func newRetryTestClient(t *testing.T, faults *faultInjector, retryInterceptor *client.RetryInterceptor) *client.LaptopClient {
+	return client.NewLaptopClient(newRetryTestConn(t, faults, retryInterceptor))
+}
+
+func newRetryTestConn(t *testing.T, faults *faultInjector, retryInterceptor *client.RetryInterceptor) *grpc.ClientConn {
+	// 搜索每台笔记本都要等待一秒，只保存一台
+	laptopStore := service.NewInMemoryLaptopStore()
+	require.NoError(t, laptopStore.Save(sample.NewLaptop()))
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(faults.Unary()),
+		grpc.StreamInterceptor(faults.Stream()),
+	)
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopServer(laptopStore, nil, service.NewInMemoryRatingStore(), nil))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(
+		listener.Addr().String(),
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(retryInterceptor.Unary()),
+		grpc.WithStreamInterceptor(retryInterceptor.Stream()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// faultInjector is a server interceptor that fails or delays the first calls of a method,
+// before the handler runs or after it, as if the response is lost
+type faultInjector struct {
+	mutex  sync.Mutex
+	faults map[string]*fault // key是方法名，不包含服务名
+}
+
+type fault struct {
+	code     codes.Code
+	failures int
+	trailer  metadata.MD
+	delay    time.Duration
+	delays   int
+	after    bool // 在handler执行之后才延迟或者失败
+	calls    int
+}
+
+// Set makes the next calls of the method fail with the code, and resets its call count
+func (injector *faultInjector) Set(method string, code codes.Code, failures int, trailer metadata.MD) {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	if injector.faults == nil {
+		injector.faults = make(map[string]*fault)
+	}
+	injector.faults[method] = &fault{code: code, failures: failures, trailer: trailer}
+}
+
+// SetDelay makes the next calls of the method slow, and resets its call count
+func (injector *faultInjector) SetDelay(method string, delay time.Duration, delays int) {
+	injector.Set(method, codes.OK, 0, nil)
+
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	injector.faults[method].delay = delay
+	injector.faults[method].delays = delays
+}
+
+// SetAfterHandler makes the fault of the method happen after the handler runs
+func (injector *faultInjector) SetAfterHandler(method string) {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	injector.faults[method].after = true
+}
+
+// Calls returns the number of calls of the method since the fault was set
+func (injector *faultInjector) Calls(method string) int {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	if fault := injector.faults[method]; fault != nil {
+		return fault.calls
+	}
+	return 0
+}
+
+// inject counts the call and returns the delay, if the fault happens after the handler, and the error of the call
+func (injector *faultInjector) inject(fullMethod string) (time.Duration, metadata.MD, bool, error) {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	fault := injector.faults[fullMethod[len("/techschool.pcbook.LaptopService/"):]]
+	if fault == nil {
+		return 0, nil, false, nil
+	}
+
+	fault.calls++
+	var delay time.Duration
+	if fault.delays > 0 {
+		fault.delays--
+		delay = fault.delay
+	}
+	if fault.failures > 0 {
+		fault.failures--
+		return delay, fault.trailer, fault.after, status.Errorf(fault.code, "injected fault")
+	}
+	return delay, nil, fault.after, nil
+}
+
+func (injector *faultInjector) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		delay, trailer, after, err := injector.inject(info.FullMethod)
+		if after {
+			res, handlerErr := handler(ctx, req)
+			time.Sleep(delay)
+			if handlerErr != nil {
+				return nil, handlerErr
+			}
+			if err != nil {
+				grpc.SetTrailer(ctx, trailer)
+				return nil, err
+			}
+			return res, nil
+		}
+
+		time.Sleep(delay)
+		if err != nil {
+			grpc.SetTrailer(ctx, trailer)
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (injector *faultInjector) Stream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		delay, trailer, _, err := injector.inject(info.FullMethod)
+		time.Sleep(delay)
+		if err != nil {
+			stream.SetTrailer(trailer)
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
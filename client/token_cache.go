@@ -0,0 +1,88 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Token is the tokens of a logged in user
+type Token struct {
+	Username     string `json:"username"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// FileTokenCache caches the tokens of a user in a file, so that the user doesn't need to log in
+// again in each process. The file is only readable by its owner
+type FileTokenCache struct {
+	path string
+}
+
+// NewFileTokenCache returns a new token cache of the file path
+func NewFileTokenCache(path string) *FileTokenCache {
+	return &FileTokenCache{path: path}
+}
+
+// Load returns the cached tokens, or nil if there are no cached tokens
+func (cache *FileTokenCache) Load() (*Token, error) {
+	data, err := ioutil.ReadFile(cache.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read token cache: %w", err)
+	}
+
+	token := &Token{}
+	err = json.Unmarshal(data, token)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse token cache %s: %w", cache.path, err)
+	}
+	return token, nil
+}
+
+// Save replaces the cached tokens
+func (cache *FileTokenCache) Save(token *Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("cannot marshal token: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(cache.path), 0700)
+	if err != nil {
+		return fmt.Errorf("cannot create token cache folder: %w", err)
+	}
+
+	// 先写入临时文件再重命名，多个进程同时刷新时不会读到写了一半的文件
+	file, err := ioutil.TempFile(filepath.Dir(cache.path), filepath.Base(cache.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("cannot create token cache: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write token cache: %w", err)
+	}
+
+	err = os.Rename(file.Name(), cache.path)
+	if err != nil {
+		return fmt.Errorf("cannot save token cache: %w", err)
+	}
+	return nil
+}
+
+// Clear removes the cached tokens
+func (cache *FileTokenCache) Clear() error {
+	err := os.Remove(cache.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove token cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package client_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTokenCache(t *testing.T) {
+	t.Parallel()
+
+	// 目录不存在时自动创建
+	path := filepath.Join(t.TempDir(), "pcbook", "token.json")
+	cache := client.NewFileTokenCache(path)
+	token, err := cache.Load()
+	require.NoError(t, err)
+	require.Nil(t, token)
+
+	expected := &client.Token{Username: "user1", AccessToken: "access1", RefreshToken: "refresh1"}
+	require.NoError(t, cache.Save(expected))
+	token, err = cache.Load()
+	require.NoError(t, err)
+	require.Equal(t, expected, token)
+
+	// token只有所有者可以读写，也不会留下临时文件
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	expected = &client.Token{Username: "user1", AccessToken: "access2", RefreshToken: "refresh2"}
+	require.NoError(t, cache.Save(expected))
+	token, err = cache.Load()
+	require.NoError(t, err)
+	require.Equal(t, expected, token)
+
+	require.NoError(t, cache.Clear())
+	require.NoError(t, cache.Clear())
+	token, err = cache.Load()
+	require.NoError(t, err)
+	require.Nil(t, token)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = cache.Load()
+	require.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"google.golang.org/grpc"
+)
+
+// UserClient is a client to call the RPCs that manage user accounts. Except Register, the RPCs must be called
+// on a connection that attaches the access token, and the admin RPCs require the admin role
+type UserClient struct {
+	service pb.AuthServiceClient
+	options *options
+}
+
+// NewUserClient returns a new user client
+func NewUserClient(cc grpc.ClientConnInterface, opts ...Option) *UserClient {
+	service := pb.NewAuthServiceClient(cc)
+	return &UserClient{service: service, options: newOptions(opts)}
+}
+
+// Register registers a new user with the default role
+func (userClient *UserClient) Register(ctx context.Context, username, password string) (*pb.UserProfile, error) {
+	ctx, cancel := withTimeout(ctx, userClient.options.timeout)
+	defer cancel()
+
+	req := &pb.RegisterRequest{Username: username, Password: password}
+	res, err := userClient.service.Register(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.GetUser(), nil
+}
+
+// GetProfile returns the profile of the current user
+func (userClient *UserClient) GetProfile(ctx context.Context) (*pb.UserProfile, error) {
+	ctx, cancel := withTimeout(ctx, userClient.options.timeout)
+	defer cancel()
+
+	res, err := userClient.service.GetProfile(ctx, &pb.GetProfileRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return res.GetUser(), nil
+}
+
+// ChangePassword changes the password of the current user, the server revokes all its tokens afterwards
+func (userClient *UserClient) ChangePassword(ctx context.Context, oldPassword, newPassword string) error {
+	ctx, cancel := withTimeout(ctx, userClient.options.timeout)
+	defer cancel()
+
+	req := &pb.ChangePasswordRequest{OldPassword: oldPassword, NewPassword: newPassword}
+	_, err := userClient.service.ChangePassword(ctx, req)
+	return err
+}
+
+// ListUsers returns the profiles of all users
+func (userClient *UserClient) ListUsers(ctx context.Context) ([]*pb.UserProfile, error) {
+	ctx, cancel := withTimeout(ctx, userClient.options.timeout)
+	defer cancel()
+
+	res, err := userClient.service.ListUsers(ctx, &pb.ListUsersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return res.GetUsers(), nil
+}
+
+// SetUserRole changes the role of the user
+func (userClient *UserClient) SetUserRole(ctx context.Context, username, role string) (*pb.UserProfile, error) {
+	ctx, cancel := withTimeout(ctx, userClient.options.timeout)
+	defer cancel()
+
+	req := &pb.SetUserRoleRequest{Username: username, Role: role}
+	res, err := userClient.service.SetUserRole(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.GetUser(), nil
+}
+
+// DisableUser disables the user, or enables it again when disabled is false
+func (userClient *UserClient) DisableUser(ctx context.Context, username string, disabled bool) (*pb.UserProfile, error) {
+	ctx, cancel := withTimeout(ctx, userClient.options.timeout)
+	defer cancel()
+
+	req := &pb.DisableUserRequest{Username: username, Disabled: disabled}
+	res, err := userClient.service.DisableUser(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.GetUser(), nil
+}
+
+// UnlockUser unlocks the user locked after too many failed logins, and returns whether it was locked
+func (userClient *UserClient) UnlockUser(ctx context.Context, username string) (bool, error) {
+	ctx, cancel := withTimeout(ctx, userClient.options.timeout)
+	defer cancel()
+
+	res, err := userClient.service.UnlockUser(ctx, &pb.UnlockUserRequest{Username: username})
+	if err != nil {
+		return false, err
+	}
+	return res.GetWasLocked(), nil
+}
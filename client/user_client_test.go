@@ -0,0 +1,179 @@
+package client_test
+
+import (
+	"context"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUserClient(t *testing.T) {
+	t.Parallel()
+
+	address := startTestAuthServer(t)
+	authConn, err := grpc.Dial(address, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { authConn.Close() })
+
+	userClient := client.NewUserClient(authConn)
+	user, err := userClient.Register(context.Background(), "user2", "secret12")
+	require.NoError(t, err)
+	require.Equal(t, service.RoleUser, user.GetRole())
+
+	_, err = userClient.Register(context.Background(), "user2", "secret12")
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	interceptor, err := client.NewAuthInterceptor(context.Background(), client.NewAuthClient(authConn, "user2", "secret12"), map[string]bool{
+		"/techschool.pcbook.AuthService/GetProfile":     true,
+		"/techschool.pcbook.AuthService/ChangePassword": true,
+		"/techschool.pcbook.AuthService/ListUsers":      true,
+	})
+	require.NoError(t, err)
+	defer interceptor.Close()
+
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithUnaryInterceptor(interceptor.Unary()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	userClient = client.NewUserClient(conn)
+
+	profile, err := userClient.GetProfile(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "user2", profile.GetUsername())
+	require.NotNil(t, profile.GetLastLoginAt())
+
+	_, err = userClient.ListUsers(context.Background())
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	err = userClient.ChangePassword(context.Background(), "wrong", "secret34")
+	require.Error(t, err)
+	require.NoError(t, userClient.ChangePassword(context.Background(), "secret12", "secret34"))
+}
+
+func TestAuthClientTokenCache(t *testing.T) {
+	t.Parallel()
+
+	address := startTestAuthServer(t)
+	authConn, err := grpc.Dial(address, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { authConn.Close() })
+
+	cache := client.NewFileTokenCache(filepath.Join(t.TempDir(), "pcbook", "token.json"))
+	token, err := cache.Load()
+	require.NoError(t, err)
+	require.Nil(t, token)
+
+	authClient := client.NewAuthClient(authConn, "user1", "secret", client.WithTokenCache(cache))
+	accessToken, err := authClient.Login(context.Background())
+	require.NoError(t, err)
+
+	token, err = cache.Load()
+	require.NoError(t, err)
+	require.Equal(t, "user1", token.Username)
+	require.Equal(t, accessToken, token.AccessToken)
+	require.NotEmpty(t, token.RefreshToken)
+
+	// 另一个进程不需要密码，直接使用缓存的token
+	interceptor, err := client.NewAuthInterceptor(context.Background(), client.NewAuthClient(authConn, "", "", client.WithTokenCache(cache)), map[string]bool{
+		"/techschool.pcbook.LaptopService/CreateLaptop": true,
+	})
+	require.NoError(t, err)
+	defer interceptor.Close()
+	require.Equal(t, accessToken, interceptor.AccessToken())
+
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithUnaryInterceptor(interceptor.Unary()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = client.NewLaptopClient(conn).CreateLaptop(context.Background(), sample.NewLaptop())
+	require.NoError(t, err)
+
+	// 其他用户不使用缓存
+	_, err = client.NewAuthClient(authConn, "user2", "", client.WithTokenCache(cache)).Refresh(context.Background())
+	require.Error(t, err)
+
+	// 缓存的refresh token用于换取新的token，新的token写回缓存
+	authClient = client.NewAuthClient(authConn, "user1", "", client.WithTokenCache(cache))
+	refreshed, err := authClient.Refresh(context.Background())
+	require.NoError(t, err)
+	token, err = cache.Load()
+	require.NoError(t, err)
+	require.Equal(t, refreshed, token.AccessToken)
+
+	require.NoError(t, authClient.Logout(context.Background(), refreshed))
+	token, err = cache.Load()
+	require.NoError(t, err)
+	require.Nil(t, token)
+}
+
+func TestAuthClientTwoFactorCode(t *testing.T) {
+	t.Parallel()
+
+	address := startTestAuthServer(t)
+	authConn, err := grpc.Dial(address, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { authConn.Close() })
+
+	accessToken, err := client.NewAuthClient(authConn, "user1", "secret").Login(context.Background())
+	require.NoError(t, err)
+
+	// 启用两步验证
+	authService := pb.NewAuthServiceClient(authConn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+	enrollRes, err := authService.EnrollTOTP(ctx, &pb.EnrollTOTPRequest{})
+	require.NoError(t, err)
+	code, err := service.GenerateTOTPCode(enrollRes.GetSecret(), time.Now())
+	require.NoError(t, err)
+	confirmRes, err := authService.ConfirmTOTP(ctx, &pb.ConfirmTOTPRequest{Code: code})
+	require.NoError(t, err)
+
+	_, err = client.NewAuthClient(authConn, "user1", "secret").Login(context.Background())
+	require.Error(t, err)
+
+	// 同一个验证码不能重复使用，这里使用恢复码
+	_, err = client.NewAuthClient(authConn, "user1", "secret", client.WithTwoFactorCode(func() (string, error) {
+		return confirmRes.GetRecoveryCodes()[0], nil
+	})).Login(context.Background())
+	require.NoError(t, err)
+}
+
+// startTestAuthServer starts a server with auth and laptop services, and a user1 with the user role
+func startTestAuthServer(t *testing.T) string {
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("user1", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	revokedTokenStore := service.NewInMemoryRevokedTokenStore()
+	serverInterceptor := service.NewAuthInterceptor(jwtManager, revokedTokenStore, nil, userStore, service.NewRolePolicy(map[string][]string{
+		"/techschool.pcbook.LaptopService/CreateLaptop": {service.RoleUser},
+		"/techschool.pcbook.AuthService/GetProfile":     {service.RoleUser},
+		"/techschool.pcbook.AuthService/ChangePassword": {service.RoleUser},
+		"/techschool.pcbook.AuthService/EnrollTOTP":     {service.RoleUser},
+		"/techschool.pcbook.AuthService/ConfirmTOTP":    {service.RoleUser},
+		"/techschool.pcbook.AuthService/Logout":         {service.RoleUser},
+		"/techschool.pcbook.AuthService/ListUsers":      {service.RoleAdmin},
+	}))
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(serverInterceptor.Unary()),
+		grpc.StreamInterceptor(serverInterceptor.Stream()),
+	)
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(userStore, jwtManager, service.NewInMemoryRefreshTokenStore(), revokedTokenStore, nil, nil, nil, nil))
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil, nil))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	return listener.Addr().String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/bench"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"google.golang.org/grpc"
+	"os"
+	"strings"
+)
+
+var benchHeader = []string{"OPERATION", "COUNT", "ERRORS", "QPS", "P50", "P90", "P99", "P99.9", "MAX"}
+
+func runBench(ctx context.Context, app *app, args []string) error {
+	config := bench.DefaultConfig()
+	flags := newFlagSet("bench")
+	inProcess := flags.Bool("in-process", false, "benchmark an in-process server with in-memory stores and without authentication")
+	flags.Float64Var(&config.QPS, "qps", config.QPS, "the operations started per second")
+	flags.DurationVar(&config.Duration, "duration", config.Duration, "the time to start operations")
+	flags.IntVar(&config.Concurrency, "concurrency", config.Concurrency, "the max number of operations in progress")
+	mix := flags.String("mix", "create=1,search=1,upload=1,rate=1", "the weights of the operations")
+	flags.IntVar(&config.Laptops, "laptops", config.Laptops, "the laptops created before the benchmark to upload images and rate")
+	flags.IntVar(&config.ImageSize, "image-size", config.ImageSize, "the bytes of each uploaded image")
+	flags.IntVar(&config.Ratings, "ratings", config.Ratings, "the ratings sent in each rate stream")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: bench [-in-process] [-qps n] [-duration d] [-mix create=1,search=1,upload=1,rate=1]")
+	}
+
+	var err error
+	config.Mix, err = bench.ParseMix(*mix)
+	if err != nil {
+		return err
+	}
+
+	var laptopClient *client.LaptopClient
+	if *inProcess {
+		server, err := bench.StartServer()
+		if err != nil {
+			return err
+		}
+		defer server.Stop()
+
+		conn, err := grpc.Dial(server.Address, grpc.WithInsecure())
+		if err != nil {
+			return fmt.Errorf("cannot dial server: %w", err)
+		}
+		defer conn.Close()
+		laptopClient = client.NewLaptopClient(conn)
+	} else {
+		// 创建laptop、上传图片和打分需要登录
+		authApp, err := newApp(app.config, true)
+		if err != nil {
+			return err
+		}
+		defer authApp.close()
+		laptopClient = authApp.laptopClient
+	}
+
+	fmt.Fprintf(os.Stderr, "running %s at %g QPS for %s\n", *mix, config.QPS, config.Duration)
+	reports, err := bench.Run(ctx, laptopClient, config)
+	if err != nil {
+		return err
+	}
+
+	results := make([]item, len(reports))
+	for i, report := range reports {
+		results[i] = benchItem(report)
+	}
+	return app.printer.printList(benchHeader, results)
+}
+
+func benchItem(report *bench.Report) item {
+	var errors []string
+	for _, code := range report.ErrorCodes() {
+		errors = append(errors, fmt.Sprintf("%s=%d", code, report.Codes[code]))
+	}
+	if len(errors) == 0 {
+		errors = []string{"0"}
+	}
+
+	return item{
+		value: report,
+		row: []string{
+			report.Operation,
+			fmt.Sprint(report.Count),
+			strings.Join(errors, ","),
+			fmt.Sprintf("%.1f", report.Throughput),
+			formatMilliseconds(report.Latency.P50),
+			formatMilliseconds(report.Latency.P90),
+			formatMilliseconds(report.Latency.P99),
+			formatMilliseconds(report.Latency.P999),
+			formatMilliseconds(report.Latency.Max),
+		},
+	}
+}
+
+func formatMilliseconds(milliseconds float64) string {
+	return fmt.Sprintf("%.2fms", milliseconds)
+}
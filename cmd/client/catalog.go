@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/serializer"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// defaultImportBatch is the number of laptops created in each BulkCreateLaptops call, the checkpoint is saved after each call
+const defaultImportBatch = 100
+
+// importResult is the output of importing a record
+type importResult struct {
+	Record  int    `json:"record"` // 记录在文件中的序号，从1开始
+	ID      string `json:"id,omitempty"`
+	Result  string `json:"result"` // created、valid或者失败的gRPC状态码
+	Message string `json:"message,omitempty"`
+}
+
+var importHeader = []string{"RECORD", "ID", "RESULT", "MESSAGE"}
+
+func (result importResult) item() item {
+	return item{
+		value: result,
+		row:   []string{fmt.Sprint(result.Record), result.ID, result.Result, result.Message},
+	}
+}
+
+// importNamespace is the UUID namespace of the ids generated for the imported records without id
+var importNamespace = uuid.MustParse("0b8a4a52-8f4e-4c43-9d1c-54a0c4d2a6f1")
+
+// importCheckpoint records the progress of importing a file, so that an interrupted import resumes after
+// the records that have been processed by the server
+type importCheckpoint struct {
+	path    string
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Records int       `json:"records"`           // 已经处理的记录数
+	Pending int       `json:"pending,omitempty"` // 正在创建的批次的最后一条记录，中断时这些记录可能已经被服务端创建
+	Created int       `json:"created"`
+	Failed  int       `json:"failed"`
+}
+
+// laptopID returns the id of a record without id. It is the same each time the unchanged file is imported,
+// so that the records created by an interrupted import are found when the import resumes
+func (checkpoint *importCheckpoint) laptopID(record int) string {
+	name := fmt.Sprintf("%s:%d:%d:%d", checkpoint.File, checkpoint.Size, checkpoint.ModTime.UnixNano(), record)
+	return uuid.NewSHA1(importNamespace, []byte(name)).String()
+}
+
+func importLaptops(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("import")
+	formatFlag := flags.String("format", "", "the file format: jsonl, csv or pb, default to the extension of the file")
+	dryRun := flags.Bool("dry-run", false, "only validate the laptops without creating them")
+	batch := flags.Int("batch", defaultImportBatch, "the number of laptops created in each call")
+	checkpointPath := flags.String("checkpoint", "", "the file to record the progress, default to the imported file name with .checkpoint")
+	restart := flags.Bool("restart", false, "ignore the checkpoint and import from the first record")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import [-format f] [-dry-run] [-batch n] [-checkpoint file] [-restart] <file>")
+	}
+	if *batch < 1 {
+		return fmt.Errorf("-batch must be positive")
+	}
+
+	path := flags.Arg(0)
+	format, err := fileFormat(path, *formatFlag)
+	if err != nil {
+		return err
+	}
+
+	input := os.Stdin
+	if path != "-" {
+		input, err = os.Open(path)
+		if err != nil {
+			return fmt.Errorf("cannot open file: %w", err)
+		}
+		defer input.Close()
+	}
+	reader, err := serializer.NewMessageReader(input, format)
+	if err != nil {
+		return err
+	}
+
+	// dry run和标准输入不使用checkpoint
+	var checkpoint *importCheckpoint
+	progress := &importCheckpoint{}
+	if !*dryRun && path != "-" {
+		if *checkpointPath == "" {
+			*checkpointPath = path + ".checkpoint"
+		}
+		checkpoint, err = loadCheckpoint(*checkpointPath, input, *restart)
+		if err != nil {
+			return err
+		}
+		progress = checkpoint
+	}
+	// 上次中断时正在创建的记录，已经存在的说明上次已经创建成功
+	interrupted := progress.Pending
+
+	for record := 1; record <= progress.Records; record++ {
+		err := reader.Read(&pb.Laptop{})
+		if err == io.EOF {
+			return fmt.Errorf("the file has only %d records, but the checkpoint has %d", record-1, progress.Records)
+		}
+		if err != nil && !errors.Is(err, serializer.ErrInvalidMessage) {
+			return fmt.Errorf("cannot read record %d: %w", record, err)
+		}
+	}
+
+	stream := app.printer.stream(importHeader)
+	record := progress.Records
+	for done := false; !done; {
+		var laptops []*pb.Laptop
+		var records []int
+		var results []importResult
+		generated := make(map[int]bool) // 由客户端生成id的记录
+
+		// 读取一批laptop，不能解析的记录直接作为失败的结果
+		for len(laptops) < *batch {
+			laptop := &pb.Laptop{}
+			err := reader.Read(laptop)
+			if err == io.EOF {
+				done = true
+				break
+			}
+			record++
+			if errors.Is(err, serializer.ErrInvalidMessage) {
+				results = append(results, importResult{Record: record, Result: codes.InvalidArgument.String(), Message: err.Error()})
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("cannot read record %d: %w", record, err)
+			}
+			// 没有id的记录使用固定的id，恢复导入时不会重复创建
+			if checkpoint != nil && laptop.GetId() == "" {
+				laptop.Id = checkpoint.laptopID(record)
+				generated[record] = true
+			}
+			laptops = append(laptops, laptop)
+			records = append(records, record)
+		}
+
+		if len(laptops) > 0 {
+			if checkpoint != nil {
+				checkpoint.Pending = record
+				err := checkpoint.save()
+				if err != nil {
+					return err
+				}
+			}
+
+			res, err := app.laptopClient.BulkCreateLaptops(ctx, laptops, *dryRun)
+			if err != nil {
+				if checkpoint != nil && progress.Records > 0 {
+					fmt.Fprintf(os.Stderr, "%d records are imported, run the same command to resume from the checkpoint\n", progress.Records)
+				}
+				return err
+			}
+			for _, result := range res.GetResults() {
+				index := int(result.GetIndex())
+				if index >= len(records) {
+					continue
+				}
+				imported := bulkResult(records[index], result, *dryRun)
+				if result.GetErrorCode() == codes.AlreadyExists.String() && generated[records[index]] && records[index] <= interrupted {
+					imported = importResult{Record: records[index], ID: laptops[index].GetId(), Result: "created", Message: "created before the interruption"}
+				}
+				results = append(results, imported)
+			}
+		}
+
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].Record < results[j].Record
+		})
+		for _, result := range results {
+			if result.ID != "" {
+				progress.Created++
+			} else {
+				progress.Failed++
+			}
+			err := stream.add(result.item())
+			if err != nil {
+				return err
+			}
+		}
+
+		progress.Records = record
+		progress.Pending = 0
+		if checkpoint != nil {
+			err := checkpoint.save()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = stream.close()
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		err := checkpoint.remove()
+		if err != nil {
+			return err
+		}
+	}
+
+	verb := "created"
+	if *dryRun {
+		verb = "valid"
+	}
+	fmt.Fprintf(os.Stderr, "%d records: %d %s, %d failed\n", progress.Records, progress.Created, verb, progress.Failed)
+	return nil
+}
+
+func bulkResult(record int, result *pb.BulkCreateLaptopResult, dryRun bool) importResult {
+	if result.GetErrorCode() != "" {
+		return importResult{Record: record, Result: result.GetErrorCode(), Message: result.GetErrorMessage()}
+	}
+	if dryRun {
+		return importResult{Record: record, ID: result.GetId(), Result: "valid"}
+	}
+	return importResult{Record: record, ID: result.GetId(), Result: "created"}
+}
+
+// loadCheckpoint returns the saved checkpoint of the input file, or a new checkpoint when there is no saved
+// checkpoint or restart is true. A checkpoint saved for another file or before the file is changed is an error
+func loadCheckpoint(path string, input *os.File, restart bool) (*importCheckpoint, error) {
+	info, err := input.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get file info: %w", err)
+	}
+	file, err := filepath.Abs(input.Name())
+	if err != nil {
+		return nil, fmt.Errorf("cannot get file path: %w", err)
+	}
+	checkpoint := &importCheckpoint{path: path, File: file, Size: info.Size(), ModTime: info.ModTime()}
+	if restart {
+		return checkpoint, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read checkpoint: %w", err)
+	}
+
+	saved := &importCheckpoint{path: path}
+	err = json.Unmarshal(data, saved)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint %s: %w", path, err)
+	}
+	if saved.File != checkpoint.File || saved.Size != checkpoint.Size || !saved.ModTime.Equal(checkpoint.ModTime) {
+		return nil, fmt.Errorf("checkpoint %s is for another file or the file has changed, use -restart to import from the first record", path)
+	}
+
+	fmt.Fprintf(os.Stderr, "resume after record %d from checkpoint %s\n", saved.Records, path)
+	return saved, nil
+}
+
+func (checkpoint *importCheckpoint) save() error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("cannot marshal checkpoint: %w", err)
+	}
+
+	// 先写入临时文件再重命名，中断时不会留下写了一半的checkpoint
+	file, err := ioutil.TempFile(filepath.Dir(checkpoint.path), filepath.Base(checkpoint.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("cannot create checkpoint: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+
+	err = os.Rename(file.Name(), checkpoint.path)
+	if err != nil {
+		return fmt.Errorf("cannot save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (checkpoint *importCheckpoint) remove() error {
+	err := os.Remove(checkpoint.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove checkpoint: %w", err)
+	}
+	return nil
+}
+
+// exportResult is the output of exporting laptops to a file
+type exportResult struct {
+	File    string `json:"file"`
+	Format  string `json:"format"`
+	Laptops int    `json:"laptops"`
+}
+
+func exportLaptops(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("export")
+	formatFlag := flags.String("format", "", "the file format: jsonl, csv or pb, default to the extension of the file")
+	filterFlag := flags.String("filter", "", "export only the laptops matching the filter of laptop search")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: export [-format f] [-filter filter] <file>")
+	}
+
+	path := flags.Arg(0)
+	format, err := fileFormat(path, *formatFlag)
+	if err != nil {
+		return err
+	}
+	filter, err := parseFilter(*filterFlag)
+	if err != nil {
+		return err
+	}
+
+	it, err := app.laptopClient.SearchLaptop(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	var output io.Writer = os.Stdout
+	var file *os.File
+	if path != "-" {
+		// 先写入临时文件，导出中断时不会覆盖已有的文件或者留下不完整的文件
+		file, err = ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+		if err != nil {
+			return fmt.Errorf("cannot create file: %w", err)
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		output = file
+	}
+
+	writer, err := serializer.NewMessageWriter(output, format, (&pb.Laptop{}).ProtoReflect().Descriptor())
+	if err != nil {
+		return err
+	}
+	count := 0
+	for it.Next() {
+		err := writer.Write(it.Laptop())
+		if err != nil {
+			return fmt.Errorf("cannot write laptop: %w", err)
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if file == nil {
+		return nil
+	}
+
+	err = file.Chmod(0644)
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot save file: %w", err)
+	}
+
+	result := exportResult{File: path, Format: string(format), Laptops: count}
+	return app.printer.printItem([]string{"FILE", "FORMAT", "LAPTOPS"}, item{
+		value: result,
+		row:   []string{result.File, result.Format, fmt.Sprint(result.Laptops)},
+	})
+}
+
+// fileFormat returns the format of the flag, or the format of the file extension when the flag is empty
+func fileFormat(path string, name string) (serializer.Format, error) {
+	if name != "" {
+		return serializer.ParseFormat(name)
+	}
+	if path == "-" {
+		return "", fmt.Errorf("-format is required for the standard input and output")
+	}
+	return serializer.FormatOf(path)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/serializer"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestImportResume imports a file whose second batch is created by the server but fails on the client,
+// and checks that resuming from the checkpoint does not create the records of that batch again
+func TestImportResume(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "catalog.jsonl")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	writer, err := serializer.NewMessageWriter(file, serializer.FormatJSONL, (&pb.Laptop{}).ProtoReflect().Descriptor())
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		laptop := sample.NewLaptop()
+		laptop.Id = ""
+		require.NoError(t, writer.Write(laptop))
+	}
+	require.NoError(t, writer.Flush())
+	require.NoError(t, file.Close())
+
+	// 第二次调用在服务端创建之后失败，客户端收不到结果
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptopStore.SetSearchDelay(0)
+	var mutex sync.Mutex
+	calls := 0
+	grpcServer := grpc.NewServer(grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		mutex.Lock()
+		calls++
+		fail := calls == 2
+		mutex.Unlock()
+		if !fail {
+			return handler(srv, stream)
+		}
+		err := handler(srv, &discardResponseStream{stream})
+		require.NoError(t, err)
+		return status.Errorf(codes.Internal, "connection lost")
+	}))
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopServer(laptopStore, nil, nil, nil))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	cfg := defaultConfig()
+	cfg.Address = listener.Addr().String()
+	cfg.TokenCache = filepath.Join(t.TempDir(), "tokens.json")
+	cfg.Output = "json"
+	app, err := newApp(cfg, false)
+	require.NoError(t, err)
+	defer app.close()
+	var output bytes.Buffer
+	app.printer.out = &output
+
+	err = importLaptops(context.Background(), app, []string{"-batch", "2", path})
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Equal(t, 4, countTestLaptops(t, laptopStore))
+	require.FileExists(t, path+".checkpoint")
+
+	output.Reset()
+	err = importLaptops(context.Background(), app, []string{"-batch", "2", path})
+	require.NoError(t, err)
+	require.Equal(t, 5, countTestLaptops(t, laptopStore))
+	require.NoFileExists(t, path+".checkpoint")
+
+	var results []importResult
+	require.NoError(t, json.Unmarshal(output.Bytes(), &results))
+	require.Len(t, results, 3)
+	for i, result := range results {
+		require.Equal(t, i+3, result.Record)
+		require.Equal(t, "created", result.Result)
+		found, err := laptopStore.Find(result.ID)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+	}
+	require.Equal(t, "created before the interruption", results[0].Message)
+	require.Empty(t, results[2].Message)
+
+	// 从头重新导入时已经存在的记录是失败的结果
+	output.Reset()
+	err = importLaptops(context.Background(), app, []string{"-restart", path})
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(output.Bytes(), &results))
+	require.Len(t, results, 5)
+	for _, result := range results {
+		require.Equal(t, codes.AlreadyExists.String(), result.Result)
+	}
+	require.Equal(t, 5, countTestLaptops(t, laptopStore))
+}
+
+// discardResponseStream drops the response sent by the handler, as if the connection is lost
+type discardResponseStream struct {
+	grpc.ServerStream
+}
+
+func (stream *discardResponseStream) SendMsg(m interface{}) error {
+	return nil
+}
+
+func countTestLaptops(t *testing.T, laptopStore *service.InMemoryLaptopStore) int {
+	count := 0
+	err := laptopStore.Search(context.Background(), &pb.Filter{MaxPriceUsd: math.MaxFloat64}, func(laptop *pb.Laptop) error {
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	return count
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// config is the settings of the CLI. Flags take precedence over environment variables,
+// and environment variables take precedence over the config file
+type config struct {
+	Address       string `yaml:"address"`
+	LoadBalancing string `yaml:"load_balancing"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	APIKey        string `yaml:"api_key"`
+	TLS           bool   `yaml:"tls"`
+	TLSCA         string `yaml:"tls_ca"`
+	TLSCert       string `yaml:"tls_cert"`
+	TLSKey        string `yaml:"tls_key"`
+	Output        string `yaml:"output"`
+	TokenCache    string `yaml:"token_cache"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Address:       "0.0.0.0:8080",
+		LoadBalancing: "round_robin",
+		TLSCA:         "cert/ca-cert.pem",
+		Output:        "table",
+	}
+}
+
+// defaultConfigFile returns the path of the config file used when -config is not set
+func defaultConfigFile() string {
+	if path := os.Getenv("PCBOOK_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "pcbook", "config.yaml")
+}
+
+// loadConfig parses the global flags in args, and returns the settings of the config file,
+// the environment variables and the flags. The command and its arguments are left in flags.Args()
+func loadConfig(flags *flag.FlagSet, args []string) (*config, error) {
+	cfg := defaultConfig()
+	flagConfig := defaultConfig()
+	configFile := flags.String("config", "", "the YAML config file, default to $PCBOOK_CONFIG or pcbook/config.yaml in the user config folder")
+	flagConfig.registerFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	path, required := *configFile, true
+	if path == "" {
+		path, required = defaultConfigFile(), false
+	}
+	err = cfg.loadFile(path, required)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.loadEnv()
+	if err != nil {
+		return nil, err
+	}
+	cfg.merge(flags, flagConfig)
+	return cfg, nil
+}
+
+// loadFile reads the settings in the YAML file, a missing file is ignored unless required
+func (cfg *config) loadFile(path string, required bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	err = yaml.Unmarshal(data, cfg)
+	if err != nil {
+		return fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv reads the settings in the PCBOOK_* environment variables
+func (cfg *config) loadEnv() error {
+	for name, value := range map[string]*string{
+		"PCBOOK_ADDRESS":        &cfg.Address,
+		"PCBOOK_LOAD_BALANCING": &cfg.LoadBalancing,
+		"PCBOOK_USERNAME":       &cfg.Username,
+		"PCBOOK_PASSWORD":       &cfg.Password,
+		"PCBOOK_API_KEY":        &cfg.APIKey,
+		"PCBOOK_TLS_CA":         &cfg.TLSCA,
+		"PCBOOK_TLS_CERT":       &cfg.TLSCert,
+		"PCBOOK_TLS_KEY":        &cfg.TLSKey,
+		"PCBOOK_OUTPUT":         &cfg.Output,
+		"PCBOOK_TOKEN_CACHE":    &cfg.TokenCache,
+	} {
+		if env, ok := os.LookupEnv(name); ok {
+			*value = env
+		}
+	}
+
+	if env, ok := os.LookupEnv("PCBOOK_TLS"); ok {
+		enabled, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("invalid PCBOOK_TLS: %w", err)
+		}
+		cfg.TLS = enabled
+	}
+	return nil
+}
+
+// registerFlags registers the global flags, which are stored in cfg
+func (cfg *config) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&cfg.Address, "address", cfg.Address, "the server address, a comma separated list of addresses or a target such as dns:///host:port (PCBOOK_ADDRESS)")
+	flags.StringVar(&cfg.LoadBalancing, "load-balancing", cfg.LoadBalancing, "the policy to balance the calls across the servers: round_robin or least_loaded (PCBOOK_LOAD_BALANCING)")
+	flags.StringVar(&cfg.Username, "username", cfg.Username, "the username to log in (PCBOOK_USERNAME)")
+	flags.StringVar(&cfg.Password, "password", cfg.Password, "the password to log in, prompted when empty (PCBOOK_PASSWORD)")
+	flags.StringVar(&cfg.APIKey, "api-key", cfg.APIKey, "the API key to authenticate instead of logging in (PCBOOK_API_KEY)")
+	flags.BoolVar(&cfg.TLS, "tls", cfg.TLS, "enable TLS (PCBOOK_TLS)")
+	flags.StringVar(&cfg.TLSCA, "tls-ca", cfg.TLSCA, "the CA certificate to verify the server certificate, empty to use the system CAs (PCBOOK_TLS_CA)")
+	flags.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "the client certificate for mTLS, empty to connect without client certificate (PCBOOK_TLS_CERT)")
+	flags.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "the client private key for mTLS (PCBOOK_TLS_KEY)")
+	flags.StringVar(&cfg.Output, "output", cfg.Output, "the output format: table, json or yaml (PCBOOK_OUTPUT)")
+	flags.StringVar(&cfg.TokenCache, "token-cache", cfg.TokenCache, "the file to cache the tokens, default to a file per server in the user cache folder (PCBOOK_TOKEN_CACHE)")
+}
+
+// merge overwrites the settings with the flags set on the command line
+func (cfg *config) merge(flags *flag.FlagSet, flagConfig *config) {
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "address":
+			cfg.Address = flagConfig.Address
+		case "load-balancing":
+			cfg.LoadBalancing = flagConfig.LoadBalancing
+		case "username":
+			cfg.Username = flagConfig.Username
+		case "password":
+			cfg.Password = flagConfig.Password
+		case "api-key":
+			cfg.APIKey = flagConfig.APIKey
+		case "tls":
+			cfg.TLS = flagConfig.TLS
+		case "tls-ca":
+			cfg.TLSCA = flagConfig.TLSCA
+		case "tls-cert":
+			cfg.TLSCert = flagConfig.TLSCert
+		case "tls-key":
+			cfg.TLSKey = flagConfig.TLSKey
+		case "output":
+			cfg.Output = flagConfig.Output
+		case "token-cache":
+			cfg.TokenCache = flagConfig.TokenCache
+		}
+	})
+}
+
+// loadBalancingPolicy returns the client load balancing policy of the setting
+func (cfg *config) loadBalancingPolicy() (string, error) {
+	switch cfg.LoadBalancing {
+	case "round_robin":
+		return client.RoundRobin, nil
+	case "least_loaded":
+		return client.LeastLoaded, nil
+	default:
+		return "", fmt.Errorf("unknown load balancing policy %q, must be round_robin or least_loaded", cfg.LoadBalancing)
+	}
+}
+
+// tokenCachePath returns the file to cache the tokens of the server
+func (cfg *config) tokenCachePath() (string, error) {
+	if cfg.TokenCache != "" {
+		return cfg.TokenCache, nil
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot find cache folder: %w", err)
+	}
+	// 每个服务器一个缓存文件
+	name := regexp.MustCompile(`[^a-zA-Z0-9.-]+`).ReplaceAllString(cfg.Address, "_")
+	return filepath.Join(dir, "pcbook", "token-"+name+".json"), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"github.com/Ruadgedy/pcbook-go/client"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 修改环境变量的测试不能并行执行
+func TestLoadConfig(t *testing.T) {
+	clearTestEnv(t)
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(configFile, []byte("address: file:8080\nusername: fileuser\noutput: yaml\nload_balancing: least_loaded\n"), 0600)
+	require.NoError(t, err)
+
+	// 没有设置环境变量和参数时使用文件中的配置，文件中没有的使用默认值
+	cfg, args := loadTestConfig(t, "-config", configFile, "laptop", "get", "id1")
+	require.Equal(t, "file:8080", cfg.Address)
+	require.Equal(t, "fileuser", cfg.Username)
+	require.Equal(t, "yaml", cfg.Output)
+	require.Equal(t, "cert/ca-cert.pem", cfg.TLSCA)
+	require.Equal(t, []string{"laptop", "get", "id1"}, args)
+
+	// 环境变量覆盖文件，参数覆盖环境变量
+	setTestEnv(t, "PCBOOK_USERNAME", "envuser")
+	setTestEnv(t, "PCBOOK_OUTPUT", "json")
+	setTestEnv(t, "PCBOOK_TLS", "true")
+	cfg, _ = loadTestConfig(t, "-config", configFile, "-output", "table", "user", "profile")
+	require.Equal(t, "file:8080", cfg.Address)
+	require.Equal(t, "envuser", cfg.Username)
+	require.Equal(t, "table", cfg.Output)
+	require.True(t, cfg.TLS)
+
+	// 参数设置为默认值也会覆盖环境变量
+	cfg, _ = loadTestConfig(t, "-config", configFile, "-tls=false")
+	require.False(t, cfg.TLS)
+
+	// 没有-config时使用PCBOOK_CONFIG
+	setTestEnv(t, "PCBOOK_CONFIG", configFile)
+	cfg, _ = loadTestConfig(t)
+	require.Equal(t, "file:8080", cfg.Address)
+	policy, err := cfg.loadBalancingPolicy()
+	require.NoError(t, err)
+	require.Equal(t, client.LeastLoaded, policy)
+
+	// 默认的配置文件不存在时忽略，-config指定的文件必须存在
+	setTestEnv(t, "PCBOOK_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+	cfg, _ = loadTestConfig(t)
+	require.Equal(t, "0.0.0.0:8080", cfg.Address)
+	_, err = loadConfig(newTestFlagSet(), []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")})
+	require.Error(t, err)
+
+	setTestEnv(t, "PCBOOK_TLS", "maybe")
+	_, err = loadConfig(newTestFlagSet(), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "PCBOOK_TLS")
+
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("address: [1, 2"), 0600))
+	_, err = loadConfig(newTestFlagSet(), []string{"-config", configFile})
+	require.Error(t, err)
+}
+
+func TestConfigSettings(t *testing.T) {
+	t.Parallel()
+
+	cfg := defaultConfig()
+	cfg.LoadBalancing = "random"
+	_, err := cfg.loadBalancingPolicy()
+	require.Error(t, err)
+
+	// 每个服务器使用单独的token缓存文件
+	cfg.Address = "dns:///pcbook.example.com:8080"
+	path, err := cfg.tokenCachePath()
+	require.NoError(t, err)
+	require.Equal(t, "token-dns_pcbook.example.com_8080.json", filepath.Base(path))
+
+	cfg.TokenCache = "tokens.json"
+	path, err = cfg.tokenCachePath()
+	require.NoError(t, err)
+	require.Equal(t, "tokens.json", path)
+}
+
+func loadTestConfig(t *testing.T, args ...string) (*config, []string) {
+	flags := newTestFlagSet()
+	cfg, err := loadConfig(flags, args)
+	require.NoError(t, err)
+	return cfg, flags.Args()
+}
+
+func newTestFlagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("pcbook", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	return flags
+}
+
+// clearTestEnv removes the PCBOOK_* variables of the environment running the tests until the test ends,
+// so that they do not change the results
+func clearTestEnv(t *testing.T) {
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "PCBOOK_") {
+			continue
+		}
+		name := strings.SplitN(env, "=", 2)[0]
+		setTestEnv(t, name, "")
+		require.NoError(t, os.Unsetenv(name))
+	}
+}
+
+// setTestEnv sets the environment variable until the test ends
+func setTestEnv(t *testing.T, name string, value string) {
+	old, ok := os.LookupEnv(name)
+	require.NoError(t, os.Setenv(name, value))
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/serializer"
+	"math"
+	"strconv"
+	"strings"
+)
+
+func createLaptops(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("laptop create")
+	from := flags.String("from", "", "the JSON file of the laptop to create")
+	samples := flags.Int("sample", 0, "the number of random sample laptops to create")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var laptops []*pb.Laptop
+	if *from != "" {
+		laptop := &pb.Laptop{}
+		err := serializer.ReadProtobufFromJSONFile(*from, laptop)
+		if err != nil {
+			return err
+		}
+		laptops = append(laptops, laptop)
+	}
+	for i := 0; i < *samples; i++ {
+		laptops = append(laptops, sample.NewLaptop())
+	}
+	if len(laptops) == 0 {
+		return fmt.Errorf("-from or -sample is required")
+	}
+
+	var results []item
+	for _, laptop := range laptops {
+		id, err := app.laptopClient.CreateLaptop(ctx, laptop)
+		if err != nil {
+			return err
+		}
+
+		// 返回服务端保存的laptop，包括owner等由服务端设置的字段
+		laptop, err = app.laptopClient.GetLaptop(ctx, id)
+		if err != nil {
+			return err
+		}
+		results = append(results, laptopItem(laptop))
+	}
+	return app.printer.printList(laptopHeader, results)
+}
+
+func getLaptops(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("laptop get")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("laptop id is required")
+	}
+
+	var results []item
+	for _, id := range flags.Args() {
+		laptop, err := app.laptopClient.GetLaptop(ctx, id)
+		if err != nil {
+			return err
+		}
+		results = append(results, laptopItem(laptop))
+	}
+
+	if len(results) == 1 {
+		return app.printer.printItem(laptopHeader, results[0])
+	}
+	return app.printer.printList(laptopHeader, results)
+}
+
+func listLaptops(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("laptop list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return printSearchResults(ctx, app, &pb.Filter{MaxPriceUsd: math.MaxFloat64})
+}
+
+func searchLaptops(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("laptop search")
+	filterFlag := flags.String("filter", "", "the comma separated conditions: max-price, min-cpu-cores, min-cpu-ghz and min-ram")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := parseFilter(*filterFlag)
+	if err != nil {
+		return err
+	}
+	return printSearchResults(ctx, app, filter)
+}
+
+// printSearchResults prints the laptops as soon as they are found, until the search ends or ctx is canceled
+func printSearchResults(ctx context.Context, app *app, filter *pb.Filter) error {
+	it, err := app.laptopClient.SearchLaptop(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	stream := app.printer.stream(laptopHeader)
+	for it.Next() {
+		err := stream.add(laptopItem(it.Laptop()))
+		if err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return stream.close()
+}
+
+// parseFilter parses the filter such as "max-price=3000,min-cpu-cores=4,min-cpu-ghz=2.5,min-ram=8GB",
+// the price is not limited when max-price is not set
+func parseFilter(text string) (*pb.Filter, error) {
+	filter := &pb.Filter{MaxPriceUsd: math.MaxFloat64}
+	if strings.TrimSpace(text) == "" {
+		return filter, nil
+	}
+
+	for _, condition := range strings.Split(text, ",") {
+		parts := strings.SplitN(condition, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid filter condition %q, must be name=value", condition)
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		var err error
+		switch name {
+		case "max-price":
+			filter.MaxPriceUsd, err = strconv.ParseFloat(value, 64)
+		case "min-cpu-cores":
+			var cores uint64
+			cores, err = strconv.ParseUint(value, 10, 32)
+			filter.MinCpuCores = uint32(cores)
+		case "min-cpu-ghz":
+			filter.MinCpuGhz, err = strconv.ParseFloat(value, 64)
+		case "min-ram":
+			filter.MinRam, err = parseMemory(value)
+		default:
+			return nil, fmt.Errorf("unknown filter condition %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return filter, nil
+}
+
+// parseMemory parses the memory size such as 8GB or 512MB
+func parseMemory(text string) (*pb.Memory, error) {
+	units := []struct {
+		suffix string
+		unit   pb.Memory_Unit
+	}{
+		// 较长的后缀在前，避免8GB被当作以B结尾
+		{"BIT", pb.Memory_BIT},
+		{"KB", pb.Memory_KILOBYTE},
+		{"MB", pb.Memory_MEGABYTE},
+		{"GB", pb.Memory_GIGABYTE},
+		{"TB", pb.Memory_TERABYTE},
+		{"B", pb.Memory_BYTE},
+	}
+
+	upper := strings.ToUpper(text)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			value, err := strconv.ParseUint(strings.TrimSpace(upper[:len(upper)-len(unit.suffix)]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return &pb.Memory{Value: value, Unit: unit.unit}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown memory unit in %q, must be one of bit, B, KB, MB, GB and TB", text)
+}
+
+func uploadImage(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("image upload")
+	laptopID := flags.String("laptop", "", "the id of the laptop")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *laptopID == "" || flags.NArg() != 1 {
+		return fmt.Errorf("usage: image upload -laptop <id> <file>")
+	}
+
+	res, err := app.laptopClient.UploadImageFile(ctx, *laptopID, flags.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+
+	result := item{
+		value: res,
+		row:   []string{res.GetId(), *laptopID, fmt.Sprint(res.GetSize())},
+	}
+	return app.printer.printItem([]string{"ID", "LAPTOP", "SIZE"}, result)
+}
+
+// downloadResult is the output of downloading an image
+type downloadResult struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+func downloadImages(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("image download")
+	dir := flags.String("dir", ".", "the folder to save the images")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("image id is required")
+	}
+
+	var results []item
+	for _, imageID := range flags.Args() {
+		path, err := app.laptopClient.DownloadImageFile(ctx, imageID, *dir, nil)
+		if err != nil {
+			return err
+		}
+
+		result := downloadResult{ID: imageID, Path: path}
+		results = append(results, item{
+			value: result,
+			row:   []string{result.ID, result.Path},
+		})
+	}
+	return app.printer.printList([]string{"ID", "PATH"}, results)
+}
+
+func watchRatings(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("watch")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: watch <laptop-id>...")
+	}
+
+	// 一直等待评分更新，直到ctx被取消
+	stream := app.printer.stream(ratingHeader)
+	err := app.laptopClient.WatchRatings(ctx, flags.Args(), func(res *pb.RateLaptopResponse) error {
+		return stream.add(ratingItem(res))
+	})
+	// Ctrl-C是正常结束watch的方式
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	return stream.close()
+}
+
+func rateLaptops(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("rate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: rate <laptop-id>=<score>...")
+	}
+
+	laptopIDs := make([]string, flags.NArg())
+	scores := make([]float64, flags.NArg())
+	for i, arg := range flags.Args() {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid rating %q, must be laptop-id=score", arg)
+		}
+		score, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid score of laptop %s: %w", parts[0], err)
+		}
+		laptopIDs[i], scores[i] = parts[0], score
+	}
+
+	ratings, err := app.laptopClient.RateLaptop(ctx, laptopIDs, scores)
+	if err != nil {
+		return err
+	}
+
+	results := make([]item, len(ratings))
+	for i, rating := range ratings {
+		results[i] = ratingItem(rating)
+	}
+	return app.printer.printList(ratingHeader, results)
+}
@@ -1,305 +1,345 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
 	"github.com/Ruadgedy/pcbook-go/client"
-	"github.com/Ruadgedy/pcbook-go/pb"
-	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/tlsconfig"
+	"golang.org/x/crypto/ssh/terminal"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
-	"time"
 )
 
-func createLaptop(laptopClient pb.LaptopServiceClient, laptop *pb.Laptop) {
-	// 测试重复的laptop
-	//laptop.Id = "e9b01f03-38ee-4cef-b27d-156813e81fa0"
-	req := &pb.CreateLaptopRequest{Laptop: laptop}
-
-	// set timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	// 调用LaptopServer去执行请求
-	res, err := laptopClient.CreateLaptop(ctx, req)
-	if err != nil {
-		st, ok := status.FromError(err)
-		if ok && st.Code() == codes.AlreadyExists {
-			log.Print("laptop already exists")
-		} else {
-			log.Fatal("cannot create laptop", err)
-		}
-		return
-	}
-
-	log.Printf("created laptop with id : %s", res.Id)
-}
-
-const (
-	username = "admin1"
-	password = "secret"
-	refreshDuration = 30 * time.Second
-)
+const usage = `usage: pcbook [flags] <command> [arguments]
+
+commands:
+  login [-otp code]                          log in and cache the tokens
+  logout                                     revoke and remove the cached tokens
+  laptop create -from file.json | -sample n  create laptops
+  laptop get <id>...                         get laptops by id
+  laptop list                                list all laptops
+  laptop search -filter <filter>             search laptops, e.g. max-price=3000,min-cpu-cores=4,min-cpu-ghz=2.5,min-ram=8GB
+  import [-dry-run] <file>                   create laptops from a JSONL, CSV or protobuf file, resumable
+  export [-filter filter] <file>             save laptops to a JSONL, CSV or protobuf file, - for stdout
+  image upload -laptop <id> <file>           upload a laptop image
+  image download [-dir folder] <id>...       download laptop images
+  rate <laptop-id>=<score>...                rate laptops
+  watch <laptop-id>...                       show rating updates until interrupted
+  user register [-password p] <name>         register a new user
+  user profile                               show the current user
+  user passwd                                change the password of the current user
+  user list                                  list all users (admin)
+  user set-role <name> <role>                change the role of a user (admin)
+  user disable|enable <name>                 disable or enable a user (admin)
+  user unlock <name>                         unlock a user locked after failed logins (admin)
+  bench [-in-process] [-qps n] [-mix m]      benchmark create, search, upload and rate at a target QPS
+  shell                                      run the commands interactively
+
+flags:`
 
 // 返回需要验证的方法
 func authMethods() map[string]bool {
 	const laptopServicePath = "/techschool.pcbook.LaptopService/"
+	const authServicePath = "/techschool.pcbook.AuthService/"
 	return map[string]bool{
 		laptopServicePath + "CreateLaptop": true,
+		laptopServicePath + "GetLaptop": true,
+		laptopServicePath + "DownloadImage": true,
+		laptopServicePath + "BulkCreateLaptops" : true,
+		laptopServicePath + "UpdateLaptop" : true,
+		laptopServicePath + "DeleteLaptop" : true,
+		laptopServicePath + "TransferLaptopOwnership" : true,
+		laptopServicePath + "DeleteImage" : true,
 		laptopServicePath + "UploadImage" : true,
 		laptopServicePath + "RateLaptop" : true,
+		laptopServicePath + "WatchRatings" : true,
+		laptopServicePath + "RemoveRating" : true,
+		laptopServicePath + "ExportRatings" : true,
+		authServicePath + "ChangePassword" : true,
+		authServicePath + "GetProfile" : true,
+		authServicePath + "ListUsers" : true,
+		authServicePath + "SetUserRole" : true,
+		authServicePath + "DisableUser" : true,
+		authServicePath + "UnlockUser" : true,
 	}
 }
-func main() {
-	serverAddress := flag.String("address", "", "the server address")
-	flag.Parse()
 
-	log.Printf("dial server: %s", *serverAddress)
+// command is a CLI command, the name of a subcommand contains its parent command such as "laptop get"
+type command struct {
+	name string
+	auth bool // 调用的RPC是否需要登录
+	run  func(ctx context.Context, app *app, args []string) error
+}
 
-	cc1, err := grpc.Dial(*serverAddress, grpc.WithInsecure())
-	if err != nil {
-		log.Fatal("cannot dial server: ", err)
-	}
-	defer cc1.Close()
+var commands = []command{
+	{name: "login", run: login},
+	{name: "logout", auth: true, run: logout},
+	{name: "laptop create", auth: true, run: createLaptops},
+	{name: "laptop get", auth: true, run: getLaptops},
+	{name: "laptop list", run: listLaptops},
+	{name: "laptop search", run: searchLaptops},
+	{name: "import", auth: true, run: importLaptops},
+	{name: "export", run: exportLaptops},
+	{name: "image upload", auth: true, run: uploadImage},
+	{name: "image download", auth: true, run: downloadImages},
+	{name: "rate", auth: true, run: rateLaptops},
+	{name: "watch", auth: true, run: watchRatings},
+	{name: "user register", run: registerUser},
+	{name: "user profile", auth: true, run: showProfile},
+	{name: "user passwd", auth: true, run: changePassword},
+	{name: "user list", auth: true, run: listUsers},
+	{name: "user set-role", auth: true, run: setUserRole},
+	{name: "user disable", auth: true, run: disableUser},
+	{name: "user enable", auth: true, run: enableUser},
+	{name: "user unlock", auth: true, run: unlockUser},
+	{name: "bench", run: runBench},
+}
 
-	authClient := client.NewAuthClient(cc1, username, password)
-	interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
-	if err != nil {
-		log.Fatal("cannot create auth interceptor: ", err)
-	}
+func init() {
+	// shell通过commands执行命令，在init中注册以避免初始化循环
+	commands = append(commands, command{name: "shell", run: runShell})
+}
 
-	cc2, err := grpc.Dial(
-		*serverAddress,
-		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(interceptor.Unary()),
-		grpc.WithStreamInterceptor(interceptor.Stream()),
-	)
-	if err != nil {
-		log.Fatal("cannot dial server: ",err)
+// findCommand returns the command of the arguments and the remaining arguments
+func findCommand(args []string) (*command, []string) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], args[len(words):]
+		}
 	}
-
-	laptopClient := client.NewLaptopClient(cc2)
-	testRateLaptop(laptopClient)
+	return nil, nil
 }
 
-func searchLaptop(client pb.LaptopServiceClient, filter *pb.Filter) {
-	log.Print("search filter: ",filter)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// newFlagSet returns the flag set of a command, which returns the errors instead of exiting in the shell
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	return flags
+}
 
-	req := &pb.SearchLaptopRequest{Filter: filter}
-	stream, err := client.SearchLaptop(ctx, req)
-	if err != nil {
-		log.Fatal("cannot search laptop: ",err)
-	}
+// app is the connections and the clients shared by the commands
+type app struct {
+	config     *config
+	printer    *printer
+	tokenCache *client.FileTokenCache
 
-	for {
-		res, err := stream.Recv()
-		// 将流中数据读取完毕
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
-			log.Fatal("cannot receive response:", err)
-		}
+	authConn    *grpc.ClientConn // 不带token的连接，用于登录
+	conn        *grpc.ClientConn
+	interceptor *client.AuthInterceptor
 
-		laptop := res.GetLaptop()
-		log.Print("- found:", laptop.GetId())
-		log.Print(" + brand:", laptop.GetBrand())
-		log.Print(" + name:", laptop.GetName())
-		log.Print(" + cpu cores:", laptop.GetCpu().GetNumberCores())
-		log.Print(" + cpu min ghz:", laptop.GetCpu().GetMinGhz())
-		log.Print(" + ram:", laptop.GetRam())
-		log.Print(" + price:", laptop.GetPriceUsd(),"usd")
-	}
+	laptopClient *client.LaptopClient
+	userClient   *client.UserClient
 }
 
-func uploadImage(laptopClient pb.LaptopServiceClient, laptopID string, imagePath string) {
-	file, err := os.Open(imagePath)
+// newApp dials the server, and logs in when the command needs authentication
+func newApp(cfg *config, auth bool) (*app, error) {
+	printer, err := newPrinter(cfg.Output, os.Stdout)
 	if err != nil {
-		log.Fatal("cannot open image file: ", err)
+		return nil, err
 	}
-	defer file.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	stream, err := laptopClient.UploadImage(ctx)
+	tokenCachePath, err := cfg.tokenCachePath()
+	if err != nil {
+		return nil, err
+	}
+	loadBalancingPolicy, err := cfg.loadBalancingPolicy()
 	if err != nil {
-		log.Fatal("cannot upload image:", err)
+		return nil, err
 	}
 
-	// 首先构造上传图片的起始请求，该请求中包含了图片信息
-	req := &pb.UploadImageRequest{
-		Data: &pb.UploadImageRequest_Info{
-			Info: &pb.ImageInfo{
-				LaptopId:  laptopID,
-				ImageType: filepath.Ext(imagePath),
-			},
-		} ,
+	transportOption := grpc.WithInsecure()
+	if cfg.TLS {
+		reloader, err := tlsconfig.NewReloader(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load TLS credentials: %w", err)
+		}
+		transportOption = grpc.WithTransportCredentials(credentials.NewTLS(reloader.ClientConfig()))
 	}
 
-	err = stream.Send(req)
+	// 地址可以是多个服务器，两个连接都在健康的服务器之间负载均衡，服务器停止后自动切换到其他服务器
+	target := client.Target(cfg.Address)
+	balancingOption := client.WithLoadBalancing(loadBalancingPolicy)
+	authConn, err := grpc.Dial(target, transportOption, balancingOption)
 	if err != nil {
-		log.Fatal("cannot send image info: ",err)
+		return nil, fmt.Errorf("cannot dial server: %w", err)
+	}
+	app := &app{
+		config:     cfg,
+		printer:    printer,
+		tokenCache: client.NewFileTokenCache(tokenCachePath),
+		authConn:   authConn,
 	}
 
-	// 开始准备具体的图片数据
-	reader := bufio.NewReader(file)
-	buffer := make([]byte, 1024)
-
-	// 循环读取图片chunk数据，并发送达server
-	for  {
-		n, err := reader.Read(buffer)
-		if err == io.EOF {
-			break
+	// 幂等的RPC遇到Unavailable时退避重试，重试在认证之外，每次重试都使用最新的token
+	retryInterceptor := client.NewRetryInterceptor(client.DefaultRetryPolicies(), client.NewRetryBudget(10, 0.1))
+	unaryInterceptors := []grpc.UnaryClientInterceptor{retryInterceptor.Unary()}
+	streamInterceptors := []grpc.StreamClientInterceptor{retryInterceptor.Stream()}
+	dialOptions := []grpc.DialOption{transportOption, balancingOption}
+
+	if cfg.APIKey != "" {
+		// 使用API key时不需要登录，每个请求都带上x-api-key
+		dialOptions = append(dialOptions, client.WithAPIKey(cfg.APIKey))
+	} else if cfg.TLS && cfg.TLSCert != "" {
+		// 客户端证书已经确定了身份，不需要登录
+	} else if auth {
+		authClient, err := app.newAuthClient(false, "")
+		if err == nil {
+			app.interceptor, err = client.NewAuthInterceptor(context.Background(), authClient, authMethods())
 		}
 		if err != nil {
-			log.Fatal("cannot read chunk to buffer: ", err)
+			app.close()
+			return nil, err
 		}
 
-		req := &pb.UploadImageRequest{
-			Data: &pb.UploadImageRequest_ChunkData{
-				ChunkData: buffer[:n],
-			},
-		}
-
-		err = stream.Send(req)
-		if err != nil {
-			// 当Send出错了后，服务器就不再发送信息，此时需要我们手动接受错误信息
-			err2 := stream.RecvMsg(nil)
-			log.Fatal("cannot send chunk to server: ", err, err2)
-		}
+		unaryInterceptors = append(unaryInterceptors, app.interceptor.Unary())
+		streamInterceptors = append(streamInterceptors, app.interceptor.Stream())
 	}
 
-	// 发送结束，关闭通道并接受对端响应
-	res, err := stream.CloseAndRecv()
+	app.conn, err = grpc.Dial(
+		target,
+		append(
+			dialOptions,
+			grpc.WithChainUnaryInterceptor(unaryInterceptors...),
+			grpc.WithChainStreamInterceptor(streamInterceptors...),
+		)...,
+	)
 	if err != nil {
-		log.Fatal("cannot receive response: ", err)
+		app.close()
+		return nil, fmt.Errorf("cannot dial server: %w", err)
 	}
 
-	log.Printf("image uploaded with id: %s, size: %d", res.GetId(), res.GetSize())
+	app.laptopClient = client.NewLaptopClient(app.conn)
+	app.userClient = client.NewUserClient(app.conn)
+	return app, nil
 }
 
-func rateLaptop(laptopClient pb.LaptopServiceClient, laptopIDs []string, scores []float64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// newAuthClient returns an auth client that uses the cached tokens of the user. When the user has no cached
+// tokens or a new login is forced, the password is prompted if it is not configured, and so is the
+// two-factor code if the user requires it and otp is empty
+func (app *app) newAuthClient(forceLogin bool, otp string) (*client.AuthClient, error) {
+	cfg := app.config
+	if !forceLogin {
+		token, err := app.tokenCache.Load()
+		if err == nil && token != nil && (cfg.Username == "" || cfg.Username == token.Username) {
+			return client.NewAuthClient(app.authConn, cfg.Username, cfg.Password, client.WithTokenCache(app.tokenCache)), nil
+		}
+	}
 
-	stream, err := laptopClient.RateLaptop(ctx)
-	if err != nil {
-		return fmt.Errorf("cannot rate laptop: %v",err)
+	if cfg.Username == "" {
+		return nil, fmt.Errorf("not logged in, run pcbook -username <name> login")
+	}
+	if cfg.Password == "" {
+		password, err := prompt("password: ", true)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Password = password
 	}
 
-	// 发送和接受会同时进行，所以需要进行同步
-	waitResponse := make(chan error)
-	// go routine to receive response
-	go func(){
-		for {
-			res, err := stream.Recv()
-			if err == io.EOF {
-				log.Println("no more response")
-				waitResponse <- nil
-				return
+	authClient := client.NewAuthClient(
+		app.authConn,
+		cfg.Username,
+		cfg.Password,
+		client.WithTokenCache(app.tokenCache),
+		client.WithTwoFactorCode(func() (string, error) {
+			if otp != "" {
+				return otp, nil
 			}
-			if err != nil {
-				waitResponse <- fmt.Errorf("cannot receive stream response: %v",err)
-				return
-			}
-
-			log.Println("receive response: ",res)
-		}
-	}()
+			return prompt("two-factor code: ", false)
+		}),
+	)
+	return authClient, nil
+}
 
-	// send request
-	for i,laptopID := range laptopIDs{
-		req := &pb.RateLaptopRequest{
-			LaptopId: laptopID,
-			Score:    scores[i],
-		}
+func (app *app) close() {
+	if app.interceptor != nil {
+		app.interceptor.Close()
+	}
+	if app.conn != nil {
+		app.conn.Close()
+	}
+	app.authConn.Close()
+}
 
-		err := stream.Send(req)
+// prompt reads a line from the terminal, without echo when secret is true
+func prompt(message string, secret bool) (string, error) {
+	fmt.Fprint(os.Stderr, message)
+	if secret && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
 		if err != nil {
-			return fmt.Errorf("cannot send stream request: %v - %v", err, stream.RecvMsg(nil))
+			return "", fmt.Errorf("cannot read password: %w", err)
 		}
-
-		log.Println("send request: ",req)
+		return string(line), nil
 	}
 
-	// 当所有的请求发送完毕后，需要关闭stream
-	err = stream.CloseSend()
+	var line string
+	_, err := fmt.Fscanln(os.Stdin, &line)
 	if err != nil {
-		return fmt.Errorf("cannot close send: %v",err)
+		return "", fmt.Errorf("cannot read input: %w", err)
 	}
-
-	// 读取发送过程中的错误，并返回
-	err = <- waitResponse
-	return err
+	return line, nil
 }
 
-func testCreateLaptop(laptopClient *client.LaptopClient)  {
-	laptopClient.CreateLaptop(sample.NewLaptop())
+// printError prints the error of a command, only the code and the message of a server error
+func printError(err error) {
+	if st, ok := status.FromError(err); ok {
+		err = fmt.Errorf("%s: %s", st.Code(), st.Message())
+	}
+	fmt.Fprintln(os.Stderr, "error:", err)
 }
 
-func testSearchLaptop(laptopClient *client.LaptopClient) {
-	for i := 0; i < 10; i++ {
-		laptopClient.CreateLaptop(sample.NewLaptop())
+func main() {
+	// 日志只用于调试，结果输出到stdout
+	log.SetOutput(ioutil.Discard)
+
+	flags := flag.NewFlagSet("pcbook", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "print the logs to stderr")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+		flags.PrintDefaults()
 	}
-
-	filter := &pb.Filter{
-		MaxPriceUsd: 3000,
-		MinCpuCores: 4,
-		MinCpuGhz:   2.5,
-		MinRam: &pb.Memory{
-			Value: 8,
-			Unit:  pb.Memory_GIGABYTE,
-		},
+	cfg, err := loadConfig(flags, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	laptopClient.SearchLaptop(filter)
-}
-
-func testUploadImage(laptopClient *client.LaptopClient) {
-	laptop := sample.NewLaptop()
-	laptopClient.CreateLaptop(laptop)
-	laptopClient.UploadImage(laptop.GetId(), "tmp/laptop.jpg")
-}
-
-func testRateLaptop(laptopClient *client.LaptopClient)  {
-	n := 3
-	laptopIDs := make([]string, n)
-
-	for i := 0; i < 3; i++ {
-		laptop := sample.NewLaptop()
-		laptopIDs[i] = laptop.GetId()
-		laptopClient.CreateLaptop(laptop)
+	if *verbose {
+		log.SetOutput(os.Stderr)
 	}
 
-	scores := make([]float64,n)
-	for {
-		fmt.Print("rate laptop (y/n)?")
-		var answer string
-		fmt.Scan(&answer)
-
-		if strings.ToLower(answer) != "y" {
-			break
-		}
+	command, args := findCommand(flags.Args())
+	if command == nil {
+		flags.Usage()
+		os.Exit(2)
+	}
 
-		for i := 0; i < n; i++ {
-			scores[i] = sample.RandomLaptopScore()
-		}
+	// Ctrl-C取消正在进行的RPC，shell中Ctrl-C只取消当前的命令，由shell自己处理
+	ctx := context.Background()
+	if command.name != "shell" {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+	}
 
-		err := laptopClient.RateLaptop( laptopIDs, scores)
-		if err != nil {
-			log.Fatal(err)
-		}
+	app, err := newApp(cfg, command.auth)
+	if err == nil {
+		err = command.run(ctx, app, args)
+		app.close()
 	}
-}
\ No newline at end of file
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	if err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/serializer"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// item is a result printed as a table row, or as a JSON or YAML object
+type item struct {
+	value interface{} // proto message或者可以用encoding/json序列化的值
+	row   []string
+}
+
+// printer prints the results of the commands in the output format
+type printer struct {
+	format  string
+	out     io.Writer
+	observe func(value interface{}) // 每个输出的结果都会调用，shell用于记录laptop id
+}
+
+func newPrinter(format string, out io.Writer) (*printer, error) {
+	switch format {
+	case "table", "json", "yaml":
+		return &printer{format: format, out: out}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q, must be table, json or yaml", format)
+	}
+}
+
+// printItem prints a single result
+func (p *printer) printItem(header []string, result item) error {
+	p.notify(result)
+	if p.format == "table" {
+		return p.printTable(header, []item{result})
+	}
+
+	data, err := marshalJSON(result.value)
+	if err != nil {
+		return err
+	}
+	return p.write(data)
+}
+
+// printList prints a list of results, an empty list is still printed as [] in JSON and YAML
+func (p *printer) printList(header []string, results []item) error {
+	p.notify(results...)
+	if p.format == "table" {
+		return p.printTable(header, results)
+	}
+
+	list := make([]json.RawMessage, len(results))
+	for i, result := range results {
+		data, err := marshalJSON(result.value)
+		if err != nil {
+			return err
+		}
+		list[i] = data
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("cannot marshal results: %w", err)
+	}
+	return p.write(data)
+}
+
+func (p *printer) notify(results ...item) {
+	if p.observe == nil {
+		return
+	}
+	for _, result := range results {
+		p.observe(result.value)
+	}
+}
+
+// itemStream prints the results one by one as they arrive
+type itemStream struct {
+	printer *printer
+	header  []string
+	widths  []int
+	items   []item // JSON和YAML格式在结束时输出整个列表
+}
+
+// stream returns an item stream, the table rows are printed immediately, while JSON and YAML are
+// printed as a list when the stream is closed
+func (p *printer) stream(header []string) *itemStream {
+	return &itemStream{printer: p, header: header}
+}
+
+func (stream *itemStream) add(result item) error {
+	if stream.printer.format != "table" {
+		stream.items = append(stream.items, result)
+		return nil
+	}
+
+	if stream.widths == nil {
+		stream.widths = make([]int, len(stream.header))
+		stream.updateWidths(stream.header)
+		stream.updateWidths(result.row)
+		err := stream.printRow(stream.header)
+		if err != nil {
+			return err
+		}
+	}
+	// 之前的行已经输出，列宽只能增加
+	stream.printer.notify(result)
+	stream.updateWidths(result.row)
+	return stream.printRow(result.row)
+}
+
+func (stream *itemStream) close() error {
+	if stream.printer.format != "table" {
+		return stream.printer.printList(stream.header, stream.items)
+	}
+	if stream.widths == nil {
+		return stream.printRow(stream.header)
+	}
+	return nil
+}
+
+func (stream *itemStream) updateWidths(row []string) {
+	for i, cell := range row {
+		if i < len(stream.widths) && len(cell) > stream.widths[i] {
+			stream.widths[i] = len(cell)
+		}
+	}
+}
+
+func (stream *itemStream) printRow(row []string) error {
+	cells := make([]string, len(row))
+	for i, cell := range row {
+		if i < len(row)-1 && i < len(stream.widths) {
+			cell = fmt.Sprintf("%-*s", stream.widths[i], cell)
+		}
+		cells[i] = cell
+	}
+	_, err := fmt.Fprintln(stream.printer.out, strings.Join(cells, "  "))
+	return err
+}
+
+func (p *printer) printTable(header []string, results []item) error {
+	writer := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(header, "\t"))
+	for _, result := range results {
+		fmt.Fprintln(writer, strings.Join(result.row, "\t"))
+	}
+	return writer.Flush()
+}
+
+// write prints the JSON data in the output format
+func (p *printer) write(data []byte) error {
+	if p.format == "yaml" {
+		// JSON也是合法的YAML，解析成node可以保留字段的顺序
+		var node yaml.Node
+		err := yaml.Unmarshal(data, &node)
+		if err != nil {
+			return fmt.Errorf("cannot convert results to YAML: %w", err)
+		}
+		resetStyle(&node)
+
+		encoder := yaml.NewEncoder(p.out)
+		encoder.SetIndent(2)
+		err = encoder.Encode(&node)
+		if err != nil {
+			return fmt.Errorf("cannot write results: %w", err)
+		}
+		return encoder.Close()
+	}
+
+	var indented bytes.Buffer
+	err := json.Indent(&indented, data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot format results: %w", err)
+	}
+	_, err = fmt.Fprintln(p.out, indented.String())
+	return err
+}
+
+// resetStyle prints the YAML converted from JSON in block style with unquoted strings where possible
+func resetStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		resetStyle(child)
+	}
+}
+
+func marshalJSON(value interface{}) ([]byte, error) {
+	if message, ok := value.(proto.Message); ok {
+		data, err := serializer.JSONMarshalOptions().Marshal(message)
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal result: %w", err)
+		}
+		return data, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal result: %w", err)
+	}
+	return data, nil
+}
+
+var laptopHeader = []string{"ID", "BRAND", "NAME", "CPU", "RAM", "PRICE", "OWNER"}
+
+func laptopItem(laptop *pb.Laptop) item {
+	return item{
+		value: laptop,
+		row: []string{
+			laptop.GetId(),
+			laptop.GetBrand(),
+			laptop.GetName(),
+			fmt.Sprintf("%d cores %.1f-%.1fGHz", laptop.GetCpu().GetNumberCores(), laptop.GetCpu().GetMinGhz(), laptop.GetCpu().GetMaxGhz()),
+			formatMemory(laptop.GetRam()),
+			fmt.Sprintf("$%.2f", laptop.GetPriceUsd()),
+			laptop.GetOwner(),
+		},
+	}
+}
+
+var ratingHeader = []string{"LAPTOP", "RATED", "AVERAGE"}
+
+func ratingItem(rating *pb.RateLaptopResponse) item {
+	return item{
+		value: rating,
+		row: []string{
+			rating.GetLaptopId(),
+			fmt.Sprint(rating.GetRatedCount()),
+			fmt.Sprintf("%.2f", rating.GetAverageScore()),
+		},
+	}
+}
+
+var userHeader = []string{"USERNAME", "ROLE", "DISABLED", "2FA", "OIDC", "LAST LOGIN"}
+
+func userItem(user *pb.UserProfile) item {
+	lastLogin := "never"
+	if user.GetLastLoginAt() != nil {
+		lastLogin = user.GetLastLoginAt().AsTime().Local().Format(time.RFC3339)
+	}
+	return item{
+		value: user,
+		row: []string{
+			user.GetUsername(),
+			user.GetRole(),
+			fmt.Sprint(user.GetDisabled()),
+			fmt.Sprint(user.GetTwoFactorEnabled()),
+			fmt.Sprint(user.GetOidcLinked()),
+			lastLogin,
+		},
+	}
+}
+
+func formatMemory(memory *pb.Memory) string {
+	unit := map[pb.Memory_Unit]string{
+		pb.Memory_BIT:      "bit",
+		pb.Memory_BYTE:     "B",
+		pb.Memory_KILOBYTE: "KB",
+		pb.Memory_MEGABYTE: "MB",
+		pb.Memory_GIGABYTE: "GB",
+		pb.Memory_TERABYTE: "TB",
+	}[memory.GetUnit()]
+	return fmt.Sprintf("%d%s", memory.GetValue(), unit)
+}
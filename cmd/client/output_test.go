@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"testing"
+)
+
+func TestPrinter(t *testing.T) {
+	t.Parallel()
+
+	laptops := []*pb.Laptop{testLaptop("id1", "Dell", 1999.5), testLaptop("id2", "Lenovo", 899)}
+	items := []item{laptopItem(laptops[0]), laptopItem(laptops[1])}
+
+	// 表格按列对齐
+	out := printTestList(t, "table", items)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, strings.Fields("ID BRAND NAME CPU RAM PRICE OWNER"), strings.Fields(lines[0]))
+	require.Equal(t, strings.Index(lines[0], "BRAND"), strings.Index(lines[1], "Dell"))
+	require.Equal(t, strings.Index(lines[0], "BRAND"), strings.Index(lines[2], "Lenovo"))
+	require.Contains(t, lines[1], "8 cores 2.5-4.5GHz")
+	require.Contains(t, lines[1], "16GB")
+	require.Contains(t, lines[1], "$1999.50")
+
+	// JSON和YAML使用proto的字段名
+	var list []map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(printTestList(t, "json", items)), &list))
+	require.Len(t, list, 2)
+	require.Equal(t, "id2", list[1]["id"])
+	require.Equal(t, 899.0, list[1]["price_usd"])
+
+	list = nil
+	require.NoError(t, yaml.Unmarshal([]byte(printTestList(t, "yaml", items)), &list))
+	require.Len(t, list, 2)
+	require.Equal(t, "Dell", list[0]["brand"])
+
+	// 单个结果不是列表，空列表也会输出
+	var object map[string]interface{}
+	var buffer bytes.Buffer
+	printer, err := newPrinter("json", &buffer)
+	require.NoError(t, err)
+	require.NoError(t, printer.printItem(laptopHeader, items[0]))
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &object))
+	require.Equal(t, "id1", object["id"])
+
+	require.JSONEq(t, "[]", printTestList(t, "json", nil))
+	require.Equal(t, "[]", strings.TrimSpace(printTestList(t, "yaml", nil)))
+
+	_, err = newPrinter("xml", &buffer)
+	require.Error(t, err)
+}
+
+func TestPrinterStream(t *testing.T) {
+	t.Parallel()
+
+	// 表格立即输出每一行，JSON在结束时输出整个列表
+	var buffer bytes.Buffer
+	printer, err := newPrinter("table", &buffer)
+	require.NoError(t, err)
+	var observed []interface{}
+	printer.observe = func(value interface{}) { observed = append(observed, value) }
+
+	stream := printer.stream(laptopHeader)
+	laptop := testLaptop("id1", "Dell", 1999.5)
+	require.NoError(t, stream.add(laptopItem(laptop)))
+	require.Contains(t, buffer.String(), "Dell")
+	require.NoError(t, stream.close())
+	require.Len(t, strings.Split(strings.TrimSpace(buffer.String()), "\n"), 2)
+	require.Equal(t, []interface{}{laptop}, observed)
+
+	buffer.Reset()
+	printer, err = newPrinter("json", &buffer)
+	require.NoError(t, err)
+	stream = printer.stream(laptopHeader)
+	require.NoError(t, stream.add(laptopItem(laptop)))
+	require.Empty(t, buffer.String())
+	require.NoError(t, stream.close())
+	var list []map[string]interface{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &list))
+	require.Len(t, list, 1)
+
+	// 没有结果的表格只输出表头
+	buffer.Reset()
+	printer, err = newPrinter("table", &buffer)
+	require.NoError(t, err)
+	require.NoError(t, printer.stream(laptopHeader).close())
+	require.Equal(t, strings.Fields("ID BRAND NAME CPU RAM PRICE OWNER"), strings.Fields(buffer.String()))
+}
+
+func printTestList(t *testing.T, format string, items []item) string {
+	var buffer bytes.Buffer
+	printer, err := newPrinter(format, &buffer)
+	require.NoError(t, err)
+	require.NoError(t, printer.printList(laptopHeader, items))
+	return buffer.String()
+}
+
+func testLaptop(id string, brand string, price float64) *pb.Laptop {
+	return &pb.Laptop{
+		Id:       id,
+		Brand:    brand,
+		Name:     "Laptop",
+		Cpu:      &pb.CPU{NumberCores: 8, MinGhz: 2.5, MaxGhz: 4.5},
+		Ram:      &pb.Memory{Value: 16, Unit: pb.Memory_GIGABYTE},
+		PriceUsd: price,
+		Owner:    "editor1",
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+)
+
+// shell runs the commands read from the terminal, with history and tab completion of the commands
+// and of the laptop ids that have been printed
+type shell struct {
+	config    *config
+	app       *app // 执行不需要登录的命令
+	authApp   *app // 第一次执行需要登录的命令时创建
+	laptopIDs map[string]bool
+	// interrupt returns a context that is canceled when Ctrl-C is pressed while a command runs
+	interrupt func(ctx context.Context) (context.Context, context.CancelFunc)
+}
+
+func newShell(app *app) *shell {
+	sh := &shell{
+		config:    app.config,
+		app:       app,
+		laptopIDs: make(map[string]bool),
+		interrupt: func(ctx context.Context) (context.Context, context.CancelFunc) {
+			return signal.NotifyContext(ctx, os.Interrupt)
+		},
+	}
+	app.printer.observe = sh.observe
+	return sh
+}
+
+func runShell(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("shell")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	sh := newShell(app)
+	defer sh.closeAuthApp()
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return sh.runScript(ctx, os.Stdin)
+	}
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("cannot set terminal to raw mode: %w", err)
+	}
+	defer terminal.Restore(fd, state)
+
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "pcbook> ")
+	term.AutoCompleteCallback = sh.complete
+	if width, height, err := terminal.GetSize(fd); err == nil {
+		term.SetSize(width, height)
+	}
+
+	return sh.runTerminal(ctx, term, func(raw bool) error {
+		if !raw {
+			return terminal.Restore(fd, state)
+		}
+		_, err := terminal.MakeRaw(fd)
+		return err
+	})
+}
+
+// runTerminal runs the commands read from the terminal with history and tab completion, until Ctrl-D,
+// Ctrl-C or exit. setRaw switches the terminal out of raw mode while a command runs and back afterwards
+func (sh *shell) runTerminal(ctx context.Context, term *terminal.Terminal, setRaw func(raw bool) error) error {
+	for {
+		// Ctrl-D或Ctrl-C退出
+		line, err := term.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read command: %w", err)
+		}
+
+		// 执行命令时恢复终端的正常模式，输出正常换行，Ctrl-C产生SIGINT用于取消RPC
+		setRaw(false)
+		quit := sh.execute(ctx, line)
+		if quit {
+			return nil
+		}
+
+		err = setRaw(true)
+		if err != nil {
+			return fmt.Errorf("cannot set terminal to raw mode: %w", err)
+		}
+	}
+}
+
+// runScript runs the commands read line by line when the input is not a terminal
+func (sh *shell) runScript(ctx context.Context, input io.Reader) error {
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		if sh.execute(ctx, scanner.Text()) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// execute runs the command line, and returns true when the shell should exit
+func (sh *shell) execute(ctx context.Context, line string) bool {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "exit", "quit":
+		return true
+	case "help":
+		fmt.Println(shellHelp())
+		return false
+	}
+
+	command, args := findCommand(args)
+	if command == nil || command.name == "shell" {
+		fmt.Fprintf(os.Stderr, "unknown command %q, type help to list the commands\n", line)
+		return false
+	}
+
+	app, err := sh.appFor(command)
+	if err != nil {
+		printError(err)
+		return false
+	}
+
+	// 每个命令使用单独的context，Ctrl-C只取消当前的命令
+	commandCtx, stop := sh.interrupt(ctx)
+	err = command.run(commandCtx, app, args)
+	interrupted := commandCtx.Err() != nil && ctx.Err() == nil
+	stop()
+
+	switch {
+	case interrupted:
+		fmt.Fprintln(os.Stderr, "interrupted")
+	case err != nil && err != flag.ErrHelp:
+		printError(err)
+	}
+
+	// 登录状态改变后，需要登录的命令重新建立连接
+	switch command.name {
+	case "login", "logout", "user passwd":
+		sh.closeAuthApp()
+	}
+	return false
+}
+
+// appFor returns the app to run the command, it logs in when the command needs authentication
+func (sh *shell) appFor(command *command) (*app, error) {
+	if !command.auth {
+		return sh.app, nil
+	}
+
+	if sh.authApp == nil {
+		authApp, err := newApp(sh.config, true)
+		if err != nil {
+			return nil, err
+		}
+		authApp.printer.observe = sh.observe
+		sh.authApp = authApp
+	}
+	return sh.authApp, nil
+}
+
+func (sh *shell) closeAuthApp() {
+	if sh.authApp != nil {
+		sh.authApp.close()
+		sh.authApp = nil
+	}
+}
+
+// observe remembers the ids of the printed laptops for tab completion
+func (sh *shell) observe(value interface{}) {
+	switch value := value.(type) {
+	case *pb.Laptop:
+		sh.laptopIDs[value.GetId()] = true
+	case *pb.RateLaptopResponse:
+		sh.laptopIDs[value.GetLaptopId()] = true
+	}
+}
+
+// complete completes the word before the cursor when tab is pressed, the first words are completed with
+// the command names and the others with the laptop ids
+func (sh *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	start := strings.LastIndex(line[:pos], " ") + 1
+	word := line[start:pos]
+	candidates := commandWords(strings.Fields(line[:start]))
+	if len(candidates) == 0 {
+		for id := range sh.laptopIDs {
+			candidates = append(candidates, id)
+		}
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		return line, pos, true
+	}
+
+	// 多个候选时补全到共同的前缀
+	completion := commonPrefix(matches)
+	if len(matches) == 1 {
+		completion += " "
+	}
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
+
+// commandWords returns the possible next words of the command names after the words
+func commandWords(words []string) []string {
+	names := []string{"help", "exit", "quit"}
+	for _, command := range commands {
+		if command.name != "shell" {
+			names = append(names, command.name)
+		}
+	}
+
+	found := make(map[string]bool)
+	var next []string
+	for _, name := range names {
+		nameWords := strings.Fields(name)
+		if len(nameWords) <= len(words) || strings.Join(nameWords[:len(words)], " ") != strings.Join(words, " ") {
+			continue
+		}
+		if word := nameWords[len(words)]; !found[word] {
+			found[word] = true
+			next = append(next, word)
+		}
+	}
+	sort.Strings(next)
+	return next
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// shellHelp returns the commands in the usage except shell, and the commands only available in the shell
+func shellHelp() string {
+	commands := usage[strings.Index(usage, "commands:"):strings.Index(usage, "\n\nflags:")]
+	var lines []string
+	for _, line := range strings.Split(commands, "\n") {
+		if !strings.HasPrefix(line, "  shell ") {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines,
+		"  help                                       show the commands",
+		"  exit                                       exit the shell, or press Ctrl-D",
+	)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/terminal"
+	"google.golang.org/grpc"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShellComplete(t *testing.T) {
+	t.Parallel()
+
+	sh := &shell{laptopIDs: map[string]bool{"abc1": true, "abc2": true, "xyz": true}}
+	testCases := []struct {
+		name    string
+		line    string
+		pos     int
+		newLine string
+		newPos  int
+	}{
+		{"command", "la", 2, "laptop ", 7},
+		{"subcommand", "laptop g", 8, "laptop get ", 11},
+		{"common prefix of the commands", "i", 1, "im", 2},
+		{"common prefix of the ids", "laptop get ab", 13, "laptop get abc", 14},
+		{"laptop id", "laptop get x", 12, "laptop get xyz ", 15},
+		{"second laptop id", "laptop get xyz a", 16, "laptop get xyz abc", 18},
+		{"no match", "laptop get q", 12, "laptop get q", 12},
+		{"cursor in the middle", "la get", 2, "laptop  get", 7},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			newLine, newPos, ok := sh.complete(tc.line, tc.pos, '\t')
+			require.True(t, ok)
+			require.Equal(t, tc.newLine, newLine)
+			require.Equal(t, tc.newPos, newPos)
+		})
+	}
+
+	// 只处理tab
+	_, _, ok := sh.complete("la", 2, 'a')
+	require.False(t, ok)
+}
+
+func TestCommandWords(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		words []string
+		next  []string
+	}{
+		{"top level", nil, []string{"bench", "exit", "export", "help", "image", "import", "laptop", "login", "logout", "quit", "rate", "user", "watch"}},
+		{"subcommands", []string{"laptop"}, []string{"create", "get", "list", "search"}},
+		{"complete command", []string{"laptop", "get"}, nil},
+		{"unknown command", []string{"computer"}, nil},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.next, commandWords(tc.words))
+		})
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		words  []string
+		prefix string
+	}{
+		{[]string{"abc", "abd"}, "ab"},
+		{[]string{"abc", "abd", "a"}, "a"},
+		{[]string{"abc"}, "abc"},
+		{[]string{"abc", "xyz"}, ""},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.prefix, commonPrefix(tc.words), "%v", tc.words)
+	}
+}
+
+// TestShellTerminal types a search, interrupts it with Ctrl-C, runs it again from the history and exits with Ctrl-D
+func TestShellTerminal(t *testing.T) {
+	t.Parallel()
+
+	server := &blockingSearchServer{started: make(chan struct{}, 1)}
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, server)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	cfg := defaultConfig()
+	cfg.Address = listener.Addr().String()
+	cfg.TokenCache = filepath.Join(t.TempDir(), "tokens.json")
+	app, err := newApp(cfg, false)
+	require.NoError(t, err)
+	defer app.close()
+
+	var output bytes.Buffer
+	app.printer.out = &output
+	sh := newShell(app)
+
+	// Ctrl-C由测试模拟，取消当前的命令
+	interrupts := make(chan context.CancelFunc, 1)
+	sh.interrupt = func(ctx context.Context) (context.Context, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(ctx)
+		interrupts <- cancel
+		return ctx, cancel
+	}
+
+	input, keys := io.Pipe()
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{input, ioutil.Discard}, "pcbook> ")
+	term.AutoCompleteCallback = sh.complete
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sh.runTerminal(context.Background(), term, func(raw bool) error { return nil })
+	}()
+
+	// tab补全命令，第一次搜索一直等待到被中断
+	_, err = keys.Write([]byte("laptop se\t\r"))
+	require.NoError(t, err)
+	waitTestSignal(t, server.started)
+	cancel := <-interrupts
+	cancel()
+
+	// 上箭头重新执行历史中的搜索
+	_, err = keys.Write([]byte("\x1b[A\r"))
+	require.NoError(t, err)
+	<-interrupts
+
+	_, err = keys.Write([]byte{4}) // Ctrl-D
+	require.NoError(t, err)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shell did not exit")
+	}
+
+	require.Equal(t, 2, server.searchCount())
+	require.Contains(t, output.String(), "laptop1")
+	require.True(t, sh.laptopIDs["laptop1"])
+}
+
+// blockingSearchServer blocks the first search until it is canceled, and returns a laptop to the next ones
+type blockingSearchServer struct {
+	pb.UnimplementedLaptopServiceServer
+	started chan struct{}
+
+	mutex    sync.Mutex
+	searches int
+}
+
+func (server *blockingSearchServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.LaptopService_SearchLaptopServer) error {
+	server.mutex.Lock()
+	server.searches++
+	first := server.searches == 1
+	server.mutex.Unlock()
+
+	if first {
+		server.started <- struct{}{}
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	}
+	return stream.Send(&pb.SearchLaptopResponse{Laptop: testLaptop("laptop1", "Dell", 1999.5)})
+}
+
+func (server *blockingSearchServer) searchCount() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.searches
+}
+
+func waitTestSignal(t *testing.T, signal <-chan struct{}) {
+	select {
+	case <-signal:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
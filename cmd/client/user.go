@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/client"
+)
+
+// loginResult is the output of logging in, the tokens are only saved in the token cache
+type loginResult struct {
+	Username   string `json:"username"`
+	TokenCache string `json:"token_cache"`
+}
+
+func login(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("login")
+	otp := flags.String("otp", "", "the TOTP code or a recovery code, prompted when required and empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	authClient, err := app.newAuthClient(true, *otp)
+	if err != nil {
+		return err
+	}
+
+	_, err = authClient.Login(ctx)
+	if err != nil {
+		return err
+	}
+
+	path, err := app.config.tokenCachePath()
+	if err != nil {
+		return err
+	}
+	result := loginResult{Username: authClient.Username(), TokenCache: path}
+	return app.printer.printItem([]string{"USERNAME", "TOKEN CACHE"}, item{
+		value: result,
+		row:   []string{result.Username, result.TokenCache},
+	})
+}
+
+func logout(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("logout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if app.interceptor == nil {
+		return fmt.Errorf("not logged in with username and password")
+	}
+
+	authClient := client.NewAuthClient(app.authConn, "", "", client.WithTokenCache(app.tokenCache))
+	return authClient.Logout(ctx, app.interceptor.AccessToken())
+}
+
+func registerUser(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("user register")
+	password := flags.String("password", "", "the password of the new user, prompted when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: user register [-password p] <name>")
+	}
+
+	if *password == "" {
+		var err error
+		*password, err = prompt("password: ", true)
+		if err != nil {
+			return err
+		}
+	}
+
+	user, err := app.userClient.Register(ctx, flags.Arg(0), *password)
+	if err != nil {
+		return err
+	}
+	return app.printer.printItem(userHeader, userItem(user))
+}
+
+func showProfile(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("user profile")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	user, err := app.userClient.GetProfile(ctx)
+	if err != nil {
+		return err
+	}
+	return app.printer.printItem(userHeader, userItem(user))
+}
+
+func changePassword(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("user passwd")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	oldPassword, err := prompt("old password: ", true)
+	if err != nil {
+		return err
+	}
+	newPassword, err := prompt("new password: ", true)
+	if err != nil {
+		return err
+	}
+
+	err = app.userClient.ChangePassword(ctx, oldPassword, newPassword)
+	if err != nil {
+		return err
+	}
+	// 修改密码后服务端吊销了所有token
+	return app.tokenCache.Clear()
+}
+
+func listUsers(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("user list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	users, err := app.userClient.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	results := make([]item, len(users))
+	for i, user := range users {
+		results[i] = userItem(user)
+	}
+	return app.printer.printList(userHeader, results)
+}
+
+func setUserRole(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("user set-role")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: user set-role <name> <role>")
+	}
+
+	user, err := app.userClient.SetUserRole(ctx, flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	return app.printer.printItem(userHeader, userItem(user))
+}
+
+func disableUser(ctx context.Context, app *app, args []string) error {
+	return setUserDisabled(ctx, app, "user disable", args, true)
+}
+
+func enableUser(ctx context.Context, app *app, args []string) error {
+	return setUserDisabled(ctx, app, "user enable", args, false)
+}
+
+func setUserDisabled(ctx context.Context, app *app, name string, args []string, disabled bool) error {
+	flags := newFlagSet(name)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: %s <name>", name)
+	}
+
+	user, err := app.userClient.DisableUser(ctx, flags.Arg(0), disabled)
+	if err != nil {
+		return err
+	}
+	return app.printer.printItem(userHeader, userItem(user))
+}
+
+// unlockResult is the output of unlocking a user
+type unlockResult struct {
+	Username  string `json:"username"`
+	WasLocked bool   `json:"was_locked"`
+}
+
+func unlockUser(ctx context.Context, app *app, args []string) error {
+	flags := newFlagSet("user unlock")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: user unlock <name>")
+	}
+
+	wasLocked, err := app.userClient.UnlockUser(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	result := unlockResult{Username: flags.Arg(0), WasLocked: wasLocked}
+	return app.printer.printItem([]string{"USERNAME", "WAS LOCKED"}, item{
+		value: result,
+		row:   []string{result.Username, fmt.Sprint(result.WasLocked)},
+	})
+}
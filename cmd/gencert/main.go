@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/tlsconfig"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gencert generates a CA, a server certificate and client certificates for local development:
+//
+//	ca-cert.pem, ca-key.pem
+//	server-cert.pem, server-key.pem
+//	<client>-cert.pem, <client>-key.pem for each client common name
+func main() {
+	out := flag.String("out", "cert", "the directory to write the certificates")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,0.0.0.0", "comma separated DNS names and IP addresses of the server")
+	clients := flag.String("clients", "client", "comma separated common names of the client certificates, mapped to users in the policy file")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "the validity of the certificates")
+	flag.Parse()
+
+	err := os.MkdirAll(*out, 0755)
+	if err != nil {
+		log.Fatal("cannot create output directory: ", err)
+	}
+
+	ca, err := tlsconfig.GenerateCA("PC Book Development CA", *validFor)
+	if err != nil {
+		log.Fatal("cannot generate CA: ", err)
+	}
+	write(ca, *out, "ca")
+
+	server, err := tlsconfig.GenerateServerCertificate(ca, "pcbook-server", splitList(*hosts), *validFor)
+	if err != nil {
+		log.Fatal("cannot generate server certificate: ", err)
+	}
+	write(server, *out, "server")
+
+	for _, commonName := range splitList(*clients) {
+		client, err := tlsconfig.GenerateClientCertificate(ca, commonName, *validFor)
+		if err != nil {
+			log.Fatalf("cannot generate client certificate %s: %v", commonName, err)
+		}
+		write(client, *out, commonName)
+	}
+}
+
+func write(cert *tlsconfig.Certificate, dir string, name string) {
+	certFile := filepath.Join(dir, fmt.Sprintf("%s-cert.pem", name))
+	keyFile := filepath.Join(dir, fmt.Sprintf("%s-key.pem", name))
+
+	err := cert.WriteFiles(certFile, keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %s and %s", certFile, keyFile)
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `usage: pcbook-policy check [-policy policy.yaml] [-strict]
+
+check lists which roles can call each method registered on the gRPC server`
+
+// 注册与cmd/server相同的服务，只用于获取所有的RPC方法
+func registeredMethods() []string {
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, &pb.UnimplementedLaptopServiceServer{})
+	pb.RegisterAuthServiceServer(grpcServer, &pb.UnimplementedAuthServiceServer{})
+	pb.RegisterAuditServiceServer(grpcServer, &pb.UnimplementedAuditServiceServer{})
+	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+	reflection.Register(grpcServer)
+
+	var methods []string
+	for serviceName, info := range grpcServer.GetServiceInfo() {
+		for _, method := range info.Methods {
+			methods = append(methods, fmt.Sprintf("/%s/%s", serviceName, method.Name))
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func check(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	policyFile := flags.String("policy", "policy.yaml", "the access policy file in YAML or JSON format")
+	strict := flags.Bool("strict", false, "fail if any method has no explicit rule")
+	flags.Parse(args)
+
+	policy, err := service.LoadPolicy(*policyFile)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "METHOD\tROLES\tRULE")
+
+	unlisted := 0
+	for _, method := range registeredMethods() {
+		rule := policy.Rule(method)
+
+		var roles, pattern string
+		switch {
+		case rule == nil && policy.DefaultDeny():
+			roles, pattern = "(denied)", "default deny"
+		case rule == nil:
+			roles, pattern = "(everyone)", "default allow"
+		case rule.Public:
+			roles, pattern = "(everyone)", rule.Pattern
+		default:
+			// 只能访问自己资源的角色加上(own)后缀
+			allowed := policy.AllowedRoles(rule, service.FullAccess)
+			for _, role := range policy.AllowedRoles(rule, service.OwnerAccess) {
+				allowed = append(allowed, role+"(own)")
+			}
+			roles, pattern = strings.Join(allowed, ","), rule.Pattern
+		}
+		if rule == nil {
+			unlisted++
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", method, roles, pattern)
+	}
+	writer.Flush()
+
+	if *strict && unlisted > 0 {
+		log.Printf("%d methods have no explicit rule", unlisted)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "check" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	os.Exit(check(os.Args[2:]))
+}
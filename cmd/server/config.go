@@ -0,0 +1,425 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/Ruadgedy/pcbook-go/tlsconfig"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redactedValue replaces the secrets when the effective config is printed
+const redactedValue = "REDACTED"
+
+// envPrefix is the prefix of the environment variables of the settings, such as PCBOOK_SERVER_JWT_SECRET
+const envPrefix = "PCBOOK_SERVER"
+
+// config is the settings of the server. Flags take precedence over environment variables,
+// and environment variables take precedence over the config file
+type config struct {
+	Port            int           `yaml:"port" toml:"port"`
+	Type            string        `yaml:"type" toml:"type"`         // grpc或者rest
+	Endpoint        string        `yaml:"endpoint" toml:"endpoint"` // REST服务器转发请求的gRPC地址
+	LogLevel        string        `yaml:"log_level" toml:"log_level"`
+	ImageFolder     string        `yaml:"image_folder" toml:"image_folder"`
+	MaxImageSize    int64         `yaml:"max_image_size" toml:"max_image_size"`
+	RatingFile      string        `yaml:"rating_file" toml:"rating_file"`
+	UserFile        string        `yaml:"user_file" toml:"user_file"`
+	APIKeyFile      string        `yaml:"api_key_file" toml:"api_key_file"`
+	AuditFile       string        `yaml:"audit_file" toml:"audit_file"`
+	AuditKey        string        `yaml:"audit_key" toml:"audit_key"` // 审计日志hash链的HMAC密钥，没有默认值，开启审计时必须设置
+	PasswordHash    string        `yaml:"password_hash" toml:"password_hash"`
+	TrustedProxies  string        `yaml:"trusted_proxies" toml:"trusted_proxies"` // 逗号分隔的IP或CIDR，例如REST网关的地址
+	HealthInterval  time.Duration `yaml:"health_interval" toml:"health_interval"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	SeedUsers       []seedUser    `yaml:"seed_users" toml:"seed_users"` // 用户文件中不存在时创建的用户
+	JWT             jwtConfig     `yaml:"jwt" toml:"jwt"`
+	OIDC            oidcConfig    `yaml:"oidc" toml:"oidc"`
+	Policy          policyConfig  `yaml:"policy" toml:"policy"`
+	Login           loginConfig   `yaml:"login" toml:"login"`
+	TLS             tlsConfig     `yaml:"tls" toml:"tls"`
+}
+
+type seedUser struct {
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	Role     string `yaml:"role" toml:"role"`
+}
+
+type jwtConfig struct {
+	Alg                  string        `yaml:"alg" toml:"alg"`
+	Secret               string        `yaml:"secret" toml:"secret"`       // HS256的密钥
+	KeyFiles             string        `yaml:"key_files" toml:"key_files"` // 逗号分隔的私钥文件，第一个用于签名
+	KeyRotation          time.Duration `yaml:"key_rotation" toml:"key_rotation"`
+	JWKSPort             int           `yaml:"jwks_port" toml:"jwks_port"`
+	TokenDuration        time.Duration `yaml:"token_duration" toml:"token_duration"`
+	RefreshTokenDuration time.Duration `yaml:"refresh_token_duration" toml:"refresh_token_duration"`
+}
+
+type oidcConfig struct {
+	Issuer        string `yaml:"issuer" toml:"issuer"`
+	ClientID      string `yaml:"client_id" toml:"client_id"`
+	UsernameClaim string `yaml:"username_claim" toml:"username_claim"`
+	RoleClaim     string `yaml:"role_claim" toml:"role_claim"`
+	Roles         string `yaml:"roles" toml:"roles"` // 逗号分隔的value=role
+	DefaultRole   string `yaml:"default_role" toml:"default_role"`
+}
+
+// policyConfig is the access policy, which also defines the roles and their inheritance
+type policyConfig struct {
+	File   string        `yaml:"file" toml:"file"`
+	Reload time.Duration `yaml:"reload" toml:"reload"`
+}
+
+// loginConfig is the rate limits of failed logins
+type loginConfig struct {
+	MaxUserFailures int           `yaml:"max_user_failures" toml:"max_user_failures"`
+	MaxIPFailures   int           `yaml:"max_ip_failures" toml:"max_ip_failures"`
+	Lockout         time.Duration `yaml:"lockout" toml:"lockout"`
+	MaxLockout      time.Duration `yaml:"max_lockout" toml:"max_lockout"`
+}
+
+type tlsConfig struct {
+	Enabled    bool          `yaml:"enabled" toml:"enabled"`
+	CA         string        `yaml:"ca" toml:"ca"`
+	Cert       string        `yaml:"cert" toml:"cert"`
+	Key        string        `yaml:"key" toml:"key"`
+	ClientAuth string        `yaml:"client_auth" toml:"client_auth"`
+	Reload     time.Duration `yaml:"reload" toml:"reload"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Type:            "grpc",
+		LogLevel:        "debug",
+		ImageFolder:     "img",
+		MaxImageSize:    service.DefaultMaxImageSize,
+		RatingFile:      "ratings.jsonl",
+		UserFile:        "users.jsonl",
+		APIKeyFile:      "api_keys.jsonl",
+		PasswordHash:    "argon2id",
+		HealthInterval:  10 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		SeedUsers: []seedUser{
+			{Username: "admin1", Password: "secret", Role: service.RoleAdmin},
+			{Username: "editor1", Password: "secret", Role: service.RoleEditor},
+			{Username: "user1", Password: "secret", Role: service.RoleUser},
+		},
+		JWT: jwtConfig{
+			Alg:                  "HS256",
+			Secret:               "secret",
+			TokenDuration:        15 * time.Minute,
+			RefreshTokenDuration: 7 * 24 * time.Hour,
+		},
+		OIDC: oidcConfig{
+			UsernameClaim: "preferred_username",
+			RoleClaim:     "groups",
+			DefaultRole:   service.RoleUser,
+		},
+		Policy: policyConfig{
+			File:   "policy.yaml",
+			Reload: 5 * time.Second,
+		},
+		Login: loginConfig{
+			MaxUserFailures: 5,  // 同一个用户连续登录失败多少次后锁定
+			MaxIPFailures:   20, // 同一个IP后面可能有多个用户
+			Lockout:         30 * time.Second,
+			MaxLockout:      15 * time.Minute,
+		},
+		TLS: tlsConfig{
+			CA:         "cert/ca-cert.pem",
+			Cert:       "cert/server-cert.pem",
+			Key:        "cert/server-key.pem",
+			ClientAuth: "verify-if-given",
+			Reload:     time.Minute,
+		},
+	}
+}
+
+// loadConfig returns the settings of the config file, the environment variables and the flags set on the command
+// line. The config file is in TOML format if its extension is .toml, otherwise it is in YAML or JSON format
+func loadConfig(path string, flags *flag.FlagSet) (*config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		err := cfg.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := cfg.loadEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.merge(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(data), cfg)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown setting %s", meta.Undecoded()[0])
+		}
+	} else {
+		decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+		if err == io.EOF {
+			// 空文件使用默认设置
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv reads the settings in the environment variables, whose names are the YAML keys of the settings in
+// upper case after envPrefix, such as PCBOOK_SERVER_PORT and PCBOOK_SERVER_JWT_TOKEN_DURATION.
+// The seed users can only be set in the config file
+func (cfg *config) loadEnv() error {
+	return loadEnvFields(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+func loadEnvFields(value reflect.Value, prefix string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := prefix + "_" + strings.ToUpper(value.Type().Field(i).Tag.Get("yaml"))
+		if field.Kind() == reflect.Struct {
+			err := loadEnvFields(field, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setField(field, env)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, text string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(text)
+	case bool:
+		enabled, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		field.SetBool(enabled)
+	case time.Duration:
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+	case int, int64:
+		number, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(number)
+	default:
+		return fmt.Errorf("cannot be set by an environment variable")
+	}
+	return nil
+}
+
+// registerFlags registers the flags of the settings, which are stored in cfg
+func (cfg *config) registerFlags(flags *flag.FlagSet) {
+	flags.IntVar(&cfg.Port, "port", cfg.Port, "the server port")
+	flags.StringVar(&cfg.Type, "type", cfg.Type, "the type of server: grpc or rest")
+	flags.StringVar(&cfg.Endpoint, "endpoint", cfg.Endpoint, "the gRPC endpoint that the REST server forwards requests to")
+	flags.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "the least severe logs to print: debug, info or error")
+	flags.StringVar(&cfg.ImageFolder, "image-folder", cfg.ImageFolder, "the folder to store the uploaded images")
+	flags.Int64Var(&cfg.MaxImageSize, "max-image-size", cfg.MaxImageSize, "the max bytes of an uploaded image")
+	flags.StringVar(&cfg.RatingFile, "rating-file", cfg.RatingFile, "the file to store rating history, empty to keep ratings in memory")
+	flags.StringVar(&cfg.UserFile, "user-file", cfg.UserFile, "the file to store users, empty to keep users in memory")
+	flags.StringVar(&cfg.APIKeyFile, "api-key-file", cfg.APIKeyFile, "the file to store API keys, empty to keep API keys in memory and lose them on restart")
+	flags.StringVar(&cfg.AuditFile, "audit-file", cfg.AuditFile, "the hash-chained file to record the calls of mutating RPCs, empty to disable auditing; requires audit_key (PCBOOK_SERVER_AUDIT_KEY)")
+	flags.StringVar(&cfg.PasswordHash, "password-hash", cfg.PasswordHash, "the algorithm to hash new passwords: argon2id or bcrypt, weaker hashes are upgraded on login")
+	flags.StringVar(&cfg.TrustedProxies, "trusted-proxies", cfg.TrustedProxies, "comma separated IPs or CIDR ranges of the proxies such as the REST gateway, whose forwarded client IPs are used to limit failed logins")
+	flags.DurationVar(&cfg.HealthInterval, "health-interval", cfg.HealthInterval, "the interval to check the readiness of the stores")
+	flags.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "the time to wait for the calls in progress when stopping, before they are canceled")
+	flags.StringVar(&cfg.OIDC.Issuer, "oidc-issuer", cfg.OIDC.Issuer, "the OpenID Connect issuer whose ID tokens can login, empty to disable")
+	flags.StringVar(&cfg.OIDC.ClientID, "oidc-client-id", cfg.OIDC.ClientID, "the client id that the audience of ID tokens must contain")
+	flags.StringVar(&cfg.OIDC.UsernameClaim, "oidc-username-claim", cfg.OIDC.UsernameClaim, "the ID token claim used as the local username")
+	flags.StringVar(&cfg.OIDC.RoleClaim, "oidc-role-claim", cfg.OIDC.RoleClaim, "the ID token claim mapped to the local role")
+	flags.StringVar(&cfg.OIDC.Roles, "oidc-roles", cfg.OIDC.Roles, "comma separated value=role mappings of the role claim, the first match wins")
+	flags.StringVar(&cfg.OIDC.DefaultRole, "oidc-default-role", cfg.OIDC.DefaultRole, "the role when no mapping matches, empty to reject the login")
+	flags.StringVar(&cfg.JWT.Alg, "jwt-alg", cfg.JWT.Alg, "the algorithm to sign access tokens: HS256, RS256, ES256 or EdDSA")
+	flags.StringVar(&cfg.JWT.KeyFiles, "jwt-key-files", cfg.JWT.KeyFiles, "comma separated PEM private key files, the first one signs tokens and the others only verify them")
+	flags.DurationVar(&cfg.JWT.KeyRotation, "jwt-key-rotation", cfg.JWT.KeyRotation, "the interval to rotate generated signing keys, 0 to disable rotation")
+	flags.IntVar(&cfg.JWT.JWKSPort, "jwks-port", cfg.JWT.JWKSPort, "the port to serve the public keys in JWKS format, 0 to disable")
+	flags.StringVar(&cfg.Policy.File, "policy", cfg.Policy.File, "the access policy file in YAML or JSON format")
+	flags.DurationVar(&cfg.Policy.Reload, "policy-reload", cfg.Policy.Reload, "the interval to check the policy file for changes, 0 to disable hot reload")
+	flags.BoolVar(&cfg.TLS.Enabled, "tls", cfg.TLS.Enabled, "enable TLS")
+	flags.StringVar(&cfg.TLS.CA, "tls-ca", cfg.TLS.CA, "the CA certificate to verify client certificates, or to verify the gRPC endpoint in REST mode")
+	flags.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "the server certificate")
+	flags.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "the server private key")
+	flags.StringVar(&cfg.TLS.ClientAuth, "tls-client-auth", cfg.TLS.ClientAuth, "the client certificate mode: none, verify-if-given or require")
+	flags.DurationVar(&cfg.TLS.Reload, "tls-reload", cfg.TLS.Reload, "the interval to check the certificate files for changes, 0 to disable hot reload")
+}
+
+// merge overwrites the settings with the flags set on the command line
+func (cfg *config) merge(flags *flag.FlagSet) error {
+	// 把设置过的flag再设置到绑定cfg的flag set上
+	target := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	cfg.registerFlags(target)
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if err == nil && target.Lookup(f.Name) != nil {
+			err = target.Set(f.Name, f.Value.String())
+		}
+	})
+	return err
+}
+
+// validate checks all the settings and returns the problems found
+func (cfg *config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.Port >= 0 && cfg.Port <= 65535, "port %d is out of range", cfg.Port)
+	check(cfg.Type == "grpc" || cfg.Type == "rest", "unknown server type %q, must be grpc or rest", cfg.Type)
+	check(cfg.Type != "rest" || cfg.Endpoint != "", "the gRPC endpoint is required for the REST server")
+	_, err := service.ParseLogLevel(cfg.LogLevel)
+	check(err == nil, "%v", err)
+	check(cfg.ImageFolder != "", "image_folder is required")
+	check(cfg.MaxImageSize > 0, "max_image_size must be positive")
+	check(cfg.PasswordHash == "argon2id" || cfg.PasswordHash == "bcrypt", "unknown password hash algorithm %q, must be argon2id or bcrypt", cfg.PasswordHash)
+	_, err = service.ParseTrustedProxies(cfg.TrustedProxies)
+	check(err == nil, "%v", err)
+	check(cfg.HealthInterval > 0, "health_interval must be positive")
+	check(cfg.ShutdownTimeout >= 0, "shutdown_timeout must not be negative")
+
+	usernames := make(map[string]bool)
+	for i, user := range cfg.SeedUsers {
+		check(user.Username != "" && user.Password != "" && user.Role != "", "seed user %d must have a username, a password and a role", i+1)
+		check(!usernames[user.Username], "seed user %s is duplicated", user.Username)
+		usernames[user.Username] = true
+	}
+
+	switch cfg.JWT.Alg {
+	case "HS256":
+		check(cfg.JWT.Secret != "" || cfg.JWT.KeyFiles != "", "jwt.secret is required for HS256")
+	case "RS256", "ES256", "EdDSA":
+	default:
+		check(false, "unknown JWT algorithm %q, must be HS256, RS256, ES256 or EdDSA", cfg.JWT.Alg)
+	}
+	check(cfg.JWT.KeyRotation == 0 || (cfg.JWT.KeyFiles == "" && cfg.JWT.Alg != "HS256"), "key rotation is only supported for generated asymmetric keys")
+	check(cfg.JWT.KeyRotation == 0 || cfg.JWT.KeyRotation >= service.JWKSMaxAge, "jwt.key_rotation must be 0 or at least %v, so that each key is published in the JWKS before it signs", service.JWKSMaxAge)
+	check(cfg.JWT.TokenDuration > 0, "jwt.token_duration must be positive")
+	check(cfg.JWT.RefreshTokenDuration > 0, "jwt.refresh_token_duration must be positive")
+
+	check(cfg.AuditFile == "" || cfg.AuditKey != "", "audit_key is required when audit_file is set")
+	check(cfg.Policy.File != "", "policy.file is required")
+	check(cfg.Login.MaxUserFailures > 0 && cfg.Login.MaxIPFailures > 0, "login failure limits must be positive")
+	check(cfg.Login.Lockout > 0 && cfg.Login.MaxLockout >= cfg.Login.Lockout, "login.lockout must be positive and not larger than login.max_lockout")
+
+	_, err = tlsconfig.ParseClientAuth(cfg.TLS.ClientAuth)
+	check(err == nil, "%v", err)
+	check(!cfg.TLS.Enabled || (cfg.TLS.Cert != "" && cfg.TLS.Key != ""), "tls.cert and tls.key are required when TLS is enabled")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// redacted returns a copy of the settings whose secrets are replaced, so that it can be printed or logged
+func (cfg *config) redacted() *config {
+	other := *cfg
+	if other.JWT.Secret != "" {
+		other.JWT.Secret = redactedValue
+	}
+	if other.AuditKey != "" {
+		other.AuditKey = redactedValue
+	}
+	other.SeedUsers = make([]seedUser, len(cfg.SeedUsers))
+	for i, user := range cfg.SeedUsers {
+		user.Password = redactedValue
+		other.SeedUsers[i] = user
+	}
+	return &other
+}
+
+// print writes the effective settings in YAML format with the secrets redacted
+func (cfg *config) print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(cfg.redacted())
+	if err == nil {
+		err = encoder.Close()
+	}
+	return err
+}
+
+// restartSettings returns the names of the settings changed in other that a reload cannot apply, such as
+// "port" or "policy.file", they are only applied after a restart
+func (cfg *config) restartSettings(other *config) []string {
+	return changedFields(reflect.ValueOf(cfg.withoutReloadable()), reflect.ValueOf(other.withoutReloadable()), "")
+}
+
+// withoutReloadable returns a copy without the settings that can be reloaded at runtime,
+// two configs with the same result only differ in the settings that a reload applies
+func (cfg *config) withoutReloadable() config {
+	other := *cfg
+	other.LogLevel = ""
+	other.Login = loginConfig{}
+	return other
+}
+
+// changedFields returns the YAML names of the fields that differ, the fields of nested settings are
+// named with their parents such as jwt.secret
+func changedFields(value reflect.Value, other reflect.Value, prefix string) []string {
+	var changed []string
+	for i := 0; i < value.NumField(); i++ {
+		name := prefix + value.Type().Field(i).Tag.Get("yaml")
+		field, otherField := value.Field(i), other.Field(i)
+		if field.Kind() == reflect.Struct {
+			changed = append(changed, changedFields(field, otherField, name+".")...)
+		} else if !reflect.DeepEqual(field.Interface(), otherField.Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 修改环境变量的测试不能并行执行
+func TestLoadConfig(t *testing.T) {
+	clearTestEnv(t)
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "server.yaml")
+	err := ioutil.WriteFile(yamlFile, []byte("port: 1000\nlog_level: info\njwt:\n  token_duration: 1m\n  refresh_token_duration: 1h\n"), 0600)
+	require.NoError(t, err)
+
+	// 文件覆盖默认值，文件中没有的使用默认值
+	cfg := loadTestConfig(t, yamlFile)
+	require.Equal(t, 1000, cfg.Port)
+	require.Equal(t, "info", cfg.LogLevel)
+	require.Equal(t, time.Minute, cfg.JWT.TokenDuration)
+	require.Equal(t, "HS256", cfg.JWT.Alg)
+	require.Equal(t, "policy.yaml", cfg.Policy.File)
+
+	// 环境变量覆盖文件，参数覆盖环境变量
+	setTestEnv(t, "PCBOOK_SERVER_PORT", "2000")
+	setTestEnv(t, "PCBOOK_SERVER_JWT_TOKEN_DURATION", "2m")
+	setTestEnv(t, "PCBOOK_SERVER_TLS_ENABLED", "true")
+	setTestEnv(t, "PCBOOK_SERVER_JWT_SECRET", "env-secret")
+	cfg = loadTestConfig(t, yamlFile, "-port", "3000", "-log-level", "error")
+	require.Equal(t, 3000, cfg.Port)
+	require.Equal(t, "error", cfg.LogLevel)
+	require.Equal(t, 2*time.Minute, cfg.JWT.TokenDuration)
+	require.Equal(t, time.Hour, cfg.JWT.RefreshTokenDuration)
+	require.True(t, cfg.TLS.Enabled)
+	require.Equal(t, "env-secret", cfg.JWT.Secret)
+
+	// 参数设置为默认值也会覆盖环境变量
+	cfg = loadTestConfig(t, yamlFile, "-tls=false")
+	require.False(t, cfg.TLS.Enabled)
+
+	// TOML格式的文件
+	tomlFile := filepath.Join(dir, "server.toml")
+	err = ioutil.WriteFile(tomlFile, []byte("log_level = \"info\"\n[policy]\nfile = \"other.yaml\"\n"), 0600)
+	require.NoError(t, err)
+	cfg = loadTestConfig(t, tomlFile)
+	require.Equal(t, "other.yaml", cfg.Policy.File)
+	require.Equal(t, 2000, cfg.Port)
+
+	// 文件中未知的设置是错误
+	for name, content := range map[string]string{"unknown.yaml": "prot: 1000\n", "unknown.toml": "prot = 1000\n"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err = loadConfig(path, newTestFlagSet(t))
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), "prot", name)
+	}
+
+	_, err = loadConfig(filepath.Join(dir, "missing.yaml"), newTestFlagSet(t))
+	require.Error(t, err)
+
+	// 加载之后验证所有设置
+	_, err = loadConfig(yamlFile, newTestFlagSet(t, "-port", "-1"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "port -1 is out of range")
+}
+
+func TestLoadConfigEnvErrors(t *testing.T) {
+	clearTestEnv(t)
+
+	testCases := map[string]string{
+		"PCBOOK_SERVER_PORT":                  "abc",
+		"PCBOOK_SERVER_MAX_IMAGE_SIZE":        "1MB",
+		"PCBOOK_SERVER_TLS_ENABLED":           "maybe",
+		"PCBOOK_SERVER_HEALTH_INTERVAL":       "10",
+		"PCBOOK_SERVER_LOGIN_LOCKOUT":         "soon",
+		"PCBOOK_SERVER_JWT_KEY_ROTATION":      "1 hour",
+		"PCBOOK_SERVER_SEED_USERS":            "admin1",
+		"PCBOOK_SERVER_LOGIN_MAX_IP_FAILURES": "many",
+	}
+	for name, value := range testCases {
+		setTestEnv(t, name, value)
+		_, err := loadConfig("", newTestFlagSet(t))
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), "invalid "+name)
+		require.NoError(t, os.Unsetenv(name))
+	}
+
+	_, err := loadConfig("", newTestFlagSet(t))
+	require.NoError(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, defaultConfig().validate())
+
+	testCases := []struct {
+		problem string
+		change  func(cfg *config)
+	}{
+		{"port 70000 is out of range", func(cfg *config) { cfg.Port = 70000 }},
+		{"unknown server type", func(cfg *config) { cfg.Type = "soap" }},
+		{"the gRPC endpoint is required", func(cfg *config) { cfg.Type = "rest" }},
+		{"unknown log level", func(cfg *config) { cfg.LogLevel = "loud" }},
+		{"image_folder is required", func(cfg *config) { cfg.ImageFolder = "" }},
+		{"max_image_size must be positive", func(cfg *config) { cfg.MaxImageSize = 0 }},
+		{"unknown password hash algorithm", func(cfg *config) { cfg.PasswordHash = "md5" }},
+		{"invalid proxy address", func(cfg *config) { cfg.TrustedProxies = "gateway" }},
+		{"health_interval must be positive", func(cfg *config) { cfg.HealthInterval = 0 }},
+		{"shutdown_timeout must not be negative", func(cfg *config) { cfg.ShutdownTimeout = -time.Second }},
+		{"seed user 2 must have a username, a password and a role", func(cfg *config) { cfg.SeedUsers[1].Password = "" }},
+		{"seed user admin1 is duplicated", func(cfg *config) { cfg.SeedUsers[1].Username = "admin1" }},
+		{"jwt.secret is required for HS256", func(cfg *config) { cfg.JWT.Secret = "" }},
+		{"unknown JWT algorithm", func(cfg *config) { cfg.JWT.Alg = "none" }},
+		{"key rotation is only supported for generated asymmetric keys", func(cfg *config) { cfg.JWT.KeyRotation = time.Hour }},
+		{"jwt.key_rotation must be 0 or at least", func(cfg *config) {
+			cfg.JWT.Alg = "ES256"
+			cfg.JWT.KeyRotation = service.JWKSMaxAge - time.Second
+		}},
+		{"jwt.token_duration must be positive", func(cfg *config) { cfg.JWT.TokenDuration = 0 }},
+		{"jwt.refresh_token_duration must be positive", func(cfg *config) { cfg.JWT.RefreshTokenDuration = 0 }},
+		{"audit_key is required when audit_file is set", func(cfg *config) { cfg.AuditFile = "audit.jsonl" }},
+		{"policy.file is required", func(cfg *config) { cfg.Policy.File = "" }},
+		{"login failure limits must be positive", func(cfg *config) { cfg.Login.MaxIPFailures = 0 }},
+		{"login.lockout must be positive and not larger than login.max_lockout", func(cfg *config) { cfg.Login.Lockout = time.Hour }},
+		{"unknown client auth mode", func(cfg *config) { cfg.TLS.ClientAuth = "sometimes" }},
+		{"tls.cert and tls.key are required when TLS is enabled", func(cfg *config) {
+			cfg.TLS.Enabled = true
+			cfg.TLS.Key = ""
+		}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.problem, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := defaultConfig()
+			tc.change(cfg)
+			err := cfg.validate()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.problem)
+		})
+	}
+
+	// 默认关闭审计，没有公开的默认密钥
+	cfg := defaultConfig()
+	require.Empty(t, cfg.AuditFile)
+	require.Empty(t, cfg.AuditKey)
+	cfg.AuditFile = "audit.jsonl"
+	cfg.AuditKey = "audit-key"
+	require.NoError(t, cfg.validate())
+
+	// 一次报告所有的问题
+	cfg.Port = -1
+	cfg.ImageFolder = ""
+	err := cfg.validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "port -1 is out of range")
+	require.Contains(t, err.Error(), "image_folder is required")
+}
+
+func TestConfigPrint(t *testing.T) {
+	t.Parallel()
+
+	cfg := defaultConfig()
+	cfg.JWT.Secret = "jwt-secret-value"
+	cfg.AuditKey = "audit-key-value"
+	cfg.SeedUsers = []seedUser{{Username: "admin1", Password: "seed-password-value", Role: service.RoleAdmin}}
+
+	var output bytes.Buffer
+	require.NoError(t, cfg.print(&output))
+	printed := output.String()
+	for _, secret := range []string{"jwt-secret-value", "audit-key-value", "seed-password-value"} {
+		require.NotContains(t, printed, secret)
+	}
+	require.Equal(t, 3, strings.Count(printed, redactedValue))
+	require.Contains(t, printed, "admin1")
+
+	// 打印不会修改生效的设置
+	require.Equal(t, "jwt-secret-value", cfg.JWT.Secret)
+	require.Equal(t, "seed-password-value", cfg.SeedUsers[0].Password)
+
+	// 没有设置的密钥不显示为REDACTED
+	cfg.JWT.Secret = ""
+	cfg.AuditKey = ""
+	cfg.SeedUsers = nil
+	output.Reset()
+	require.NoError(t, cfg.print(&output))
+	require.NotContains(t, output.String(), redactedValue)
+}
+
+func TestConfigRestartSettings(t *testing.T) {
+	t.Parallel()
+
+	cfg := defaultConfig()
+	reloaded := defaultConfig()
+	require.Empty(t, cfg.restartSettings(reloaded))
+
+	// 重新加载可以生效的设置不需要重启
+	reloaded.LogLevel = "error"
+	reloaded.Login.Lockout = time.Minute
+	require.Empty(t, cfg.restartSettings(reloaded))
+
+	reloaded.Port = 9090
+	reloaded.Policy.File = "other.yaml"
+	reloaded.JWT.Secret = "other"
+	reloaded.SeedUsers = reloaded.SeedUsers[:1]
+	require.Equal(t, []string{"port", "seed_users", "jwt.secret", "policy.file"}, cfg.restartSettings(reloaded))
+}
+
+func loadTestConfig(t *testing.T, path string, args ...string) *config {
+	cfg, err := loadConfig(path, newTestFlagSet(t, args...))
+	require.NoError(t, err)
+	return cfg
+}
+
+// newTestFlagSet returns the flags of the settings parsed from args
+func newTestFlagSet(t *testing.T, args ...string) *flag.FlagSet {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	defaultConfig().registerFlags(flags)
+	require.NoError(t, flags.Parse(args))
+	return flags
+}
+
+// clearTestEnv removes the PCBOOK_SERVER_* variables of the environment running the tests until the test ends,
+// so that they do not change the results
+func clearTestEnv(t *testing.T) {
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, envPrefix+"_") {
+			continue
+		}
+		name := strings.SplitN(env, "=", 2)[0]
+		setTestEnv(t, name, "")
+		require.NoError(t, os.Unsetenv(name))
+	}
+}
+
+// setTestEnv sets the environment variable until the test ends
+func setTestEnv(t *testing.T, name string, value string) {
+	old, ok := os.LookupEnv(name)
+	require.NoError(t, os.Setenv(name, value))
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
@@ -1,82 +1,596 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/Ruadgedy/pcbook-go/pb"
 	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/Ruadgedy/pcbook-go/tlsconfig"
+	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-func seedUsers(userStore service.UserStore) error {
-	err := createUser(userStore, "admin1", "secret", "admin")
-	if err != nil {
-		return nil
+// admin需要两步验证，示例客户端使用editor登录；用户的角色必须在策略中定义
+func seedUsers(userStore service.UserStore, hasher service.PasswordHasher, users []seedUser, policy *service.Policy) error {
+	for _, user := range users {
+		err := policy.ValidateRole(user.Role)
+		if err != nil {
+			return fmt.Errorf("seed user %s: %w", user.Username, err)
+		}
+		err = createUser(userStore, hasher, user.Username, user.Password, user.Role)
+		if err != nil {
+			return err
+		}
 	}
-	return createUser(userStore,"user1","secret", "user")
+	return nil
 }
 
-func createUser(userStore service.UserStore, username,password, role string) error {
-	user, err := service.NewUser(username, password, role)
+// 用户已经存在时（例如从用户文件中加载）保留原来的用户
+func createUser(userStore service.UserStore, hasher service.PasswordHasher, username,password, role string) error {
+	existing, err := userStore.Find(username)
+	if err != nil || existing != nil {
+		return err
+	}
+
+	user, err := service.NewUserWithHasher(hasher, username, password, role)
 	if err != nil {
 		return err
 	}
 	return userStore.Save(user)
 }
 
-const(
-	secretKey = "secret"
-	tokenDuration = 15 *time.Minute
+const ratingBufferSize = 16 // 每个评分订阅者最多缓存的更新数量，超过后断开该订阅者
+
+// 健康检查中的服务名
+const (
+	laptopServiceName = "techschool.pcbook.LaptopService"
+	authServiceName   = "techschool.pcbook.AuthService"
+	auditServiceName  = "techschool.pcbook.AuditService"
 )
 
-func accessibleRoles() map[string][]string {
+// 创建签名token的key：HS256使用共享密钥，其他算法从PEM文件加载或者自动生成
+func newKeySet(alg string, secret string, keyFiles string) (*service.KeySet, error) {
+	if keyFiles != "" {
+		var keys []*service.SigningKey
+		for _, keyFile := range strings.Split(keyFiles, ",") {
+			key, err := service.LoadSigningKey("", strings.TrimSpace(keyFile))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+
+		keySet := service.NewKeySet(keys[0])
+		for _, key := range keys[1:] {
+			keySet.AddVerificationKey(key, time.Time{})
+		}
+		return keySet, nil
+	}
+
+	if alg == "HS256" {
+		return service.NewKeySet(service.NewHMACSigningKey("", secret)), nil
+	}
+
+	key, err := service.GenerateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	return service.NewKeySet(key), nil
+}
+
+// 通过HTTP提供JWKS，其他服务不需要共享密钥也能验证token
+func serveJWKS(keySet *service.KeySet, port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/jwks.json", keySet.JWKSHandler())
+
+	address := fmt.Sprintf("0.0.0.0:%d", port)
+	log.Printf("serve JWKS on %s", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		log.Fatalf("cannot serve JWKS: %v", err)
+	}
+}
+
+// 评分文件为空时评分只保存在内存中
+func newRatingStore(ratingFile string) (service.RatingStore, error) {
+	if ratingFile == "" {
+		return service.NewInMemoryRatingStore(), nil
+	}
+	return service.NewFileRatingStore(ratingFile)
+}
+
+// 返回需要审计的方法：所有修改数据的方法以及登录相关的方法
+func auditMethods() map[string]bool {
 	const laptopServicePath = "/techschool.pcbook.LaptopService/"
-	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {"admin"},
-		laptopServicePath + "UploadImage" : {"admin"},
-		laptopServicePath + "RateLaptop" : {"admin", "user"},
+	const authServicePath = "/techschool.pcbook.AuthService/"
+	methods := make(map[string]bool)
+	for _, method := range []string{
+		laptopServicePath + "CreateLaptop",
+		laptopServicePath + "BulkCreateLaptops",
+		laptopServicePath + "UpdateLaptop",
+		laptopServicePath + "DeleteLaptop",
+		laptopServicePath + "TransferLaptopOwnership",
+		laptopServicePath + "UploadImage",
+		laptopServicePath + "DeleteImage",
+		laptopServicePath + "RateLaptop",
+		laptopServicePath + "RemoveRating",
+		authServicePath + "Login",
+		authServicePath + "LoginWithOIDC",
+		authServicePath + "VerifyTwoFactor",
+		authServicePath + "Logout",
+		authServicePath + "Register",
+		authServicePath + "ChangePassword",
+		authServicePath + "EnrollTOTP",
+		authServicePath + "ConfirmTOTP",
+		authServicePath + "SetUserRole",
+		authServicePath + "DisableUser",
+		authServicePath + "UnlockUser",
+		authServicePath + "ResetTwoFactor",
+		authServicePath + "CreateAPIKey",
+		authServicePath + "RevokeAPIKey",
+	} {
+		methods[method] = true
+	}
+	return methods
+}
+
+// 用户文件为空时用户只保存在内存中
+func newUserStore(userFile string) (service.UserStore, error) {
+	if userFile == "" {
+		return service.NewInMemoryUserStore(), nil
+	}
+	return service.NewFileUserStore(userFile)
+}
+
+// API key文件为空时key只保存在内存中，重启后失效
+func newAPIKeyStore(apiKeyFile string) (service.APIKeyStore, error) {
+	if apiKeyFile == "" {
+		return service.NewInMemoryAPIKeyStore(), nil
+	}
+	return service.NewFileAPIKeyStore(apiKeyFile)
+}
+
+func newPasswordHasher(alg string) (service.PasswordHasher, error) {
+	switch alg {
+	case "argon2id":
+		return service.NewArgon2idHasher(service.DefaultArgon2Params), nil
+	case "bcrypt":
+		return service.NewBcryptHasher(bcrypt.DefaultCost), nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q, must be argon2id or bcrypt", alg)
+	}
+}
+
+// issuer为空时不启用OpenID Connect登录，roles的格式为 claim值=角色，用逗号分隔，按顺序匹配，角色必须是策略中定义的角色
+func newOIDCVerifier(issuer, clientID, usernameClaim, roleClaim, roles, defaultRole string, policy *service.Policy) (*service.OIDCVerifier, error) {
+	if issuer == "" {
+		return nil, nil
+	}
+
+	config := service.OIDCConfig{
+		Issuer:        issuer,
+		ClientID:      clientID,
+		UsernameClaim: usernameClaim,
+		RoleClaim:     roleClaim,
+		DefaultRole:   defaultRole,
+	}
+	for _, mapping := range strings.Split(roles, ",") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid role mapping %q, must be value=role", mapping)
+		}
+		role := strings.TrimSpace(parts[1])
+		if err := policy.ValidateRole(role); err != nil {
+			return nil, fmt.Errorf("invalid role mapping %q: %w", mapping, err)
+		}
+		config.RoleMappings = append(config.RoleMappings, service.OIDCRoleMapping{
+			Value: strings.TrimSpace(parts[0]),
+			Role:  role,
+		})
+	}
+	if defaultRole != "" {
+		if err := policy.ValidateRole(defaultRole); err != nil {
+			return nil, fmt.Errorf("invalid default role: %w", err)
+		}
+	}
+	return service.NewOIDCVerifier(config, nil)
+}
+
+// 加载服务端证书，客户端证书模式不为none时使用CA验证客户端证书（mTLS）
+func loadTLSCredentials(caFile, certFile, keyFile, clientAuthMode string, reload time.Duration) (credentials.TransportCredentials, func(), error) {
+	clientAuth, err := tlsconfig.ParseClientAuth(clientAuthMode)
+	if err != nil {
+		return nil, nil, err
+	}
+	if clientAuth == tls.NoClientCert {
+		caFile = ""
+	}
+
+	reloader, err := tlsconfig.NewReloader(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err := reloader.ServerConfig(clientAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := func() {}
+	if reload > 0 {
+		stop = reloader.Watch(reload)
+	}
+	return credentials.NewTLS(config), stop, nil
+}
+
+// REST网关把HTTP/JSON请求转发到endpoint的gRPC服务器，启用TLS时用CA验证gRPC服务器的证书。
+// ctx结束后停止接受新的请求，等待正在处理的请求最多shutdownTimeout
+func runRESTServer(ctx context.Context, listener net.Listener, endpoint string, maxImageSize int64, enableTLS bool, caFile, certFile, keyFile string, reload, shutdownTimeout time.Duration) error {
+	dialOptions := []grpc.DialOption{grpc.WithInsecure()}
+	if enableTLS {
+		caReloader, err := tlsconfig.NewReloader(caFile, "", "")
+		if err != nil {
+			return err
+		}
+		dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(caReloader.ClientConfig()))}
+	}
+
+	// 网关的连接在正在处理的请求结束之后才关闭
+	gatewayCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gateway, err := service.NewRESTGateway(gatewayCtx, endpoint, dialOptions, maxImageSize)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: gateway}
+	if enableTLS {
+		reloader, err := tlsconfig.NewReloader("", certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		if reload > 0 {
+			stopReload := reloader.Watch(reload)
+			defer stopReload()
+		}
+		server.TLSConfig, err = reloader.ServerConfig(tls.NoClientCert)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("start REST server at %s, TLS = %t", listener.Addr().String(), enableTLS)
+	serveErr := make(chan error, 1)
+	go func() {
+		if enableTLS {
+			serveErr <- server.ServeTLS(listener, "", "")
+		} else {
+			serveErr <- server.Serve(listener)
+		}
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, wait up to %s for the requests in progress", shutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	err = server.Shutdown(shutdownCtx)
+	if err == context.DeadlineExceeded {
+		log.Print("shutdown timeout, close the requests in progress")
+		err = server.Close()
 	}
+	return err
 }
 
 func main() {
-	port := flag.Int("port", 0, "the server port") // 返回值是指针类型
+	configFile := flag.String("config", os.Getenv("PCBOOK_SERVER_CONFIG"), "the config file in YAML or TOML format, the settings in it are overridden by the PCBOOK_SERVER_* environment variables and the flags (PCBOOK_SERVER_CONFIG)")
+	printConfig := flag.Bool("print-config", false, "print the effective config with the secrets redacted and exit")
+	defaultConfig().registerFlags(flag.CommandLine)
 	flag.Parse()
-	log.Printf("start server on port %d", *port)
 
-	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore("img")
-	ratingStore := service.NewInMemoryRatingStore()
-	userStore := service.NewInMemoryUserStore()
-	err := seedUsers(userStore) // 注册模拟用户
-	if err != nil {
-		log.Fatal("cannot seed users")
-	}
-	jwtManager := service.NewJWTManager(secretKey, tokenDuration)
-	authServer := service.NewAuthServer(userStore, jwtManager)
-	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles())
-
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
-	grpcServer := grpc.NewServer( // 创建新的gRPC服务器实例，但此时服务器实例未与我们定义的服务器注册绑定
-		grpc.UnaryInterceptor(interceptor.Unary()),    // 添加unary interceptor
-		grpc.StreamInterceptor(interceptor.Stream()),   // 添加stream interceptor
-	)
-	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)    // 将我们自定义跌服务器与gRPC服务器绑定
-	pb.RegisterAuthServiceServer(grpcServer, authServer)    // 将我们自定义的认证服务器与gRPC服务器绑定
-	reflection.Register(grpcServer) // 注册gRPC reflection
+	cfg, err := loadConfig(*configFile, flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		err = cfg.print(os.Stdout)
+		if err != nil {
+			log.Fatal("cannot print config: ", err)
+		}
+		return
+	}
+	logLevel, _ := service.ParseLogLevel(cfg.LogLevel)
+	service.SetLogLevel(logLevel)
+	log.Printf("start %s server on port %d, TLS = %t", cfg.Type, cfg.Port, cfg.TLS.Enabled)
 
-	address := fmt.Sprintf("0.0.0.0:%d", *port)
+	address := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
 	log.Printf("address: %s", address)
 	listener, err := net.Listen("tcp", address) // 注册监听器
 	if err != nil {
 		log.Fatalf("cannnot start server:%v", err)
 	}
 
-	err = grpcServer.Serve(listener)    // 开启服务
+	// 收到信号后停止服务器，再次收到信号时直接退出，不再等待
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if cfg.Type == "rest" {
+		err = runRESTServer(ctx, listener, cfg.Endpoint, cfg.MaxImageSize, cfg.TLS.Enabled, cfg.TLS.CA, cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.Reload, cfg.ShutdownTimeout)
+		if err != nil {
+			log.Fatalf("cannot run REST server: %v", err)
+		}
+		log.Print("server stopped")
+		return
+	}
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewDiskImageStore(cfg.ImageFolder)
+	ratingStore, err := newRatingStore(cfg.RatingFile)
+	if err != nil {
+		log.Fatal("cannot create rating store: ", err)
+	}
+	ratingBroker := service.NewRatingBroker(ratingBufferSize, service.DisconnectSubscriber)
+	passwordHasher, err := newPasswordHasher(cfg.PasswordHash)
 	if err != nil {
+		log.Fatal(err)
+	}
+	policy, err := service.NewPolicyWatcher(cfg.Policy.File)
+	if err != nil {
+		log.Fatal("cannot load policy: ", err)
+	}
+	if cfg.Policy.Reload > 0 {
+		stopWatch := policy.Watch(cfg.Policy.Reload)
+		defer stopWatch()
+	}
+	userStore, err := newUserStore(cfg.UserFile)
+	if err != nil {
+		log.Fatal("cannot create user store: ", err)
+	}
+	err = seedUsers(userStore, passwordHasher, cfg.SeedUsers, policy.Policy()) // 注册模拟用户
+	if err != nil {
+		log.Fatal("cannot seed users: ", err)
+	}
+	refreshTokenStore := service.NewInMemoryRefreshTokenStore()
+	revokedTokenStore := service.NewInMemoryRevokedTokenStore()
+	apiKeyStore, err := newAPIKeyStore(cfg.APIKeyFile)
+	if err != nil {
+		log.Fatal("cannot create api key store: ", err)
+	}
+	loginLimiter := service.NewLoginLimiter(cfg.Login.MaxUserFailures, cfg.Login.MaxIPFailures, cfg.Login.Lockout, cfg.Login.MaxLockout)
+	keySet, err := newKeySet(cfg.JWT.Alg, cfg.JWT.Secret, cfg.JWT.KeyFiles)
+	if err != nil {
+		log.Fatal("cannot create signing keys: ", err)
+	}
+	if cfg.JWT.KeyRotation > 0 {
+		keyOverlap := 2 * cfg.JWT.TokenDuration // 轮换后旧key继续验证token的时间，必须大于token的有效期
+		stopRotation := keySet.StartRotation(cfg.JWT.KeyRotation, keyOverlap, func() (*service.SigningKey, error) {
+			return service.GenerateSigningKey(cfg.JWT.Alg)
+		})
+		defer stopRotation()
+	}
+	if cfg.JWT.JWKSPort > 0 {
+		go serveJWKS(keySet, cfg.JWT.JWKSPort)
+	}
+
+	oidcVerifier, err := newOIDCVerifier(cfg.OIDC.Issuer, cfg.OIDC.ClientID, cfg.OIDC.UsernameClaim, cfg.OIDC.RoleClaim, cfg.OIDC.Roles, cfg.OIDC.DefaultRole, policy.Policy())
+	if err != nil {
+		log.Fatal("cannot create OpenID Connect verifier: ", err)
+	}
+
+	jwtManager := service.NewJWTManagerWithKeySet(keySet, cfg.JWT.TokenDuration, cfg.JWT.RefreshTokenDuration)
+	authServer := service.NewAuthServer(userStore, jwtManager, refreshTokenStore, revokedTokenStore, apiKeyStore, loginLimiter, passwordHasher, oidcVerifier)
+	trustedProxies, _ := service.ParseTrustedProxies(cfg.TrustedProxies) // 已经在加载配置时验证过
+	authServer.SetTrustedProxies(trustedProxies)
+	authServer.SetPolicy(policy)
+	interceptor := service.NewAuthInterceptor(jwtManager, revokedTokenStore, apiKeyStore, userStore, policy)
+
+	// 最先执行，停止时等待所有的调用返回之后才关闭存储
+	callTracker := service.NewCallTracker()
+	unaryInterceptors := []grpc.UnaryServerInterceptor{callTracker.Unary()}
+	streamInterceptors := []grpc.StreamServerInterceptor{callTracker.Stream()}
+	var auditLog *service.FileAuditLog
+	var auditServer *service.AuditServer
+	if cfg.AuditFile != "" {
+		auditLog, err = service.NewFileAuditLog(cfg.AuditFile, []byte(cfg.AuditKey))
+		if err != nil {
+			log.Fatal("cannot open audit log: ", err)
+		}
+
+		// 在认证之前执行，认证失败和没有权限的调用也会被记录
+		auditInterceptor := service.NewAuditInterceptor(auditLog, auditMethods())
+		unaryInterceptors = append(unaryInterceptors, auditInterceptor.Unary())
+		streamInterceptors = append(streamInterceptors, auditInterceptor.Stream())
+		auditServer = service.NewAuditServer(auditLog)
+	}
+	unaryInterceptors = append(unaryInterceptors, interceptor.Unary())
+	streamInterceptors = append(streamInterceptors, interceptor.Stream())
+
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore, ratingBroker)
+	laptopServer.SetMaxImageSize(cfg.MaxImageSize)
+	laptopServer.SetUserStore(userStore)
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),    // 添加unary interceptor
+		grpc.ChainStreamInterceptor(streamInterceptors...),   // 添加stream interceptor
+	}
+	if cfg.TLS.Enabled {
+		tlsCredentials, stopReload, err := loadTLSCredentials(cfg.TLS.CA, cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientAuth, cfg.TLS.Reload)
+		if err != nil {
+			log.Fatal("cannot load TLS credentials: ", err)
+		}
+		defer stopReload()
+		serverOptions = append(serverOptions, grpc.Creds(tlsCredentials))
+	}
+	grpcServer := grpc.NewServer(serverOptions...) // 创建新的gRPC服务器实例，但此时服务器实例未与我们定义的服务器注册绑定
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)    // 将我们自定义跌服务器与gRPC服务器绑定
+	pb.RegisterAuthServiceServer(grpcServer, authServer)    // 将我们自定义的认证服务器与gRPC服务器绑定
+	if auditServer != nil {
+		pb.RegisterAuditServiceServer(grpcServer, auditServer)
+	}
+	reflection.Register(grpcServer) // 注册gRPC reflection
+
+	// 客户端按健康检查做负载均衡，存储不可用时对应的服务变为NOT_SERVING
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+	healthMonitor := service.NewHealthMonitor(healthServer)
+	stores := []serverStore{
+		{"image store", imageStore, laptopServiceName},
+		{"rating store", ratingStore, laptopServiceName},
+		{"user store", userStore, authServiceName},
+		{"api key store", apiKeyStore, authServiceName},
+	}
+	if auditLog != nil {
+		stores = append(stores, serverStore{"audit log", auditLog, auditServiceName})
+	}
+	for _, store := range stores {
+		if checker, ok := store.store.(service.HealthChecker); ok {
+			healthMonitor.AddCheck(store.name, checker, store.service)
+		}
+	}
+	healthMonitor.Check()
+	stopHealth := healthMonitor.Watch(cfg.HealthInterval)
+	defer stopHealth()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(listener) // 开启服务
+	}()
+
+	stopReload := watchReload(cfg, *configFile, flag.CommandLine, loginLimiter, policy)
+	defer stopReload()
+
+	select {
+	case err := <-serveErr:
 		log.Fatalf("cannnot start server:%v", err)
+	case <-ctx.Done():
+	}
+
+	shutdown(grpcServer, callTracker, healthMonitor, ratingBroker, cfg.ShutdownTimeout)
+	for _, store := range stores {
+		if closer, ok := store.store.(io.Closer); ok {
+			err := closer.Close()
+			if err != nil {
+				log.Printf("cannot close %s: %v", store.name, err)
+			}
+		}
+	}
+	log.Print("server stopped")
+}
+
+// serverStore is a store that the service depends on, it is checked for readiness if it is a
+// service.HealthChecker and closed after the server stops if it is an io.Closer
+type serverStore struct {
+	name    string
+	store   interface{}
+	service string
+}
+
+// shutdown stops the server gracefully: the health service reports NOT_SERVING so that the clients send the new
+// calls to other servers, the rating watchers are told to watch on other servers, and the calls in progress
+// are waited for until the timeout, after which they are canceled. It returns after all the handlers return,
+// so that the stores can be closed
+func shutdown(grpcServer *grpc.Server, callTracker *service.CallTracker, healthMonitor *service.HealthMonitor, ratingBroker *service.RatingBroker, timeout time.Duration) {
+	log.Printf("shutting down, wait up to %s for the calls in progress", timeout)
+	healthMonitor.Shutdown()
+	ratingBroker.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		log.Print("shutdown timeout, cancel the calls in progress")
+		grpcServer.Stop()
+		<-stopped
+	}
+
+	// Stop关闭连接后不等待handler返回，被取消的handler可能还在使用存储
+	callTracker.Wait()
+}
+
+// watchReload reloads the config on SIGHUP until stop is called. Only the log level, the login rate limits and
+// the access policy are applied at runtime, the changes of the other settings are applied after a restart
+func watchReload(cfg *config, configFile string, flags *flag.FlagSet, loginLimiter *service.LoginLimiter, policy *service.PolicyWatcher) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		current := cfg
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+			}
+
+			reloaded, err := loadConfig(configFile, flags)
+			if err != nil {
+				// 新的配置无效时保留当前的配置
+				log.Printf("cannot reload config: %v", err)
+				continue
+			}
+
+			logLevel, _ := service.ParseLogLevel(reloaded.LogLevel)
+			service.SetLogLevel(logLevel)
+			loginLimiter.SetLimits(reloaded.Login.MaxUserFailures, reloaded.Login.MaxIPFailures, reloaded.Login.Lockout, reloaded.Login.MaxLockout)
+			// 策略文件的路径修改后需要重启，在此之前继续重新加载原来的文件
+			if reloaded.Policy.File != current.Policy.File {
+				log.Printf("policy.file is changed to %s, the policy is reloaded from %s until the server restarts", reloaded.Policy.File, current.Policy.File)
+			}
+			_, err = policy.Reload()
+			if err != nil {
+				log.Printf("cannot reload policy: %v", err)
+			}
+			log.Printf("reloaded config, log level = %s", logLevel)
+			if changed := current.restartSettings(reloaded); len(changed) > 0 {
+				log.Printf("changed settings cannot be reloaded, restart the server to apply them: %s", strings.Join(changed, ", "))
+			}
+
+			// 只记录已经生效的设置，下次比较时不会漏掉需要重启的修改
+			applied := *current
+			applied.LogLevel = reloaded.LogLevel
+			applied.Login = reloaded.Login
+			current = &applied
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
 	}
 }
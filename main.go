@@ -1,15 +1,5 @@
 package main
 
-import (
-	"flag"
-	"fmt"
-	"github.com/Ruadgedy/pcbook-go/pb"
-	"github.com/Ruadgedy/pcbook-go/service"
-	"google.golang.org/grpc"
-	"log"
-	"net"
-)
-
 func main() {
 
 }
@@ -0,0 +1,117 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// AuditServiceClient is the client API for AuditService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AuditServiceClient interface {
+	QueryAuditLog(ctx context.Context, in *QueryAuditLogRequest, opts ...grpc.CallOption) (AuditService_QueryAuditLogClient, error)
+}
+
+type auditServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAuditServiceClient(cc grpc.ClientConnInterface) AuditServiceClient {
+	return &auditServiceClient{cc}
+}
+
+func (c *auditServiceClient) QueryAuditLog(ctx context.Context, in *QueryAuditLogRequest, opts ...grpc.CallOption) (AuditService_QueryAuditLogClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_AuditService_serviceDesc.Streams[0], "/techschool.pcbook.AuditService/QueryAuditLog", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &auditServiceQueryAuditLogClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type AuditService_QueryAuditLogClient interface {
+	Recv() (*QueryAuditLogResponse, error)
+	grpc.ClientStream
+}
+
+type auditServiceQueryAuditLogClient struct {
+	grpc.ClientStream
+}
+
+func (x *auditServiceQueryAuditLogClient) Recv() (*QueryAuditLogResponse, error) {
+	m := new(QueryAuditLogResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AuditServiceServer is the server API for AuditService service.
+// All implementations must embed UnimplementedAuditServiceServer
+// for forward compatibility
+type AuditServiceServer interface {
+	QueryAuditLog(*QueryAuditLogRequest, AuditService_QueryAuditLogServer) error
+	mustEmbedUnimplementedAuditServiceServer()
+}
+
+// UnimplementedAuditServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedAuditServiceServer struct {
+}
+
+func (*UnimplementedAuditServiceServer) QueryAuditLog(*QueryAuditLogRequest, AuditService_QueryAuditLogServer) error {
+	return status.Errorf(codes.Unimplemented, "method QueryAuditLog not implemented")
+}
+func (*UnimplementedAuditServiceServer) mustEmbedUnimplementedAuditServiceServer() {}
+
+func RegisterAuditServiceServer(s *grpc.Server, srv AuditServiceServer) {
+	s.RegisterService(&_AuditService_serviceDesc, srv)
+}
+
+func _AuditService_QueryAuditLog_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(QueryAuditLogRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AuditServiceServer).QueryAuditLog(m, &auditServiceQueryAuditLogServer{stream})
+}
+
+type AuditService_QueryAuditLogServer interface {
+	Send(*QueryAuditLogResponse) error
+	grpc.ServerStream
+}
+
+type auditServiceQueryAuditLogServer struct {
+	grpc.ServerStream
+}
+
+func (x *auditServiceQueryAuditLogServer) Send(m *QueryAuditLogResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _AuditService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "techschool.pcbook.AuditService",
+	HandlerType: (*AuditServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "QueryAuditLog",
+			Handler:       _AuditService_QueryAuditLog_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "audit_service.proto",
+}
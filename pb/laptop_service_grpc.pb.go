@@ -18,9 +18,19 @@ const _ = grpc.SupportPackageIsVersion6
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type LaptopServiceClient interface {
 	CreateLaptop(ctx context.Context, in *CreateLaptopRequest, opts ...grpc.CallOption) (*CreateLaptopResponse, error)
+	BulkCreateLaptops(ctx context.Context, opts ...grpc.CallOption) (LaptopService_BulkCreateLaptopsClient, error)
+	UpdateLaptop(ctx context.Context, in *UpdateLaptopRequest, opts ...grpc.CallOption) (*UpdateLaptopResponse, error)
+	DeleteLaptop(ctx context.Context, in *DeleteLaptopRequest, opts ...grpc.CallOption) (*DeleteLaptopResponse, error)
+	TransferLaptopOwnership(ctx context.Context, in *TransferLaptopOwnershipRequest, opts ...grpc.CallOption) (*TransferLaptopOwnershipResponse, error)
+	GetLaptop(ctx context.Context, in *GetLaptopRequest, opts ...grpc.CallOption) (*GetLaptopResponse, error)
 	SearchLaptop(ctx context.Context, in *SearchLaptopRequest, opts ...grpc.CallOption) (LaptopService_SearchLaptopClient, error)
 	UploadImage(ctx context.Context, opts ...grpc.CallOption) (LaptopService_UploadImageClient, error)
+	DownloadImage(ctx context.Context, in *DownloadImageRequest, opts ...grpc.CallOption) (LaptopService_DownloadImageClient, error)
+	DeleteImage(ctx context.Context, in *DeleteImageRequest, opts ...grpc.CallOption) (*DeleteImageResponse, error)
 	RateLaptop(ctx context.Context, opts ...grpc.CallOption) (LaptopService_RateLaptopClient, error)
+	WatchRatings(ctx context.Context, in *WatchRatingsRequest, opts ...grpc.CallOption) (LaptopService_WatchRatingsClient, error)
+	RemoveRating(ctx context.Context, in *RemoveRatingRequest, opts ...grpc.CallOption) (*RemoveRatingResponse, error)
+	ExportRatings(ctx context.Context, in *ExportRatingsRequest, opts ...grpc.CallOption) (LaptopService_ExportRatingsClient, error)
 }
 
 type laptopServiceClient struct {
@@ -40,8 +50,78 @@ func (c *laptopServiceClient) CreateLaptop(ctx context.Context, in *CreateLaptop
 	return out, nil
 }
 
+func (c *laptopServiceClient) BulkCreateLaptops(ctx context.Context, opts ...grpc.CallOption) (LaptopService_BulkCreateLaptopsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[0], "/techschool.pcbook.LaptopService/BulkCreateLaptops", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &laptopServiceBulkCreateLaptopsClient{stream}
+	return x, nil
+}
+
+type LaptopService_BulkCreateLaptopsClient interface {
+	Send(*BulkCreateLaptopsRequest) error
+	CloseAndRecv() (*BulkCreateLaptopsResponse, error)
+	grpc.ClientStream
+}
+
+type laptopServiceBulkCreateLaptopsClient struct {
+	grpc.ClientStream
+}
+
+func (x *laptopServiceBulkCreateLaptopsClient) Send(m *BulkCreateLaptopsRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *laptopServiceBulkCreateLaptopsClient) CloseAndRecv() (*BulkCreateLaptopsResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BulkCreateLaptopsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *laptopServiceClient) UpdateLaptop(ctx context.Context, in *UpdateLaptopRequest, opts ...grpc.CallOption) (*UpdateLaptopResponse, error) {
+	out := new(UpdateLaptopResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/UpdateLaptop", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) DeleteLaptop(ctx context.Context, in *DeleteLaptopRequest, opts ...grpc.CallOption) (*DeleteLaptopResponse, error) {
+	out := new(DeleteLaptopResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/DeleteLaptop", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) TransferLaptopOwnership(ctx context.Context, in *TransferLaptopOwnershipRequest, opts ...grpc.CallOption) (*TransferLaptopOwnershipResponse, error) {
+	out := new(TransferLaptopOwnershipResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/TransferLaptopOwnership", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) GetLaptop(ctx context.Context, in *GetLaptopRequest, opts ...grpc.CallOption) (*GetLaptopResponse, error) {
+	out := new(GetLaptopResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/GetLaptop", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *laptopServiceClient) SearchLaptop(ctx context.Context, in *SearchLaptopRequest, opts ...grpc.CallOption) (LaptopService_SearchLaptopClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[0], "/techschool.pcbook.LaptopService/SearchLaptop", opts...)
+	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[1], "/techschool.pcbook.LaptopService/SearchLaptop", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +153,7 @@ func (x *laptopServiceSearchLaptopClient) Recv() (*SearchLaptopResponse, error)
 }
 
 func (c *laptopServiceClient) UploadImage(ctx context.Context, opts ...grpc.CallOption) (LaptopService_UploadImageClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[1], "/techschool.pcbook.LaptopService/UploadImage", opts...)
+	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[2], "/techschool.pcbook.LaptopService/UploadImage", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -106,8 +186,49 @@ func (x *laptopServiceUploadImageClient) CloseAndRecv() (*UploadImageResponse, e
 	return m, nil
 }
 
+func (c *laptopServiceClient) DownloadImage(ctx context.Context, in *DownloadImageRequest, opts ...grpc.CallOption) (LaptopService_DownloadImageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[3], "/techschool.pcbook.LaptopService/DownloadImage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &laptopServiceDownloadImageClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LaptopService_DownloadImageClient interface {
+	Recv() (*DownloadImageResponse, error)
+	grpc.ClientStream
+}
+
+type laptopServiceDownloadImageClient struct {
+	grpc.ClientStream
+}
+
+func (x *laptopServiceDownloadImageClient) Recv() (*DownloadImageResponse, error) {
+	m := new(DownloadImageResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *laptopServiceClient) DeleteImage(ctx context.Context, in *DeleteImageRequest, opts ...grpc.CallOption) (*DeleteImageResponse, error) {
+	out := new(DeleteImageResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/DeleteImage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *laptopServiceClient) RateLaptop(ctx context.Context, opts ...grpc.CallOption) (LaptopService_RateLaptopClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[2], "/techschool.pcbook.LaptopService/RateLaptop", opts...)
+	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[4], "/techschool.pcbook.LaptopService/RateLaptop", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -137,14 +258,97 @@ func (x *laptopServiceRateLaptopClient) Recv() (*RateLaptopResponse, error) {
 	return m, nil
 }
 
+func (c *laptopServiceClient) WatchRatings(ctx context.Context, in *WatchRatingsRequest, opts ...grpc.CallOption) (LaptopService_WatchRatingsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[5], "/techschool.pcbook.LaptopService/WatchRatings", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &laptopServiceWatchRatingsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LaptopService_WatchRatingsClient interface {
+	Recv() (*RateLaptopResponse, error)
+	grpc.ClientStream
+}
+
+type laptopServiceWatchRatingsClient struct {
+	grpc.ClientStream
+}
+
+func (x *laptopServiceWatchRatingsClient) Recv() (*RateLaptopResponse, error) {
+	m := new(RateLaptopResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *laptopServiceClient) RemoveRating(ctx context.Context, in *RemoveRatingRequest, opts ...grpc.CallOption) (*RemoveRatingResponse, error) {
+	out := new(RemoveRatingResponse)
+	err := c.cc.Invoke(ctx, "/techschool.pcbook.LaptopService/RemoveRating", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *laptopServiceClient) ExportRatings(ctx context.Context, in *ExportRatingsRequest, opts ...grpc.CallOption) (LaptopService_ExportRatingsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_LaptopService_serviceDesc.Streams[6], "/techschool.pcbook.LaptopService/ExportRatings", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &laptopServiceExportRatingsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LaptopService_ExportRatingsClient interface {
+	Recv() (*ExportRatingsResponse, error)
+	grpc.ClientStream
+}
+
+type laptopServiceExportRatingsClient struct {
+	grpc.ClientStream
+}
+
+func (x *laptopServiceExportRatingsClient) Recv() (*ExportRatingsResponse, error) {
+	m := new(ExportRatingsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // LaptopServiceServer is the server API for LaptopService service.
 // All implementations must embed UnimplementedLaptopServiceServer
 // for forward compatibility
 type LaptopServiceServer interface {
 	CreateLaptop(context.Context, *CreateLaptopRequest) (*CreateLaptopResponse, error)
+	BulkCreateLaptops(LaptopService_BulkCreateLaptopsServer) error
+	UpdateLaptop(context.Context, *UpdateLaptopRequest) (*UpdateLaptopResponse, error)
+	DeleteLaptop(context.Context, *DeleteLaptopRequest) (*DeleteLaptopResponse, error)
+	TransferLaptopOwnership(context.Context, *TransferLaptopOwnershipRequest) (*TransferLaptopOwnershipResponse, error)
+	GetLaptop(context.Context, *GetLaptopRequest) (*GetLaptopResponse, error)
 	SearchLaptop(*SearchLaptopRequest, LaptopService_SearchLaptopServer) error
 	UploadImage(LaptopService_UploadImageServer) error
+	DownloadImage(*DownloadImageRequest, LaptopService_DownloadImageServer) error
+	DeleteImage(context.Context, *DeleteImageRequest) (*DeleteImageResponse, error)
 	RateLaptop(LaptopService_RateLaptopServer) error
+	WatchRatings(*WatchRatingsRequest, LaptopService_WatchRatingsServer) error
+	RemoveRating(context.Context, *RemoveRatingRequest) (*RemoveRatingResponse, error)
+	ExportRatings(*ExportRatingsRequest, LaptopService_ExportRatingsServer) error
 	mustEmbedUnimplementedLaptopServiceServer()
 }
 
@@ -155,15 +359,45 @@ type UnimplementedLaptopServiceServer struct {
 func (*UnimplementedLaptopServiceServer) CreateLaptop(context.Context, *CreateLaptopRequest) (*CreateLaptopResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method CreateLaptop not implemented")
 }
+func (*UnimplementedLaptopServiceServer) BulkCreateLaptops(LaptopService_BulkCreateLaptopsServer) error {
+	return status.Errorf(codes.Unimplemented, "method BulkCreateLaptops not implemented")
+}
+func (*UnimplementedLaptopServiceServer) UpdateLaptop(context.Context, *UpdateLaptopRequest) (*UpdateLaptopResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateLaptop not implemented")
+}
+func (*UnimplementedLaptopServiceServer) DeleteLaptop(context.Context, *DeleteLaptopRequest) (*DeleteLaptopResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteLaptop not implemented")
+}
+func (*UnimplementedLaptopServiceServer) TransferLaptopOwnership(context.Context, *TransferLaptopOwnershipRequest) (*TransferLaptopOwnershipResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TransferLaptopOwnership not implemented")
+}
+func (*UnimplementedLaptopServiceServer) GetLaptop(context.Context, *GetLaptopRequest) (*GetLaptopResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLaptop not implemented")
+}
 func (*UnimplementedLaptopServiceServer) SearchLaptop(*SearchLaptopRequest, LaptopService_SearchLaptopServer) error {
 	return status.Errorf(codes.Unimplemented, "method SearchLaptop not implemented")
 }
 func (*UnimplementedLaptopServiceServer) UploadImage(LaptopService_UploadImageServer) error {
 	return status.Errorf(codes.Unimplemented, "method UploadImage not implemented")
 }
+func (*UnimplementedLaptopServiceServer) DownloadImage(*DownloadImageRequest, LaptopService_DownloadImageServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadImage not implemented")
+}
+func (*UnimplementedLaptopServiceServer) DeleteImage(context.Context, *DeleteImageRequest) (*DeleteImageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteImage not implemented")
+}
 func (*UnimplementedLaptopServiceServer) RateLaptop(LaptopService_RateLaptopServer) error {
 	return status.Errorf(codes.Unimplemented, "method RateLaptop not implemented")
 }
+func (*UnimplementedLaptopServiceServer) WatchRatings(*WatchRatingsRequest, LaptopService_WatchRatingsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRatings not implemented")
+}
+func (*UnimplementedLaptopServiceServer) RemoveRating(context.Context, *RemoveRatingRequest) (*RemoveRatingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveRating not implemented")
+}
+func (*UnimplementedLaptopServiceServer) ExportRatings(*ExportRatingsRequest, LaptopService_ExportRatingsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportRatings not implemented")
+}
 func (*UnimplementedLaptopServiceServer) mustEmbedUnimplementedLaptopServiceServer() {}
 
 func RegisterLaptopServiceServer(s *grpc.Server, srv LaptopServiceServer) {
@@ -188,6 +422,104 @@ func _LaptopService_CreateLaptop_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _LaptopService_BulkCreateLaptops_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LaptopServiceServer).BulkCreateLaptops(&laptopServiceBulkCreateLaptopsServer{stream})
+}
+
+type LaptopService_BulkCreateLaptopsServer interface {
+	SendAndClose(*BulkCreateLaptopsResponse) error
+	Recv() (*BulkCreateLaptopsRequest, error)
+	grpc.ServerStream
+}
+
+type laptopServiceBulkCreateLaptopsServer struct {
+	grpc.ServerStream
+}
+
+func (x *laptopServiceBulkCreateLaptopsServer) SendAndClose(m *BulkCreateLaptopsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *laptopServiceBulkCreateLaptopsServer) Recv() (*BulkCreateLaptopsRequest, error) {
+	m := new(BulkCreateLaptopsRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _LaptopService_UpdateLaptop_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateLaptopRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).UpdateLaptop(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/UpdateLaptop",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).UpdateLaptop(ctx, req.(*UpdateLaptopRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_DeleteLaptop_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteLaptopRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).DeleteLaptop(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/DeleteLaptop",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).DeleteLaptop(ctx, req.(*DeleteLaptopRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_TransferLaptopOwnership_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransferLaptopOwnershipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).TransferLaptopOwnership(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/TransferLaptopOwnership",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).TransferLaptopOwnership(ctx, req.(*TransferLaptopOwnershipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_GetLaptop_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetLaptopRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).GetLaptop(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/GetLaptop",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).GetLaptop(ctx, req.(*GetLaptopRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _LaptopService_SearchLaptop_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(SearchLaptopRequest)
 	if err := stream.RecvMsg(m); err != nil {
@@ -235,6 +567,45 @@ func (x *laptopServiceUploadImageServer) Recv() (*UploadImageRequest, error) {
 	return m, nil
 }
 
+func _LaptopService_DownloadImage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadImageRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LaptopServiceServer).DownloadImage(m, &laptopServiceDownloadImageServer{stream})
+}
+
+type LaptopService_DownloadImageServer interface {
+	Send(*DownloadImageResponse) error
+	grpc.ServerStream
+}
+
+type laptopServiceDownloadImageServer struct {
+	grpc.ServerStream
+}
+
+func (x *laptopServiceDownloadImageServer) Send(m *DownloadImageResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LaptopService_DeleteImage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteImageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).DeleteImage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/DeleteImage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).DeleteImage(ctx, req.(*DeleteImageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _LaptopService_RateLaptop_Handler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(LaptopServiceServer).RateLaptop(&laptopServiceRateLaptopServer{stream})
 }
@@ -261,6 +632,66 @@ func (x *laptopServiceRateLaptopServer) Recv() (*RateLaptopRequest, error) {
 	return m, nil
 }
 
+func _LaptopService_WatchRatings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRatingsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LaptopServiceServer).WatchRatings(m, &laptopServiceWatchRatingsServer{stream})
+}
+
+type LaptopService_WatchRatingsServer interface {
+	Send(*RateLaptopResponse) error
+	grpc.ServerStream
+}
+
+type laptopServiceWatchRatingsServer struct {
+	grpc.ServerStream
+}
+
+func (x *laptopServiceWatchRatingsServer) Send(m *RateLaptopResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LaptopService_RemoveRating_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveRatingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LaptopServiceServer).RemoveRating(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/techschool.pcbook.LaptopService/RemoveRating",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LaptopServiceServer).RemoveRating(ctx, req.(*RemoveRatingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LaptopService_ExportRatings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportRatingsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LaptopServiceServer).ExportRatings(m, &laptopServiceExportRatingsServer{stream})
+}
+
+type LaptopService_ExportRatingsServer interface {
+	Send(*ExportRatingsResponse) error
+	grpc.ServerStream
+}
+
+type laptopServiceExportRatingsServer struct {
+	grpc.ServerStream
+}
+
+func (x *laptopServiceExportRatingsServer) Send(m *ExportRatingsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _LaptopService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "techschool.pcbook.LaptopService",
 	HandlerType: (*LaptopServiceServer)(nil),
@@ -269,8 +700,37 @@ var _LaptopService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "CreateLaptop",
 			Handler:    _LaptopService_CreateLaptop_Handler,
 		},
+		{
+			MethodName: "UpdateLaptop",
+			Handler:    _LaptopService_UpdateLaptop_Handler,
+		},
+		{
+			MethodName: "DeleteLaptop",
+			Handler:    _LaptopService_DeleteLaptop_Handler,
+		},
+		{
+			MethodName: "TransferLaptopOwnership",
+			Handler:    _LaptopService_TransferLaptopOwnership_Handler,
+		},
+		{
+			MethodName: "GetLaptop",
+			Handler:    _LaptopService_GetLaptop_Handler,
+		},
+		{
+			MethodName: "DeleteImage",
+			Handler:    _LaptopService_DeleteImage_Handler,
+		},
+		{
+			MethodName: "RemoveRating",
+			Handler:    _LaptopService_RemoveRating_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BulkCreateLaptops",
+			Handler:       _LaptopService_BulkCreateLaptops_Handler,
+			ClientStreams: true,
+		},
 		{
 			StreamName:    "SearchLaptop",
 			Handler:       _LaptopService_SearchLaptop_Handler,
@@ -281,12 +741,27 @@ var _LaptopService_serviceDesc = grpc.ServiceDesc{
 			Handler:       _LaptopService_UploadImage_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "DownloadImage",
+			Handler:       _LaptopService_DownloadImage_Handler,
+			ServerStreams: true,
+		},
 		{
 			StreamName:    "RateLaptop",
 			Handler:       _LaptopService_RateLaptop_Handler,
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "WatchRatings",
+			Handler:       _LaptopService_WatchRatings_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ExportRatings",
+			Handler:       _LaptopService_ExportRatings_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "laptop_service.proto",
 }
@@ -3,6 +3,7 @@ package serializer
 import (
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 func ProtobufToJSON(message proto.Message) (string, error) {
@@ -20,3 +21,13 @@ func ProtobufToJSON(message proto.Message) (string, error) {
 func JSONToProtobufMessage(data string, message proto.Message) error {
 	return jsonpb.UnmarshalString(data, message)
 }
+
+// JSONMarshalOptions returns the protojson options with the same conventions as ProtobufToJSON:
+// original field names, enums as strings and default values included, without indentation
+func JSONMarshalOptions() protojson.MarshalOptions {
+	return protojson.MarshalOptions{
+		UseProtoNames:   true,
+		UseEnumNumbers:  false,
+		EmitUnpopulated: true,
+	}
+}
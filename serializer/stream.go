@@ -0,0 +1,497 @@
+package serializer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Format is the file format of a stream of messages
+type Format string
+
+const (
+	// FormatJSONL writes a JSON object per line
+	FormatJSONL Format = "jsonl"
+	// FormatCSV writes a header and a row per message. The nested messages are flattened into columns such as
+	// cpu.brand, while the repeated fields and the well-known types are written as JSON
+	FormatCSV Format = "csv"
+	// FormatProtobuf writes the binary messages, each one is prefixed with its size encoded as a varint
+	FormatProtobuf Format = "pb"
+)
+
+// maxMessageSize limits the size of a length-delimited message, so that corrupted data cannot allocate too much memory
+const maxMessageSize = 64 << 20
+
+// ErrInvalidMessage is wrapped by the errors of the messages that cannot be decoded,
+// the reader can still read the next message after such an error
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ParseFormat returns the format of the name: jsonl, csv or pb
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case FormatJSONL, FormatCSV, FormatProtobuf:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, must be jsonl, csv or pb", name)
+	}
+}
+
+// FormatOf returns the format of the file from its extension: .jsonl, .csv or .pb
+func FormatOf(filename string) (Format, error) {
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	if ext == "" {
+		return "", fmt.Errorf("cannot get format of %s without extension", filename)
+	}
+	return ParseFormat(ext)
+}
+
+// MessageReader reads a stream of messages
+type MessageReader interface {
+	// Read reads the next message, it returns io.EOF when there are no more messages
+	Read(message proto.Message) error
+}
+
+// MessageWriter writes a stream of messages
+type MessageWriter interface {
+	// Write writes a message to the buffer
+	Write(message proto.Message) error
+	// Flush writes the buffered messages to the underlying writer
+	Flush() error
+}
+
+// NewMessageReader returns a reader of the messages in the format
+func NewMessageReader(r io.Reader, format Format) (MessageReader, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonlReader{reader: bufio.NewReader(r)}, nil
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.ReuseRecord = true
+		return &csvReader{reader: reader}, nil
+	case FormatProtobuf:
+		return &protobufReader{reader: bufio.NewReader(r)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// NewMessageWriter returns a writer of the messages in the format,
+// the descriptor of the messages is used to write the CSV header
+func NewMessageWriter(w io.Writer, format Format, descriptor protoreflect.MessageDescriptor) (MessageWriter, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonlWriter{writer: bufio.NewWriter(w)}, nil
+	case FormatCSV:
+		return newCSVWriter(w, descriptor)
+	case FormatProtobuf:
+		return &protobufWriter{writer: bufio.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+type jsonlReader struct {
+	reader *bufio.Reader
+}
+
+func (r *jsonlReader) Read(message proto.Message) error {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return err
+		}
+
+		// 忽略空行
+		line = []byte(strings.TrimSpace(string(line)))
+		if len(line) == 0 {
+			continue
+		}
+
+		err = protojson.Unmarshal(line, message)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		return nil
+	}
+}
+
+type jsonlWriter struct {
+	writer *bufio.Writer
+}
+
+func (w *jsonlWriter) Write(message proto.Message) error {
+	data, err := JSONMarshalOptions().Marshal(message)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+
+	w.writer.Write(data)
+	return w.writer.WriteByte('\n')
+}
+
+func (w *jsonlWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+type protobufReader struct {
+	reader *bufio.Reader
+}
+
+func (r *protobufReader) Read(message proto.Message) error {
+	size, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return err
+	}
+	if size > maxMessageSize {
+		return fmt.Errorf("message size %d exceeds the limit %d", size, maxMessageSize)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r.reader, data)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	err = proto.Unmarshal(data, message)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	return nil
+}
+
+type protobufWriter struct {
+	writer *bufio.Writer
+}
+
+func (w *protobufWriter) Write(message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("cannot marshal proto message to binary: %w", err)
+	}
+
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, uint64(len(data)))
+	w.writer.Write(size[:n])
+	_, err = w.writer.Write(data)
+	return err
+}
+
+func (w *protobufWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+// csvColumn is a column of the CSV file, the path is the fields from the message to the value
+type csvColumn struct {
+	name string
+	path []protoreflect.FieldDescriptor
+}
+
+// csvColumns returns the columns of the fields of the message, the singular nested messages are flattened
+// except the well-known types and the messages that contain themselves
+func csvColumns(descriptor protoreflect.MessageDescriptor, path []protoreflect.FieldDescriptor) []csvColumn {
+	var columns []csvColumn
+	fields := descriptor.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		fieldPath := append(append([]protoreflect.FieldDescriptor{}, path...), field)
+		if flattened(field, path) {
+			columns = append(columns, csvColumns(field.Message(), fieldPath)...)
+			continue
+		}
+
+		names := make([]string, len(fieldPath))
+		for j, pathField := range fieldPath {
+			names[j] = string(pathField.Name())
+		}
+		columns = append(columns, csvColumn{name: strings.Join(names, "."), path: fieldPath})
+	}
+	return columns
+}
+
+func flattened(field protoreflect.FieldDescriptor, path []protoreflect.FieldDescriptor) bool {
+	if field.Kind() != protoreflect.MessageKind || field.IsList() || field.IsMap() {
+		return false
+	}
+	if strings.HasPrefix(string(field.Message().FullName()), "google.protobuf.") {
+		return false
+	}
+	for _, parent := range path {
+		if parent.Message().FullName() == field.Message().FullName() {
+			return false
+		}
+	}
+	return field.ContainingMessage().FullName() != field.Message().FullName()
+}
+
+// get returns the text of the column in the message, or an empty string when the value is not set
+func (column csvColumn) get(message protoreflect.Message) (string, error) {
+	field := column.path[len(column.path)-1]
+	for _, parent := range column.path[:len(column.path)-1] {
+		if !message.Has(parent) {
+			return "", nil
+		}
+		message = message.Get(parent).Message()
+	}
+	// 没有设置的字段和空的列表都是空的单元格
+	if (field.HasPresence() || field.IsList() || field.IsMap()) && !message.Has(field) {
+		return "", nil
+	}
+
+	if field.IsList() || field.IsMap() || field.Kind() == protoreflect.MessageKind {
+		return marshalField(message, field)
+	}
+	return formatScalar(field, message.Get(field)), nil
+}
+
+// set sets the value of the column in the message from the text, an empty text leaves the value unset
+func (column csvColumn) set(message protoreflect.Message, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	field := column.path[len(column.path)-1]
+	for _, parent := range column.path[:len(column.path)-1] {
+		message = message.Mutable(parent).Message()
+	}
+
+	// 字符串保留原样，其他类型忽略表格软件加入的空格
+	if field.Kind() != protoreflect.StringKind {
+		text = strings.TrimSpace(text)
+	}
+	if field.IsList() || field.IsMap() || field.Kind() == protoreflect.MessageKind {
+		return unmarshalField(message, field, text)
+	}
+	value, err := parseScalar(field, text)
+	if err != nil {
+		return err
+	}
+	message.Set(field, value)
+	return nil
+}
+
+// marshalField returns the JSON of a single field, a JSON string is unquoted to be readable in spreadsheets
+func marshalField(message protoreflect.Message, field protoreflect.FieldDescriptor) (string, error) {
+	// 只包含这个字段的message序列化后取出字段的值
+	single := message.New()
+	single.Set(field, message.Get(field))
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(single.Interface())
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal field %s to JSON: %w", field.Name(), err)
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal field %s to JSON: %w", field.Name(), err)
+	}
+	value := fields[string(field.Name())]
+
+	var text string
+	if json.Unmarshal(value, &text) == nil {
+		return text, nil
+	}
+	return string(value), nil
+}
+
+func unmarshalField(message protoreflect.Message, field protoreflect.FieldDescriptor, text string) error {
+	value := []byte(text)
+	if !json.Valid(value) {
+		// 写入时去掉了JSON字符串的引号
+		value, _ = json.Marshal(text)
+	}
+
+	data, err := json.Marshal(map[string]json.RawMessage{string(field.Name()): value})
+	if err != nil {
+		return err
+	}
+	single := message.New()
+	err = protojson.Unmarshal(data, single.Interface())
+	if err != nil {
+		return err
+	}
+	message.Set(field, single.Get(field))
+	return nil
+}
+
+func formatScalar(field protoreflect.FieldDescriptor, value protoreflect.Value) string {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return strconv.FormatBool(value.Bool())
+	case protoreflect.EnumKind:
+		if enumValue := field.Enum().Values().ByNumber(value.Enum()); enumValue != nil {
+			return string(enumValue.Name())
+		}
+		return strconv.Itoa(int(value.Enum()))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return strconv.FormatInt(value.Int(), 10)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return strconv.FormatUint(value.Uint(), 10)
+	case protoreflect.FloatKind:
+		return strconv.FormatFloat(value.Float(), 'g', -1, 32)
+	case protoreflect.DoubleKind:
+		return strconv.FormatFloat(value.Float(), 'g', -1, 64)
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(value.Bytes())
+	default:
+		return value.String()
+	}
+}
+
+func parseScalar(field protoreflect.FieldDescriptor, text string) (protoreflect.Value, error) {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		value, err := strconv.ParseBool(text)
+		return protoreflect.ValueOfBool(value), err
+	case protoreflect.EnumKind:
+		if enumValue := field.Enum().Values().ByName(protoreflect.Name(text)); enumValue != nil {
+			return protoreflect.ValueOfEnum(enumValue.Number()), nil
+		}
+		value, err := strconv.ParseInt(text, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("unknown enum value %q", text)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(value)), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		value, err := strconv.ParseInt(text, 10, 32)
+		return protoreflect.ValueOfInt32(int32(value)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		value, err := strconv.ParseInt(text, 10, 64)
+		return protoreflect.ValueOfInt64(value), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		value, err := strconv.ParseUint(text, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(value)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		value, err := strconv.ParseUint(text, 10, 64)
+		return protoreflect.ValueOfUint64(value), err
+	case protoreflect.FloatKind:
+		value, err := strconv.ParseFloat(text, 32)
+		return protoreflect.ValueOfFloat32(float32(value)), err
+	case protoreflect.DoubleKind:
+		value, err := strconv.ParseFloat(text, 64)
+		return protoreflect.ValueOfFloat64(value), err
+	case protoreflect.BytesKind:
+		value, err := base64.StdEncoding.DecodeString(text)
+		return protoreflect.ValueOfBytes(value), err
+	default:
+		return protoreflect.ValueOfString(text), nil
+	}
+}
+
+type csvReader struct {
+	reader  *csv.Reader
+	header  []string
+	columns []csvColumn // 读取第一个message时根据header确定
+}
+
+func (r *csvReader) Read(message proto.Message) error {
+	if r.header == nil {
+		header, err := r.reader.Read()
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read CSV header: %w", err)
+		}
+		r.header = append([]string{}, header...)
+	}
+	if r.columns == nil {
+		columns, err := resolveColumns(message.ProtoReflect().Descriptor(), r.header)
+		if err != nil {
+			return err
+		}
+		r.columns = columns
+	}
+
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return io.EOF
+	}
+	var parseError *csv.ParseError
+	if errors.As(err, &parseError) {
+		// 列数不对或者引号错误时可以继续读取下一行
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	proto.Reset(message)
+	reflectMessage := message.ProtoReflect()
+	for i, column := range r.columns {
+		err := column.set(reflectMessage, record[i])
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s %q: %v", ErrInvalidMessage, column.name, record[i], err)
+		}
+	}
+	return nil
+}
+
+// resolveColumns returns the columns of the header, the columns can be in any order and some can be omitted
+func resolveColumns(descriptor protoreflect.MessageDescriptor, header []string) ([]csvColumn, error) {
+	known := make(map[string]csvColumn)
+	for _, column := range csvColumns(descriptor, nil) {
+		known[column.name] = column
+	}
+
+	columns := make([]csvColumn, len(header))
+	for i, name := range header {
+		column, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown CSV column %q of %s", name, descriptor.FullName())
+		}
+		columns[i] = column
+	}
+	return columns, nil
+}
+
+type csvWriter struct {
+	writer  *csv.Writer
+	columns []csvColumn
+}
+
+func newCSVWriter(w io.Writer, descriptor protoreflect.MessageDescriptor) (*csvWriter, error) {
+	writer := &csvWriter{writer: csv.NewWriter(w), columns: csvColumns(descriptor, nil)}
+
+	header := make([]string, len(writer.columns))
+	for i, column := range writer.columns {
+		header[i] = column.name
+	}
+	err := writer.writer.Write(header)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write CSV header: %w", err)
+	}
+	return writer, nil
+}
+
+func (w *csvWriter) Write(message proto.Message) error {
+	reflectMessage := message.ProtoReflect()
+	record := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		text, err := column.get(reflectMessage)
+		if err != nil {
+			return err
+		}
+		record[i] = text
+	}
+	return w.writer.Write(record)
+}
+
+func (w *csvWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
@@ -0,0 +1,95 @@
+package serializer
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMessageStream(t *testing.T) {
+	t.Parallel()
+
+	laptops := []*pb.Laptop{sample.NewLaptop(), sample.NewLaptop(), {Id: "empty"}}
+	for _, format := range []Format{FormatJSONL, FormatCSV, FormatProtobuf} {
+		format := format
+		t.Run(string(format), func(t *testing.T) {
+			t.Parallel()
+
+			var buffer bytes.Buffer
+			writer, err := NewMessageWriter(&buffer, format, (&pb.Laptop{}).ProtoReflect().Descriptor())
+			require.NoError(t, err)
+			for _, laptop := range laptops {
+				require.NoError(t, writer.Write(laptop))
+			}
+			require.NoError(t, writer.Flush())
+
+			reader, err := NewMessageReader(&buffer, format)
+			require.NoError(t, err)
+			for _, laptop := range laptops {
+				other := &pb.Laptop{}
+				require.NoError(t, reader.Read(other))
+				require.True(t, proto.Equal(laptop, other), "expected %v, got %v", laptop, other)
+			}
+			require.Equal(t, io.EOF, reader.Read(&pb.Laptop{}))
+		})
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	t.Parallel()
+
+	format, err := FormatOf("catalog.CSV")
+	require.NoError(t, err)
+	require.Equal(t, FormatCSV, format)
+
+	_, err = FormatOf("catalog.xlsx")
+	require.Error(t, err)
+	_, err = FormatOf("catalog")
+	require.Error(t, err)
+}
+
+func TestCSVReader(t *testing.T) {
+	t.Parallel()
+
+	// 列可以是任意顺序，也可以省略
+	input := strings.Join([]string{
+		"name,ram.value,ram.unit, price_usd,weight_kg,gpus",
+		`Thinkpad,16,GIGABYTE, 1999.5,1.2,"[{""brand"":""NVIDIA""}]"`,
+		"Macbook,8,PETABYTE,1000,,",
+		"XPS,too,many,columns,,,",
+		"Surface,4,GIGABYTE,800,,",
+	}, "\n")
+	reader, err := NewMessageReader(strings.NewReader(input), FormatCSV)
+	require.NoError(t, err)
+
+	laptop := &pb.Laptop{}
+	require.NoError(t, reader.Read(laptop))
+	require.Equal(t, "Thinkpad", laptop.GetName())
+	require.True(t, proto.Equal(&pb.Memory{Value: 16, Unit: pb.Memory_GIGABYTE}, laptop.GetRam()))
+	require.Equal(t, 1999.5, laptop.GetPriceUsd())
+	require.Equal(t, 1.2, laptop.GetWeightKg())
+	require.Len(t, laptop.GetGpus(), 1)
+	require.Equal(t, "NVIDIA", laptop.GetGpus()[0].GetBrand())
+	require.Nil(t, laptop.GetCpu())
+
+	// 无效的行返回ErrInvalidMessage之后可以继续读取
+	err = reader.Read(laptop)
+	require.True(t, errors.Is(err, ErrInvalidMessage))
+	err = reader.Read(laptop)
+	require.True(t, errors.Is(err, ErrInvalidMessage))
+
+	require.NoError(t, reader.Read(laptop))
+	require.Equal(t, "Surface", laptop.GetName())
+	require.Nil(t, laptop.GetWeight())
+	require.Equal(t, io.EOF, reader.Read(laptop))
+
+	reader, err = NewMessageReader(strings.NewReader("name,color\nThinkpad,black\n"), FormatCSV)
+	require.NoError(t, err)
+	require.Error(t, reader.Read(laptop))
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// apiKeyPrefix makes API keys easy to recognize, for example by secret scanners
+const apiKeyPrefix = "pcbk_"
+
+// APIKey contains the information of an API key for service-to-service clients
+type APIKey struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"` // key原文的hash值，不保存key原文
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"` // 创建该key的用户，使用该key的请求以这个用户的身份执行
+	Roles     []string  `json:"roles"` // 该key可以使用的角色，不能超过owner当前的角色
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// GenerateAPIKey generates a new random API key, only the hash of the key is kept in the returned APIKey
+func GenerateAPIKey(name string, owner string, roles []string, expiresAt time.Time) (string, *APIKey, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot generate api key id: %v", err)
+	}
+
+	data := make([]byte, 32)
+	_, err = rand.Read(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot generate api key: %v", err)
+	}
+
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(data)
+	apiKey := &APIKey{
+		ID:        id.String(),
+		Hash:      HashAPIKey(key),
+		Name:      name,
+		Owner:     owner,
+		Roles:     append([]string(nil), roles...),
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	return key, apiKey, nil
+}
+
+// HashAPIKey returns the hash under which an API key is stored,
+// a fast hash is enough since the keys are long random strings
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// IsValid checks if the key is neither revoked nor expired
+func (key *APIKey) IsValid() bool {
+	return !key.Revoked && time.Now().Before(key.ExpiresAt)
+}
+
+// Clone returns a deep copy of the API key
+func (key *APIKey) Clone() *APIKey {
+	other := *key
+	other.Roles = append([]string(nil), key.Roles...)
+	return &other
+}
+
+// APIKeyStore is an interface to store API keys
+type APIKeyStore interface {
+	// Save saves a new API key to the store
+	Save(key *APIKey) error
+	// FindByHash finds an API key by the hash of the key
+	FindByHash(hash string) (*APIKey, error)
+	// List returns all API keys sorted by creation time
+	List() ([]*APIKey, error)
+	// Revoke revokes an API key by id and returns it
+	Revoke(id string) (*APIKey, error)
+}
+
+// InMemoryAPIKeyStore stores API keys in memory
+type InMemoryAPIKeyStore struct {
+	mutex  sync.RWMutex
+	keys   map[string]*APIKey // key是API key的id
+	hashes map[string]string  // key是API key的hash值，value是id
+}
+
+// NewInMemoryAPIKeyStore returns a new InMemoryAPIKeyStore
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{
+		keys:   make(map[string]*APIKey),
+		hashes: make(map[string]string),
+	}
+}
+
+func (store *InMemoryAPIKeyStore) Save(key *APIKey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.keys[key.ID] != nil || store.hashes[key.Hash] != "" {
+		return ErrAlreadyExists
+	}
+
+	store.keys[key.ID] = key.Clone()
+	store.hashes[key.Hash] = key.ID
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) FindByHash(hash string) (*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	key := store.keys[store.hashes[hash]]
+	if key == nil {
+		return nil, nil
+	}
+	return key.Clone(), nil
+}
+
+func (store *InMemoryAPIKeyStore) List() ([]*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	keys := make([]*APIKey, 0, len(store.keys))
+	for _, key := range store.keys {
+		keys = append(keys, key.Clone())
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (store *InMemoryAPIKeyStore) Revoke(id string) (*APIKey, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := store.keys[id]
+	if key == nil {
+		return nil, fmt.Errorf("api key %s: %w", id, ErrNotFound)
+	}
+
+	key.Revoked = true
+	return key.Clone(), nil
+}
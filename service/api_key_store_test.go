@@ -0,0 +1,53 @@
+package service_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileAPIKeyStore(t *testing.T) {
+	t.Parallel()
+
+	apiKeyFile := filepath.Join(t.TempDir(), "api_keys.jsonl")
+	store, err := service.NewFileAPIKeyStore(apiKeyFile)
+	require.NoError(t, err)
+
+	key1, apiKey1, err := service.GenerateAPIKey("importer", "admin1", []string{service.RoleUser}, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, store.Save(apiKey1))
+	require.ErrorIs(t, store.Save(apiKey1), service.ErrAlreadyExists)
+
+	_, apiKey2, err := service.GenerateAPIKey("exporter", "admin1", []string{service.RoleUser}, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, store.Save(apiKey2))
+	_, err = store.Revoke(apiKey2.ID)
+	require.NoError(t, err)
+	_, err = store.Revoke("unknown")
+	require.ErrorIs(t, err, service.ErrNotFound)
+	require.NoError(t, store.Close())
+
+	info, err := os.Stat(apiKeyFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// 重启后key和吊销状态都还在
+	store, err = service.NewFileAPIKeyStore(apiKeyFile)
+	require.NoError(t, err)
+	defer store.Close()
+
+	found, err := store.FindByHash(service.HashAPIKey(key1))
+	require.NoError(t, err)
+	require.Equal(t, apiKey1.ID, found.ID)
+	require.Equal(t, []string{service.RoleUser}, found.Roles)
+	require.True(t, found.IsValid())
+
+	keys, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, apiKey2.ID, keys[1].ID)
+	require.True(t, keys[1].Revoked)
+}
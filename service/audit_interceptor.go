@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"strings"
+	"time"
+)
+
+// maxAuditMessages is the max number of request and response summaries recorded for a stream
+const maxAuditMessages = 100
+
+// auditFields are the fields included in the summaries of requests and responses,
+// secrets such as passwords, tokens and codes are never included
+var auditFields = map[string]bool{
+	"id":         true,
+	"laptop_id":  true,
+	"rating_id":  true,
+	"image_type": true,
+	"size":       true,
+	"score":      true,
+	"username":   true,
+	"owner":      true,
+	"new_owner":  true,
+	"role":       true,
+	"roles":      true,
+	"name":       true,
+	"disabled":   true,
+}
+
+// AuditInterceptor is a server interceptor that records the calls of audited methods to the audit log.
+// It must run before the auth interceptor, so that the calls denied by the auth interceptor are recorded too,
+// the auth interceptor tells it the caller as soon as the credential is verified
+type AuditInterceptor struct {
+	auditLog AuditLog
+	methods  map[string]bool // 需要审计的方法
+}
+
+// NewAuditInterceptor returns a new audit interceptor that records the calls of the methods
+func NewAuditInterceptor(auditLog AuditLog, methods map[string]bool) *AuditInterceptor {
+	return &AuditInterceptor{auditLog, methods}
+}
+
+// Unary returns a server interceptor function to audit unary RPC
+func (interceptor *AuditInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if !interceptor.methods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		start := time.Now()
+		caller := &auditCaller{}
+		res, err := handler(context.WithValue(ctx, auditCallerKey{}, caller), req)
+
+		record := newAuditRecord(ctx, caller, info.FullMethod, start, err)
+		record.Requests = []map[string]string{summarizeMessage(req)}
+		if err == nil {
+			record.Responses = []map[string]string{summarizeMessage(res)}
+		}
+		interceptor.append(record)
+		return res, err
+	}
+}
+
+// Stream returns a server interceptor function to audit stream RPC
+func (interceptor *AuditInterceptor) Stream() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if !interceptor.methods[info.FullMethod] {
+			return handler(srv, stream)
+		}
+
+		start := time.Now()
+		caller := &auditCaller{}
+		auditStream := &auditServerStream{
+			ServerStream: stream,
+			ctx:          context.WithValue(stream.Context(), auditCallerKey{}, caller),
+		}
+		err := handler(srv, auditStream)
+
+		record := newAuditRecord(stream.Context(), caller, info.FullMethod, start, err)
+		record.Requests = auditStream.requests
+		record.Responses = auditStream.responses
+		interceptor.append(record)
+		return err
+	}
+}
+
+func (interceptor *AuditInterceptor) append(record *AuditRecord) {
+	// RPC已经执行完成，写入失败只记录日志，不影响返回结果
+	err := interceptor.auditLog.Append(record)
+	if err != nil {
+		logErrorf("cannot append audit record of %s: %v", record.Method, err)
+	}
+}
+
+// auditCaller is filled by the auth interceptor with the claims of the verified caller
+type auditCaller struct {
+	claims *UserClaims
+}
+
+type auditCallerKey struct{}
+
+// setAuditCaller tells the audit interceptor the caller of an audited call, even if the call is denied later
+func setAuditCaller(ctx context.Context, claims *UserClaims) {
+	if caller, ok := ctx.Value(auditCallerKey{}).(*auditCaller); ok {
+		caller.claims = claims
+	}
+}
+
+// newAuditRecord returns the record of a call with the caller, the result and the latency
+func newAuditRecord(ctx context.Context, caller *auditCaller, method string, start time.Time, err error) *AuditRecord {
+	record := &AuditRecord{
+		Time:    start.UTC(),
+		Method:  method,
+		Code:    status.Code(err).String(),
+		Latency: time.Since(start),
+	}
+	if err != nil {
+		record.Error = status.Convert(err).Message()
+	}
+
+	if claims := caller.claims; claims != nil {
+		record.Username = claims.Username
+		record.AuthMethod = "token"
+		if claims.Subject == apiKeySubject || claims.Subject == clientCertSubject {
+			record.AuthMethod = claims.Subject
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		record.Peer = p.Addr.String()
+	}
+	return record
+}
+
+// summarizeMessage returns the audited fields of the message and of its direct sub-messages
+func summarizeMessage(message interface{}) map[string]string {
+	summary := make(map[string]string)
+	if message, ok := message.(proto.Message); ok {
+		summarizeFields(message.ProtoReflect(), "", summary)
+	}
+	return summary
+}
+
+func summarizeFields(message protoreflect.Message, prefix string, summary map[string]string) {
+	fields := message.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		name := string(field.Name())
+
+		switch {
+		case field.ContainingOneof() != nil && !message.Has(field):
+			// oneof中没有设置的字段
+		case field.Kind() == protoreflect.MessageKind && !field.IsList() && !field.IsMap():
+			// 只展开一层，例如laptop.id和info.laptop_id
+			if prefix == "" && message.Has(field) {
+				summarizeFields(message.Get(field).Message(), name+".", summary)
+			}
+		case !auditFields[name] || field.IsMap() || field.Kind() == protoreflect.BytesKind:
+		case field.IsList():
+			list := message.Get(field).List()
+			values := make([]string, list.Len())
+			for j := range values {
+				values[j] = fmt.Sprint(list.Get(j).Interface())
+			}
+			summary[prefix+name] = strings.Join(values, ",")
+		default:
+			summary[prefix+name] = fmt.Sprint(message.Get(field).Interface())
+		}
+	}
+}
+
+// auditServerStream wraps a server stream to record the summaries of the messages
+// and to carry the context with the caller
+type auditServerStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	requests  []map[string]string
+	responses []map[string]string
+}
+
+func (stream *auditServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *auditServerStream) RecvMsg(m interface{}) error {
+	err := stream.ServerStream.RecvMsg(m)
+	if err == nil && len(stream.requests) < maxAuditMessages {
+		stream.requests = append(stream.requests, summarizeMessage(m))
+	}
+	return err
+}
+
+func (stream *auditServerStream) SendMsg(m interface{}) error {
+	err := stream.ServerStream.SendMsg(m)
+	if err == nil && len(stream.responses) < maxAuditMessages {
+		stream.responses = append(stream.responses, summarizeMessage(m))
+	}
+	return err
+}
@@ -0,0 +1,387 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ErrAuditLogTampered is returned when the hash chain of the audit log is broken
+var ErrAuditLogTampered = errors.New("audit log is tampered")
+
+// AuditRecord is the record of a call to an audited RPC method
+type AuditRecord struct {
+	Seq        int64               `json:"seq"`
+	Time       time.Time           `json:"time"`
+	Method     string              `json:"method"`
+	Username   string              `json:"username,omitempty"`
+	AuthMethod string              `json:"auth_method,omitempty"`
+	Peer       string              `json:"peer,omitempty"`
+	Requests   []map[string]string `json:"requests,omitempty"`
+	Responses  []map[string]string `json:"responses,omitempty"`
+	Code       string              `json:"code"`
+	Error      string              `json:"error,omitempty"`
+	Latency    time.Duration       `json:"latency"`
+	PrevHash   string              `json:"prev_hash"` // 上一条记录的hash，第一条记录为空
+	Hash       string              `json:"hash"`      // 除hash以外所有字段的HMAC-SHA256
+}
+
+// AuditFilter selects audit records, the zero value of each field matches every record
+type AuditFilter struct {
+	From     time.Time // 包含
+	To       time.Time // 不包含
+	Username string
+	Method   string // 支持path.Match的通配符
+}
+
+// AuditLog is an interface to store audit records
+type AuditLog interface {
+	// Append adds the record to the end of the log, and sets its sequence number and hashes
+	Append(record *AuditRecord) error
+	// Query finds the records that match the filter in the order they were appended
+	Query(ctx context.Context, filter *AuditFilter, found func(record *AuditRecord) error) error
+}
+
+// FileAuditLog stores audit records in an append-only log file, each record is chained to the previous one
+// by its HMAC, so that records cannot be modified, removed or forged without the key. The end of the chain
+// is also signed in a head file next to the log, so that removing the last records is detected as well
+type FileAuditLog struct {
+	mutex        sync.Mutex
+	filename     string
+	headFilename string
+	file         *os.File
+	key          []byte
+	size         int64 // 已经完整写入的字节数，查询只读取这一部分
+	lastSeq      int64
+	lastHash     string
+}
+
+// auditHead is the end of the hash chain, which is stored outside the log file
+type auditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+	MAC  string `json:"mac"` // seq和hash的HMAC，没有key不能伪造
+}
+
+// NewFileAuditLog opens the audit log file and verifies its hash chain with the key
+func NewFileAuditLog(filename string, key []byte) (*FileAuditLog, error) {
+	if len(key) == 0 {
+		return nil, errors.New("audit log key is required")
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+
+	auditLog := &FileAuditLog{
+		filename:     filename,
+		headFilename: filename + ".head",
+		file:         file,
+		key:          key,
+	}
+
+	err = auditLog.replay()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return auditLog, nil
+}
+
+// replay verifies every record of the log file and the head file, and finds the end of the hash chain
+func (auditLog *FileAuditLog) replay() error {
+	head, err := auditLog.readHead()
+	if err != nil {
+		return err
+	}
+
+	headFound := head == nil || head.Seq == 0
+	size, err := readAuditRecords(auditLog.file, auditLog.key, func(record *AuditRecord) error {
+		auditLog.lastSeq = record.Seq
+		auditLog.lastHash = record.Hash
+		if head != nil && record.Seq == head.Seq {
+			headFound = record.Hash == head.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// head在记录写入之后更新，崩溃时日志最多比head多一条记录
+	switch {
+	case head == nil && auditLog.lastSeq > 1:
+		return fmt.Errorf("head of %d records is missing: %w", auditLog.lastSeq, ErrAuditLogTampered)
+	case head != nil && (!headFound || auditLog.lastSeq > head.Seq+1):
+		return fmt.Errorf("records do not end at record %d of the head: %w", head.Seq, ErrAuditLogTampered)
+	}
+	if head == nil || head.Seq != auditLog.lastSeq {
+		err = auditLog.writeHead()
+		if err != nil {
+			return err
+		}
+	}
+
+	// 丢弃最后一条没有写完的记录
+	err = auditLog.file.Truncate(size)
+	if err != nil {
+		return fmt.Errorf("cannot truncate audit log: %w", err)
+	}
+	_, err = auditLog.file.Seek(size, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("cannot seek audit log: %w", err)
+	}
+
+	auditLog.size = size
+	return nil
+}
+
+func (auditLog *FileAuditLog) Append(record *AuditRecord) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	record.Seq = auditLog.lastSeq + 1
+	record.PrevHash = auditLog.lastHash
+	hash, err := record.computeHash(auditLog.key)
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot encode audit record: %w", err)
+	}
+	data = append(data, '\n')
+
+	_, err = auditLog.file.Write(data)
+	if err != nil {
+		err = fmt.Errorf("cannot write audit record: %w", err)
+	} else if err = auditLog.file.Sync(); err != nil {
+		err = fmt.Errorf("cannot sync audit log: %w", err)
+	}
+	if err != nil {
+		// 去掉写了一半的记录，否则之后的记录都接在这条不完整的记录后面
+		truncateErr := auditLog.file.Truncate(auditLog.size)
+		if truncateErr == nil {
+			_, truncateErr = auditLog.file.Seek(auditLog.size, io.SeekStart)
+		}
+		if truncateErr != nil {
+			logErrorf("cannot truncate audit log to %d: %v", auditLog.size, truncateErr)
+		}
+		return err
+	}
+
+	auditLog.size += int64(len(data))
+	auditLog.lastSeq = record.Seq
+	auditLog.lastHash = record.Hash
+	return auditLog.writeHead()
+}
+
+// readHead reads and verifies the head file, and returns nil if it does not exist
+func (auditLog *FileAuditLog) readHead() (*auditHead, error) {
+	data, err := ioutil.ReadFile(auditLog.headFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read audit log head: %w", err)
+	}
+
+	head := &auditHead{}
+	if err := json.Unmarshal(data, head); err != nil {
+		return nil, fmt.Errorf("head cannot be decoded: %w", ErrAuditLogTampered)
+	}
+	if !hmac.Equal([]byte(head.MAC), []byte(auditHeadMAC(auditLog.key, head.Seq, head.Hash))) {
+		return nil, fmt.Errorf("head is not signed by the key: %w", ErrAuditLogTampered)
+	}
+	return head, nil
+}
+
+// writeHead replaces the head file with the current end of the chain, the caller must hold the mutex
+func (auditLog *FileAuditLog) writeHead() error {
+	head := &auditHead{
+		Seq:  auditLog.lastSeq,
+		Hash: auditLog.lastHash,
+		MAC:  auditHeadMAC(auditLog.key, auditLog.lastSeq, auditLog.lastHash),
+	}
+	data, err := json.Marshal(head)
+	if err != nil {
+		return fmt.Errorf("cannot encode audit log head: %w", err)
+	}
+
+	// 先写临时文件再替换，崩溃时不会留下不完整的head
+	tmpFilename := auditLog.headFilename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create audit log head: %w", err)
+	}
+	defer os.Remove(tmpFilename)
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write audit log head: %w", err)
+	}
+
+	err = os.Rename(tmpFilename, auditLog.headFilename)
+	if err != nil {
+		return fmt.Errorf("cannot replace audit log head: %w", err)
+	}
+	return nil
+}
+
+// Query reads the log file from the beginning and verifies the hash chain on the way,
+// ErrAuditLogTampered is returned when a broken record is reached
+func (auditLog *FileAuditLog) Query(ctx context.Context, filter *AuditFilter, found func(record *AuditRecord) error) error {
+	auditLog.mutex.Lock()
+	size := auditLog.size
+	lastSeq := auditLog.lastSeq
+	auditLog.mutex.Unlock()
+
+	// 单独打开文件读取，不阻塞新记录的写入
+	file, err := os.Open(auditLog.filename)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+	defer file.Close()
+
+	seq := int64(0)
+	_, err = readAuditRecords(io.LimitReader(file, size), auditLog.key, func(record *AuditRecord) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		seq = record.Seq
+		if !filter.Match(record) {
+			return nil
+		}
+		return found(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	// 文件在运行时被截断
+	if seq < lastSeq {
+		return fmt.Errorf("records after %d are removed: %w", seq, ErrAuditLogTampered)
+	}
+	return nil
+}
+
+// CheckHealth returns an error if the audit log file cannot be appended
+func (auditLog *FileAuditLog) CheckHealth() error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	return checkOpenFile(auditLog.file)
+}
+
+// Close closes the audit log file
+func (auditLog *FileAuditLog) Close() error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	return auditLog.file.Close()
+}
+
+// Match checks if the record is selected by the filter
+func (filter *AuditFilter) Match(record *AuditRecord) bool {
+	if !filter.From.IsZero() && record.Time.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !record.Time.Before(filter.To) {
+		return false
+	}
+	if filter.Username != "" && record.Username != filter.Username {
+		return false
+	}
+	if filter.Method != "" {
+		if ok, _ := path.Match(filter.Method, record.Method); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// computeHash returns the hex encoded HMAC-SHA256 of the record without its hash,
+// the previous hash is included so that the records form a chain
+func (record *AuditRecord) computeHash(key []byte) (string, error) {
+	other := *record
+	other.Hash = ""
+
+	data, err := json.Marshal(&other)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode audit record: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// auditHeadMAC returns the hex encoded HMAC-SHA256 of the end of the chain
+func auditHeadMAC(key []byte, seq int64, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d:%s", seq, hash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readAuditRecords reads and verifies the records of the log until the end, and returns the size
+// of the complete records. An incomplete last line is ignored since it is left by a crash during writing
+func readAuditRecords(reader io.Reader, key []byte, found func(record *AuditRecord) error) (int64, error) {
+	buffered := bufio.NewReader(reader)
+	offset := int64(0)
+	lastSeq := int64(0)
+	lastHash := ""
+
+	for {
+		line, err := buffered.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				logInfof("ignore incomplete audit record at offset %d", offset)
+			}
+			return offset, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot read audit log: %w", err)
+		}
+
+		record := &AuditRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return 0, fmt.Errorf("record at offset %d cannot be decoded: %w", offset, ErrAuditLogTampered)
+		}
+
+		hash, err := record.computeHash(key)
+		if err != nil {
+			return 0, err
+		}
+		if record.Seq != lastSeq+1 || record.PrevHash != lastHash || !hmac.Equal([]byte(record.Hash), []byte(hash)) {
+			return 0, fmt.Errorf("record %d breaks the hash chain: %w", lastSeq+1, ErrAuditLogTampered)
+		}
+
+		offset += int64(len(line))
+		lastSeq = record.Seq
+		lastHash = record.Hash
+
+		if err := found(record); err != nil {
+			return 0, err
+		}
+	}
+}
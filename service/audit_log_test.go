@@ -0,0 +1,213 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testAuditKey = []byte("audit-secret")
+
+func TestFileAuditLog(t *testing.T) {
+	t.Parallel()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := service.NewFileAuditLog(auditFile, testAuditKey)
+	require.NoError(t, err)
+
+	start := time.Now().UTC()
+	records := []*service.AuditRecord{
+		{Time: start, Method: "/techschool.pcbook.LaptopService/CreateLaptop", Username: "user1", Code: "OK"},
+		{Time: start.Add(time.Second), Method: "/techschool.pcbook.LaptopService/RateLaptop", Username: "user2", Code: "OK"},
+		{Time: start.Add(2 * time.Second), Method: "/techschool.pcbook.AuthService/Login", Code: "NotFound"},
+	}
+	for _, record := range records {
+		require.NoError(t, auditLog.Append(record))
+	}
+	require.Equal(t, int64(3), records[2].Seq)
+	require.Equal(t, records[1].Hash, records[2].PrevHash)
+	require.NoError(t, auditLog.Close())
+
+	// 重新打开后继续原来的hash链
+	auditLog, err = service.NewFileAuditLog(auditFile, testAuditKey)
+	require.NoError(t, err)
+	record := &service.AuditRecord{Time: start.Add(3 * time.Second), Method: "/techschool.pcbook.LaptopService/CreateLaptop", Username: "user1"}
+	require.NoError(t, auditLog.Append(record))
+	require.Equal(t, int64(4), record.Seq)
+	require.Equal(t, records[2].Hash, record.PrevHash)
+
+	found := queryAuditLog(t, auditLog, &service.AuditFilter{Username: "user1"})
+	require.Equal(t, []int64{1, 4}, found)
+	found = queryAuditLog(t, auditLog, &service.AuditFilter{Method: "/techschool.pcbook.LaptopService/*"})
+	require.Equal(t, []int64{1, 2, 4}, found)
+	found = queryAuditLog(t, auditLog, &service.AuditFilter{From: start.Add(time.Second), To: start.Add(3 * time.Second)})
+	require.Equal(t, []int64{2, 3}, found)
+	require.NoError(t, auditLog.Close())
+
+	// 写到一半崩溃留下的不完整记录在打开时被丢弃
+	data, err := ioutil.ReadFile(auditFile)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(auditFile, append(data, []byte(`{"seq":5,"time"`)...), 0600))
+
+	auditLog, err = service.NewFileAuditLog(auditFile, testAuditKey)
+	require.NoError(t, err)
+	found = queryAuditLog(t, auditLog, &service.AuditFilter{})
+	require.Equal(t, []int64{1, 2, 3, 4}, found)
+	require.NoError(t, auditLog.Close())
+
+	// 修改任何一条记录都会被发现
+	tampered := bytes.Replace(data, []byte(`"username":"user2"`), []byte(`"username":"user3"`), 1)
+	require.NoError(t, ioutil.WriteFile(auditFile, tampered, 0600))
+
+	_, err = service.NewFileAuditLog(auditFile, testAuditKey)
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	// 删除一条记录也会被发现
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	removed := bytes.Join(append(lines[:1:1], lines[2:]...), nil)
+	require.NoError(t, ioutil.WriteFile(auditFile, removed, 0600))
+
+	_, err = service.NewFileAuditLog(auditFile, testAuditKey)
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	// 删除最后的记录和head中的记录对不上
+	truncated := bytes.Join(lines[:2], nil)
+	require.NoError(t, ioutil.WriteFile(auditFile, truncated, 0600))
+
+	_, err = service.NewFileAuditLog(auditFile, testAuditKey)
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	// 没有key不能重新计算hash链，删除head也会被发现
+	require.NoError(t, ioutil.WriteFile(auditFile, data, 0600))
+	_, err = service.NewFileAuditLog(auditFile, []byte("other-secret"))
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	require.NoError(t, os.Remove(auditFile+".head"))
+	_, err = service.NewFileAuditLog(auditFile, testAuditKey)
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	_, err = service.NewFileAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"), nil)
+	require.Error(t, err)
+}
+
+func TestAuditInterceptor(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	admin, err := service.NewUser("admin1", "secret", service.RoleAdmin)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin))
+	user, err := service.NewUser("user1", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	auditLog, err := service.NewFileAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"), testAuditKey)
+	require.NoError(t, err)
+	t.Cleanup(func() { auditLog.Close() })
+
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	revokedTokenStore := service.NewInMemoryRevokedTokenStore()
+	authInterceptor := service.NewAuthInterceptor(jwtManager, revokedTokenStore, nil, userStore, service.NewRolePolicy(map[string][]string{
+		"/techschool.pcbook.AuthService/ChangePassword": {service.RoleAdmin},
+		"/techschool.pcbook.AuditService/QueryAuditLog": {service.RoleAdmin},
+	}))
+	auditInterceptor := service.NewAuditInterceptor(auditLog, map[string]bool{
+		"/techschool.pcbook.AuthService/Login":          true,
+		"/techschool.pcbook.AuthService/ChangePassword": true,
+	})
+
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(auditInterceptor.Unary(), authInterceptor.Unary()),
+		grpc.ChainStreamInterceptor(auditInterceptor.Stream(), authInterceptor.Stream()),
+	)
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(userStore, jwtManager, service.NewInMemoryRefreshTokenStore(), revokedTokenStore, nil, nil, nil, nil))
+	pb.RegisterAuditServiceServer(grpcServer, service.NewAuditServer(auditLog))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+	auditClient := pb.NewAuditServiceClient(conn)
+
+	_, err = authClient.Login(context.Background(), &pb.LoginRequest{Username: "admin1", Password: "wrong"})
+	require.Error(t, err)
+	adminCtx := loginTestUser(t, authClient, "admin1", "secret")
+	_, err = authClient.ChangePassword(adminCtx, &pb.ChangePasswordRequest{OldPassword: "secret", NewPassword: "password1"})
+	require.NoError(t, err)
+
+	// 修改密码后旧的token失效，不审计的方法也不会记录
+	_, err = authClient.GetProfile(adminCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	adminCtx = loginTestUser(t, authClient, "admin1", "password1")
+
+	// 没有权限和没有认证的调用也会记录
+	userCtx := loginTestUser(t, authClient, "user1", "secret")
+	_, err = authClient.ChangePassword(userCtx, &pb.ChangePasswordRequest{OldPassword: "secret", NewPassword: "password1"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = authClient.ChangePassword(context.Background(), &pb.ChangePasswordRequest{OldPassword: "secret", NewPassword: "password1"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	stream, err := auditClient.QueryAuditLog(adminCtx, &pb.QueryAuditLogRequest{})
+	require.NoError(t, err)
+	var records []*pb.AuditRecord
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		records = append(records, res.GetRecord())
+	}
+	require.Len(t, records, 7)
+
+	// 登录失败的记录只有请求中的用户名，不包含密码
+	require.Equal(t, "/techschool.pcbook.AuthService/Login", records[0].GetMethod())
+	require.Equal(t, codes.NotFound.String(), records[0].GetCode())
+	require.Empty(t, records[0].GetUsername())
+	require.Equal(t, map[string]string{"username": "admin1"}, records[0].GetRequests()[0].GetFields())
+	require.NotEmpty(t, records[0].GetPeer())
+
+	require.Equal(t, "/techschool.pcbook.AuthService/ChangePassword", records[2].GetMethod())
+	require.Equal(t, codes.OK.String(), records[2].GetCode())
+	require.Equal(t, "admin1", records[2].GetUsername())
+	require.Equal(t, "token", records[2].GetAuthMethod())
+	require.Empty(t, records[2].GetRequests()[0].GetFields())
+	require.Equal(t, records[1].GetHash(), records[2].GetPrevHash())
+
+	require.Equal(t, codes.PermissionDenied.String(), records[5].GetCode())
+	require.Equal(t, "user1", records[5].GetUsername())
+	require.Equal(t, codes.Unauthenticated.String(), records[6].GetCode())
+	require.Empty(t, records[6].GetUsername())
+
+	stream, err = auditClient.QueryAuditLog(adminCtx, &pb.QueryAuditLogRequest{Method: "["})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// queryAuditLog returns the sequence numbers of the records that match the filter
+func queryAuditLog(t *testing.T, auditLog *service.FileAuditLog, filter *service.AuditFilter) []int64 {
+	var seqs []int64
+	err := auditLog.Query(context.Background(), filter, func(record *service.AuditRecord) error {
+		seqs = append(seqs, record.Seq)
+		return nil
+	})
+	require.NoError(t, err)
+	return seqs
+}
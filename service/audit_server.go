@@ -0,0 +1,86 @@
+package service
+
+import (
+	"errors"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"path"
+)
+
+// AuditServer is the server to query the audit log
+type AuditServer struct {
+	auditLog AuditLog
+	pb.UnimplementedAuditServiceServer
+}
+
+// NewAuditServer returns a new audit server
+func NewAuditServer(auditLog AuditLog) *AuditServer {
+	return &AuditServer{auditLog: auditLog}
+}
+
+// QueryAuditLog is a server-streaming RPC for admin to find the audit records by time, user and method
+func (server *AuditServer) QueryAuditLog(req *pb.QueryAuditLogRequest, stream pb.AuditService_QueryAuditLogServer) error {
+	filter := &AuditFilter{
+		Username: req.GetUsername(),
+		Method:   req.GetMethod(),
+	}
+	if req.GetFrom() != nil {
+		filter.From = req.GetFrom().AsTime()
+	}
+	if req.GetTo() != nil {
+		filter.To = req.GetTo().AsTime()
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return status.Errorf(codes.InvalidArgument, "from %v must be before to %v", filter.From, filter.To)
+	}
+	if _, err := path.Match(filter.Method, ""); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid method pattern %q: %v", filter.Method, err)
+	}
+
+	err := server.auditLog.Query(stream.Context(), filter, func(record *AuditRecord) error {
+		err := stream.Send(&pb.QueryAuditLogResponse{Record: toAuditRecordProto(record)})
+		if err != nil {
+			return status.Errorf(codes.Unknown, "cannot send stream response: %v", err)
+		}
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	if ctxErr := contextError(stream.Context()); ctxErr != nil {
+		return ctxErr
+	}
+	if errors.Is(err, ErrAuditLogTampered) {
+		return status.Errorf(codes.DataLoss, "cannot query audit log: %v", err)
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Internal, "cannot query audit log: %v", err)
+}
+
+func toAuditRecordProto(record *AuditRecord) *pb.AuditRecord {
+	res := &pb.AuditRecord{
+		Seq:        record.Seq,
+		Time:       timestamppb.New(record.Time),
+		Method:     record.Method,
+		Username:   record.Username,
+		AuthMethod: record.AuthMethod,
+		Peer:       record.Peer,
+		Code:       record.Code,
+		Error:      record.Error,
+		Latency:    durationpb.New(record.Latency),
+		PrevHash:   record.PrevHash,
+		Hash:       record.Hash,
+	}
+	for _, fields := range record.Requests {
+		res.Requests = append(res.Requests, &pb.AuditMessage{Fields: fields})
+	}
+	for _, fields := range record.Responses {
+		res.Responses = append(res.Responses, &pb.AuditMessage{Fields: fields})
+	}
+	return res
+}
@@ -2,21 +2,54 @@ package service
 
 import (
 	"context"
+	"crypto/x509"
+	"github.com/dgrijalva/jwt-go"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
-	"log"
 )
 
+const (
+	// apiKeySubject is the subject of the claims of requests authenticated by API keys
+	apiKeySubject = "api-key"
+	// clientCertSubject is the subject of the claims of requests authenticated by client certificates
+	clientCertSubject = "client-certificate"
+)
+
+// twoFactorSetupMethods can be called by users whose role requires two-factor authentication
+// before they have enrolled, so that they are able to enroll
+var twoFactorSetupMethods = map[string]bool{
+	"/techschool.pcbook.AuthService/Logout":      true,
+	"/techschool.pcbook.AuthService/GetProfile":  true,
+	"/techschool.pcbook.AuthService/EnrollTOTP":  true,
+	"/techschool.pcbook.AuthService/ConfirmTOTP": true,
+}
+
+// ownerCheckedMethods check the owner of the resources they access, so that owner_roles of the policy can be
+// used for them. Owner access to other methods is denied, since nothing would restrict it to the caller's resources
+var ownerCheckedMethods = map[string]bool{
+	"/techschool.pcbook.LaptopService/UpdateLaptop":            true,
+	"/techschool.pcbook.LaptopService/DeleteLaptop":            true,
+	"/techschool.pcbook.LaptopService/TransferLaptopOwnership": true,
+	"/techschool.pcbook.LaptopService/UploadImage":             true,
+	"/techschool.pcbook.LaptopService/DeleteImage":             true,
+}
+
 // AuthInterceptor is a server interceptor for authentication and authorization
 type AuthInterceptor struct {
 	jwtManager *JWTManager
-	accessibleRoles map[string][]string // 存储每个RPC方法与能够访问它的角色：key是RPC方法名字，value是角色切片类型
+	revokedTokenStore RevokedTokenStore
+	apiKeyStore APIKeyStore // 为nil时不接受API key
+	userStore UserStore // 每次调用时检查用户和API key的owner是否仍然有效，以及用户当前的角色
+	policy PolicySource // 决定每个RPC方法能够被哪些角色访问
 }
 
-func NewAuthInterceptor(jwtManager *JWTManager, accessibleRoles map[string][]string) *AuthInterceptor {
-	return &AuthInterceptor{jwtManager,accessibleRoles}
+// NewAuthInterceptor returns a new auth interceptor, apiKeyStore may be nil if API keys are not accepted
+func NewAuthInterceptor(jwtManager *JWTManager, revokedTokenStore RevokedTokenStore, apiKeyStore APIKeyStore, userStore UserStore, policy PolicySource) *AuthInterceptor {
+	return &AuthInterceptor{jwtManager,revokedTokenStore,apiKeyStore,userStore,policy}
 }
 
 // Unary returns a server interceptor function to authentication and authorize unary RPC
@@ -27,10 +60,10 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	)(resp interface{}, err error){
-		log.Println("--> unary interceptor: ", info.FullMethod)
+		logDebugf("--> unary interceptor: %s", info.FullMethod)
 
 		// 验证是否有权限
-		err = interceptor.authorize(ctx, info.FullMethod)
+		ctx, err = interceptor.authorize(ctx, info.FullMethod)
 		if err != nil {
 			return nil, err
 		}
@@ -47,48 +80,270 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 		info *grpc.StreamServerInfo,
 		handler grpc.StreamHandler,
 	) error {
-		log.Println("--> stream interceptor: ",info.FullMethod)
+		logDebugf("--> stream interceptor: %s", info.FullMethod)
 
 		// 验证是否有权限
-		err := interceptor.authorize(stream.Context(), info.FullMethod)
+		ctx, err := interceptor.authorize(stream.Context(), info.FullMethod)
 		if err != nil {
 			return err
 		}
 
-		return handler(srv, stream)
+		return handler(srv, &authServerStream{stream, ctx})
 	}
 }
 
-func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) error {
+// authorize checks the access token of the request, and returns a context carrying the claims
+// and the access level of the caller, the claims are not set if the method is accessible by everyone
+func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) (context.Context, error) {
 	// 拿到该RPC方法所需要的权限
-	accessibleRoles, ok := interceptor.accessibleRoles[method]
-	if !ok {
-		// 权限列表中没有key，则说明任何人都可以访问
-		return nil
+	policy := interceptor.policy.Policy()
+	rule := policy.Rule(method)
+	if rule == nil {
+		if policy.DefaultDeny() {
+			return nil, status.Errorf(codes.PermissionDenied, "method %s is not allowed by the policy", method)
+		}
+		// 策略中没有该方法的规则，并且默认允许，则说明任何人都可以访问
+		return ctx, nil
+	}
+	if rule.Public {
+		return ctx, nil
 	}
 
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok{
-		return status.Errorf(codes.Unauthenticated,"metadata is not provided")
+		return nil, status.Errorf(codes.Unauthenticated,"metadata is not provided")
+	}
+
+	// 服务之间的调用可以使用API key代替access token
+	var claims *UserClaims
+	var roles []string
+	var err error
+	if values := md["x-api-key"]; len(values) > 0 {
+		claims, roles, err = interceptor.verifyAPIKey(values[0], policy)
+	} else if cert := verifiedClientCertificate(ctx); cert != nil && len(md["authorization"]) == 0 {
+		// mTLS的客户端可以不使用token，由证书的subject决定用户和角色
+		claims, err = verifyClientCertificate(cert, policy)
+		if err == nil {
+			_, err = interceptor.findActiveUser(claims.Username)
+		}
+	} else {
+		claims, err = interceptor.verifyAccessToken(md)
+		if err == nil {
+			claims, err = interceptor.checkTokenUser(claims)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 凭证已经验证，即使之后没有权限也要在审计日志中记录调用者
+	setAuditCaller(ctx, claims)
+	if roles == nil {
+		roles = []string{claims.Role}
+	}
+	err = checkTwoFactor(claims, roles, policy, method)
+	if err != nil {
+		return nil, err
 	}
 
+	// 判断用户的角色（包括继承的角色）是否有该权限，有多个角色时取最高的访问级别
+	access := NoAccess
+	for _, role := range roles {
+		if other := policy.Access(rule, role); other > access {
+			access = other
+		}
+	}
+	if access == OwnerAccess && !ownerCheckedMethods[method] {
+		return nil, status.Errorf(codes.PermissionDenied, "method %s does not support owner access", method)
+	}
+	if access != NoAccess {
+		ctx = contextWithClaims(ctx, claims)
+		return context.WithValue(ctx, accessKey{}, access), nil
+	}
+
+	return nil, status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+}
+
+// verifyAccessToken verifies the access token in the authorization header and returns its claims
+func (interceptor *AuthInterceptor) verifyAccessToken(md metadata.MD) (*UserClaims, error) {
 	values := md["authorization"]
 	if len(values) == 0 {
-		return status.Errorf(codes.Unauthenticated,"authorization token is not provided")
+		return nil, status.Errorf(codes.Unauthenticated,"authorization token is not provided")
 	}
 
 	accessToken := values[0]
 	claims, err := interceptor.jwtManager.Verify(accessToken)
 	if err != nil {
-		return status.Errorf(codes.Unauthenticated,"access token is invalid: %v" ,err)
+		return nil, status.Errorf(codes.Unauthenticated,"access token is invalid: %v" ,err)
+	}
+
+	// 检查token是否已经被吊销（注销或refresh token被盗用）
+	revoked, err := interceptor.revokedTokenStore.IsRevoked(claims.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot check access token: %v", err)
+	}
+	if revoked {
+		return nil, status.Errorf(codes.Unauthenticated, "access token is revoked")
+	}
+	return claims, nil
+}
+
+// checkTokenUser checks that the user of the access token still exists and is not disabled, and returns a copy
+// of the claims with the current role of the user, so that changes of the user take effect before the token expires
+func (interceptor *AuthInterceptor) checkTokenUser(claims *UserClaims) (*UserClaims, error) {
+	user, err := interceptor.findActiveUser(claims.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	other := *claims
+	other.Role = user.Role
+	return &other, nil
+}
+
+// findActiveUser finds the user that a credential acts as, and returns an error if the user is not found or disabled
+func (interceptor *AuthInterceptor) findActiveUser(username string) (*User, error) {
+	user, err := interceptor.userStore.Find(username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user %s is not found", username)
+	}
+	if user.Disabled {
+		return nil, status.Errorf(codes.PermissionDenied, "user %s is disabled", username)
+	}
+	return user, nil
+}
+
+// checkTwoFactor checks that the caller has passed two-factor authentication if the policy requires it for any of the roles.
+// API keys and client certificates cannot pass two-factor authentication, so they cannot use such roles
+func checkTwoFactor(claims *UserClaims, roles []string, policy *Policy, method string) error {
+	for _, role := range roles {
+		if !policy.RequiresTwoFactor(role) {
+			continue
+		}
+		if claims.Subject == apiKeySubject || claims.Subject == clientCertSubject {
+			return status.Errorf(codes.PermissionDenied, "role %s requires two-factor authentication, which API keys and client certificates cannot provide", role)
+		}
+		if claims.HasAuthMethod(AuthMethodOTP) || claims.HasAuthMethod(AuthMethodMFA) || twoFactorSetupMethods[method] {
+			continue
+		}
+		return status.Errorf(codes.PermissionDenied, "role %s requires two-factor authentication, enable it with EnrollTOTP and login again", role)
+	}
+	return nil
+}
+
+// verifyAPIKey verifies the API key and returns the claims of its owner with the roles of the key.
+// The owner is checked on every call, and the roles are limited to those of the owner's current role,
+// so that disabling or demoting the owner also takes effect on the keys
+func (interceptor *AuthInterceptor) verifyAPIKey(key string, policy *Policy) (*UserClaims, []string, error) {
+	if interceptor.apiKeyStore == nil {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "api key is not accepted")
+	}
+
+	apiKey, err := interceptor.apiKeyStore.FindByHash(HashAPIKey(key))
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "cannot find api key: %v", err)
+	}
+	if apiKey == nil || !apiKey.IsValid() {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "api key is invalid")
+	}
+
+	owner, err := interceptor.findActiveUser(apiKey.Owner)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// 遍历所需权限，判断用户是否有该权限
-	for _, role := range accessibleRoles {
-		if role == claims.Role {
-			return nil
+	// API key的角色由key本身决定，而不是owner的角色，但不能超过owner当前的角色
+	roles := make([]string, 0, len(apiKey.Roles))
+	for _, role := range apiKey.Roles {
+		if policy.Grants(owner.Role, role) {
+			roles = append(roles, role)
 		}
 	}
+	claims := &UserClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        apiKey.ID,
+			Subject:   apiKeySubject,
+			ExpiresAt: apiKey.ExpiresAt.Unix(),
+		},
+		Username: apiKey.Owner,
+	}
+	return claims, roles, nil
+}
+
+// verifiedClientCertificate returns the client certificate verified in the TLS handshake,
+// or nil if the connection is not mTLS
+func verifiedClientCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+// verifyClientCertificate returns the claims of the user that the policy maps the client certificate to,
+// the caller checks that the user exists and is not disabled
+func verifyClientCertificate(cert *x509.Certificate, policy *Policy) (*UserClaims, error) {
+	identity := policy.ClientCertIdentity(cert.Subject.CommonName)
+	if identity == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "client certificate %q is not mapped to a user", cert.Subject.CommonName)
+	}
+
+	claims := &UserClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   clientCertSubject,
+			ExpiresAt: cert.NotAfter.Unix(),
+		},
+		Username: identity.Username,
+		Role:     identity.Role,
+	}
+	return claims, nil
+}
+
+// authServerStream wraps a server stream to carry the context with the caller's claims
+type authServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *authServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+type claimsKey struct{}
+
+// contextWithClaims returns a copy of ctx that carries the claims of the caller
+func contextWithClaims(ctx context.Context, claims *UserClaims) context.Context {
+	if claims == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+type accessKey struct{}
+
+// authorizeOwner checks if the caller can access the resource of the owner,
+// callers that are not restricted to their own resources can access any resource
+func authorizeOwner(ctx context.Context, owner string) error {
+	access, ok := ctx.Value(accessKey{}).(Access)
+	if !ok || access != OwnerAccess {
+		return nil
+	}
+
+	claims := ClaimsFromContext(ctx)
+	if claims == nil || claims.Username != owner {
+		return status.Errorf(codes.PermissionDenied, "no permission to access the resource of other users")
+	}
+	return nil
+}
 
-	return status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+// ClaimsFromContext returns the claims of the authenticated caller, or nil if the caller is not authenticated
+func ClaimsFromContext(ctx context.Context) *UserClaims {
+	claims, _ := ctx.Value(claimsKey{}).(*UserClaims)
+	return claims
 }
\ No newline at end of file
@@ -2,44 +2,1013 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
 //AuthServer is the server for authentication
 type AuthServer struct {
 	userStore UserStore
 	jwtManager *JWTManager
+	refreshTokenStore RefreshTokenStore
+	revokedTokenStore RevokedTokenStore
+	apiKeyStore APIKeyStore
+	loginLimiter *LoginLimiter // 为nil时不限制登录失败次数
+	passwordHasher PasswordHasher // 新密码使用的hash算法，登录时把较弱的hash升级为该算法
+	oidcVerifier *OIDCVerifier // 为nil时不能通过OpenID Connect登录
+	trustedProxies []*net.IPNet // 信任这些代理（例如REST网关）转发的客户端IP
+	policy PolicySource // 定义了哪些角色，为nil时不能设置角色
+	oidcMutex sync.Mutex // 串行创建和更新OpenID Connect用户
+	dummyPasswordOnce sync.Once
+	dummyPasswordHash string
+	twoFactorMutex sync.Mutex // 串行检查和吊销challenge token，避免同一个challenge token被并发使用两次
 	pb.UnimplementedAuthServiceServer
 }
 
 // Login is a unary RPC to login user
 func (server *AuthServer) Login(ctx context.Context,req *pb.LoginRequest) (*pb.LoginResponse, error) {
 	username := req.GetUsername()
+	ip := server.clientIP(ctx)
+	if server.loginLimiter != nil {
+		if wait := server.loginLimiter.Allow(username, ip); wait > 0 {
+			return nil, tooManyLoginFailures(wait)
+		}
+	}
+
 	user, err := server.userStore.Find(username)
 	if err != nil {
+		if server.loginLimiter != nil {
+			server.loginLimiter.Release(username, ip)
+		}
 		return nil, status.Errorf(codes.Internal, "cannot find user: %v",err)
 	}
+	if user == nil {
+		// 不存在的用户也做一次同样耗时的密码比较，避免通过响应时间判断用户是否存在
+		server.compareDummyPassword(req.GetPassword())
+	}
 	if user == nil || !user.IsCorrectPassword(req.GetPassword()){
+		if server.loginLimiter != nil {
+			if wait := server.loginLimiter.Fail(username, ip); wait > 0 {
+				logInfof("too many failed logins for user %s from %s, locked out for %v", username, ip, wait)
+			}
+		}
 		return nil, status.Errorf(codes.NotFound,"incorrect username/password")
 	}
+	// 启用两步验证时，验证码正确后才清除失败记录，避免知道密码的人通过重新登录不断猜验证码
+	if server.loginLimiter != nil {
+		if user.TOTPEnabled {
+			server.loginLimiter.Release(username, ip)
+		} else {
+			server.loginLimiter.Succeed(username, ip)
+		}
+	}
+	// 密码正确后再检查是否被禁用，避免泄露用户的状态
+	if user.Disabled {
+		return nil, status.Errorf(codes.PermissionDenied, "user is disabled")
+	}
+
+	// 只有登录时才知道密码原文，顺便把旧算法或者较弱参数的hash升级
+	hashedPassword := user.HashedPassword
+	rehashed := server.rehashPassword(user, req.GetPassword())
+	if rehashed != "" || !user.TOTPEnabled {
+		now := time.Now()
+		user, err = server.updateUser(username, func(user *User) error {
+			// 比较密码期间用户可能被禁用或者修改了密码
+			if user.Disabled {
+				return status.Errorf(codes.PermissionDenied, "user is disabled")
+			}
+			if rehashed != "" && user.HashedPassword == hashedPassword {
+				user.HashedPassword = rehashed
+			}
+			if !user.TOTPEnabled {
+				user.LastLoginAt = now
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if user.TOTPEnabled {
+		challengeToken, err := server.jwtManager.GenerateChallenge(user, AuthMethodPassword)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot generate challenge token: %v", err)
+		}
+
+		res := &pb.LoginResponse{TwoFactorRequired: true, ChallengeToken: challengeToken}
+		return res, nil
+	}
 
-	token, err := server.jwtManager.Generate(user)
+	accessToken, refreshToken, err := server.startTokenFamily(user, []string{AuthMethodPassword})
 	if err != nil {
-		return nil, status.Errorf(codes.Internal,"cannot generate access token: %v",err)
+		return nil, err
 	}
 
-	res := &pb.LoginResponse{AccessToken:token}
+	res := &pb.LoginResponse{AccessToken:accessToken, RefreshToken: refreshToken}
 	return res,nil
 }
 
-// NewAuthServer creates a new auth server
-func NewAuthServer(userStore UserStore, jwtManager *JWTManager) *AuthServer {
+// LoginWithOIDC is a unary RPC to login with an ID token of the OpenID Connect provider, the local user
+// is created on the first login, and its role follows the claims of the token on each login
+func (server *AuthServer) LoginWithOIDC(ctx context.Context, req *pb.LoginWithOIDCRequest) (*pb.LoginWithOIDCResponse, error) {
+	if server.oidcVerifier == nil {
+		return nil, status.Errorf(codes.Unimplemented, "OpenID Connect login is not enabled")
+	}
+
+	identity, err := server.oidcVerifier.Verify(ctx, req.GetIdToken(), req.GetNonce())
+	if err != nil {
+		code := codes.Unauthenticated
+		if errors.Is(err, ErrOIDCProviderUnavailable) {
+			code = codes.Unavailable
+		} else if errors.Is(err, ErrOIDCUserNotMapped) {
+			code = codes.PermissionDenied
+		}
+		return nil, status.Errorf(code, "cannot verify ID token: %v", err)
+	}
+
+	user, err := server.saveOIDCUser(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	// provider已经进行了多因素认证时不再要求本地的TOTP验证码
+	authMethods := []string{AuthMethodOIDC}
+	if identity.MFA {
+		authMethods = append(authMethods, AuthMethodMFA)
+	}
+	if user.TOTPEnabled && !identity.MFA {
+		challengeToken, err := server.jwtManager.GenerateChallenge(user, authMethods...)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot generate challenge token: %v", err)
+		}
+
+		res := &pb.LoginWithOIDCResponse{TwoFactorRequired: true, ChallengeToken: challengeToken}
+		return res, nil
+	}
+
+	accessToken, refreshToken, err := server.startTokenFamily(user, authMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.LoginWithOIDCResponse{AccessToken: accessToken, RefreshToken: refreshToken}
+	return res, nil
+}
+
+// saveOIDCUser creates the user of the identity or updates its role, and returns the saved user.
+// A local user with the same name that is not linked to the identity cannot be taken over
+func (server *AuthServer) saveOIDCUser(identity *OIDCIdentity) (*User, error) {
+	server.oidcMutex.Lock()
+	defer server.oidcMutex.Unlock()
+
+	user, err := server.userStore.Find(identity.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+
+	if user == nil {
+		user = &User{
+			Username:    identity.Username,
+			Role:        identity.Role,
+			OIDCSubject: identity.Subject,
+			CreatedAt:   time.Now(),
+			LastLoginAt: time.Now(),
+		}
+		err = server.userStore.Save(user)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot save user: %v", err)
+		}
+		logInfof("created user %s with role %s for %s", user.Username, user.Role, user.OIDCSubject)
+		return user, nil
+	}
+
+	return server.updateUser(identity.Username, func(user *User) error {
+		if user.OIDCSubject != identity.Subject {
+			return status.Errorf(codes.PermissionDenied, "user %s is not linked to the OpenID Connect account", user.Username)
+		}
+		if user.Disabled {
+			return status.Errorf(codes.PermissionDenied, "user is disabled")
+		}
+
+		if user.Role != identity.Role {
+			logInfof("change role of user %s from %s to %s by OpenID Connect claims", user.Username, user.Role, identity.Role)
+			user.Role = identity.Role
+		}
+		if !user.TOTPEnabled || identity.MFA {
+			user.LastLoginAt = time.Now()
+		}
+		return nil
+	})
+}
+
+// VerifyTwoFactor is a unary RPC to complete the login of a user with two-factor authentication,
+// it exchanges the challenge token returned by Login and a TOTP code or a recovery code for the tokens
+func (server *AuthServer) VerifyTwoFactor(ctx context.Context, req *pb.VerifyTwoFactorRequest) (*pb.VerifyTwoFactorResponse, error) {
+	claims, err := server.jwtManager.VerifyChallenge(req.GetChallengeToken())
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "challenge token is invalid: %v", err)
+	}
+
+	// 验证码只有6位，和密码共用登录失败次数的限制；Allow在比较验证码之前就计入一次失败，并发的猜测也不能超过限制
+	username := claims.Username
+	ip := server.clientIP(ctx)
+	if server.loginLimiter != nil {
+		if wait := server.loginLimiter.Allow(username, ip); wait > 0 {
+			return nil, tooManyLoginFailures(wait)
+		}
+	}
+
+	server.twoFactorMutex.Lock()
+	defer server.twoFactorMutex.Unlock()
+
+	// challenge token验证成功后就被吊销，不能再换取新的token
+	revoked, err := server.revokedTokenStore.IsRevoked(claims.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot check challenge token: %v", err)
+	}
+	if revoked {
+		return nil, status.Errorf(codes.Unauthenticated, "challenge token is already used")
+	}
+
+	now := time.Now()
+	incorrectCode := false
+	user, err := server.updateUser(username, func(user *User) error {
+		if user.Disabled {
+			return status.Errorf(codes.PermissionDenied, "user is disabled")
+		}
+		if !user.TOTPEnabled {
+			return status.Errorf(codes.FailedPrecondition, "two-factor authentication is not enabled")
+		}
+
+		// 保存已经使用的验证码时间窗口和剩余的恢复码
+		if !user.VerifyTOTPCode(req.GetCode(), now) && !user.UseRecoveryCode(req.GetCode()) {
+			incorrectCode = true
+			return status.Errorf(codes.Unauthenticated, "incorrect two-factor code")
+		}
+		user.LastLoginAt = now
+		return nil
+	})
+	if incorrectCode && server.loginLimiter != nil {
+		if wait := server.loginLimiter.Fail(username, ip); wait > 0 {
+			logInfof("too many failed two-factor codes for user %s from %s, locked out for %v", username, ip, wait)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if server.loginLimiter != nil {
+		server.loginLimiter.Succeed(username, ip)
+	}
+
+	err = server.revokedTokenStore.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke challenge token: %v", err)
+	}
+
+	// 第一步的认证方式来自challenge token，可能是密码或者OpenID Connect
+	authMethods := append(append([]string(nil), claims.AuthMethods...), AuthMethodOTP)
+	accessToken, refreshToken, err := server.startTokenFamily(user, authMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.VerifyTwoFactorResponse{AccessToken: accessToken, RefreshToken: refreshToken}
+	return res, nil
+}
+
+// RefreshToken is a unary RPC to exchange a refresh token for a new access token and a new refresh token,
+// reusing a refresh token revokes its whole token family
+func (server *AuthServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	tokenID := HashRefreshToken(req.GetRefreshToken())
+	token, err := server.refreshTokenStore.Find(tokenID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find refresh token: %v", err)
+	}
+	if token == nil || time.Now().After(token.ExpiresAt) {
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token is invalid")
+	}
+
+	ok, err := server.refreshTokenStore.MarkUsed(tokenID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot use refresh token: %v", err)
+	}
+	if !ok {
+		// refresh token已经用过，可能被盗用了，吊销整个family，合法用户需要重新登录
+		logInfof("refresh token reuse detected for user %s, revoking token family %s", token.Username, token.FamilyID)
+		if err := server.revokeFamily(token.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token is already used")
+	}
+
+	user, err := server.userStore.Find(token.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil || user.Disabled {
+		if err := server.revokeFamily(token.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "user is disabled")
+	}
+
+	accessToken, refreshToken, err := server.issueTokens(user, token.FamilyID, token.AuthMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.RefreshTokenResponse{AccessToken: accessToken, RefreshToken: refreshToken}
+	return res, nil
+}
+
+// Logout is a unary RPC to revoke the access token of the caller and the token family of the refresh token
+func (server *AuthServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	err := checkTokenCaller(claims, "logout")
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.revokedTokenStore.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot revoke access token: %v", err)
+	}
+
+	if req.GetRefreshToken() != "" {
+		token, err := server.refreshTokenStore.Find(HashRefreshToken(req.GetRefreshToken()))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot find refresh token: %v", err)
+		}
+		// 只能注销自己的refresh token
+		if token != nil && token.Username == claims.Username {
+			if err := server.revokeFamily(token.FamilyID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &pb.LogoutResponse{}, nil
+}
+
+// startTokenFamily issues the tokens of a new login, each login starts a new refresh token family
+func (server *AuthServer) startTokenFamily(user *User, authMethods []string) (string, string, error) {
+	familyID, err := uuid.NewRandom()
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "cannot generate token family: %v", err)
+	}
+
+	return server.issueTokens(user, familyID.String(), authMethods)
+}
+
+// issueTokens generates a new access token and a new refresh token of the family for user
+// who logged in with the authentication methods
+func (server *AuthServer) issueTokens(user *User, familyID string, authMethods []string) (string, string, error) {
+	accessToken, claims, err := server.jwtManager.Generate(user, authMethods...)
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal,"cannot generate access token: %v",err)
+	}
+
+	refreshToken, token, err := server.jwtManager.GenerateRefreshToken(user.Username, familyID, claims.Id, authMethods)
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "cannot generate refresh token: %v", err)
+	}
+
+	err = server.refreshTokenStore.Save(token)
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "cannot save refresh token: %v", err)
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// revokeFamily removes all refresh tokens of the family and revokes the access tokens issued with them
+func (server *AuthServer) revokeFamily(familyID string) error {
+	tokens, err := server.refreshTokenStore.RemoveFamily(familyID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot remove token family: %v", err)
+	}
+	return server.revokeAccessTokens(tokens)
+}
+
+// revokeUserTokens removes the refresh tokens of all token families of the user and revokes the access tokens
+// issued with them, so that the user has to login again
+func (server *AuthServer) revokeUserTokens(username string) error {
+	tokens, err := server.refreshTokenStore.RemoveUser(username)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot remove user tokens: %v", err)
+	}
+	return server.revokeAccessTokens(tokens)
+}
+
+// revokeAccessTokens revokes the access tokens issued with the refresh tokens
+func (server *AuthServer) revokeAccessTokens(tokens []*RefreshToken) error {
+	for _, token := range tokens {
+		// access token的有效期比refresh token短，用refresh token的过期时间作为上限
+		err := server.revokedTokenStore.Revoke(token.AccessTokenID, token.ExpiresAt)
+		if err != nil {
+			return status.Errorf(codes.Internal, "cannot revoke access token: %v", err)
+		}
+	}
+	return nil
+}
+
+// Register is a unary RPC to create a new user with the user role
+func (server *AuthServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	username := req.GetUsername()
+	err := ValidateUsername(username)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid username: %v", err)
+	}
+
+	err = ValidatePassword(username, req.GetPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid password: %v", err)
+	}
+
+	user, err := NewUserWithHasher(server.passwordHasher, username, req.GetPassword(), RoleUser)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create user: %v", err)
+	}
+
+	err = server.userStore.Save(user)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExists) {
+			code = codes.AlreadyExists
+		}
+		return nil, status.Errorf(code, "cannot save user: %v", err)
+	}
+
+	res := &pb.RegisterResponse{User: toUserProfile(user)}
+	return res, nil
+}
+
+// ChangePassword is a unary RPC to change the password of the caller
+func (server *AuthServer) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	user, err := server.findCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user.OIDCSubject != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "user %s logs in with OpenID Connect and has no password", user.Username)
+	}
+
+	if !user.IsCorrectPassword(req.GetOldPassword()) {
+		return nil, status.Errorf(codes.InvalidArgument, "incorrect old password")
+	}
+
+	err = ValidatePassword(user.Username, req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid password: %v", err)
+	}
+
+	hashedPassword, err := server.passwordHasher.Hash(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot hash password: %v", err)
+	}
+
+	_, err = server.updateUser(user.Username, func(current *User) error {
+		// 比较旧密码期间密码被修改过时，旧密码不一定还是正确的
+		if current.HashedPassword != user.HashedPassword {
+			return status.Errorf(codes.Aborted, "password is changed by another request, try again")
+		}
+		current.HashedPassword = hashedPassword
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+// GetProfile is a unary RPC to get the profile of the caller
+func (server *AuthServer) GetProfile(ctx context.Context, req *pb.GetProfileRequest) (*pb.GetProfileResponse, error) {
+	user, err := server.findCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.GetProfileResponse{User: toUserProfile(user)}
+	return res, nil
+}
+
+// EnrollTOTP is a unary RPC to start enabling two-factor authentication for the caller,
+// the returned secret is only used to login after it is confirmed with ConfirmTOTP
+func (server *AuthServer) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	err := checkTokenCaller(claims, "enroll two-factor authentication")
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate totp secret: %v", err)
+	}
+
+	user, err := server.updateUser(claims.Username, func(user *User) error {
+		if user.TOTPEnabled {
+			return status.Errorf(codes.FailedPrecondition, "two-factor authentication is already enabled")
+		}
+
+		// 重新enroll会替换掉还没有确认的secret
+		user.TOTPSecret = secret
+		user.TOTPLastCounter = 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.EnrollTOTPResponse{
+		Secret:          secret,
+		ProvisioningUri: TOTPProvisioningURI(totpIssuer, user.Username, secret),
+	}
+	return res, nil
+}
+
+// ConfirmTOTP is a unary RPC to enable two-factor authentication for the caller with a code of the enrolled secret,
+// it returns the recovery codes, which are never returned again. The caller has to login again to get a token
+// that has passed two-factor authentication
+func (server *AuthServer) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	err := checkTokenCaller(claims, "enroll two-factor authentication")
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, hashes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate recovery codes: %v", err)
+	}
+
+	now := time.Now()
+	_, err = server.updateUser(claims.Username, func(user *User) error {
+		if user.TOTPEnabled {
+			return status.Errorf(codes.FailedPrecondition, "two-factor authentication is already enabled")
+		}
+		if user.TOTPSecret == "" {
+			return status.Errorf(codes.FailedPrecondition, "two-factor authentication is not enrolled, call EnrollTOTP first")
+		}
+
+		if !user.VerifyTOTPCode(req.GetCode(), now) {
+			return status.Errorf(codes.InvalidArgument, "incorrect totp code")
+		}
+
+		user.TOTPEnabled = true
+		user.RecoveryCodeHashes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}
+	return res, nil
+}
+
+// ListUsers is a unary RPC for admin to list all users
+func (server *AuthServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	users, err := server.userStore.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list users: %v", err)
+	}
+
+	res := &pb.ListUsersResponse{}
+	for _, user := range users {
+		res.Users = append(res.Users, toUserProfile(user))
+	}
+	return res, nil
+}
+
+// SetUserRole is a unary RPC for admin to change the role of a user
+func (server *AuthServer) SetUserRole(ctx context.Context, req *pb.SetUserRoleRequest) (*pb.SetUserRoleResponse, error) {
+	err := server.validateRole(req.GetRole())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid role: %v", err)
+	}
+
+	err = checkOtherUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	user, err := server.updateUser(req.GetUsername(), func(user *User) error {
+		changed = user.Role != req.GetRole()
+		user.Role = req.GetRole()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 已经签发的token带有旧的角色，需要重新登录
+	if changed {
+		err = server.revokeUserTokens(user.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &pb.SetUserRoleResponse{User: toUserProfile(user)}
+	return res, nil
+}
+
+// DisableUser is a unary RPC for admin to disable or re-enable a user
+func (server *AuthServer) DisableUser(ctx context.Context, req *pb.DisableUserRequest) (*pb.DisableUserResponse, error) {
+	err := checkOtherUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := server.updateUser(req.GetUsername(), func(user *User) error {
+		user.Disabled = req.GetDisabled()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		err = server.revokeUserTokens(user.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &pb.DisableUserResponse{User: toUserProfile(user)}
+	return res, nil
+}
+
+// CreateAPIKey is a unary RPC for admin to create an API key with scoped roles,
+// requests with the key act as the admin but can only use the roles of the key
+func (server *AuthServer) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+	// API key不能创建新的API key，否则泄露的key可以一直延续下去
+	err := checkTokenCaller(ClaimsFromContext(ctx), "create api keys")
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := server.findCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "api key name is required")
+	}
+	if len(req.GetRoles()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "api key must have at least one role")
+	}
+	for _, role := range req.GetRoles() {
+		err := server.validateRole(role)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid role: %v", err)
+		}
+	}
+
+	if req.GetExpiresAt() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "api key expiry is required")
+	}
+	expiresAt := req.GetExpiresAt().AsTime()
+	if !expiresAt.After(time.Now()) {
+		return nil, status.Errorf(codes.InvalidArgument, "api key expiry %v is in the past", expiresAt)
+	}
+
+	key, apiKey, err := GenerateAPIKey(req.GetName(), owner.Username, req.GetRoles(), expiresAt)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate api key: %v", err)
+	}
+
+	err = server.apiKeyStore.Save(apiKey)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save api key: %v", err)
+	}
+
+	res := &pb.CreateAPIKeyResponse{Key: key, ApiKey: toAPIKeyInfo(apiKey)}
+	return res, nil
+}
+
+// ListAPIKeys is a unary RPC for admin to list all API keys, the keys themselves are never returned
+func (server *AuthServer) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	apiKeys, err := server.apiKeyStore.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list api keys: %v", err)
+	}
+
+	res := &pb.ListAPIKeysResponse{}
+	for _, apiKey := range apiKeys {
+		res.ApiKeys = append(res.ApiKeys, toAPIKeyInfo(apiKey))
+	}
+	return res, nil
+}
+
+// RevokeAPIKey is a unary RPC for admin to revoke an API key
+func (server *AuthServer) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.RevokeAPIKeyResponse, error) {
+	apiKey, err := server.apiKeyStore.Revoke(req.GetId())
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+		return nil, status.Errorf(code, "cannot revoke api key: %v", err)
+	}
+
+	res := &pb.RevokeAPIKeyResponse{ApiKey: toAPIKeyInfo(apiKey)}
+	return res, nil
+}
+
+// UnlockUser is a unary RPC for admin to remove the lockout of a user after too many failed logins
+func (server *AuthServer) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	user, err := server.userStore.Find(req.GetUsername())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil {
+		return nil, status.Errorf(codes.NotFound, "user %s is not found", req.GetUsername())
+	}
+
+	res := &pb.UnlockUserResponse{}
+	if server.loginLimiter != nil {
+		res.WasLocked = server.loginLimiter.Unlock(user.Username)
+	}
+	return res, nil
+}
+
+// ResetTwoFactor is a unary RPC for admin to disable two-factor authentication of a user
+// who has lost both the TOTP device and the recovery codes
+func (server *AuthServer) ResetTwoFactor(ctx context.Context, req *pb.ResetTwoFactorRequest) (*pb.ResetTwoFactorResponse, error) {
+	err := checkOtherUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := server.updateUser(req.GetUsername(), func(user *User) error {
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
+		user.TOTPLastCounter = 0
+		user.RecoveryCodeHashes = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ResetTwoFactorResponse{User: toUserProfile(user)}
+	return res, nil
+}
+
+// findCaller returns the user who calls the RPC
+func (server *AuthServer) findCaller(ctx context.Context) (*User, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+
+	user, err := server.userStore.Find(claims.Username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+	if user == nil {
+		return nil, status.Errorf(codes.NotFound, "user %s is not found", claims.Username)
+	}
+	return user, nil
+}
+
+// validateRole checks if the role is defined in the current policy
+func (server *AuthServer) validateRole(role string) error {
+	if server.policy == nil {
+		return fmt.Errorf("no policy defines role %q", role)
+	}
+	return server.policy.Policy().ValidateRole(role)
+}
+
+// checkOtherUser checks that the user managed by an admin is not the admin, admins cannot manage themselves to avoid locking out
+func checkOtherUser(ctx context.Context, username string) error {
+	claims := ClaimsFromContext(ctx)
+	if claims != nil && claims.Username == username {
+		return status.Errorf(codes.FailedPrecondition, "cannot manage your own account")
+	}
+	return nil
+}
+
+// updateUser changes the user with the update function in the store and returns the updated user,
+// the status errors returned by the function are returned as they are
+func (server *AuthServer) updateUser(username string, update func(user *User) error) (*User, error) {
+	user, err := server.userStore.Update(username, update)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		if errors.Is(err, ErrNotFound) {
+			return nil, status.Errorf(codes.NotFound, "user %s is not found", username)
+		}
+		return nil, status.Errorf(codes.Internal, "cannot update user: %v", err)
+	}
+	return user, nil
+}
+
+// rehashPassword returns a new hash of the password if the hash of the user is weaker than the hasher,
+// or an empty string if the hash does not need to be upgraded
+func (server *AuthServer) rehashPassword(user *User, password string) string {
+	if !server.passwordHasher.NeedsRehash(user.HashedPassword) {
+		return ""
+	}
+
+	hashedPassword, err := server.passwordHasher.Hash(password)
+	if err != nil {
+		// 升级失败不影响登录，下次登录再试
+		logErrorf("cannot rehash password of user %s: %v", user.Username, err)
+		return ""
+	}
+	return hashedPassword
+}
+
+// compareDummyPassword takes as long as checking the password of a user, it is used for unknown users
+// so that the response time does not reveal which usernames exist
+func (server *AuthServer) compareDummyPassword(password string) {
+	server.dummyPasswordOnce.Do(func() {
+		// 生成失败时hash为空，比较会立即返回，只是失去了时间上的保护
+		server.dummyPasswordHash, _ = server.passwordHasher.Hash("dummy password")
+	})
+	CheckPassword(server.dummyPasswordHash, password)
+}
+
+// checkTokenCaller checks that the caller logged in with a token, rather than an API key or a client certificate
+func checkTokenCaller(claims *UserClaims, action string) error {
+	if claims == nil {
+		return status.Errorf(codes.Unauthenticated, "user is not authenticated")
+	}
+	if claims.Subject == apiKeySubject || claims.Subject == clientCertSubject {
+		return status.Errorf(codes.FailedPrecondition, "only users logged in with a token can %s", action)
+	}
+	return nil
+}
+
+func toUserProfile(user *User) *pb.UserProfile {
+	profile := &pb.UserProfile{
+		Username:         user.Username,
+		Role:             user.Role,
+		Disabled:         user.Disabled,
+		TwoFactorEnabled: user.TOTPEnabled,
+		OidcLinked:       user.OIDCSubject != "",
+		CreatedAt:        timestamppb.New(user.CreatedAt),
+	}
+	if !user.LastLoginAt.IsZero() {
+		profile.LastLoginAt = timestamppb.New(user.LastLoginAt)
+	}
+	return profile
+}
+
+// tooManyLoginFailures returns a ResourceExhausted error with the time to wait before the next login
+func tooManyLoginFailures(wait time.Duration) error {
+	st := status.Newf(codes.ResourceExhausted, "too many failed login attempts, retry after %v", wait.Round(time.Second))
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// SetPolicy sets the access policy whose roles can be given to users and API keys,
+// it should be the same policy source as the auth interceptor so that reloaded roles take effect
+func (server *AuthServer) SetPolicy(policy PolicySource) {
+	server.policy = policy
+}
+
+// SetTrustedProxies sets the proxies, such as the REST gateway, whose x-forwarded-for metadata is trusted
+// as the IP address of the client to limit failed logins. The metadata of other peers is ignored
+func (server *AuthServer) SetTrustedProxies(proxies []*net.IPNet) {
+	server.trustedProxies = proxies
+}
+
+// clientIP returns the IP address of the client, or empty if it is unknown. For the calls of a trusted proxy,
+// it is the last address of x-forwarded-for, which is the address that the proxy sees
+func (server *AuthServer) clientIP(ctx context.Context) string {
+	ip := peerIP(ctx)
+	if ip == "" || !server.isTrustedProxy(ip) {
+		return ip
+	}
+
+	// 前面的地址由HTTP客户端提供，可以伪造
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("x-forwarded-for")
+	if len(values) == 0 {
+		return ip
+	}
+	addresses := strings.Split(values[len(values)-1], ",")
+	if forwarded := strings.TrimSpace(addresses[len(addresses)-1]); forwarded != "" {
+		return forwarded
+	}
+	return ip
+}
+
+func (server *AuthServer) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, proxy := range server.trustedProxies {
+		if parsed != nil && proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP address of the peer, or empty if it is unknown
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and CIDR ranges
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, proxy, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q: %w", item, err)
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+func toAPIKeyInfo(apiKey *APIKey) *pb.APIKey {
+	return &pb.APIKey{
+		Id:        apiKey.ID,
+		Name:      apiKey.Name,
+		Owner:     apiKey.Owner,
+		Roles:     apiKey.Roles,
+		CreatedAt: timestamppb.New(apiKey.CreatedAt),
+		ExpiresAt: timestamppb.New(apiKey.ExpiresAt),
+		Revoked:   apiKey.Revoked,
+	}
+}
+
+// NewAuthServer creates a new auth server, loginLimiter may be nil to allow unlimited login attempts,
+// passwordHasher may be nil to use the default hasher, and oidcVerifier may be nil to disable OpenID Connect login
+func NewAuthServer(
+	userStore UserStore,
+	jwtManager *JWTManager,
+	refreshTokenStore RefreshTokenStore,
+	revokedTokenStore RevokedTokenStore,
+	apiKeyStore APIKeyStore,
+	loginLimiter *LoginLimiter,
+	passwordHasher PasswordHasher,
+	oidcVerifier *OIDCVerifier,
+) *AuthServer {
+	if passwordHasher == nil {
+		passwordHasher = DefaultPasswordHasher()
+	}
 	return &AuthServer{
 		userStore:                      userStore,
 		jwtManager:                     jwtManager,
+		refreshTokenStore:              refreshTokenStore,
+		revokedTokenStore:              revokedTokenStore,
+		apiKeyStore:                    apiKeyStore,
+		loginLimiter:                   loginLimiter,
+		passwordHasher:                 passwordHasher,
+		oidcVerifier:                   oidcVerifier,
 	}
 }
-
-
@@ -0,0 +1,802 @@
+package service_test
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/Ruadgedy/pcbook-go/tlsconfig"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthServerAccountManagement(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	admin, err := service.NewUser("admin1", "secret", service.RoleAdmin)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin))
+
+	serverAddress := startTestAuthServer(t, userStore)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+	ctx := context.Background()
+
+	_, err = authClient.Register(ctx, &pb.RegisterRequest{Username: "Bob", Password: "password1"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = authClient.Register(ctx, &pb.RegisterRequest{Username: "bob", Password: "short1"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	res, err := authClient.Register(ctx, &pb.RegisterRequest{Username: "bob", Password: "password1"})
+	require.NoError(t, err)
+	require.Equal(t, service.RoleUser, res.GetUser().GetRole())
+
+	_, err = authClient.Register(ctx, &pb.RegisterRequest{Username: "bob", Password: "password2"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	bobCtx := loginTestUser(t, authClient, "bob", "password1")
+	profile, err := authClient.GetProfile(bobCtx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "bob", profile.GetUser().GetUsername())
+
+	_, err = authClient.ChangePassword(bobCtx, &pb.ChangePasswordRequest{OldPassword: "wrong", NewPassword: "password2"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = authClient.ChangePassword(bobCtx, &pb.ChangePasswordRequest{OldPassword: "password1", NewPassword: "password2"})
+	require.NoError(t, err)
+
+	_, err = authClient.ListUsers(bobCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	adminCtx := loginTestUser(t, authClient, "admin1", "secret")
+	users, err := authClient.ListUsers(adminCtx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+	require.Len(t, users.GetUsers(), 2)
+
+	_, err = authClient.DisableUser(adminCtx, &pb.DisableUserRequest{Username: "admin1", Disabled: true})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	login, err := authClient.Login(ctx, &pb.LoginRequest{Username: "bob", Password: "password2"})
+	require.NoError(t, err)
+	_, err = authClient.DisableUser(adminCtx, &pb.DisableUserRequest{Username: "bob", Disabled: true})
+	require.NoError(t, err)
+
+	_, err = authClient.Login(ctx, &pb.LoginRequest{Username: "bob", Password: "password2"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 禁用用户时吊销所有已经签发的token
+	_, err = authClient.GetProfile(bobCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = authClient.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = authClient.DisableUser(adminCtx, &pb.DisableUserRequest{Username: "bob", Disabled: false})
+	require.NoError(t, err)
+
+	login, err = authClient.Login(ctx, &pb.LoginRequest{Username: "bob", Password: "password2"})
+	require.NoError(t, err)
+	bobCtx = metadata.AppendToOutgoingContext(ctx, "authorization", login.GetAccessToken())
+	_, err = authClient.GetProfile(bobCtx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+
+	// 修改角色时也需要重新登录，旧的token带有旧的角色
+	role, err := authClient.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "bob", Role: service.RoleAdmin})
+	require.NoError(t, err)
+	require.Equal(t, service.RoleAdmin, role.GetUser().GetRole())
+	_, err = authClient.GetProfile(bobCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = authClient.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 每次调用都按用户当前的状态检查，即使token没有被吊销
+	bobCtx = loginTestUser(t, authClient, "bob", "password2")
+	_, err = authClient.ListUsers(bobCtx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+	_, err = userStore.Update("bob", func(user *service.User) error {
+		user.Role = service.RoleUser
+		return nil
+	})
+	require.NoError(t, err)
+	_, err = authClient.ListUsers(bobCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = userStore.Update("bob", func(user *service.User) error {
+		user.Disabled = true
+		return nil
+	})
+	require.NoError(t, err)
+	_, err = authClient.GetProfile(bobCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = authClient.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "bob", Role: "root"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestAuthServerRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("user1", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	serverAddress := startTestAuthServer(t, userStore)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+	ctx := context.Background()
+
+	login, err := authClient.Login(ctx, &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+	require.NotEmpty(t, login.GetRefreshToken())
+
+	refreshed, err := authClient.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+	require.NotEqual(t, login.GetRefreshToken(), refreshed.GetRefreshToken())
+
+	refreshedCtx := metadata.AppendToOutgoingContext(ctx, "authorization", refreshed.GetAccessToken())
+	_, err = authClient.GetProfile(refreshedCtx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+
+	// 重复使用旧的refresh token会吊销整个token family
+	_, err = authClient.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = authClient.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = authClient.GetProfile(refreshedCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 注销后access token和refresh token都不能再使用
+	login, err = authClient.Login(ctx, &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+
+	loginCtx := metadata.AppendToOutgoingContext(ctx, "authorization", login.GetAccessToken())
+	_, err = authClient.Logout(loginCtx, &pb.LogoutRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+
+	_, err = authClient.GetProfile(loginCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = authClient.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestAuthServerPasswordRehash(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUserWithHasher(service.NewBcryptHasher(bcrypt.MinCost), "user1", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	serverAddress := startTestAuthServer(t, userStore)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+
+	// 登录失败时不修改hash
+	_, err = authClient.Login(context.Background(), &pb.LoginRequest{Username: "user1", Password: "wrong"})
+	require.Error(t, err)
+	found, err := userStore.Find("user1")
+	require.NoError(t, err)
+	require.Equal(t, user.HashedPassword, found.HashedPassword)
+	require.True(t, found.LastLoginAt.IsZero())
+
+	// 登录成功后bcrypt的hash升级为argon2id，并记录登录时间
+	userCtx := loginTestUser(t, authClient, "user1", "secret")
+	found, err = userStore.Find("user1")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(found.HashedPassword, "$argon2id$"))
+	require.True(t, found.IsCorrectPassword("secret"))
+	require.False(t, found.LastLoginAt.IsZero())
+
+	profile, err := authClient.GetProfile(userCtx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+	require.Equal(t, user.CreatedAt.Unix(), profile.GetUser().GetCreatedAt().AsTime().Unix())
+	require.NotNil(t, profile.GetUser().GetLastLoginAt())
+
+	loginTestUser(t, authClient, "user1", "secret")
+	rehashed, err := userStore.Find("user1")
+	require.NoError(t, err)
+	require.Equal(t, found.HashedPassword, rehashed.HashedPassword)
+}
+
+func TestAuthServerLoginLockout(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	for _, username := range []string{"admin1", "user1"} {
+		user, err := service.NewUser(username, "secret", service.RoleAdmin)
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(user))
+	}
+
+	serverAddress := startTestAuthServer(t, userStore)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+	adminCtx := loginTestUser(t, authClient, "admin1", "secret")
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err = authClient.Login(ctx, &pb.LoginRequest{Username: "user1", Password: "wrong"})
+		require.Equal(t, codes.NotFound, status.Code(err))
+	}
+
+	// 锁定后即使密码正确也不能登录，并返回需要等待的时间
+	_, err = authClient.Login(ctx, &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	details := status.Convert(err).Details()
+	require.Len(t, details, 1)
+	retryInfo, ok := details[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	require.InDelta(t, time.Minute.Seconds(), retryInfo.GetRetryDelay().AsDuration().Seconds(), 1)
+
+	// 不存在的用户同样会被锁定，不会泄露用户是否存在
+	for i := 0; i < 3; i++ {
+		_, err = authClient.Login(ctx, &pb.LoginRequest{Username: "nobody", Password: "wrong"})
+		require.Equal(t, codes.NotFound, status.Code(err))
+	}
+	_, err = authClient.Login(ctx, &pb.LoginRequest{Username: "nobody", Password: "wrong"})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	res, err := authClient.UnlockUser(adminCtx, &pb.UnlockUserRequest{Username: "user1"})
+	require.NoError(t, err)
+	require.True(t, res.GetWasLocked())
+	loginTestUser(t, authClient, "user1", "secret")
+}
+
+func TestAuthServerTrustedProxy(t *testing.T) {
+	t.Parallel()
+
+	proxies, err := service.ParseTrustedProxies("10.0.0.1, 192.168.0.0/16")
+	require.NoError(t, err)
+	_, err = service.ParseTrustedProxies("10.0.0.300")
+	require.Error(t, err)
+
+	// 同一个IP失败两次后锁定
+	authServer := service.NewAuthServer(service.NewInMemoryUserStore(), service.NewJWTManager("secret", time.Minute, time.Hour),
+		service.NewInMemoryRefreshTokenStore(), service.NewInMemoryRevokedTokenStore(), service.NewInMemoryAPIKeyStore(),
+		service.NewLoginLimiter(100, 2, time.Minute, time.Hour), nil, nil)
+	authServer.SetTrustedProxies(proxies)
+	login := func(peerAddress string, forwardedFor string) codes.Code {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(peerAddress), Port: 1234}})
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", forwardedFor))
+		_, err := authServer.Login(ctx, &pb.LoginRequest{Username: "nobody", Password: "wrong"})
+		return status.Code(err)
+	}
+
+	// 信任的代理转发的最后一个地址是客户端的IP，前面的地址可以伪造，不被使用
+	require.Equal(t, codes.NotFound, login("10.0.0.1", "1.1.1.1, 172.16.0.1"))
+	require.Equal(t, codes.NotFound, login("192.168.1.1", "2.2.2.2, 172.16.0.1"))
+	require.Equal(t, codes.ResourceExhausted, login("10.0.0.1", "3.3.3.3, 172.16.0.1"))
+	require.Equal(t, codes.NotFound, login("10.0.0.1", "172.16.0.2"))
+
+	// 不信任的peer的x-forwarded-for被忽略
+	require.Equal(t, codes.NotFound, login("10.0.0.2", "172.16.0.3"))
+	require.Equal(t, codes.NotFound, login("10.0.0.2", "172.16.0.4"))
+	require.Equal(t, codes.ResourceExhausted, login("10.0.0.2", "172.16.0.5"))
+}
+
+func TestAuthServerAPIKey(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	admin, err := service.NewUser("admin1", "secret", service.RoleAdmin)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin))
+
+	admin2, err := service.NewUser("admin2", "secret", service.RoleAdmin)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin2))
+
+	policy, err := service.ParsePolicy([]byte(`
+default: allow
+roles:
+  admin: {inherits: [user]}
+  user: {}
+rules:
+  - methods:
+      - /techschool.pcbook.AuthService/ListUsers
+      - /techschool.pcbook.AuthService/SetUserRole
+      - /techschool.pcbook.AuthService/DisableUser
+      - /techschool.pcbook.AuthService/CreateAPIKey
+      - /techschool.pcbook.AuthService/ListAPIKeys
+      - /techschool.pcbook.AuthService/RevokeAPIKey
+    roles: [admin]
+  - methods: [/techschool.pcbook.AuthService/GetProfile]
+    roles: [user]
+`))
+	require.NoError(t, err)
+
+	serverAddress := startTestAuthServerWithPolicy(t, userStore, policy, nil)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+	adminCtx := loginTestUser(t, authClient, "admin1", "secret")
+
+	_, err = authClient.CreateAPIKey(adminCtx, &pb.CreateAPIKeyRequest{
+		Name:      "importer",
+		Roles:     []string{service.RoleUser},
+		ExpiresAt: timestamppb.New(time.Now().Add(-time.Minute)),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	res, err := authClient.CreateAPIKey(adminCtx, &pb.CreateAPIKeyRequest{
+		Name:      "importer",
+		Roles:     []string{service.RoleUser},
+		ExpiresAt: timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetKey())
+	require.Equal(t, "admin1", res.GetApiKey().GetOwner())
+
+	// API key以创建者的身份访问，但只能使用key的角色
+	keyCtx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", res.GetKey())
+	profile, err := authClient.GetProfile(keyCtx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "admin1", profile.GetUser().GetUsername())
+	_, err = authClient.ListUsers(keyCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	badKeyCtx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "pcbk_invalid")
+	_, err = authClient.GetProfile(badKeyCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	list, err := authClient.ListAPIKeys(adminCtx, &pb.ListAPIKeysRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetApiKeys(), 1)
+
+	_, err = authClient.RevokeAPIKey(adminCtx, &pb.RevokeAPIKeyRequest{Id: res.GetApiKey().GetId()})
+	require.NoError(t, err)
+	_, err = authClient.GetProfile(keyCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// API key不能创建新的API key
+	res, err = authClient.CreateAPIKey(loginTestUser(t, authClient, "admin2", "secret"), &pb.CreateAPIKeyRequest{
+		Name:      "ops",
+		Roles:     []string{service.RoleAdmin},
+		ExpiresAt: timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	require.NoError(t, err)
+	keyCtx = metadata.AppendToOutgoingContext(context.Background(), "x-api-key", res.GetKey())
+	_, err = authClient.ListUsers(keyCtx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+	_, err = authClient.CreateAPIKey(keyCtx, &pb.CreateAPIKeyRequest{
+		Name:      "copy",
+		Roles:     []string{service.RoleAdmin},
+		ExpiresAt: timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// 只能使用策略中定义的角色
+	_, err = authClient.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "admin2", Role: service.RoleEditor})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// key的角色不能超过owner当前的角色，owner被禁用后key失效
+	_, err = authClient.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "admin2", Role: service.RoleUser})
+	require.NoError(t, err)
+	_, err = authClient.ListUsers(keyCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = authClient.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "admin2", Role: service.RoleAdmin})
+	require.NoError(t, err)
+	_, err = authClient.ListUsers(keyCtx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+
+	_, err = authClient.DisableUser(adminCtx, &pb.DisableUserRequest{Username: "admin2", Disabled: true})
+	require.NoError(t, err)
+	_, err = authClient.ListUsers(keyCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAuthServerTwoFactor(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	admin, err := service.NewUser("admin1", "secret", service.RoleAdmin)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin))
+
+	policy, err := service.ParsePolicy([]byte(`
+default: allow
+roles:
+  admin: {inherits: [user], require_two_factor: true}
+  user: {}
+rules:
+  - methods: [/techschool.pcbook.AuthService/ListUsers, /techschool.pcbook.AuthService/CreateAPIKey]
+    roles: [admin]
+  - methods: [/techschool.pcbook.AuthService/GetProfile, /techschool.pcbook.AuthService/EnrollTOTP, /techschool.pcbook.AuthService/ConfirmTOTP]
+    roles: [user]
+`))
+	require.NoError(t, err)
+
+	serverAddress := startTestAuthServerWithPolicy(t, userStore, policy, nil)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+	ctx := context.Background()
+
+	// 没有启用两步验证的admin只能启用两步验证
+	adminCtx := loginTestUser(t, authClient, "admin1", "secret")
+	_, err = authClient.ListUsers(adminCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	enroll, err := authClient.EnrollTOTP(adminCtx, &pb.EnrollTOTPRequest{})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(enroll.GetProvisioningUri(), "otpauth://totp/PC%20Book:admin1?"))
+	require.Contains(t, enroll.GetProvisioningUri(), "secret="+enroll.GetSecret())
+
+	_, err = authClient.ConfirmTOTP(adminCtx, &pb.ConfirmTOTPRequest{Code: "abc"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	now := time.Now()
+	code, err := service.GenerateTOTPCode(enroll.GetSecret(), now)
+	require.NoError(t, err)
+	confirm, err := authClient.ConfirmTOTP(adminCtx, &pb.ConfirmTOTPRequest{Code: code})
+	require.NoError(t, err)
+	require.Len(t, confirm.GetRecoveryCodes(), service.RecoveryCodeCount)
+
+	profile, err := authClient.GetProfile(adminCtx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+	require.True(t, profile.GetUser().GetTwoFactorEnabled())
+	_, err = authClient.EnrollTOTP(adminCtx, &pb.EnrollTOTPRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// 启用后登录只返回challenge token，不能当作access token使用
+	login, err := authClient.Login(ctx, &pb.LoginRequest{Username: "admin1", Password: "secret"})
+	require.NoError(t, err)
+	require.True(t, login.GetTwoFactorRequired())
+	require.Empty(t, login.GetAccessToken())
+	challengeCtx := metadata.AppendToOutgoingContext(ctx, "authorization", login.GetChallengeToken())
+	_, err = authClient.GetProfile(challengeCtx, &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 确认时用过的验证码不能再次使用
+	_, err = authClient.VerifyTwoFactor(ctx, &pb.VerifyTwoFactorRequest{ChallengeToken: login.GetChallengeToken(), Code: code})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	nextCode, err := service.GenerateTOTPCode(enroll.GetSecret(), now.Add(30*time.Second))
+	require.NoError(t, err)
+	verified, err := authClient.VerifyTwoFactor(ctx, &pb.VerifyTwoFactorRequest{ChallengeToken: login.GetChallengeToken(), Code: nextCode})
+	require.NoError(t, err)
+	verifiedCtx := metadata.AppendToOutgoingContext(ctx, "authorization", verified.GetAccessToken())
+	_, err = authClient.ListUsers(verifiedCtx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+
+	// API key不能通过两步验证，不能使用要求两步验证的角色
+	key, err := authClient.CreateAPIKey(verifiedCtx, &pb.CreateAPIKeyRequest{
+		Name:      "ops",
+		Roles:     []string{service.RoleAdmin},
+		ExpiresAt: timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	require.NoError(t, err)
+	keyCtx := metadata.AppendToOutgoingContext(ctx, "x-api-key", key.GetKey())
+	_, err = authClient.ListUsers(keyCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// refresh token换取的access token保持两步验证的状态
+	refreshed, err := authClient.RefreshToken(ctx, &pb.RefreshTokenRequest{RefreshToken: verified.GetRefreshToken()})
+	require.NoError(t, err)
+	refreshedCtx := metadata.AppendToOutgoingContext(ctx, "authorization", refreshed.GetAccessToken())
+	_, err = authClient.ListUsers(refreshedCtx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+
+	// challenge token和恢复码都只能使用一次
+	recoveryCode := confirm.GetRecoveryCodes()[0]
+	_, err = authClient.VerifyTwoFactor(ctx, &pb.VerifyTwoFactorRequest{ChallengeToken: login.GetChallengeToken(), Code: recoveryCode})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	login, err = authClient.Login(ctx, &pb.LoginRequest{Username: "admin1", Password: "secret"})
+	require.NoError(t, err)
+	_, err = authClient.VerifyTwoFactor(ctx, &pb.VerifyTwoFactorRequest{ChallengeToken: login.GetChallengeToken(), Code: recoveryCode})
+	require.NoError(t, err)
+
+	login, err = authClient.Login(ctx, &pb.LoginRequest{Username: "admin1", Password: "secret"})
+	require.NoError(t, err)
+	_, err = authClient.VerifyTwoFactor(ctx, &pb.VerifyTwoFactorRequest{ChallengeToken: login.GetChallengeToken(), Code: recoveryCode})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestAuthServerLoginWithOIDC(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	bob, err := service.NewUser("bob", "password1", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(bob))
+
+	policy, err := service.ParsePolicy([]byte(`
+default: allow
+roles:
+  admin: {inherits: [user], require_two_factor: true}
+  user: {}
+rules:
+  - methods: [/techschool.pcbook.AuthService/ListUsers]
+    roles: [admin]
+  - methods: [/techschool.pcbook.AuthService/GetProfile, /techschool.pcbook.AuthService/ChangePassword]
+    roles: [user]
+`))
+	require.NoError(t, err)
+
+	issuer := newFakeOIDCIssuer(t)
+	verifier, err := service.NewOIDCVerifier(service.OIDCConfig{
+		Issuer:       issuer.URL(),
+		ClientID:     "pcbook",
+		RoleMappings: []service.OIDCRoleMapping{{Value: "pcbook-admins", Role: service.RoleAdmin}},
+		DefaultRole:  service.RoleUser,
+	}, nil)
+	require.NoError(t, err)
+
+	serverAddress := startTestAuthServerWithPolicy(t, userStore, policy, verifier)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+
+	// 第一次登录时创建用户
+	res, err := authClient.LoginWithOIDC(context.Background(), &pb.LoginWithOIDCRequest{IdToken: issuer.IDToken(t, nil)})
+	require.NoError(t, err)
+	require.False(t, res.GetTwoFactorRequired())
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", res.GetAccessToken())
+	profile, err := authClient.GetProfile(ctx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "jane", profile.GetUser().GetUsername())
+	require.Equal(t, service.RoleUser, profile.GetUser().GetRole())
+	require.True(t, profile.GetUser().GetOidcLinked())
+
+	// provider创建的用户没有本地密码
+	_, err = authClient.Login(context.Background(), &pb.LoginRequest{Username: "jane", Password: ""})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = authClient.ChangePassword(ctx, &pb.ChangePasswordRequest{NewPassword: "password1"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// 每次登录时按照claims更新角色，admin需要provider的多因素认证
+	res, err = authClient.LoginWithOIDC(context.Background(), &pb.LoginWithOIDCRequest{IdToken: issuer.IDToken(t, jwt.MapClaims{"groups": []string{"pcbook-admins"}})})
+	require.NoError(t, err)
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", res.GetAccessToken())
+	_, err = authClient.ListUsers(ctx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err = authClient.LoginWithOIDC(context.Background(), &pb.LoginWithOIDCRequest{IdToken: issuer.IDToken(t, jwt.MapClaims{"groups": []string{"pcbook-admins"}, "amr": []string{"mfa"}})})
+	require.NoError(t, err)
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", res.GetAccessToken())
+	_, err = authClient.ListUsers(ctx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+
+	// 不能通过provider接管同名的本地用户
+	_, err = authClient.LoginWithOIDC(context.Background(), &pb.LoginWithOIDCRequest{IdToken: issuer.IDToken(t, jwt.MapClaims{"sub": "user-2", "preferred_username": "bob"})})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = authClient.LoginWithOIDC(context.Background(), &pb.LoginWithOIDCRequest{IdToken: issuer.IDToken(t, jwt.MapClaims{"sub": "user-2", "preferred_username": "jane"})})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = authClient.LoginWithOIDC(context.Background(), &pb.LoginWithOIDCRequest{IdToken: issuer.IDToken(t, jwt.MapClaims{"aud": "other"})})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 没有配置provider时不能使用OpenID Connect登录
+	conn, err = grpc.Dial(startTestAuthServer(t, userStore), grpc.WithInsecure())
+	require.NoError(t, err)
+	_, err = pb.NewAuthServiceClient(conn).LoginWithOIDC(context.Background(), &pb.LoginWithOIDCRequest{IdToken: issuer.IDToken(t, nil)})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestAuthServerTwoFactorConcurrentGuesses(t *testing.T) {
+	t.Parallel()
+
+	secret, err := service.GenerateTOTPSecret()
+	require.NoError(t, err)
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("user1", "secret", service.RoleUser)
+	require.NoError(t, err)
+	user.TOTPSecret = secret
+	user.TOTPEnabled = true
+	require.NoError(t, userStore.Save(user))
+
+	serverAddress := startTestAuthServer(t, userStore)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	authClient := pb.NewAuthServiceClient(conn)
+	ctx := context.Background()
+
+	login, err := authClient.Login(ctx, &pb.LoginRequest{Username: "user1", Password: "secret"})
+	require.NoError(t, err)
+	require.True(t, login.GetTwoFactorRequired())
+
+	// 并发猜测验证码时，比较验证码之前就计入失败次数，最多只能猜3次
+	const n = 10
+	results := make(chan codes.Code, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := authClient.VerifyTwoFactor(ctx, &pb.VerifyTwoFactorRequest{ChallengeToken: login.GetChallengeToken(), Code: "abcdef"})
+			results <- status.Code(err)
+		}()
+	}
+
+	guesses := 0
+	for i := 0; i < n; i++ {
+		code := <-results
+		if code == codes.Unauthenticated {
+			guesses++
+		} else {
+			require.Equal(t, codes.ResourceExhausted, code)
+		}
+	}
+	require.LessOrEqual(t, guesses, 3)
+}
+
+func TestAuthServerClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ca, err := tlsconfig.GenerateCA("test CA", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, ca.WriteFiles(filepath.Join(dir, "ca-cert.pem"), filepath.Join(dir, "ca-key.pem")))
+	for _, name := range []string{"importer", "operator", "orphan", "unknown"} {
+		cert, err := tlsconfig.GenerateClientCertificate(ca, name, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, cert.WriteFiles(filepath.Join(dir, name+"-cert.pem"), filepath.Join(dir, name+"-key.pem")))
+	}
+	serverCert, err := tlsconfig.GenerateServerCertificate(ca, "server", []string{"127.0.0.1"}, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, serverCert.WriteFiles(filepath.Join(dir, "server-cert.pem"), filepath.Join(dir, "server-key.pem")))
+
+	policy, err := service.ParsePolicy([]byte(`
+roles:
+  admin: {inherits: [user], require_two_factor: true}
+  user: {}
+rules:
+  - methods: [/techschool.pcbook.AuthService/Login]
+    public: true
+  - methods: [/techschool.pcbook.AuthService/GetProfile]
+    roles: [user]
+client_certificates:
+  importer:
+    username: importer
+    role: user
+  operator:
+    username: operator
+    role: admin
+  orphan:
+    username: orphan
+    role: user
+`))
+	require.NoError(t, err)
+
+	userStore := service.NewInMemoryUserStore()
+	importer, err := service.NewUser("importer", "password1", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(importer))
+	operator, err := service.NewUser("operator", "password1", service.RoleAdmin)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(operator))
+
+	reloader, err := tlsconfig.NewReloader(filepath.Join(dir, "ca-cert.pem"), filepath.Join(dir, "server-cert.pem"), filepath.Join(dir, "server-key.pem"))
+	require.NoError(t, err)
+	serverConfig, err := reloader.ServerConfig(tls.VerifyClientCertIfGiven)
+	require.NoError(t, err)
+
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	revokedTokenStore := service.NewInMemoryRevokedTokenStore()
+	interceptor := service.NewAuthInterceptor(jwtManager, revokedTokenStore, nil, userStore, policy)
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(serverConfig)), grpc.UnaryInterceptor(interceptor.Unary()))
+	pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(userStore, jwtManager, service.NewInMemoryRefreshTokenStore(), revokedTokenStore, nil, nil, nil, nil))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	dial := func(certName string) pb.AuthServiceClient {
+		certFile, keyFile := "", ""
+		if certName != "" {
+			certFile, keyFile = filepath.Join(dir, certName+"-cert.pem"), filepath.Join(dir, certName+"-key.pem")
+		}
+		clientReloader, err := tlsconfig.NewReloader(filepath.Join(dir, "ca-cert.pem"), certFile, keyFile)
+		require.NoError(t, err)
+
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientReloader.ClientConfig())))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return pb.NewAuthServiceClient(conn)
+	}
+
+	// 证书映射到的用户不需要token
+	res, err := dial("importer").GetProfile(context.Background(), &pb.GetProfileRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "importer", res.GetUser().GetUsername())
+
+	_, err = dial("unknown").GetProfile(context.Background(), &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 证书不能通过两步验证，不能使用要求两步验证的角色
+	_, err = dial("operator").GetProfile(context.Background(), &pb.GetProfileRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 证书映射到的用户每次调用都要存在并且没有被禁用
+	_, err = dial("orphan").GetProfile(context.Background(), &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = userStore.Update("importer", func(user *service.User) error {
+		user.Disabled = true
+		return nil
+	})
+	require.NoError(t, err)
+	_, err = dial("importer").GetProfile(context.Background(), &pb.GetProfileRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = userStore.Update("importer", func(user *service.User) error {
+		user.Disabled = false
+		return nil
+	})
+	require.NoError(t, err)
+
+	// 没有客户端证书时仍然可以使用token
+	authClient := dial("")
+	_, err = authClient.GetProfile(context.Background(), &pb.GetProfileRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	ctx := loginTestUser(t, authClient, "importer", "password1")
+	_, err = authClient.GetProfile(ctx, &pb.GetProfileRequest{})
+	require.NoError(t, err)
+}
+
+func startTestAuthServer(t *testing.T, userStore service.UserStore) string {
+	const authServicePath = "/techschool.pcbook.AuthService/"
+
+	return startTestAuthServerWithPolicy(t, userStore, service.NewRolePolicy(map[string][]string{
+		authServicePath + "Logout":         {service.RoleAdmin, service.RoleUser},
+		authServicePath + "ChangePassword": {service.RoleAdmin, service.RoleUser},
+		authServicePath + "GetProfile":     {service.RoleAdmin, service.RoleUser},
+		authServicePath + "ListUsers":      {service.RoleAdmin},
+		authServicePath + "SetUserRole":    {service.RoleAdmin},
+		authServicePath + "DisableUser":    {service.RoleAdmin},
+		authServicePath + "UnlockUser":     {service.RoleAdmin},
+		authServicePath + "CreateAPIKey":   {service.RoleAdmin},
+		authServicePath + "ListAPIKeys":    {service.RoleAdmin},
+		authServicePath + "RevokeAPIKey":   {service.RoleAdmin},
+	}), nil)
+}
+
+func startTestAuthServerWithPolicy(t *testing.T, userStore service.UserStore, policy service.PolicySource, oidcVerifier *service.OIDCVerifier) string {
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	refreshTokenStore := service.NewInMemoryRefreshTokenStore()
+	revokedTokenStore := service.NewInMemoryRevokedTokenStore()
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	interceptor := service.NewAuthInterceptor(jwtManager, revokedTokenStore, apiKeyStore, userStore, policy)
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	authServer := service.NewAuthServer(userStore, jwtManager, refreshTokenStore, revokedTokenStore, apiKeyStore, service.NewLoginLimiter(3, 10, time.Minute, time.Hour), nil, oidcVerifier)
+	authServer.SetPolicy(policy)
+	pb.RegisterAuthServiceServer(grpcServer, authServer)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener.Addr().String()
+}
+
+// loginTestUser logs in and returns a context carrying the access token of the user
+func loginTestUser(t *testing.T, authClient pb.AuthServiceClient, username string, password string) context.Context {
+	res, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: username, Password: password})
+	require.NoError(t, err)
+
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", res.GetAccessToken())
+}
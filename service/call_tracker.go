@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"sync"
+)
+
+// CallTracker is a server interceptor that counts the calls in progress, so that the server waits for
+// the handlers to return before closing the stores they use. It must run before the other interceptors,
+// so that the records written by them after the handler returns are waited for too
+type CallTracker struct {
+	mutex sync.Mutex
+	idle  *sync.Cond // 没有正在进行的调用时通知
+	calls int
+}
+
+// NewCallTracker returns a new call tracker
+func NewCallTracker() *CallTracker {
+	tracker := &CallTracker{}
+	tracker.idle = sync.NewCond(&tracker.mutex)
+	return tracker
+}
+
+// Unary returns a server interceptor function to track unary RPC
+func (tracker *CallTracker) Unary() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		tracker.start()
+		defer tracker.done()
+		return handler(ctx, req)
+	}
+}
+
+// Stream returns a server interceptor function to track stream RPC
+func (tracker *CallTracker) Stream() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		tracker.start()
+		defer tracker.done()
+		return handler(srv, stream)
+	}
+}
+
+// Wait blocks until no call is in progress
+func (tracker *CallTracker) Wait() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for tracker.calls > 0 {
+		tracker.idle.Wait()
+	}
+}
+
+func (tracker *CallTracker) start() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.calls++
+}
+
+func (tracker *CallTracker) done() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.calls--
+	if tracker.calls == 0 {
+		tracker.idle.Broadcast()
+	}
+}
@@ -0,0 +1,49 @@
+package service_test
+
+import (
+	"context"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+func TestCallTracker(t *testing.T) {
+	t.Parallel()
+
+	tracker := service.NewCallTracker()
+	tracker.Wait() // 没有调用时立即返回
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	go tracker.Unary()(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return nil, nil
+	})
+	go tracker.Stream()(nil, nil, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	<-started
+	<-started
+
+	waited := make(chan struct{})
+	go func() {
+		tracker.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("wait returned before the calls returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return after the calls returned")
+	}
+}
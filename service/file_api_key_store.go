@@ -0,0 +1,176 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileAPIKeyStore stores API keys in a log file, each line is the latest version of a key,
+// so that the keys survive restarts. The keys are kept in memory and looked up by hash
+type FileAPIKeyStore struct {
+	file   *os.File
+	memory *InMemoryAPIKeyStore
+}
+
+// NewFileAPIKeyStore opens the API key file and replays it to load the keys.
+// Only the hashes of the keys are stored, but the file is still only readable by the owner
+func NewFileAPIKeyStore(filename string) (*FileAPIKeyStore, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open api key file: %w", err)
+	}
+
+	store := &FileAPIKeyStore{
+		file:   file,
+		memory: NewInMemoryAPIKeyStore(),
+	}
+
+	err = file.Chmod(0600)
+	if err == nil {
+		err = store.replay()
+	} else {
+		err = fmt.Errorf("cannot change mode of api key file: %w", err)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// replay loads every key of the log file into the memory store, the later versions of a key replace the earlier ones
+func (store *FileAPIKeyStore) replay() error {
+	reader := bufio.NewReader(store.file)
+	offset := int64(0)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				// 最后一行没有写完就崩溃了，丢弃这条不完整的记录
+				logInfof("discard incomplete api key record at offset %d", offset)
+				if err := store.file.Truncate(offset); err != nil {
+					return fmt.Errorf("cannot truncate api key file: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read api key file: %w", err)
+		}
+
+		key := &APIKey{}
+		if err := json.Unmarshal(line, key); err != nil {
+			return fmt.Errorf("cannot decode api key record at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+
+		store.memory.keys[key.ID] = key
+		store.memory.hashes[key.Hash] = key.ID
+	}
+
+	_, err := store.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("cannot seek api key file: %w", err)
+	}
+	return nil
+}
+
+func (store *FileAPIKeyStore) Save(key *APIKey) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	if store.memory.keys[key.ID] != nil || store.memory.hashes[key.Hash] != "" {
+		return ErrAlreadyExists
+	}
+
+	// 先写文件再修改内存，保证内存中的数据都已经持久化
+	err := store.append(key)
+	if err != nil {
+		return err
+	}
+
+	store.memory.keys[key.ID] = key.Clone()
+	store.memory.hashes[key.Hash] = key.ID
+	return nil
+}
+
+func (store *FileAPIKeyStore) FindByHash(hash string) (*APIKey, error) {
+	return store.memory.FindByHash(hash)
+}
+
+func (store *FileAPIKeyStore) List() ([]*APIKey, error) {
+	return store.memory.List()
+}
+
+func (store *FileAPIKeyStore) Revoke(id string) (*APIKey, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	key := store.memory.keys[id]
+	if key == nil {
+		return nil, fmt.Errorf("api key %s: %w", id, ErrNotFound)
+	}
+
+	revoked := key.Clone()
+	revoked.Revoked = true
+	err := store.append(revoked)
+	if err != nil {
+		return nil, err
+	}
+
+	store.memory.keys[id] = revoked
+	return revoked.Clone(), nil
+}
+
+// CheckHealth returns an error if the api key file cannot be appended
+func (store *FileAPIKeyStore) CheckHealth() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return checkOpenFile(store.file)
+}
+
+// Close closes the api key file
+func (store *FileAPIKeyStore) Close() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return store.file.Close()
+}
+
+// append writes the key to the end of the log file and flushes it to disk, the caller must hold the mutex.
+// If the write fails, the file is truncated back so that a partial record does not corrupt the file
+func (store *FileAPIKeyStore) append(key *APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("cannot encode api key record: %w", err)
+	}
+
+	offset, err := store.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("cannot seek api key file: %w", err)
+	}
+
+	_, err = store.file.Write(append(data, '\n'))
+	if err != nil {
+		err = fmt.Errorf("cannot write api key record: %w", err)
+	} else if err = store.file.Sync(); err != nil {
+		err = fmt.Errorf("cannot sync api key file: %w", err)
+	}
+	if err != nil {
+		truncateErr := store.file.Truncate(offset)
+		if truncateErr == nil {
+			_, truncateErr = store.file.Seek(offset, io.SeekStart)
+		}
+		if truncateErr != nil {
+			logErrorf("cannot truncate api key file to %d: %v", offset, truncateErr)
+		}
+		return err
+	}
+	return nil
+}
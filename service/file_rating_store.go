@@ -0,0 +1,195 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	ratingOpAdd    = "add"
+	ratingOpRemove = "remove"
+)
+
+// ratingRecord is a line of the rating log file
+type ratingRecord struct {
+	Op       string       `json:"op"`
+	Event    *RatingEvent `json:"event,omitempty"`     // 新增的打分记录，op为add时有效
+	RatingID string       `json:"rating_id,omitempty"` // 被删除的打分记录id，op为remove时有效
+}
+
+// FileRatingStore stores every rating event in an append-only log file,
+// and derives the laptop ratings from the events in memory
+type FileRatingStore struct {
+	file   *os.File
+	memory *InMemoryRatingStore
+}
+
+// NewFileRatingStore opens the rating log file and replays it to rebuild the ratings
+func NewFileRatingStore(filename string) (*FileRatingStore, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open rating file: %w", err)
+	}
+
+	store := &FileRatingStore{
+		file:   file,
+		memory: NewInMemoryRatingStore(),
+	}
+
+	err = store.replay()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// replay applies every record of the log file to the memory store
+func (store *FileRatingStore) replay() error {
+	reader := bufio.NewReader(store.file)
+	offset := int64(0)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				// 最后一行没有写完就崩溃了，丢弃这条不完整的记录
+				logInfof("discard incomplete rating record at offset %d", offset)
+				if err := store.file.Truncate(offset); err != nil {
+					return fmt.Errorf("cannot truncate rating file: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read rating file: %w", err)
+		}
+
+		record := &ratingRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return fmt.Errorf("cannot decode rating record at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+
+		switch record.Op {
+		case ratingOpAdd:
+			if record.Event == nil || record.Event.ID == "" || record.Event.LaptopID == "" {
+				return fmt.Errorf("cannot replay rating record at offset %d: missing event", offset)
+			}
+			store.memory.addEvent(record.Event)
+		case ratingOpRemove:
+			if _, _, err := store.memory.removeEvent(record.RatingID); err != nil {
+				return fmt.Errorf("cannot replay rating record at offset %d: %w", offset, err)
+			}
+		default:
+			return fmt.Errorf("unknown rating record operation %q", record.Op)
+		}
+	}
+
+	_, err := store.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("cannot seek rating file: %w", err)
+	}
+	return nil
+}
+
+func (store *FileRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	event, err := newRatingEvent(laptopID, username, score)
+	if err != nil {
+		return nil, err
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	// 先写日志再修改内存，保证内存中的数据都已经持久化
+	err = store.append(&ratingRecord{Op: ratingOpAdd, Event: event})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.memory.addEvent(event), nil
+}
+
+func (store *FileRatingStore) Find(laptopID string) (*Rating, error) {
+	return store.memory.Find(laptopID)
+}
+
+func (store *FileRatingStore) Remove(ratingID string) (*RatingEvent, *Rating, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	if store.memory.findEvent(ratingID) == nil {
+		return nil, nil, fmt.Errorf("rating %s: %w", ratingID, ErrNotFound)
+	}
+
+	err := store.append(&ratingRecord{Op: ratingOpRemove, RatingID: ratingID})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return store.memory.removeEvent(ratingID)
+}
+
+func (store *FileRatingStore) History(laptopID string, from time.Time, to time.Time) ([]*RatingEvent, error) {
+	return store.memory.History(laptopID, from, to)
+}
+
+// CheckHealth returns an error if the rating log file cannot be appended
+func (store *FileRatingStore) CheckHealth() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return checkOpenFile(store.file)
+}
+
+// Close closes the rating log file
+func (store *FileRatingStore) Close() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return store.file.Close()
+}
+
+// append writes a record to the end of the log file and flushes it to disk, the caller must hold the mutex.
+// If the write fails, the file is truncated back so that a partial record does not corrupt the log
+func (store *FileRatingStore) append(record *ratingRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot encode rating record: %w", err)
+	}
+
+	offset, err := store.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("cannot seek rating file: %w", err)
+	}
+
+	_, err = store.file.Write(append(data, '\n'))
+	if err != nil {
+		err = fmt.Errorf("cannot write rating record: %w", err)
+	} else if err = store.file.Sync(); err != nil {
+		err = fmt.Errorf("cannot sync rating file: %w", err)
+	}
+	if err != nil {
+		store.rollback(offset)
+		return err
+	}
+	return nil
+}
+
+// rollback removes the partial record written after offset, and writes the next record from offset
+func (store *FileRatingStore) rollback(offset int64) {
+	err := store.file.Truncate(offset)
+	if err == nil {
+		_, err = store.file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		logErrorf("cannot truncate rating file to %d: %v", offset, err)
+	}
+}
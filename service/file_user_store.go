@@ -0,0 +1,230 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileUserStore stores users in a log file, each line is the latest version of a user.
+// The users are kept in memory, and the file is compacted to one line per user when it is opened
+type FileUserStore struct {
+	filename string
+	file     *os.File
+	memory   *InMemoryUserStore
+}
+
+// NewFileUserStore opens the user file and replays it to load the users.
+// The file contains password hashes and TOTP secrets, so it is only readable by the owner
+func NewFileUserStore(filename string) (*FileUserStore, error) {
+	store := &FileUserStore{
+		filename: filename,
+		memory:   NewInMemoryUserStore(),
+	}
+
+	records, err := store.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	// 每次修改都追加一行，打开时重写文件去掉旧版本
+	if records > len(store.memory.users) {
+		err = store.compact()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	store.file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open user file: %w", err)
+	}
+
+	// OpenFile不会修改已经存在的文件的权限
+	err = store.file.Chmod(0600)
+	if err != nil {
+		store.file.Close()
+		return nil, fmt.Errorf("cannot change mode of user file: %w", err)
+	}
+	return store, nil
+}
+
+// replay loads every user of the log file into the memory store, and returns the number of records
+func (store *FileUserStore) replay() (int, error) {
+	file, err := os.OpenFile(store.filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open user file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	records := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				// 最后一行没有写完就崩溃了，丢弃这条不完整的记录
+				logInfof("discard incomplete user record at offset %d", offset)
+				if err := file.Truncate(offset); err != nil {
+					return 0, fmt.Errorf("cannot truncate user file: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot read user file: %w", err)
+		}
+
+		user := &User{}
+		if err := json.Unmarshal(line, user); err != nil {
+			return 0, fmt.Errorf("cannot decode user record at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+		records++
+
+		store.memory.users[user.Username] = user
+	}
+	return records, nil
+}
+
+// compact rewrites the user file with only the latest version of each user,
+// the new file replaces the old one atomically so that a crash never loses users
+func (store *FileUserStore) compact() error {
+	tmpFilename := store.filename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create user file: %w", err)
+	}
+	defer os.Remove(tmpFilename)
+
+	writer := bufio.NewWriter(file)
+	for _, user := range store.memory.users {
+		err = writeUserRecord(writer, user)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write user file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("cannot close user file: %w", err)
+	}
+
+	err = os.Rename(tmpFilename, store.filename)
+	if err != nil {
+		return fmt.Errorf("cannot replace user file: %w", err)
+	}
+	return nil
+}
+
+func (store *FileUserStore) Save(user *User) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	if store.memory.users[user.Username] != nil {
+		return ErrAlreadyExists
+	}
+
+	// 先写文件再修改内存，保证内存中的数据都已经持久化
+	err := store.append(user)
+	if err != nil {
+		return err
+	}
+
+	store.memory.users[user.Username] = user.Clone()
+	return nil
+}
+
+func (store *FileUserStore) Find(username string) (*User, error) {
+	return store.memory.Find(username)
+}
+
+func (store *FileUserStore) Update(username string, update func(user *User) error) (*User, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	user, err := store.memory.update(username, update)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.append(user)
+	if err != nil {
+		return nil, err
+	}
+
+	store.memory.users[username] = user
+	return user.Clone(), nil
+}
+
+func (store *FileUserStore) List() ([]*User, error) {
+	return store.memory.List()
+}
+
+// CheckHealth returns an error if the user file cannot be appended
+func (store *FileUserStore) CheckHealth() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return checkOpenFile(store.file)
+}
+
+// Close closes the user file
+func (store *FileUserStore) Close() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return store.file.Close()
+}
+
+// append writes the user to the end of the log file and flushes it to disk, the caller must hold the mutex.
+// If the write fails, the file is truncated back so that a partial record does not corrupt the file
+func (store *FileUserStore) append(user *User) error {
+	offset, err := store.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("cannot seek user file: %w", err)
+	}
+
+	err = writeUserRecord(store.file, user)
+	if err == nil {
+		err = store.file.Sync()
+		if err != nil {
+			err = fmt.Errorf("cannot sync user file: %w", err)
+		}
+	}
+	if err != nil {
+		if truncateErr := store.file.Truncate(offset); truncateErr != nil {
+			logErrorf("cannot truncate user file to %d: %v", offset, truncateErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func writeUserRecord(writer io.Writer, user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("cannot encode user record: %w", err)
+	}
+
+	_, err = writer.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("cannot write user record: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"fmt"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthChecker is implemented by the stores that can stop working while the server is running,
+// such as the stores on disk
+type HealthChecker interface {
+	// CheckHealth returns an error if the store cannot serve requests
+	CheckHealth() error
+}
+
+// healthCheck is a readiness check of the services that depend on a store
+type healthCheck struct {
+	name     string
+	checker  HealthChecker
+	services []string
+}
+
+// HealthMonitor runs the readiness checks of the stores and reports the results through the standard gRPC
+// health service: a service is SERVING only if all the stores it depends on pass their checks, and the whole
+// server (the empty service name) is SERVING only if all the checks pass
+type HealthMonitor struct {
+	server *health.Server
+
+	mutex    sync.Mutex
+	checks   []*healthCheck
+	failures map[string]error // key是检查的名字，value是最近一次检查的错误
+}
+
+// NewHealthMonitor returns a health monitor that updates the statuses of the health server
+func NewHealthMonitor(server *health.Server) *HealthMonitor {
+	return &HealthMonitor{
+		server:   server,
+		failures: make(map[string]error),
+	}
+}
+
+// AddCheck adds a readiness check of the store that the services depend on
+func (monitor *HealthMonitor) AddCheck(name string, checker HealthChecker, services ...string) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	monitor.checks = append(monitor.checks, &healthCheck{name: name, checker: checker, services: services})
+}
+
+// Check runs all the checks and updates the statuses, it returns the errors of the failed checks by name
+func (monitor *HealthMonitor) Check() map[string]error {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+
+	failures := make(map[string]error)
+	serving := map[string]bool{"": true}
+	for _, check := range monitor.checks {
+		err := check.checker.CheckHealth()
+		if err != nil {
+			failures[check.name] = err
+			serving[""] = false
+		}
+		for _, service := range check.services {
+			if _, ok := serving[service]; !ok {
+				serving[service] = true
+			}
+			if err != nil {
+				serving[service] = false
+			}
+		}
+
+		// 只在状态变化时记录日志
+		_, failed := monitor.failures[check.name]
+		if err != nil && !failed {
+			logErrorf("health check %s failed: %v", check.name, err)
+		} else if err == nil && failed {
+			logInfof("health check %s passed", check.name)
+		}
+	}
+	monitor.failures = failures
+
+	services := make([]string, 0, len(serving))
+	for service := range serving {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		status := grpc_health_v1.HealthCheckResponse_SERVING
+		if !serving[service] {
+			status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+		// Shutdown之后的状态更新会被忽略
+		monitor.server.SetServingStatus(service, status)
+	}
+	return failures
+}
+
+// Watch runs the checks at every interval until stop is called
+func (monitor *HealthMonitor) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				monitor.Check()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Shutdown sets all the services to NOT_SERVING and ignores the results of later checks,
+// so that the clients stop sending new calls to the server before it stops
+func (monitor *HealthMonitor) Shutdown() {
+	monitor.server.Shutdown()
+}
+
+// checkOpenFile returns an error if the open file of a store is closed, or is removed or replaced on disk,
+// in which case the records appended by the store are lost
+func checkOpenFile(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat file: %w", err)
+	}
+	pathInfo, err := os.Stat(file.Name())
+	if err != nil {
+		return fmt.Errorf("cannot stat file %s: %w", file.Name(), err)
+	}
+	if !os.SameFile(info, pathInfo) {
+		return fmt.Errorf("file %s has been replaced", file.Name())
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeChecker struct {
+	err error
+}
+
+func (checker *fakeChecker) CheckHealth() error {
+	return checker.err
+}
+
+func TestHealthMonitor(t *testing.T) {
+	t.Parallel()
+
+	healthServer := health.NewServer()
+	monitor := service.NewHealthMonitor(healthServer)
+	imageChecker := &fakeChecker{}
+	userChecker := &fakeChecker{}
+	monitor.AddCheck("image store", imageChecker, "laptop")
+	monitor.AddCheck("user store", userChecker, "auth")
+
+	require.Empty(t, monitor.Check())
+	requireServing(t, healthServer, "", true)
+	requireServing(t, healthServer, "laptop", true)
+	requireServing(t, healthServer, "auth", true)
+
+	// 只有依赖失败存储的服务变为NOT_SERVING
+	userChecker.err = errors.New("cannot open user file")
+	failures := monitor.Check()
+	require.Len(t, failures, 1)
+	require.Equal(t, userChecker.err, failures["user store"])
+	requireServing(t, healthServer, "", false)
+	requireServing(t, healthServer, "laptop", true)
+	requireServing(t, healthServer, "auth", false)
+
+	userChecker.err = nil
+	require.Empty(t, monitor.Check())
+	requireServing(t, healthServer, "auth", true)
+
+	// 停止后不再因为检查通过而恢复SERVING
+	monitor.Shutdown()
+	monitor.Check()
+	requireServing(t, healthServer, "", false)
+	requireServing(t, healthServer, "laptop", false)
+}
+
+func TestStoreHealthChecks(t *testing.T) {
+	t.Parallel()
+
+	folder := t.TempDir()
+	imageStore := service.NewDiskImageStore(folder)
+	require.NoError(t, imageStore.CheckHealth())
+	require.Error(t, service.NewDiskImageStore(filepath.Join(folder, "missing")).CheckHealth())
+
+	ratingFile := filepath.Join(folder, "ratings.jsonl")
+	ratingStore, err := service.NewFileRatingStore(ratingFile)
+	require.NoError(t, err)
+	require.NoError(t, ratingStore.CheckHealth())
+
+	// 文件被删除后追加的记录会丢失
+	require.NoError(t, os.Remove(ratingFile))
+	require.Error(t, ratingStore.CheckHealth())
+	require.NoError(t, ratingStore.Close())
+	require.Error(t, ratingStore.CheckHealth())
+}
+
+func requireServing(t *testing.T, healthServer *health.Server, service string, serving bool) {
+	res, err := healthServer.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+	require.NoError(t, err)
+
+	expected := grpc_health_v1.HealthCheckResponse_SERVING
+	if !serving {
+		expected = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	require.Equal(t, expected, res.GetStatus())
+}
@@ -4,19 +4,25 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/google/uuid"
+	"io/ioutil"
 	"os"
 	"sync"
 )
 
 // ImageStore is an interface to store laptop images
 type ImageStore interface {
-	// Save saves a new laptop image to the store
-	Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error)
+	// Save saves a new laptop image uploaded by the owner to the store
+	Save(laptopID string, owner string, imageType string, imageData bytes.Buffer) (string, error)
+	// Find finds the image info by image id
+	Find(imageID string) (*ImageInfo, error)
+	// Delete deletes an image by image id
+	Delete(imageID string) error
 }
 
 // ImageInfo contains information of the laptop image
 type ImageInfo struct{
 	LaptopID string
+	Owner string // 上传该图片的用户
 	Type string
 	Path string
 }
@@ -36,7 +42,7 @@ func NewDiskImageStore(imageFolder string) *DiskImageStore {
 	}
 }
 
-func (store *DiskImageStore) Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error) {
+func (store *DiskImageStore) Save(laptopID string, owner string, imageType string, imageData bytes.Buffer) (string, error) {
 	imageID, err := uuid.NewRandom()
 	if err != nil {
 		return "",fmt.Errorf("cannot generate image id: %v",err)
@@ -59,9 +65,56 @@ func (store *DiskImageStore) Save(laptopID string, imageType string, imageData b
 
 	store.images[imageID.String()] = &ImageInfo{
 		LaptopID: laptopID,
+		Owner:    owner,
 		Type:     imageType,
 		Path:     imagePath,
 	}
 
 	return imageID.String(), nil
 }
+
+func (store *DiskImageStore) Find(imageID string) (*ImageInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return nil, nil
+	}
+
+	other := *info
+	return &other, nil
+}
+
+func (store *DiskImageStore) Delete(imageID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return fmt.Errorf("image %s: %w", imageID, ErrNotFound)
+	}
+
+	err := os.Remove(info.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove image file: %v", err)
+	}
+
+	delete(store.images, imageID)
+	return nil
+}
+
+// CheckHealth returns an error if no image can be saved in the image folder
+func (store *DiskImageStore) CheckHealth() error {
+	file, err := ioutil.TempFile(store.imageFolder, ".health-*")
+	if err != nil {
+		return fmt.Errorf("image folder is not writable: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("image folder is not writable: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA implements the EdDSA signing method with Ed25519 keys,
+// which is not provided by the jwt-go library
+type SigningMethodEdDSA struct{}
+
+// SigningMethodEd25519 is the EdDSA signing method, it expects ed25519.PrivateKey for signing
+// and ed25519.PublicKey for verification
+var SigningMethodEd25519 = &SigningMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEd25519.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEd25519
+	})
+}
+
+func (method *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (method *SigningMethodEdDSA) Verify(signingString string, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (method *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	sig := ed25519.Sign(privateKey, []byte(signingString))
+	return jwt.EncodeSegment(sig), nil
+}
@@ -1,54 +1,166 @@
 package service
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 	"time"
 )
 
 // JWTManager is a JSON web token manager
 type JWTManager struct{
-	secretKey string    // secretKey to sign and verify the access token
+	keySet *KeySet    // keySet to sign and verify the access token
 	tokenDuration time.Duration // valid duration of the token
+	refreshTokenDuration time.Duration // valid duration of the refresh token
 }
 
+const (
+	// AuthMethodPassword is the authentication method of users who login with a password, as defined in RFC 8176
+	AuthMethodPassword = "pwd"
+	// AuthMethodOTP is the authentication method of users who also verify a one-time password
+	AuthMethodOTP = "otp"
+
+	// challengePurpose is the purpose of the tokens that can only be used to complete the two-factor login
+	challengePurpose = "2fa-challenge"
+	// challengeTokenDuration is the time the user has to enter the two-factor code after the password
+	challengeTokenDuration = 5 * time.Minute
+)
+
 // UserClaims is a custom JWT claims that contains some user's information
 type UserClaims struct{
 	jwt.StandardClaims
 	Username string `json:"username"`
 	Role string `json:"role"`
+	AuthMethods []string `json:"amr,omitempty"` // 用户登录时使用的认证方式
+	Purpose string `json:"purpose,omitempty"` // 不为空时不是access token，不能用来访问RPC
+}
+
+// HasAuthMethod checks if the user used the authentication method to login
+func (claims *UserClaims) HasAuthMethod(method string) bool {
+	for _, other := range claims.AuthMethods {
+		if other == method {
+			return true
+		}
+	}
+	return false
+}
+
+// NewJWTManager returns a new JWT manager that signs tokens with HS256 and the secret key
+func NewJWTManager(secretKey string, tokenDuration time.Duration, refreshTokenDuration time.Duration) *JWTManager{
+	return NewJWTManagerWithKeySet(NewKeySet(NewHMACSigningKey("", secretKey)), tokenDuration, refreshTokenDuration)
 }
 
-// NewJWTManager returns a new JWT manager
-func NewJWTManager(secretKey string, tokenDuration time.Duration) *JWTManager{
+// NewJWTManagerWithKeySet returns a new JWT manager that signs tokens with the current key of the key set
+func NewJWTManagerWithKeySet(keySet *KeySet, tokenDuration time.Duration, refreshTokenDuration time.Duration) *JWTManager {
 	return &JWTManager{
-		secretKey:     secretKey,
+		keySet:        keySet,
 		tokenDuration: tokenDuration,
+		refreshTokenDuration: refreshTokenDuration,
+	}
+}
+
+// KeySet returns the key set used by the manager
+func (manager *JWTManager) KeySet() *KeySet {
+	return manager.keySet
+}
+
+// Generate generates and signs a new access token for user who logged in with the authentication methods,
+// and returns the token with its claims
+func (manager *JWTManager) Generate(user *User, authMethods ...string) (string, *UserClaims, error) {
+	claims, err := manager.newClaims(user, manager.tokenDuration)
+	if err != nil {
+		return "", nil, err
+	}
+	claims.AuthMethods = authMethods
+
+	signedToken, err := manager.sign(claims)
+	if err != nil {
+		return "", nil, err
 	}
+	return signedToken, claims, nil
 }
 
-// Generate generates and signs a new token for user
-func (manager *JWTManager) Generate(user *User) (string, error) {
-	claims := UserClaims{
+// GenerateChallenge generates a short-lived token for user who has passed the first factor with the
+// authentication methods but still has to verify the two-factor code, it cannot be used as an access token
+func (manager *JWTManager) GenerateChallenge(user *User, authMethods ...string) (string, error) {
+	claims, err := manager.newClaims(user, challengeTokenDuration)
+	if err != nil {
+		return "", err
+	}
+	claims.AuthMethods = authMethods
+	claims.Purpose = challengePurpose
+
+	return manager.sign(claims)
+}
+
+func (manager *JWTManager) newClaims(user *User, duration time.Duration) (*UserClaims, error) {
+	tokenID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate token id: %v", err)
+	}
+
+	now := time.Now()
+	claims := &UserClaims{
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(manager.tokenDuration).Unix(),
+			Id:        tokenID.String(), // jti，用于吊销token
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(duration).Unix(),
 		},
 		Username: user.Username,
 		Role: user.Role,
 	}
+	return claims, nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(manager.secretKey))    // 这里传入的参数是[]byte类型
+func (manager *JWTManager) sign(claims *UserClaims) (string, error) {
+	key := manager.keySet.Current()
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID    // 验证方根据kid找到对应的公钥
+	}
+	return token.SignedString(key.signKey)
 }
 
 // Verify verifies the access token string and returns a user claim if the token is valid
 func (manager *JWTManager) Verify(accessToken string) (*UserClaims, error) {
-	token, err := jwt.ParseWithClaims(accessToken, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		_, ok := token.Method.(*jwt.SigningMethodHMAC)
-		if !ok {
+	claims, err := manager.parse(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("invalid token: not an access token")
+	}
+	return claims, nil
+}
+
+// VerifyChallenge verifies the two-factor challenge token string and returns its user claim if the token is valid
+func (manager *JWTManager) VerifyChallenge(challengeToken string) (*UserClaims, error) {
+	claims, err := manager.parse(challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != challengePurpose {
+		return nil, fmt.Errorf("invalid token: not a challenge token")
+	}
+	return claims, nil
+}
+
+func (manager *JWTManager) parse(signedToken string) (*UserClaims, error) {
+	token, err := jwt.ParseWithClaims(signedToken, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := manager.keySet.Find(kid)
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		// 签名算法必须和key一致，防止用公钥作为HMAC密钥伪造token
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("unexpected token signing method")
 		}
-		return []byte(manager.secretKey), nil
+		return key.verifyKey, nil
 	})
 
 	if err != nil {
@@ -61,3 +173,30 @@ func (manager *JWTManager) Verify(accessToken string) (*UserClaims, error) {
 	}
 	return claims,nil
 }
+
+// GenerateRefreshToken generates a new opaque refresh token in the token family,
+// only the hash of the token is kept in the returned RefreshToken
+func (manager *JWTManager) GenerateRefreshToken(username string, familyID string, accessTokenID string, authMethods []string) (string, *RefreshToken, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot generate refresh token: %v", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(data)
+	refreshToken := &RefreshToken{
+		ID:            HashRefreshToken(token),
+		FamilyID:      familyID,
+		Username:      username,
+		AccessTokenID: accessTokenID,
+		AuthMethods:   authMethods,
+		ExpiresAt:     time.Now().Add(manager.refreshTokenDuration),
+	}
+	return token, refreshToken, nil
+}
+
+// HashRefreshToken returns the id under which a refresh token is stored
+func HashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
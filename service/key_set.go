@@ -0,0 +1,511 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SigningKey is a key used to sign and verify tokens
+type SigningKey struct {
+	ID        string // 写入token header的kid
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	retiredAt time.Time // 轮换后不再用于签名，过了这个时间也不再用于验证；零值表示未轮换
+}
+
+// NewHMACSigningKey returns a symmetric key, it is never published in the JWKS
+func NewHMACSigningKey(id string, secretKey string) *SigningKey {
+	return &SigningKey{
+		ID:        id,
+		Method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secretKey),
+		verifyKey: []byte(secretKey),
+	}
+}
+
+// NewSigningKey returns an asymmetric key from its private key, the signing method is chosen by the key type:
+// RSA keys use RS256, ECDSA keys use ES256/ES384/ES512 by their curve, and Ed25519 keys use EdDSA.
+// If id is empty, the JWK thumbprint of the public key is used
+func NewSigningKey(id string, privateKey crypto.Signer) (*SigningKey, error) {
+	key := &SigningKey{
+		ID:        id,
+		signKey:   privateKey,
+		verifyKey: privateKey.Public(),
+	}
+
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		switch privateKey.Curve {
+		case elliptic.P256():
+			key.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.Method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve %s", privateKey.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		key.Method = SigningMethodEd25519
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+
+	if key.ID == "" {
+		thumbprint, err := key.Thumbprint()
+		if err != nil {
+			return nil, err
+		}
+		key.ID = thumbprint
+	}
+	return key, nil
+}
+
+// GenerateSigningKey generates a new asymmetric key for the algorithm RS256, ES256 or EdDSA
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case SigningMethodEd25519.Alg():
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate %s key: %v", alg, err)
+	}
+
+	return NewSigningKey("", privateKey)
+}
+
+// LoadSigningKey loads an asymmetric private key from a PEM file in PKCS#8, PKCS#1 or SEC 1 format
+func LoadSigningKey(id string, filename string) (*SigningKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in key file %s", filename)
+	}
+
+	var privateKey interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q in key file %s", block.Type, filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key file %s: %w", filename, err)
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T in key file %s", privateKey, filename)
+	}
+	return NewSigningKey(id, signer)
+}
+
+// JSONWebKey is the public part of a signing key in JWK format (RFC 7517)
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of JWKs
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+// JWK returns the public key in JWK format, symmetric keys cannot be published
+func (key *SigningKey) JWK() (*JSONWebKey, error) {
+	jwk := &JSONWebKey{
+		KeyID:     key.ID,
+		Use:       "sig",
+		Algorithm: key.Method.Alg(),
+	}
+
+	switch publicKey := key.verifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encodeBigInt(publicKey.N, 0)
+		jwk.E = encodeBigInt(big.NewInt(int64(publicKey.E)), 0)
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = publicKey.Curve.Params().Name
+		jwk.X = encodeBigInt(publicKey.X, size)
+		jwk.Y = encodeBigInt(publicKey.Y, size)
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	default:
+		return nil, fmt.Errorf("key %s cannot be published", key.ID)
+	}
+	return jwk, nil
+}
+
+// VerificationKey returns a key that can only verify tokens from the public key of the JWK,
+// the signing method is chosen by the alg of the JWK, or by the key type when alg is empty
+func (jwk *JSONWebKey) VerificationKey() (*SigningKey, error) {
+	var publicKey interface{}
+	var method jwt.SigningMethod
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus of key %s: %v", jwk.KeyID, err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() > math.MaxInt32 {
+			return nil, fmt.Errorf("invalid RSA exponent of key %s", jwk.KeyID)
+		}
+		publicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		method = jwt.SigningMethodRS256
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve, method = elliptic.P256(), jwt.SigningMethodES256
+		case "P-384":
+			curve, method = elliptic.P384(), jwt.SigningMethodES384
+		case "P-521":
+			curve, method = elliptic.P521(), jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve %q of key %s", jwk.Curve, jwk.KeyID)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate of key %s: %v", jwk.KeyID, err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate of key %s: %v", jwk.KeyID, err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point of key %s is not on curve %s", jwk.KeyID, jwk.Curve)
+		}
+		publicKey = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key %s", jwk.KeyID)
+		}
+		publicKey = ed25519.PublicKey(x)
+		method = SigningMethodEd25519
+	default:
+		return nil, fmt.Errorf("unsupported key type %q of key %s", jwk.KeyType, jwk.KeyID)
+	}
+
+	// RSA key可以用于RS384等算法，但是alg必须和key的类型一致
+	if jwk.Algorithm != "" && jwk.Algorithm != method.Alg() {
+		other := jwt.GetSigningMethod(jwk.Algorithm)
+		_, isRSA := other.(*jwt.SigningMethodRSA)
+		if !isRSA || jwk.KeyType != "RSA" {
+			return nil, fmt.Errorf("unsupported algorithm %q of key %s", jwk.Algorithm, jwk.KeyID)
+		}
+		method = other
+	}
+
+	key := &SigningKey{
+		ID:        jwk.KeyID,
+		Method:    method,
+		verifyKey: publicKey,
+	}
+	return key, nil
+}
+
+// Thumbprint returns the JWK thumbprint of the public key (RFC 7638)
+func (key *SigningKey) Thumbprint() (string, error) {
+	jwk, err := key.JWK()
+	if err != nil {
+		return "", err
+	}
+
+	// thumbprint只包含必需字段，并且按字典序排列
+	var members interface{}
+	switch jwk.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Curve, jwk.KeyType, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode key thumbprint: %v", err)
+	}
+
+	hash := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func encodeBigInt(n *big.Int, size int) string {
+	data := n.Bytes()
+	if len(data) < size {
+		data = append(make([]byte, size-len(data)), data...)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// JWKSMaxAge is how long verifiers may cache the JWKS, a new key must be published for this long before it signs tokens
+const JWKSMaxAge = 5 * time.Minute
+
+// KeySet holds the current signing key, the next key that is published before it signs,
+// and the retired keys that can still verify tokens
+type KeySet struct {
+	mutex       sync.RWMutex
+	current     *SigningKey
+	next        *SigningKey
+	publishedAt time.Time     // next发布到JWKS的时间
+	publishLead time.Duration // next至少发布这么久之后才能用于签名
+	keys        map[string]*SigningKey
+}
+
+// NewKeySet returns a key set that signs with the given key
+func NewKeySet(current *SigningKey) *KeySet {
+	return &KeySet{
+		current:     current,
+		publishLead: JWKSMaxAge,
+		keys:        map[string]*SigningKey{current.ID: current},
+	}
+}
+
+// SetPublishLead sets how long the next key is published before Rotate can sign with it,
+// it should not be shorter than the time verifiers cache the JWKS
+func (keySet *KeySet) SetPublishLead(lead time.Duration) {
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+	keySet.publishLead = lead
+}
+
+// AddVerificationKey adds a key that is only used to verify tokens until the retire time,
+// a zero retire time means the key never retires
+func (keySet *KeySet) AddVerificationKey(key *SigningKey, retiredAt time.Time) {
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+
+	other := *key
+	other.retiredAt = retiredAt
+	keySet.keys[key.ID] = &other
+}
+
+// PublishNext publishes the key in the JWKS as the next signing key, so that verifiers that cache the JWKS
+// already know the key when Rotate starts to sign with it. A previous next key that has not signed is replaced
+func (keySet *KeySet) PublishNext(key *SigningKey) {
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+
+	if keySet.next != nil {
+		delete(keySet.keys, keySet.next.ID)
+	}
+	keySet.next = key
+	keySet.publishedAt = time.Now()
+	keySet.keys[key.ID] = key
+}
+
+// Rotate makes the next key the current signing key and returns it, the previous key still verifies tokens
+// during the overlap window. The overlap window should be at least the token duration so that no issued token
+// becomes invalid. An error is returned if the next key has not been published for the publish lead
+func (keySet *KeySet) Rotate(overlap time.Duration) (*SigningKey, error) {
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+
+	now := time.Now()
+	if keySet.next == nil {
+		return nil, errors.New("no next key is published")
+	}
+	if published := now.Sub(keySet.publishedAt); published < keySet.publishLead {
+		return nil, fmt.Errorf("next key %s is only published for %v, less than %v", keySet.next.ID, published, keySet.publishLead)
+	}
+
+	previous := *keySet.current
+	previous.retiredAt = now.Add(overlap)
+	keySet.keys[previous.ID] = &previous
+
+	for id, other := range keySet.keys {
+		if !other.retiredAt.IsZero() && now.After(other.retiredAt) {
+			delete(keySet.keys, id)
+		}
+	}
+
+	keySet.current = keySet.next
+	keySet.next = nil
+	return keySet.current, nil
+}
+
+// StartRotation rotates the signing key with newly generated keys every interval until stop is called.
+// Each key is generated and published one interval before it signs, so the interval should not be shorter
+// than the publish lead
+func (keySet *KeySet) StartRotation(interval time.Duration, overlap time.Duration, generate func() (*SigningKey, error)) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	publishNext := func() {
+		key, err := generate()
+		if err != nil {
+			logErrorf("cannot generate next signing key, keep using the current one: %v", err)
+			return
+		}
+		keySet.PublishNext(key)
+		logInfof("published next signing key, key id: %s", key.ID)
+	}
+	publishNext()
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// 生成失败时没有next，这次只发布新的key，下一次再轮换
+				key, err := keySet.Rotate(overlap)
+				if err != nil {
+					logErrorf("cannot rotate signing key, keep using the current one: %v", err)
+				} else {
+					logInfof("rotated signing key, new key id: %s", key.ID)
+				}
+				publishNext()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Current returns the key to sign new tokens
+func (keySet *KeySet) Current() *SigningKey {
+	keySet.mutex.RLock()
+	defer keySet.mutex.RUnlock()
+	return keySet.current
+}
+
+// Find returns the key with the id if it can still verify tokens, or nil
+func (keySet *KeySet) Find(id string) *SigningKey {
+	keySet.mutex.RLock()
+	defer keySet.mutex.RUnlock()
+
+	key := keySet.keys[id]
+	if key == nil || (!key.retiredAt.IsZero() && time.Now().After(key.retiredAt)) {
+		return nil
+	}
+	return key
+}
+
+// JWKS returns the public keys that can still verify tokens and the next key, symmetric keys are skipped
+func (keySet *KeySet) JWKS() *JSONWebKeySet {
+	keySet.mutex.RLock()
+	defer keySet.mutex.RUnlock()
+
+	now := time.Now()
+	jwks := &JSONWebKeySet{Keys: []*JSONWebKey{}}
+	for _, key := range keySet.keys {
+		if !key.retiredAt.IsZero() && now.After(key.retiredAt) {
+			continue
+		}
+
+		jwk, err := key.JWK()
+		if err != nil {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID
+	})
+	return jwks
+}
+
+// JWKSHandler returns an HTTP handler that serves the public keys in JWKS format
+func (keySet *KeySet) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, err := json.Marshal(keySet.JWKS())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		// 验证方可以缓存公钥，新的key在签名之前至少提前这么久发布
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(JWKSMaxAge.Seconds())))
+		w.Write(data)
+	})
+}
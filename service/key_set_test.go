@@ -0,0 +1,122 @@
+package service_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJWTManagerAsymmetricKeys(t *testing.T) {
+	t.Parallel()
+
+	user := &service.User{Username: "user1", Role: service.RoleUser}
+
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, err := service.GenerateSigningKey(alg)
+		require.NoError(t, err)
+		require.Equal(t, alg, key.Method.Alg())
+
+		manager := service.NewJWTManagerWithKeySet(service.NewKeySet(key), time.Minute, time.Hour)
+		token, _, err := manager.Generate(user)
+		require.NoError(t, err)
+
+		claims, err := manager.Verify(token)
+		require.NoError(t, err)
+		require.Equal(t, "user1", claims.Username)
+
+		jwks := manager.KeySet().JWKS()
+		require.Len(t, jwks.Keys, 1)
+		require.Equal(t, key.ID, jwks.Keys[0].KeyID)
+		require.Equal(t, alg, jwks.Keys[0].Algorithm)
+	}
+
+	// 不能用HS256签名的token冒充非对称key签名的token
+	hmacManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	token, _, err := hmacManager.Generate(user)
+	require.NoError(t, err)
+
+	key, err := service.GenerateSigningKey("ES256")
+	require.NoError(t, err)
+	_, err = service.NewJWTManagerWithKeySet(service.NewKeySet(key), time.Minute, time.Hour).Verify(token)
+	require.Error(t, err)
+	require.Empty(t, hmacManager.KeySet().JWKS().Keys)
+}
+
+func TestKeySetRotation(t *testing.T) {
+	t.Parallel()
+
+	user := &service.User{Username: "user1", Role: service.RoleUser}
+
+	oldKey, err := service.GenerateSigningKey("EdDSA")
+	require.NoError(t, err)
+	newKey, err := service.GenerateSigningKey("EdDSA")
+	require.NoError(t, err)
+
+	keySet := service.NewKeySet(oldKey)
+	manager := service.NewJWTManagerWithKeySet(keySet, time.Minute, time.Hour)
+	oldToken, _, err := manager.Generate(user)
+	require.NoError(t, err)
+
+	// 新的key发布之后至少要等待publish lead才能签名，缓存JWKS的验证方才能拿到它
+	overlap := 100 * time.Millisecond
+	lead := 50 * time.Millisecond
+	keySet.SetPublishLead(lead)
+	_, err = keySet.Rotate(overlap)
+	require.Error(t, err)
+
+	keySet.PublishNext(newKey)
+	require.Len(t, keySet.JWKS().Keys, 2)
+	_, err = keySet.Rotate(overlap)
+	require.Error(t, err)
+	require.Equal(t, oldKey.ID, keySet.Current().ID)
+
+	time.Sleep(lead)
+	key, err := keySet.Rotate(overlap)
+	require.NoError(t, err)
+	require.Equal(t, newKey.ID, key.ID)
+	require.Equal(t, newKey.ID, keySet.Current().ID)
+	require.Len(t, keySet.JWKS().Keys, 2)
+
+	// 重叠窗口内旧key签名的token仍然有效
+	_, err = manager.Verify(oldToken)
+	require.NoError(t, err)
+
+	newToken, _, err := manager.Generate(user)
+	require.NoError(t, err)
+
+	time.Sleep(2 * overlap)
+	_, err = manager.Verify(oldToken)
+	require.Error(t, err)
+	_, err = manager.Verify(newToken)
+	require.NoError(t, err)
+	require.Len(t, keySet.JWKS().Keys, 1)
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	t.Parallel()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	data, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0600)
+	require.NoError(t, err)
+
+	key, err := service.LoadSigningKey("", keyFile)
+	require.NoError(t, err)
+	require.Equal(t, "ES256", key.Method.Alg())
+
+	expected, err := service.NewSigningKey("", privateKey)
+	require.NoError(t, err)
+	require.Equal(t, expected.ID, key.ID)
+}
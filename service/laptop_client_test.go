@@ -2,6 +2,7 @@ package service_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/Ruadgedy/pcbook-go/pb"
@@ -10,18 +11,22 @@ import (
 	"github.com/Ruadgedy/pcbook-go/service"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestClientCreateLaptop(t *testing.T) {
 	t.Parallel()
 
 	laptopStore := service.NewInMemoryLaptopStore()
-	serverAddress := startTestLaptopServer(t,laptopStore, nil, nil)
+	serverAddress := startTestLaptopServer(t,laptopStore, nil, nil, nil)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
 	laptop := sample.NewLaptop()
@@ -43,6 +48,88 @@ func TestClientCreateLaptop(t *testing.T) {
 
 }
 
+func TestClientBulkCreateLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	existing := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(existing))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	noID := sample.NewLaptop()
+	noID.Id = ""
+	invalidID := sample.NewLaptop()
+	invalidID.Id = "invalid"
+	noCPU := sample.NewLaptop()
+	noCPU.Cpu = nil
+	laptop := sample.NewLaptop()
+	laptops := []*pb.Laptop{laptop, noID, invalidID, existing, laptop, noCPU}
+
+	// dry run和创建的检查相同，只是不保存任何laptop
+	res := bulkCreateLaptops(t, laptopClient, laptops, true)
+	require.Equal(t, uint32(2), res.GetCreatedCount())
+	require.Equal(t, uint32(4), res.GetFailedCount())
+	require.Equal(t, codes.InvalidArgument.String(), res.GetResults()[5].GetErrorCode())
+	require.Contains(t, res.GetResults()[5].GetErrorMessage(), "cpu")
+	found, err := laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	res = bulkCreateLaptops(t, laptopClient, laptops, false)
+	require.Equal(t, uint32(2), res.GetCreatedCount())
+	require.Equal(t, uint32(4), res.GetFailedCount())
+
+	results := res.GetResults()
+	require.Len(t, results, len(laptops))
+	for i, result := range results {
+		require.Equal(t, uint32(i), result.GetIndex())
+	}
+	require.Equal(t, laptop.Id, results[0].GetId())
+	require.Empty(t, results[0].GetErrorCode())
+	require.NotEmpty(t, results[1].GetId())
+	require.Equal(t, codes.InvalidArgument.String(), results[2].GetErrorCode())
+	require.Equal(t, codes.AlreadyExists.String(), results[3].GetErrorCode())
+	require.Equal(t, codes.AlreadyExists.String(), results[4].GetErrorCode())
+	require.Equal(t, codes.InvalidArgument.String(), results[5].GetErrorCode())
+
+	for _, id := range []string{laptop.Id, results[1].GetId()} {
+		found, err := laptopStore.Find(id)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+	}
+}
+
+func bulkCreateLaptops(t *testing.T, laptopClient pb.LaptopServiceClient, laptops []*pb.Laptop, dryRun bool) *pb.BulkCreateLaptopsResponse {
+	stream, err := laptopClient.BulkCreateLaptops(context.Background())
+	require.NoError(t, err)
+	for _, laptop := range laptops {
+		require.NoError(t, stream.Send(&pb.BulkCreateLaptopsRequest{Laptop: laptop, DryRun: dryRun}))
+	}
+	res, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	return res
+}
+
+func TestClientGetLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	res, err := laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+	requireSameLaptop(t, laptop, res.GetLaptop())
+
+	_, err = laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
 func requireSameLaptop(t *testing.T, laptop *pb.Laptop, other *pb.Laptop) {
 	// 不能直接比较，因为laptop中有一些proto产生的grpc字段
 	//require.Equal(t,laptop, other)
@@ -62,8 +149,8 @@ func newTestLaptopClient(t *testing.T, serverAddress string) pb.LaptopServiceCli
 	return pb.NewLaptopServiceClient(conn)
 }
 
-func startTestLaptopServer(t *testing.T, laptopStore service.LaptopStore, imageStore service.ImageStore, ratingStore service.RatingStore)  string {
-	LaptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+func startTestLaptopServer(t *testing.T, laptopStore service.LaptopStore, imageStore service.ImageStore, ratingStore service.RatingStore, ratingBroker *service.RatingBroker)  string {
+	LaptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore, ratingBroker)
 
 	grpcServer := grpc.NewServer()
 	pb.RegisterLaptopServiceServer(grpcServer, LaptopServer)
@@ -133,7 +220,7 @@ func TestClientSearchLaptop(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil, nil)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 	request := &pb.SearchLaptopRequest{Filter: filter}
 	stream, err := laptopClient.SearchLaptop(context.Background(), request)
@@ -167,7 +254,7 @@ func TestClientUploadImage(t *testing.T) {
 	err := laptopStore.Save(laptop)
 	require.NoError(t, err)
 
-	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil, nil)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
 	imagePath := fmt.Sprintf("%s/laptop.jpg", testImageFolder)
@@ -224,6 +311,50 @@ func TestClientUploadImage(t *testing.T) {
 	require.NoError(t, os.Remove(savedImagePath))
 }
 
+func TestClientDownloadImage(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewDiskImageStore(t.TempDir())
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	image := make([]byte, 100*1024)
+	for i := range image {
+		image[i] = byte(i)
+	}
+	imageID, err := imageStore.Save(laptop.GetId(), "", ".jpg", *bytes.NewBuffer(image))
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	stream, err := laptopClient.DownloadImage(context.Background(), &pb.DownloadImageRequest{Id: imageID})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetId(), res.GetInfo().GetLaptopId())
+	require.Equal(t, ".jpg", res.GetInfo().GetImageType())
+
+	var downloaded []byte
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		downloaded = append(downloaded, res.GetChunkData()...)
+	}
+	require.Equal(t, image, downloaded)
+
+	stream, err = laptopClient.DownloadImage(context.Background(), &pb.DownloadImageRequest{Id: "unknown"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
 func TestClientRateLaptop(t *testing.T)  {
 	t.Parallel()
 
@@ -234,7 +365,7 @@ func TestClientRateLaptop(t *testing.T)  {
 	err := laptopStore.Save(laptop)
 	require.NoError(t, err)
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore, nil)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
 	stream, err := laptopClient.RateLaptop(context.Background())
@@ -270,4 +401,163 @@ func TestClientRateLaptop(t *testing.T)  {
 		require.Equal(t, uint32(idx+1), res.GetRatedCount())
 		require.Equal(t, averages[idx], res.GetAverageScore())
 	}
-}
\ No newline at end of file
+}
+func TestClientWatchRatings(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	ratingBroker := service.NewRatingBroker(10, service.DropUpdates)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	other := sample.NewLaptop()
+	err = laptopStore.Save(other)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore, ratingBroker)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watchStream, err := laptopClient.WatchRatings(ctx, &pb.WatchRatingsRequest{LaptopIds: []string{laptop.GetId()}})
+	require.NoError(t, err)
+
+	// 收到header说明服务端已经完成订阅
+	_, err = watchStream.Header()
+	require.NoError(t, err)
+
+	rateStream, err := laptopClient.RateLaptop(context.Background())
+	require.NoError(t, err)
+
+	requests := []*pb.RateLaptopRequest{
+		{LaptopId: laptop.GetId(), Score: 8},
+		{LaptopId: other.GetId(), Score: 5},
+		{LaptopId: laptop.GetId(), Score: 10},
+	}
+	for _, req := range requests {
+		err := rateStream.Send(req)
+		require.NoError(t, err)
+	}
+	err = rateStream.CloseSend()
+	require.NoError(t, err)
+
+	// 只会收到被订阅的laptop的评分更新
+	averages := []float64{8, 9}
+	for idx, average := range averages {
+		res, err := watchStream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, laptop.GetId(), res.GetLaptopId())
+		require.Equal(t, uint32(idx+1), res.GetRatedCount())
+		require.Equal(t, average, res.GetAverageScore())
+	}
+
+	unknownStream, err := laptopClient.WatchRatings(context.Background(), &pb.WatchRatingsRequest{LaptopIds: []string{"unknown-id"}})
+	require.NoError(t, err)
+
+	_, err = unknownStream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// 服务器停止时关闭broker，watcher收到Unavailable后可以到其他服务器重新订阅
+	ratingBroker.Close()
+	_, err = watchStream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestClientLaptopOwnership(t *testing.T) {
+	t.Parallel()
+
+	policy, err := service.ParsePolicy([]byte(`
+roles:
+  admin:
+    inherits: [editor]
+  editor: {}
+rules:
+  - methods: [/techschool.pcbook.LaptopService/CreateLaptop]
+    roles: [editor]
+  - methods:
+      - /techschool.pcbook.LaptopService/UpdateLaptop
+      - /techschool.pcbook.LaptopService/DeleteLaptop
+    roles: [admin]
+    owner_roles: [editor]
+  - methods: [/techschool.pcbook.LaptopService/TransferLaptopOwnership]
+    roles: [admin]
+  - methods: [/techschool.pcbook.LaptopService/GetLaptop]
+    roles: [admin]
+    owner_roles: [editor]
+`))
+	require.NoError(t, err)
+
+	jwtManager := service.NewJWTManager("secret", time.Minute, time.Hour)
+	userStore := service.NewInMemoryUserStore()
+	interceptor := service.NewAuthInterceptor(jwtManager, service.NewInMemoryRevokedTokenStore(), nil, userStore, policy)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(interceptor.Unary()))
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptopServer := service.NewLaptopServer(laptopStore, nil, nil, nil)
+	laptopServer.SetUserStore(userStore)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	laptopClient := newTestLaptopClient(t, listener.Addr().String())
+	contextOf := func(username string, role string) context.Context {
+		user, err := service.NewUser(username, "secret", role)
+		require.NoError(t, err)
+		require.NoError(t, userStore.Save(user))
+		accessToken, _, err := jwtManager.Generate(user)
+		require.NoError(t, err)
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken)
+	}
+	alice := contextOf("alice", service.RoleEditor)
+	bob := contextOf("bob", service.RoleEditor)
+	admin := contextOf("admin1", service.RoleAdmin)
+
+	// 客户端指定的owner会被忽略
+	laptop := sample.NewLaptop()
+	laptop.Owner = "bob"
+	_, err = laptopClient.CreateLaptop(alice, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+	found, err := laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, "alice", found.Owner)
+
+	// editor只能修改自己的laptop
+	_, err = laptopClient.UpdateLaptop(bob, &pb.UpdateLaptopRequest{Laptop: laptop})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	laptop.PriceUsd = 1000
+	_, err = laptopClient.UpdateLaptop(alice, &pb.UpdateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+	found, err = laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, float64(1000), found.PriceUsd)
+	require.Equal(t, "alice", found.Owner)
+
+	// 不检查owner的方法不能使用owner_roles，否则owner限制不会生效
+	_, err = laptopClient.GetLaptop(alice, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = laptopClient.GetLaptop(admin, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+
+	// 只有admin可以转移所有权，新的owner必须存在
+	transfer := &pb.TransferLaptopOwnershipRequest{LaptopId: laptop.Id, NewOwner: "bob"}
+	_, err = laptopClient.TransferLaptopOwnership(alice, transfer)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = laptopClient.TransferLaptopOwnership(admin, &pb.TransferLaptopOwnershipRequest{LaptopId: laptop.Id, NewOwner: "nobody"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	res, err := laptopClient.TransferLaptopOwnership(admin, transfer)
+	require.NoError(t, err)
+	require.Equal(t, "bob", res.GetLaptop().GetOwner())
+
+	_, err = laptopClient.DeleteLaptop(alice, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = laptopClient.DeleteLaptop(bob, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+	_, err = laptopClient.DeleteLaptop(admin, &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
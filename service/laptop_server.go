@@ -7,53 +7,61 @@ import (
 	"github.com/Ruadgedy/pcbook-go/pb"
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
-	"log"
+	"os"
+	"time"
 )
 
-const maxImageSize = 1 << 20
+// DefaultMaxImageSize is the default max size of an uploaded image
+const DefaultMaxImageSize = 1 << 20
+
+const (
+	// imageChunkSize is the size of the image data sent in each download response
+	imageChunkSize = 32 * 1024
+	// maxBulkLaptops limits the laptops of a BulkCreateLaptops call, which are kept in memory until the stream is closed
+	maxBulkLaptops = 1000
+)
 
 // LaptopServer is the server that provides the laptop services.
 type LaptopServer struct {
 	laptopStore LaptopStore
 	imageStore ImageStore
 	ratingStore RatingStore
+	ratingBroker *RatingBroker
+	maxImageSize int64
+	userStore UserStore // 转移laptop时检查新的owner是否存在，为nil时不能转移
 	pb.UnimplementedLaptopServiceServer // UnimplementedLaptopServiceServer must be embedded to have forward compatible implementations.
 }
 
 // 输入unary，输出unary
 func (server *LaptopServer) CreateLaptop(cxt context.Context, req *pb.CreateLaptopRequest) (*pb.CreateLaptopResponse, error) {
 	laptop := req.GetLaptop()
-	log.Printf("receive a create laptop request with id :%s", laptop.Id)
+	logDebugf("receive a create laptop request with id :%s", laptop.Id)
 
-	if len(laptop.Id) > 0 {
-		// check if it's a valid UUID
-		_, err := uuid.Parse(laptop.Id)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "code ID is not a valid UUID: %v", err)
-		}
-	} else {
-		id, err := uuid.NewRandom()
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "cannot generate a new laptop ID:%v", err)
-		}
-		laptop.Id = id.String()
+	if err := prepareLaptopID(laptop); err != nil {
+		return nil, err
 	}
 
 	// some heavy processing to satisfy timeout
 	//time.Sleep(6*time.Second)
 	// 判断请求是否被取消
 	if cxt.Err() == context.Canceled {
-		log.Print("request is canceled")
+		logDebugf("request is canceled")
 		return nil, status.Errorf(codes.Canceled, "request is canceled")
 	}
 	// 判断请求是否超时
 	if cxt.Err() == context.DeadlineExceeded {
-		log.Print("deadline exceeded")
+		logDebugf("deadline exceeded")
 		return nil, status.Error(codes.DeadlineExceeded,"deadline exceeded")
 	}
 
+	// 创建laptop的用户成为它的owner，客户端不能指定owner
+	laptop.Owner = usernameFromContext(cxt)
+
 	// save the laptop to in-memory storage
 	if err := server.laptopStore.Save(laptop); err != nil {
 		code := codes.Internal
@@ -64,16 +72,259 @@ func (server *LaptopServer) CreateLaptop(cxt context.Context, req *pb.CreateLapt
 		return nil, status.Errorf(code, "cannot save laptop to the store: %v", err)
 	}
 
-	log.Printf("saved laptop with id : %s", laptop.Id)
+	logDebugf("saved laptop with id : %s", laptop.Id)
 
 	res := &pb.CreateLaptopResponse{Id: laptop.Id}
 	return res, nil
 }
 
+// prepareLaptopID checks the id of the laptop is a valid UUID, or generates a new id when it is empty
+func prepareLaptopID(laptop *pb.Laptop) error {
+	if len(laptop.Id) > 0 {
+		// check if it's a valid UUID
+		_, err := uuid.Parse(laptop.Id)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "code ID is not a valid UUID: %v", err)
+		}
+	} else {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return status.Errorf(codes.Internal, "cannot generate a new laptop ID:%v", err)
+		}
+		laptop.Id = id.String()
+	}
+	return nil
+}
+
+// validateLaptop checks the fields of a laptop created in bulk, which usually come from a hand-written catalog
+func validateLaptop(laptop *pb.Laptop) error {
+	invalid := func(format string, args ...interface{}) error {
+		return status.Errorf(codes.InvalidArgument, format, args...)
+	}
+
+	switch cpu, ram := laptop.GetCpu(), laptop.GetRam(); {
+	case laptop.GetBrand() == "":
+		return invalid("brand is required")
+	case laptop.GetName() == "":
+		return invalid("name is required")
+	case cpu == nil:
+		return invalid("cpu is required")
+	case cpu.GetNumberCores() == 0:
+		return invalid("cpu number_cores must be positive")
+	case cpu.GetNumberThreads() < cpu.GetNumberCores():
+		return invalid("cpu number_threads must be at least number_cores")
+	case cpu.GetMinGhz() <= 0 || cpu.GetMaxGhz() < cpu.GetMinGhz():
+		return invalid("cpu min_ghz must be positive and not greater than max_ghz")
+	case ram == nil || ram.GetValue() == 0 || ram.GetUnit() == pb.Memory_UNKNOWN:
+		return invalid("ram must have a positive value and a unit")
+	case laptop.GetPriceUsd() < 0:
+		return invalid("price_usd cannot be negative")
+	}
+
+	for i, gpu := range laptop.GetGpus() {
+		if gpu.GetMinGhz() <= 0 || gpu.GetMaxGhz() < gpu.GetMinGhz() {
+			return invalid("gpus[%d] min_ghz must be positive and not greater than max_ghz", i)
+		}
+	}
+	for i, storage := range laptop.GetStorages() {
+		if memory := storage.GetMemory(); memory == nil || memory.GetValue() == 0 || memory.GetUnit() == pb.Memory_UNKNOWN {
+			return invalid("storages[%d] memory must have a positive value and a unit", i)
+		}
+	}
+	return nil
+}
+
+// BulkCreateLaptops is a client-streaming RPC to create many laptops, and reports the result of each laptop.
+// The laptops are saved after the client closes the stream, so an interrupted call creates nothing
+func (server *LaptopServer) BulkCreateLaptops(stream pb.LaptopService_BulkCreateLaptopsServer) error {
+	var laptops []*pb.Laptop
+	dryRun := false
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot receive laptop: %v", err))
+		}
+
+		if len(laptops) == 0 {
+			dryRun = req.GetDryRun()
+		}
+		if len(laptops) >= maxBulkLaptops {
+			return logError(status.Errorf(codes.InvalidArgument, "cannot create more than %d laptops in one call", maxBulkLaptops))
+		}
+		laptops = append(laptops, req.GetLaptop())
+	}
+	logDebugf("receive a bulk-create-laptops request with %d laptops, dry run: %v", len(laptops), dryRun)
+
+	owner := usernameFromContext(stream.Context())
+	created := make(map[string]bool)
+	res := &pb.BulkCreateLaptopsResponse{}
+	for i, laptop := range laptops {
+		result := &pb.BulkCreateLaptopResult{Index: uint32(i)}
+		err := server.bulkCreateLaptop(laptop, owner, dryRun, created)
+		if err != nil {
+			result.ErrorCode = status.Code(err).String()
+			result.ErrorMessage = status.Convert(err).Message()
+			res.FailedCount++
+		} else {
+			result.Id = laptop.GetId()
+			res.CreatedCount++
+		}
+		res.Results = append(res.Results, result)
+	}
+
+	return stream.SendAndClose(res)
+}
+
+// bulkCreateLaptop creates a laptop of the bulk, or only validates it in dry run. The created ids include
+// the laptops validated in dry run, so that the duplicate ids in the same call are found
+func (server *LaptopServer) bulkCreateLaptop(laptop *pb.Laptop, owner string, dryRun bool, created map[string]bool) error {
+	if laptop == nil {
+		return status.Errorf(codes.InvalidArgument, "laptop is required")
+	}
+	if err := prepareLaptopID(laptop); err != nil {
+		return err
+	}
+	// dry run和创建使用相同的检查，dry run通过的laptop才能被创建
+	if err := validateLaptop(laptop); err != nil {
+		return err
+	}
+	if created[laptop.Id] {
+		return status.Errorf(codes.AlreadyExists, "laptop %s is duplicated in the request", laptop.Id)
+	}
+	laptop.Owner = owner
+
+	if dryRun {
+		found, err := server.laptopStore.Find(laptop.Id)
+		if err != nil {
+			return status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+		}
+		if found != nil {
+			return status.Errorf(codes.AlreadyExists, "cannot save laptop to the store: %v", ErrAlreadyExists)
+		}
+	} else if err := server.laptopStore.Save(laptop); err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExists) {
+			code = codes.AlreadyExists
+		}
+		return status.Errorf(code, "cannot save laptop to the store: %v", err)
+	}
+
+	created[laptop.Id] = true
+	return nil
+}
+
+// UpdateLaptop is a unary RPC to replace an existing laptop, the owner of the laptop is kept
+func (server *LaptopServer) UpdateLaptop(ctx context.Context, req *pb.UpdateLaptopRequest) (*pb.UpdateLaptopResponse, error) {
+	laptop := req.GetLaptop()
+	logDebugf("receive an update-laptop request with id: %s", laptop.GetId())
+
+	// 在存储的锁内检查owner，避免检查之后laptop被转移给其他人
+	_, err := server.laptopStore.Update(laptop.GetId(), func(found *pb.Laptop) error {
+		err := authorizeOwner(ctx, found.Owner)
+		if err != nil {
+			return err
+		}
+
+		owner := found.Owner
+		proto.Reset(found)
+		proto.Merge(found, laptop)
+		found.Owner = owner
+		return nil
+	})
+	if err != nil {
+		return nil, logError(laptopStoreError("update", err))
+	}
+
+	return &pb.UpdateLaptopResponse{}, nil
+}
+
+// DeleteLaptop is a unary RPC to delete a laptop
+func (server *LaptopServer) DeleteLaptop(ctx context.Context, req *pb.DeleteLaptopRequest) (*pb.DeleteLaptopResponse, error) {
+	laptopID := req.GetId()
+	logDebugf("receive a delete-laptop request with id: %s", laptopID)
+
+	err := server.laptopStore.Delete(laptopID, func(laptop *pb.Laptop) error {
+		return authorizeOwner(ctx, laptop.Owner)
+	})
+	if err != nil {
+		return nil, logError(laptopStoreError("delete", err))
+	}
+
+	return &pb.DeleteLaptopResponse{}, nil
+}
+
+// TransferLaptopOwnership is a unary RPC for admin to change the owner of a laptop to an existing user
+func (server *LaptopServer) TransferLaptopOwnership(ctx context.Context, req *pb.TransferLaptopOwnershipRequest) (*pb.TransferLaptopOwnershipResponse, error) {
+	laptopID := req.GetLaptopId()
+	newOwner := req.GetNewOwner()
+	logDebugf("receive a transfer-laptop-ownership request: id=%s, new owner=%s", laptopID, newOwner)
+
+	if newOwner == "" {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "new owner is required"))
+	}
+	if server.userStore == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "cannot check the new owner without a user store"))
+	}
+	user, err := server.userStore.Find(newOwner)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find user: %v", err))
+	}
+	if user == nil {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "new owner %s is not found", newOwner))
+	}
+
+	laptop, err := server.laptopStore.Update(laptopID, func(laptop *pb.Laptop) error {
+		err := authorizeOwner(ctx, laptop.Owner)
+		if err != nil {
+			return err
+		}
+
+		laptop.Owner = newOwner
+		return nil
+	})
+	if err != nil {
+		return nil, logError(laptopStoreError("update", err))
+	}
+
+	res := &pb.TransferLaptopOwnershipResponse{Laptop: laptop}
+	return res, nil
+}
+
+// laptopStoreError converts the error of changing a laptop in the store to a gRPC status,
+// the errors of the owner check are already gRPC status
+func laptopStoreError(action string, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, ErrNotFound) {
+		return status.Errorf(codes.NotFound, "cannot %s laptop: %v", action, err)
+	}
+	return status.Errorf(codes.Internal, "cannot %s laptop: %v", action, err)
+}
+
+// GetLaptop is a unary RPC to get a laptop by id
+func (server *LaptopServer) GetLaptop(ctx context.Context, req *pb.GetLaptopRequest) (*pb.GetLaptopResponse, error) {
+	laptopID := req.GetId()
+	logDebugf("receive a get-laptop request with id: %s", laptopID)
+
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop %s is not found", laptopID))
+	}
+
+	return &pb.GetLaptopResponse{Laptop: laptop}, nil
+}
+
 // 输入unary， 输出stream
 func (server *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest,stream pb.LaptopService_SearchLaptopServer) error{
 	filter := req.GetFilter()
-	log.Printf("receive a search-laptop request with filter: %v",filter)
+	logDebugf("receive a search-laptop request with filter: %v",filter)
 
 	err := server.laptopStore.Search(
 		stream.Context(), // 传递流上下文
@@ -86,7 +337,7 @@ func (server *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest,stream pb.L
 				return err
 			}
 
-			log.Printf("sent laptop with id: %s", laptop.GetId())
+			logDebugf("sent laptop with id: %s", laptop.GetId())
 			return nil
 		},
 	)
@@ -107,7 +358,7 @@ func (server *LaptopServer)UploadImage(stream pb.LaptopService_UploadImageServer
 	// 获取到请求中的laptopID和imageType
 	laptopId := req.GetInfo().GetLaptopId()
 	imageType := req.GetInfo().GetImageType()
-	log.Printf("receivae an upload-image request for laptop %s with image type %s", laptopId, imageType)
+	logDebugf("receivae an upload-image request for laptop %s with image type %s", laptopId, imageType)
 
 	// 查找给定的laptop是否存在
 	laptop, err := server.laptopStore.Find(laptopId)
@@ -117,6 +368,11 @@ func (server *LaptopServer)UploadImage(stream pb.LaptopService_UploadImageServer
 	if laptop == nil {
 		return logError(status.Errorf(codes.InvalidArgument, "laptop id %s doesn't exist",laptopId))
 	}
+	// 只能给自己拥有的laptop上传图片时，检查laptop的owner
+	err = authorizeOwner(stream.Context(), laptop.Owner)
+	if err != nil {
+		return logError(err)
+	}
 
 	imageData := bytes.Buffer{}
 	imageSize := 0
@@ -127,11 +383,11 @@ func (server *LaptopServer)UploadImage(stream pb.LaptopService_UploadImageServer
 			return err
 		}
 
-		log.Println("waiting to receive more data")
+		logDebugf("waiting to receive more data")
 
 		req, err := stream.Recv()
 		if err == io.EOF{
-			log.Println(" no more data")
+			logDebugf("no more data")
 			break
 		}
 		if err != nil {
@@ -141,11 +397,11 @@ func (server *LaptopServer)UploadImage(stream pb.LaptopService_UploadImageServer
 		chunk := req.GetChunkData()
 		size := len(chunk)
 
-		log.Printf("receive a chunk with size: %d", size)
+		logDebugf("receive a chunk with size: %d", size)
 
 		imageSize += size
-		if imageSize > maxImageSize {
-			return logError(status.Errorf(codes.InvalidArgument," image is too large:%d > %d", imageSize, maxImageSize))
+		if int64(imageSize) > server.maxImageSize {
+			return logError(status.Errorf(codes.InvalidArgument," image is too large:%d > %d", imageSize, server.maxImageSize))
 		}
 
 		// write slowly
@@ -158,7 +414,7 @@ func (server *LaptopServer)UploadImage(stream pb.LaptopService_UploadImageServer
 		}
 	}
 
-	imageID, err := server.imageStore.Save(laptopId, imageType, imageData)
+	imageID, err := server.imageStore.Save(laptopId, usernameFromContext(stream.Context()), imageType, imageData)
 	if err != nil {
 		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
 	}
@@ -174,10 +430,97 @@ func (server *LaptopServer)UploadImage(stream pb.LaptopService_UploadImageServer
 		return logError(status.Errorf(codes.Unknown, "cannot send response: %v",err))
 	}
 
-	log.Printf("saved image with id: %s, size: %d", imageID, imageSize)
+	logDebugf("saved image with id: %s, size: %d", imageID, imageSize)
 	return nil
 }
 
+// 输入unary，输出stream
+// DownloadImage is a server-streaming RPC to download a laptop image, the first response is the image info
+func (server *LaptopServer) DownloadImage(req *pb.DownloadImageRequest, stream pb.LaptopService_DownloadImageServer) error {
+	imageID := req.GetId()
+	logDebugf("receive a download-image request with id: %s", imageID)
+
+	info, err := server.imageStore.Find(imageID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	}
+	if info == nil {
+		return logError(status.Errorf(codes.NotFound, "image %s is not found", imageID))
+	}
+
+	file, err := os.Open(info.Path)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot open image file: %v", err))
+	}
+	defer file.Close()
+
+	res := &pb.DownloadImageResponse{
+		Data: &pb.DownloadImageResponse_Info{
+			Info: &pb.ImageInfo{
+				LaptopId:  info.LaptopID,
+				ImageType: info.Type,
+			},
+		},
+	}
+	err = stream.Send(res)
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send image info: %v", err))
+	}
+
+	buffer := make([]byte, imageChunkSize)
+	for {
+		n, err := file.Read(buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot read image file: %v", err))
+		}
+
+		res := &pb.DownloadImageResponse{
+			Data: &pb.DownloadImageResponse_ChunkData{
+				ChunkData: buffer[:n],
+			},
+		}
+		err = stream.Send(res)
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot send chunk data: %v", err))
+		}
+	}
+
+	return nil
+}
+
+// DeleteImage is a unary RPC to delete a laptop image
+func (server *LaptopServer) DeleteImage(ctx context.Context, req *pb.DeleteImageRequest) (*pb.DeleteImageResponse, error) {
+	imageID := req.GetId()
+	logDebugf("receive a delete-image request with id: %s", imageID)
+
+	info, err := server.imageStore.Find(imageID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	}
+	if info == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "image %s is not found", imageID))
+	}
+
+	err = authorizeOwner(ctx, info.Owner)
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	err = server.imageStore.Delete(imageID)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot delete image: %v", err))
+	}
+
+	return &pb.DeleteImageResponse{}, nil
+}
+
 // 输入stream，输出stream
 // RateLaptop is a bidirectional-stream RPC that allows client to rate a stream of laptops
 // with a score, and returns a stream of average score for each of them
@@ -190,7 +533,7 @@ func (server *LaptopServer)RateLaptop(stream pb.LaptopService_RateLaptopServer)
 
 		req, err := stream.Recv()
 		if err == io.EOF {
-			log.Println("no more data")
+			logDebugf("no more data")
 			break
 		}
 		if err != nil {
@@ -200,7 +543,7 @@ func (server *LaptopServer)RateLaptop(stream pb.LaptopService_RateLaptopServer)
 		laptopId := req.GetLaptopId()
 		score := req.GetScore()
 
-		log.Printf("receive a rate-laptop request: id=%s, score=%.2f",laptopId, score)
+		logDebugf("receive a rate-laptop request: id=%s, score=%.2f",laptopId, score)
 
 		found, err := server.laptopStore.Find(laptopId)
 		if err != nil {
@@ -210,7 +553,7 @@ func (server *LaptopServer)RateLaptop(stream pb.LaptopService_RateLaptopServer)
 			return logError(status.Errorf(codes.NotFound,"laptop %s is not found",laptopId))
 		}
 
-		rating, err := server.ratingStore.Add(laptopId, score)
+		rating, err := server.ratingStore.Add(laptopId, usernameFromContext(stream.Context()), score)
 		if err != nil {
 			return logError(status.Errorf(codes.Internal,"cannot add rating to the store: %v",err))
 		}
@@ -221,6 +564,11 @@ func (server *LaptopServer)RateLaptop(stream pb.LaptopService_RateLaptopServer)
 			AverageScore: rating.Sum / float64(rating.Count),
 		}
 
+		// 将评分更新推送给所有订阅了该laptop的客户端
+		if server.ratingBroker != nil {
+			server.ratingBroker.Publish(res)
+		}
+
 		err = stream.Send(res)
 		if err != nil {
 			return logError(status.Errorf(codes.Unknown,"cannot send stream response: %v", err))
@@ -229,6 +577,146 @@ func (server *LaptopServer)RateLaptop(stream pb.LaptopService_RateLaptopServer)
 	return nil
 }
 
+// 输入unary，输出stream
+// WatchRatings is a server-streaming RPC that sends the rating updates of the given laptops
+// whenever anyone rates them
+func (server *LaptopServer) WatchRatings(req *pb.WatchRatingsRequest, stream pb.LaptopService_WatchRatingsServer) error {
+	if server.ratingBroker == nil {
+		return logError(status.Errorf(codes.Unimplemented, "rating updates are not available"))
+	}
+
+	laptopIDs := req.GetLaptopIds()
+	if len(laptopIDs) == 0 {
+		return logError(status.Errorf(codes.InvalidArgument, "no laptop id to watch"))
+	}
+
+	logDebugf("receive a watch-ratings request for laptops: %v", laptopIDs)
+
+	for _, laptopID := range laptopIDs {
+		found, err := server.laptopStore.Find(laptopID)
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		}
+		if found == nil {
+			return logError(status.Errorf(codes.NotFound, "laptop %s is not found", laptopID))
+		}
+	}
+
+	sub := server.ratingBroker.Subscribe(laptopIDs)
+	defer sub.Close()
+
+	// 订阅成功后立即发送header，客户端收到header即可确认不会错过之后的评分更新
+	err := stream.SendHeader(metadata.MD{})
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send header: %v", err))
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return contextError(stream.Context())
+		case <-sub.Done():
+			if errors.Is(sub.Err(), ErrSlowConsumer) {
+				return logError(status.Errorf(codes.ResourceExhausted, "%v", sub.Err()))
+			}
+			if errors.Is(sub.Err(), ErrBrokerClosed) {
+				// 服务器正在停止，客户端可以到其他服务器重新订阅
+				return logError(status.Errorf(codes.Unavailable, "server is shutting down"))
+			}
+			return nil
+		case res := <-sub.Updates():
+			err := stream.Send(res)
+			if err != nil {
+				return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
+			}
+		}
+	}
+}
+
+// RemoveRating is a unary RPC to remove a rating for moderation, the rating of its laptop is recomputed
+func (server *LaptopServer) RemoveRating(ctx context.Context, req *pb.RemoveRatingRequest) (*pb.RemoveRatingResponse, error) {
+	ratingID := req.GetRatingId()
+	logDebugf("receive a remove-rating request with id: %s", ratingID)
+
+	event, rating, err := server.ratingStore.Remove(ratingID)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot remove rating: %v", err))
+	}
+
+	update := &pb.RateLaptopResponse{
+		LaptopId:   event.LaptopID,
+		RatedCount: rating.Count,
+	}
+	if rating.Count > 0 {
+		update.AverageScore = rating.Sum / float64(rating.Count)
+	}
+
+	if server.ratingBroker != nil {
+		server.ratingBroker.Publish(update)
+	}
+
+	res := &pb.RemoveRatingResponse{Rating: update}
+	return res, nil
+}
+
+// ExportRatings is a server-streaming RPC that sends the rating history of a laptop in a time range
+func (server *LaptopServer) ExportRatings(req *pb.ExportRatingsRequest, stream pb.LaptopService_ExportRatingsServer) error {
+	laptopID := req.GetLaptopId()
+	logDebugf("receive an export-ratings request for laptop %s", laptopID)
+
+	var from, to time.Time
+	if req.GetFrom() != nil {
+		from = req.GetFrom().AsTime()
+	}
+	if req.GetTo() != nil {
+		to = req.GetTo().AsTime()
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return logError(status.Errorf(codes.InvalidArgument, "from %v must be before to %v", from, to))
+	}
+
+	events, err := server.ratingStore.History(laptopID, from, to)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot get rating history: %v", err))
+	}
+
+	for _, event := range events {
+		err := contextError(stream.Context())
+		if err != nil {
+			return err
+		}
+
+		res := &pb.ExportRatingsResponse{
+			Rating: &pb.Rating{
+				Id:        event.ID,
+				LaptopId:  event.LaptopID,
+				Username:  event.Username,
+				Score:     event.Score,
+				CreatedAt: timestamppb.New(event.CreatedAt),
+			},
+		}
+
+		err = stream.Send(res)
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
+		}
+	}
+	return nil
+}
+
+// usernameFromContext returns the username of the authenticated caller, or empty if there is none
+func usernameFromContext(ctx context.Context) string {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return ""
+	}
+	return claims.Username
+}
+
 func contextError(ctx context.Context) error {
 	switch ctx.Err() {
 	case context.Canceled:
@@ -242,15 +730,28 @@ func contextError(ctx context.Context) error {
 
 func logError(err error) error {
 	if err != nil {
-		log.Print(err)
+		logErrorf("%v", err)
 	}
 	return err
 }
 
-func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
+// NewLaptopServer returns a new LaptopServer, ratingBroker may be nil if rating updates are not needed
+func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore, ratingBroker *RatingBroker) *LaptopServer {
 	return &LaptopServer{
 		laptopStore:                      laptopStore,
 		imageStore:                       imageStore,
 		ratingStore:                      ratingStore,
+		ratingBroker:                     ratingBroker,
+		maxImageSize:                     DefaultMaxImageSize,
 	}
 }
+
+// SetMaxImageSize sets the max size of an uploaded image, it must be called before the server starts
+func (server *LaptopServer) SetMaxImageSize(size int64) {
+	server.maxImageSize = size
+}
+
+// SetUserStore sets the store of the users that laptops can be transferred to, it must be called before the server starts
+func (server *LaptopServer) SetUserStore(userStore UserStore) {
+	server.userStore = userStore
+}
@@ -22,7 +22,7 @@ func TestServerCreateLaptop(t *testing.T) {
 
 	laptopDuplicateID := sample.NewLaptop()
 	storeDuplicateID := service.NewInMemoryLaptopStore()
-	err := storeDuplicateID.Save(laptopInvalidID)
+	err := storeDuplicateID.Save(laptopDuplicateID)
 	require.NoError(t, err)
 
 	testCases := []struct {
@@ -67,7 +67,7 @@ func TestServerCreateLaptop(t *testing.T) {
 				Laptop: tc.laptop,
 			}
 
-			server := service.NewLaptopServer(tc.store, nil,nil)
+			server := service.NewLaptopServer(tc.store, nil, nil, nil)
 			res, err := server.CreateLaptop(context.Background(), req)
 			if tc.code == codes.OK {
 				require.NoError(t, err)
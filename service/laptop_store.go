@@ -6,12 +6,12 @@ import (
 	"fmt"
 	"github.com/Ruadgedy/pcbook-go/pb"
 	"github.com/jinzhu/copier"
-	"log"
 	"sync"
 	"time"
 )
 
 var ErrAlreadyExists = errors.New("record already exists")
+var ErrNotFound = errors.New("record not found")
 
 // LaptopStore is an interface to store laptop
 type LaptopStore interface {
@@ -19,14 +19,20 @@ type LaptopStore interface {
 	Save(laptop *pb.Laptop) error
 	// Find finds a laptop by id
 	Find(id string) (*pb.Laptop, error)
+	// Update changes an existing laptop with the update function under the store lock and returns the updated laptop,
+	// the laptop is not changed if update returns an error
+	Update(id string, update func(laptop *pb.Laptop) error) (*pb.Laptop, error)
+	// Delete deletes a laptop by id if check, which may be nil, returns no error for it under the store lock
+	Delete(id string, check func(laptop *pb.Laptop) error) error
 	// Search searches the laptop with filter, returns one by one via the found function.
 	Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error
 }
 
 // InMemoryLaptopStore stores laptop in memory
 type InMemoryLaptopStore struct {
-	mutex sync.RWMutex
-	data  map[string]*pb.Laptop
+	mutex       sync.RWMutex
+	data        map[string]*pb.Laptop
+	searchDelay time.Duration // 模拟检查每个laptop的耗时
 }
 
 
@@ -35,11 +41,11 @@ func (store *InMemoryLaptopStore) Search(ctx context.Context, filter *pb.Filter,
 	defer store.mutex.RUnlock()
 
 	for _, laptop := range store.data{
-		time.Sleep(time.Second)
-		log.Println("do some check")
+		time.Sleep(store.searchDelay)
+		logDebugf("do some check")
 
 		if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
-			log.Println("context is canceled")
+			logDebugf("context is canceled")
 			return errors.New("context is cancelled")
 		}
 
@@ -145,9 +151,61 @@ func (store *InMemoryLaptopStore) Save(laptop *pb.Laptop) error {
 	return nil
 }
 
+func (store *InMemoryLaptopStore) Update(id string, update func(laptop *pb.Laptop) error) (*pb.Laptop, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	laptop := store.data[id]
+	if laptop == nil {
+		return nil, fmt.Errorf("laptop %s: %w", id, ErrNotFound)
+	}
+
+	// 在副本上修改，update返回错误时不影响保存的laptop
+	other, err := deepCopy(laptop)
+	if err != nil {
+		return nil, err
+	}
+	err = update(other)
+	if err != nil {
+		return nil, err
+	}
+	other.Id = id
+
+	store.data[id] = other
+	return deepCopy(other)
+}
+
+func (store *InMemoryLaptopStore) Delete(id string, check func(laptop *pb.Laptop) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	laptop := store.data[id]
+	if laptop == nil {
+		return fmt.Errorf("laptop %s: %w", id, ErrNotFound)
+	}
+	if check != nil {
+		err := check(laptop)
+		if err != nil {
+			return err
+		}
+	}
+
+	delete(store.data, id)
+	return nil
+}
+
 // NewInMemoryLaptopStore returns a new InMemoryLaptopStore.
 func NewInMemoryLaptopStore() *InMemoryLaptopStore {
 	return &InMemoryLaptopStore{
-		data: make(map[string]*pb.Laptop),
+		data:        make(map[string]*pb.Laptop),
+		searchDelay: time.Second,
 	}
 }
+
+// SetSearchDelay sets the simulated time to check each laptop when searching, the default is one second
+func (store *InMemoryLaptopStore) SetSearchDelay(delay time.Duration) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.searchDelay = delay
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the least severe level of the logs printed by the services
+type LogLevel int32
+
+const (
+	// LogDebug prints every log, including the trace of each request
+	LogDebug LogLevel = iota
+	// LogInfo prints the events of the server such as lockouts and key rotations, and the errors
+	LogInfo
+	// LogError prints only the errors
+	LogError
+)
+
+var logLevel = int32(LogDebug)
+
+var logLevelNames = []string{"debug", "info", "error"}
+
+// ParseLogLevel returns the log level of the name: debug, info or error
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+func (level LogLevel) String() string {
+	if level < 0 || int(level) >= len(logLevelNames) {
+		return fmt.Sprintf("LogLevel(%d)", level)
+	}
+	return logLevelNames[level]
+}
+
+// SetLogLevel sets the least severe level of the logs to print, it can be changed while the server is running
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+func logEnabled(level LogLevel) bool {
+	return level >= LogLevel(atomic.LoadInt32(&logLevel))
+}
+
+func logDebugf(format string, args ...interface{}) {
+	if logEnabled(LogDebug) {
+		log.Printf(format, args...)
+	}
+}
+
+func logInfof(format string, args ...interface{}) {
+	if logEnabled(LogInfo) {
+		log.Printf(format, args...)
+	}
+}
+
+func logErrorf(format string, args ...interface{}) {
+	if logEnabled(LogError) {
+		log.Printf(format, args...)
+	}
+}
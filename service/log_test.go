@@ -0,0 +1,24 @@
+package service_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []service.LogLevel{service.LogDebug, service.LogInfo, service.LogError} {
+		parsed, err := service.ParseLogLevel(level.String())
+		require.NoError(t, err)
+		require.Equal(t, level, parsed)
+	}
+
+	level, err := service.ParseLogLevel("INFO")
+	require.NoError(t, err)
+	require.Equal(t, service.LogInfo, level)
+
+	_, err = service.ParseLogLevel("warning")
+	require.Error(t, err)
+}
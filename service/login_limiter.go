@@ -0,0 +1,197 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginLimiter tracks failed login attempts per username and per client IP, and locks them out
+// with exponential backoff once they fail too many times
+type LoginLimiter struct {
+	mutex           sync.Mutex
+	maxUserFailures int
+	maxIPFailures   int
+	baseLockout     time.Duration
+	maxLockout      time.Duration
+	users           map[string]*loginFailures
+	ips             map[string]*loginFailures
+	lastPrune       time.Time
+}
+
+// loginFailures is the failed login attempts of a username or an IP
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// NewLoginLimiter returns a new LoginLimiter. A username or IP is locked out for baseLockout after it fails
+// the max number of times in a row, and the lockout doubles on each further failure up to maxLockout.
+// Failures are forgotten after maxLockout without any new failure
+func NewLoginLimiter(maxUserFailures int, maxIPFailures int, baseLockout time.Duration, maxLockout time.Duration) *LoginLimiter {
+	return &LoginLimiter{
+		maxUserFailures: maxUserFailures,
+		maxIPFailures:   maxIPFailures,
+		baseLockout:     baseLockout,
+		maxLockout:      maxLockout,
+		users:           make(map[string]*loginFailures),
+		ips:             make(map[string]*loginFailures),
+	}
+}
+
+// SetLimits changes the limits of the limiter while it is in use, the recorded failures are kept
+func (limiter *LoginLimiter) SetLimits(maxUserFailures int, maxIPFailures int, baseLockout time.Duration, maxLockout time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.maxUserFailures = maxUserFailures
+	limiter.maxIPFailures = maxIPFailures
+	limiter.baseLockout = baseLockout
+	limiter.maxLockout = maxLockout
+}
+
+// Allow returns how long the client has to wait before it can try to login again, 0 if it can login now.
+// An allowed attempt is counted as a failure right away, so that concurrent attempts cannot pass the limit
+// while the passwords are being compared. The caller must end it with Fail, Succeed or Release.
+// ip may be empty if it is unknown
+func (limiter *LoginLimiter) Allow(username string, ip string) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	wait := limiter.users[username].wait(now)
+	if ip != "" {
+		if other := limiter.ips[ip].wait(now); other > wait {
+			wait = other
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	limiter.prune(now)
+	limiter.fail(limiter.users, username, limiter.maxUserFailures, now)
+	if ip != "" {
+		limiter.fail(limiter.ips, ip, limiter.maxIPFailures, now)
+	}
+	return 0
+}
+
+// Fail ends an attempt allowed by Allow as a failure, and returns how long the client is locked out after it,
+// 0 if it is not
+func (limiter *LoginLimiter) Fail(username string, ip string) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	// 失败已经在Allow中计算过了
+	now := time.Now()
+	wait := limiter.users[username].wait(now)
+	if ip != "" {
+		if other := limiter.ips[ip].wait(now); other > wait {
+			wait = other
+		}
+	}
+	return wait
+}
+
+// Succeed ends an attempt allowed by Allow as a successful login, and forgets the failed attempts of the username.
+// The failures of the IP are kept so that logging in to one account does not reset the guessing of others
+func (limiter *LoginLimiter) Succeed(username string, ip string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	delete(limiter.users, username)
+	if ip != "" {
+		limiter.release(limiter.ips, ip, limiter.maxIPFailures)
+	}
+}
+
+// Release ends an attempt allowed by Allow that is neither a failure nor a completed login,
+// such as a correct password that still needs a two-factor code
+func (limiter *LoginLimiter) Release(username string, ip string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.release(limiter.users, username, limiter.maxUserFailures)
+	if ip != "" {
+		limiter.release(limiter.ips, ip, limiter.maxIPFailures)
+	}
+}
+
+// Unlock removes the lockout of the username, and returns true if it was locked out
+func (limiter *LoginLimiter) Unlock(username string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	locked := limiter.users[username].wait(time.Now()) > 0
+	delete(limiter.users, username)
+	return locked
+}
+
+func (limiter *LoginLimiter) fail(failures map[string]*loginFailures, key string, maxFailures int, now time.Time) {
+	entry := failures[key]
+	if entry == nil || entry.expired(now, limiter.maxLockout) {
+		entry = &loginFailures{}
+		failures[key] = entry
+	}
+
+	entry.count++
+	entry.lastFailure = now
+	if entry.count < maxFailures {
+		return
+	}
+
+	// 达到上限后每多失败一次，锁定时间翻倍
+	lockout := limiter.baseLockout
+	for i := maxFailures; i < entry.count && lockout < limiter.maxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > limiter.maxLockout {
+		lockout = limiter.maxLockout
+	}
+
+	entry.lockedUntil = now.Add(lockout)
+}
+
+// release removes an attempt counted by Allow, and the lockout that it caused
+func (limiter *LoginLimiter) release(failures map[string]*loginFailures, key string, maxFailures int) {
+	entry := failures[key]
+	if entry == nil {
+		return
+	}
+
+	entry.count--
+	if entry.count <= 0 {
+		delete(failures, key)
+	} else if entry.count < maxFailures {
+		entry.lockedUntil = time.Time{}
+	}
+}
+
+// prune removes the expired failures at most once per max lockout, so that the maps do not grow forever
+func (limiter *LoginLimiter) prune(now time.Time) {
+	if now.Sub(limiter.lastPrune) < limiter.maxLockout {
+		return
+	}
+	limiter.lastPrune = now
+
+	for _, failures := range []map[string]*loginFailures{limiter.users, limiter.ips} {
+		for key, entry := range failures {
+			if entry.expired(now, limiter.maxLockout) {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+func (failures *loginFailures) wait(now time.Time) time.Duration {
+	if failures == nil || !now.Before(failures.lockedUntil) {
+		return 0
+	}
+	return failures.lockedUntil.Sub(now)
+}
+
+// expired checks if the failures are old enough to be forgotten
+func (failures *loginFailures) expired(now time.Time, maxLockout time.Duration) bool {
+	return !now.Before(failures.lockedUntil) && now.Sub(failures.lastFailure) > maxLockout
+}
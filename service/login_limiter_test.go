@@ -0,0 +1,88 @@
+package service_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	t.Parallel()
+
+	const lockout = 100 * time.Millisecond
+	limiter := service.NewLoginLimiter(2, 3, lockout, 3*lockout)
+	fail := func(username string, ip string) time.Duration {
+		require.Zero(t, limiter.Allow(username, ip))
+		return limiter.Fail(username, ip)
+	}
+
+	require.Zero(t, fail("user1", "10.0.0.1"))
+	require.InDelta(t, float64(lockout), float64(fail("user1", "10.0.0.1")), float64(lockout/2))
+	require.NotZero(t, limiter.Allow("user1", "10.0.0.2"))
+	require.Zero(t, limiter.Allow("user2", "10.0.0.2"))
+	limiter.Release("user2", "10.0.0.2")
+
+	// 锁定结束后每多失败一次锁定时间翻倍，直到上限
+	require.Eventually(t, func() bool { return limiter.Allow("user1", "10.0.0.2") == 0 }, time.Second, 10*time.Millisecond)
+	require.InDelta(t, float64(2*lockout), float64(limiter.Fail("user1", "10.0.0.2")), float64(lockout/2))
+	require.Eventually(t, func() bool { return limiter.Allow("user1", "10.0.0.2") == 0 }, time.Second, 10*time.Millisecond)
+	require.InDelta(t, float64(3*lockout), float64(limiter.Fail("user1", "10.0.0.2")), float64(lockout/2))
+
+	// IP的失败次数单独计算，锁定后其他用户也不能从该IP登录
+	require.Zero(t, fail("user2", "10.0.0.3"))
+	require.Zero(t, fail("user3", "10.0.0.3"))
+	require.NotZero(t, fail("user4", "10.0.0.3"))
+	require.NotZero(t, limiter.Allow("user5", "10.0.0.3"))
+
+	require.True(t, limiter.Unlock("user1"))
+	require.False(t, limiter.Unlock("user1"))
+	require.Zero(t, limiter.Allow("user1", "10.0.0.1"))
+	limiter.Succeed("user1", "10.0.0.1")
+
+	// 登录成功后清除用户的失败记录，并且不计入IP的失败次数
+	require.Zero(t, fail("user6", ""))
+	require.Zero(t, limiter.Allow("user6", ""))
+	limiter.Succeed("user6", "")
+	require.Zero(t, fail("user6", ""))
+	for i := 0; i < 5; i++ {
+		require.Zero(t, limiter.Allow("user7", "10.0.0.4"))
+		limiter.Succeed("user7", "10.0.0.4")
+	}
+}
+
+func TestLoginLimiterConcurrentAttempts(t *testing.T) {
+	t.Parallel()
+
+	// 并发的尝试在比较密码之前就被计数，最多只有上限次数的尝试能通过
+	limiter := service.NewLoginLimiter(3, 100, time.Minute, time.Hour)
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Allow("user1", "10.0.0.1") == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, 3, allowed)
+}
+
+func TestLoginLimiterSetLimits(t *testing.T) {
+	t.Parallel()
+
+	limiter := service.NewLoginLimiter(3, 10, time.Minute, 3*time.Minute)
+	require.Zero(t, limiter.Allow("user1", ""))
+	require.Zero(t, limiter.Fail("user1", ""))
+
+	// 修改限制后之前的失败次数仍然计算在内
+	limiter.SetLimits(2, 10, 2*time.Minute, 5*time.Minute)
+	require.Zero(t, limiter.Allow("user1", ""))
+	require.InDelta(t, float64(2*time.Minute), float64(limiter.Fail("user1", "")), float64(time.Second))
+	require.NotZero(t, limiter.Allow("user1", ""))
+}
@@ -0,0 +1,345 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AuthMethodOIDC is the authentication method of users who login with an ID token of the OpenID Connect provider
+	AuthMethodOIDC = "oidc"
+	// AuthMethodMFA is the authentication method asserted by the OpenID Connect provider
+	// when the user has passed multi-factor authentication, as defined in RFC 8176
+	AuthMethodMFA = "mfa"
+
+	// oidcKeysMaxAge is how long the keys of the provider are cached before they are fetched again
+	oidcKeysMaxAge = time.Hour
+	// oidcMinRefreshInterval limits how often an unknown key id can make the verifier fetch the keys
+	oidcMinRefreshInterval = time.Minute
+	// oidcFetchTimeout is the max time to fetch the keys, the fetch is shared by the concurrent logins
+	oidcFetchTimeout = 10 * time.Second
+	// maxOIDCResponseSize is the max size of the discovery document and the JWKS
+	maxOIDCResponseSize = 1 << 20
+)
+
+var (
+	// ErrOIDCProviderUnavailable is returned when the discovery document or the keys of the provider cannot be fetched
+	ErrOIDCProviderUnavailable = errors.New("OpenID Connect provider is unavailable")
+	// ErrOIDCUserNotMapped is returned when a valid ID token cannot be mapped to a local username and role
+	ErrOIDCUserNotMapped = errors.New("ID token is not mapped to a local user")
+)
+
+// OIDCConfig configures the OpenID Connect provider whose ID tokens are accepted to login
+type OIDCConfig struct {
+	Issuer        string            // discovery文档位于 Issuer + /.well-known/openid-configuration
+	ClientID      string            // ID token的aud必须包含client id
+	UsernameClaim string            // 作为本地用户名的claim，为空时使用preferred_username
+	RoleClaim     string            // 用于映射角色的claim，值可以是字符串或字符串数组，为空时使用groups
+	RoleMappings  []OIDCRoleMapping // 按顺序匹配，第一个匹配的映射决定角色
+	DefaultRole   string            // 没有匹配的映射时的角色，为空时拒绝登录
+}
+
+// OIDCRoleMapping maps a value of the role claim to a local role
+type OIDCRoleMapping struct {
+	Value string
+	Role  string
+}
+
+// OIDCIdentity is the local identity that a verified ID token is mapped to
+type OIDCIdentity struct {
+	Subject  string // issuer和sub，唯一标识provider中的用户
+	Username string
+	Role     string
+	MFA      bool // provider的amr包含mfa，用户已经通过多因素认证
+}
+
+// OIDCVerifier verifies the ID tokens of an OpenID Connect provider with the keys published in its JWKS,
+// the keys are found by the discovery document and cached
+type OIDCVerifier struct {
+	config     OIDCConfig
+	httpClient *http.Client
+	fetches    singleflight.Group // 同时只有一个请求获取key，其他登录等待它的结果
+
+	mutex         sync.Mutex
+	keys          map[string]*SigningKey // key是kid
+	loadedAt      time.Time
+	lastMissFetch time.Time // 上一次因为未知的kid重新获取key的时间
+}
+
+// NewOIDCVerifier returns a verifier for the provider of the config, httpClient may be nil to use a client
+// with a timeout. The provider is contacted on the first login, so the server can start when it is down
+func NewOIDCVerifier(config OIDCConfig, httpClient *http.Client) (*OIDCVerifier, error) {
+	if config.Issuer == "" || config.ClientID == "" {
+		return nil, fmt.Errorf("OpenID Connect issuer and client id are required")
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.RoleClaim == "" {
+		config.RoleClaim = "groups"
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	verifier := &OIDCVerifier{
+		config:     config,
+		httpClient: httpClient,
+	}
+	return verifier, nil
+}
+
+// Verify verifies the signature and the claims of the ID token, and maps it to a local identity.
+// If nonce is not empty, it must be equal to the nonce claim of the token
+func (verifier *OIDCVerifier) Verify(ctx context.Context, idToken string, nonce string) (*OIDCIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := verifier.findKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		// 签名算法必须和provider公布的key一致
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected token signing method %s", token.Method.Alg())
+		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && errors.Is(validationErr.Inner, ErrOIDCProviderUnavailable) {
+			return nil, validationErr.Inner
+		}
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	// MapClaims.Valid只检查存在的exp，ID token必须有过期时间
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("invalid ID token: missing expiration time")
+	}
+	if iss, _ := claims["iss"].(string); iss != verifier.config.Issuer {
+		return nil, fmt.Errorf("invalid ID token: unexpected issuer %q", iss)
+	}
+	if !stringClaimContains(claims["aud"], verifier.config.ClientID) {
+		return nil, fmt.Errorf("invalid ID token: audience does not contain client id")
+	}
+	if nonce != "" && claims["nonce"] != nonce {
+		return nil, fmt.Errorf("invalid ID token: nonce does not match")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("invalid ID token: missing subject")
+	}
+
+	return verifier.mapIdentity(claims, sub)
+}
+
+// mapIdentity maps the claims of a valid ID token to the local username and role
+func (verifier *OIDCVerifier) mapIdentity(claims jwt.MapClaims, sub string) (*OIDCIdentity, error) {
+	// 使用email作为用户名时，必须是provider验证过的email
+	if verifier.config.UsernameClaim == "email" && claims["email_verified"] != true {
+		return nil, fmt.Errorf("email of the ID token is not verified: %w", ErrOIDCUserNotMapped)
+	}
+	username, _ := claims[verifier.config.UsernameClaim].(string)
+	username = strings.ToLower(username)
+	if err := ValidateUsername(username); err != nil {
+		return nil, fmt.Errorf("claim %s cannot be used as username: %v: %w", verifier.config.UsernameClaim, err, ErrOIDCUserNotMapped)
+	}
+
+	role := verifier.config.DefaultRole
+	for _, mapping := range verifier.config.RoleMappings {
+		if stringClaimContains(claims[verifier.config.RoleClaim], mapping.Value) {
+			role = mapping.Role
+			break
+		}
+	}
+	if role == "" {
+		return nil, fmt.Errorf("no role is mapped for user %s: %w", username, ErrOIDCUserNotMapped)
+	}
+
+	identity := &OIDCIdentity{
+		Subject:  verifier.config.Issuer + "#" + sub,
+		Username: username,
+		Role:     role,
+		MFA:      stringClaimContains(claims["amr"], AuthMethodMFA),
+	}
+	return identity, nil
+}
+
+// findKey returns the key of the provider with the kid, the keys are fetched again when they are too old,
+// or when the kid is unknown since the provider may have rotated its keys. If the provider is unavailable
+// when the keys are too old, the old keys are still used until it is available again
+func (verifier *OIDCVerifier) findKey(ctx context.Context, kid string) (*SigningKey, error) {
+	verifier.mutex.Lock()
+	keys, loadedAt := verifier.keys, verifier.loadedAt
+	verifier.mutex.Unlock()
+
+	now := time.Now()
+	fetched := false
+	if keys == nil || now.Sub(loadedAt) > oidcKeysMaxAge {
+		freshKeys, err := verifier.refreshKeys(ctx)
+		switch {
+		case err == nil:
+			keys = freshKeys
+			fetched = true
+		case keys == nil:
+			return nil, err
+		default:
+			logErrorf("cannot refresh the keys of the OpenID Connect provider, use the keys loaded at %s: %v", loadedAt.Format(time.RFC3339), err)
+		}
+	}
+
+	key := lookupKey(keys, kid)
+	if key == nil && !fetched && verifier.allowMissFetch(now) {
+		freshKeys, err := verifier.refreshKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		key = lookupKey(freshKeys, kid)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// allowMissFetch checks if an unknown kid can fetch the keys again, and records the time of the fetch
+func (verifier *OIDCVerifier) allowMissFetch(now time.Time) bool {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	// 限制频率，避免伪造的kid让服务器不断请求provider
+	if now.Sub(verifier.lastMissFetch) <= oidcMinRefreshInterval {
+		return false
+	}
+	verifier.lastMissFetch = now
+	return true
+}
+
+// refreshKeys fetches the keys of the provider without holding the mutex, concurrent calls share one fetch.
+// The fetch is not canceled with ctx since other calls may wait for it, but the caller stops waiting
+func (verifier *OIDCVerifier) refreshKeys(ctx context.Context) (map[string]*SigningKey, error) {
+	result := verifier.fetches.DoChan("keys", func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.Background(), oidcFetchTimeout)
+		defer cancel()
+
+		keys, err := verifier.fetchKeys(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		verifier.mutex.Lock()
+		verifier.keys = keys
+		verifier.loadedAt = time.Now()
+		verifier.mutex.Unlock()
+		return keys, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("cannot wait for the keys: %v: %w", ctx.Err(), ErrOIDCProviderUnavailable)
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(map[string]*SigningKey), nil
+	}
+}
+
+// lookupKey finds the key with the kid, a token without kid can only be verified when there is one key
+func lookupKey(keys map[string]*SigningKey, kid string) *SigningKey {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[kid]
+}
+
+// fetchKeys fetches the discovery document and the JWKS of the provider
+func (verifier *OIDCVerifier) fetchKeys(ctx context.Context) (map[string]*SigningKey, error) {
+	discovery := &struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	discoveryURL := strings.TrimSuffix(verifier.config.Issuer, "/") + "/.well-known/openid-configuration"
+	err := verifier.getJSON(ctx, discoveryURL, discovery)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != verifier.config.Issuer {
+		return nil, fmt.Errorf("discovery document has issuer %q: %w", discovery.Issuer, ErrOIDCProviderUnavailable)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document has no jwks_uri: %w", ErrOIDCProviderUnavailable)
+	}
+
+	jwks := &JSONWebKeySet{}
+	err = verifier.getJSON(ctx, discovery.JWKSURI, jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*SigningKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// 忽略不支持的key，provider可能同时公布其他算法的key
+		key, err := jwk.VerificationKey()
+		if err != nil {
+			continue
+		}
+		keys[key.ID] = key
+	}
+	return keys, nil
+}
+
+func (verifier *OIDCVerifier) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create request to %s: %v: %w", url, err, ErrOIDCProviderUnavailable)
+	}
+
+	res, err := verifier.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot get %s: %v: %w", url, err, ErrOIDCProviderUnavailable)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return fmt.Errorf("cannot get %s: status %s: %w", url, res.Status, ErrOIDCProviderUnavailable)
+	}
+
+	err = json.NewDecoder(io.LimitReader(res.Body, maxOIDCResponseSize)).Decode(v)
+	if err != nil {
+		return fmt.Errorf("cannot decode %s: %v: %w", url, err, ErrOIDCProviderUnavailable)
+	}
+	return nil
+}
+
+// stringClaimContains checks if the claim is the value, or is an array that contains the value
+func stringClaimContains(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == value
+	case []interface{}:
+		for _, other := range claim {
+			if other == value {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package service_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOIDCVerifier(t *testing.T) {
+	t.Parallel()
+
+	issuer := newFakeOIDCIssuer(t)
+	verifier, err := service.NewOIDCVerifier(service.OIDCConfig{
+		Issuer:   issuer.URL(),
+		ClientID: "pcbook",
+		RoleMappings: []service.OIDCRoleMapping{
+			{Value: "pcbook-admins", Role: service.RoleAdmin},
+			{Value: "pcbook-editors", Role: service.RoleEditor},
+		},
+	}, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	identity, err := verifier.Verify(ctx, issuer.IDToken(t, jwt.MapClaims{"groups": []string{"staff", "pcbook-editors"}}), "")
+	require.NoError(t, err)
+	require.Equal(t, "jane", identity.Username)
+	require.Equal(t, service.RoleEditor, identity.Role)
+	require.Equal(t, issuer.URL()+"#user-1", identity.Subject)
+	require.False(t, identity.MFA)
+
+	// 第一个匹配的映射决定角色，aud可以是数组
+	identity, err = verifier.Verify(ctx, issuer.IDToken(t, jwt.MapClaims{
+		"aud":    []string{"other", "pcbook"},
+		"groups": []string{"pcbook-editors", "pcbook-admins"},
+		"amr":    []string{"pwd", "mfa"},
+		"nonce":  "nonce1",
+	}), "nonce1")
+	require.NoError(t, err)
+	require.Equal(t, service.RoleAdmin, identity.Role)
+	require.True(t, identity.MFA)
+	require.Equal(t, 1, issuer.KeyFetches())
+
+	invalidClaims := []jwt.MapClaims{
+		{"aud": "other"},
+		{"iss": "https://other.example.com"},
+		{"exp": time.Now().Add(-time.Minute).Unix()},
+		{"exp": nil},
+		{"sub": ""},
+		{"nonce": "nonce2"},
+	}
+	for _, claims := range invalidClaims {
+		_, err = verifier.Verify(ctx, issuer.IDToken(t, claims), "nonce1")
+		require.Error(t, err, "claims %v", claims)
+	}
+
+	// 签名不是provider的私钥
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = verifier.Verify(ctx, signIDToken(t, jwt.SigningMethodRS256, "key1", otherKey, issuer.Claims(nil)), "")
+	require.Error(t, err)
+
+	// 不接受对称算法和none
+	_, err = verifier.Verify(ctx, signIDToken(t, jwt.SigningMethodHS256, "key1", []byte("secret"), issuer.Claims(nil)), "")
+	require.Error(t, err)
+	_, err = verifier.Verify(ctx, signIDToken(t, jwt.SigningMethodNone, "key1", jwt.UnsafeAllowNoneSignatureType, issuer.Claims(nil)), "")
+	require.Error(t, err)
+
+	// 没有映射的角色，或者不能作为用户名的claim
+	_, err = verifier.Verify(ctx, issuer.IDToken(t, jwt.MapClaims{"groups": "staff"}), "")
+	require.ErrorIs(t, err, service.ErrOIDCUserNotMapped)
+	_, err = verifier.Verify(ctx, issuer.IDToken(t, jwt.MapClaims{"preferred_username": "Jane Doe"}), "")
+	require.ErrorIs(t, err, service.ErrOIDCUserNotMapped)
+
+	// provider轮换key后，未知的kid会让verifier重新获取key
+	issuer.RotateKey(t, "key2")
+	identity, err = verifier.Verify(ctx, issuer.IDToken(t, jwt.MapClaims{"groups": "pcbook-editors"}), "")
+	require.NoError(t, err)
+	require.Equal(t, service.RoleEditor, identity.Role)
+	require.Equal(t, 2, issuer.KeyFetches())
+
+	// 短时间内不会因为未知的kid再次获取key
+	_, err = verifier.Verify(ctx, signIDToken(t, jwt.SigningMethodRS256, "key3", otherKey, issuer.Claims(nil)), "")
+	require.Error(t, err)
+	require.Equal(t, 2, issuer.KeyFetches())
+}
+
+func TestOIDCVerifierProviderUnavailable(t *testing.T) {
+	t.Parallel()
+
+	issuer := newFakeOIDCIssuer(t)
+	idToken := issuer.IDToken(t, nil)
+	issuer.server.Close()
+
+	verifier, err := service.NewOIDCVerifier(service.OIDCConfig{Issuer: issuer.URL(), ClientID: "pcbook", DefaultRole: service.RoleUser}, nil)
+	require.NoError(t, err)
+
+	_, err = verifier.Verify(context.Background(), idToken, "")
+	require.ErrorIs(t, err, service.ErrOIDCProviderUnavailable)
+}
+
+func TestOIDCVerifierConcurrentLogins(t *testing.T) {
+	t.Parallel()
+
+	issuer := newFakeOIDCIssuer(t)
+	verifier, err := service.NewOIDCVerifier(service.OIDCConfig{Issuer: issuer.URL(), ClientID: "pcbook", DefaultRole: service.RoleUser}, nil)
+	require.NoError(t, err)
+
+	// 同时登录只获取一次key
+	idToken := issuer.IDToken(t, nil)
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := verifier.Verify(context.Background(), idToken, "")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.Equal(t, 1, issuer.KeyFetches())
+}
+
+// fakeOIDCIssuer is an in-process OpenID Connect provider that serves the discovery document and the JWKS
+type fakeOIDCIssuer struct {
+	server *httptest.Server
+
+	mutex      sync.Mutex
+	keyID      string
+	privateKey *rsa.PrivateKey
+	keys       []*service.SigningKey
+	keyFetches int
+}
+
+func newFakeOIDCIssuer(t *testing.T) *fakeOIDCIssuer {
+	issuer := &fakeOIDCIssuer{}
+	issuer.RotateKey(t, "key1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer.URL(),
+			"jwks_uri": issuer.URL() + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mutex.Lock()
+		defer issuer.mutex.Unlock()
+
+		issuer.keyFetches++
+		jwks := &service.JSONWebKeySet{}
+		for _, key := range issuer.keys {
+			jwk, err := key.JWK()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+		json.NewEncoder(w).Encode(jwks)
+	})
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (issuer *fakeOIDCIssuer) URL() string {
+	return issuer.server.URL
+}
+
+// KeyFetches returns how many times the JWKS has been fetched
+func (issuer *fakeOIDCIssuer) KeyFetches() int {
+	issuer.mutex.Lock()
+	defer issuer.mutex.Unlock()
+
+	return issuer.keyFetches
+}
+
+// RotateKey generates a new signing key, the old keys are still published
+func (issuer *fakeOIDCIssuer) RotateKey(t *testing.T, keyID string) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := service.NewSigningKey(keyID, privateKey)
+	require.NoError(t, err)
+
+	issuer.mutex.Lock()
+	defer issuer.mutex.Unlock()
+
+	issuer.keyID = keyID
+	issuer.privateKey = privateKey
+	issuer.keys = append(issuer.keys, key)
+}
+
+// Claims returns the claims of a valid ID token for user jane, overridden by the extra claims
+func (issuer *fakeOIDCIssuer) Claims(extra jwt.MapClaims) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                issuer.URL(),
+		"aud":                "pcbook",
+		"sub":                "user-1",
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Minute).Unix(),
+		"preferred_username": "jane",
+	}
+	for name, value := range extra {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+// IDToken returns an ID token signed by the current key of the issuer
+func (issuer *fakeOIDCIssuer) IDToken(t *testing.T, extra jwt.MapClaims) string {
+	issuer.mutex.Lock()
+	keyID, privateKey := issuer.keyID, issuer.privateKey
+	issuer.mutex.Unlock()
+
+	return signIDToken(t, jwt.SigningMethodRS256, keyID, privateKey, issuer.Claims(extra))
+}
+
+func signIDToken(t *testing.T, method jwt.SigningMethod, keyID string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = keyID
+	signedToken, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signedToken
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// argon2idPrefix is the prefix of argon2id hashes in the PHC string format
+const argon2idPrefix = "$argon2id$"
+
+// PasswordHasher hashes passwords to store them
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password, which includes the algorithm and its parameters
+	Hash(password string) (string, error)
+	// NeedsRehash checks if the hash uses another algorithm or weaker parameters than the hasher,
+	// so that it should be replaced the next time the password is known
+	NeedsRehash(hash string) bool
+}
+
+// Argon2Params are the cost parameters of argon2id
+type Argon2Params struct {
+	Memory      uint32 // 单位是KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params are the minimum argon2id parameters recommended by OWASP
+var DefaultArgon2Params = Argon2Params{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Argon2idHasher hashes passwords with argon2id
+type Argon2idHasher struct {
+	params Argon2Params
+}
+
+// NewArgon2idHasher returns a new argon2id hasher with the parameters
+func NewArgon2idHasher(params Argon2Params) *Argon2idHasher {
+	return &Argon2idHasher{params}
+}
+
+// Hash hashes the password with a random salt, and encodes it in the PHC string format
+func (hasher *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, hasher.params.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate salt: %v", err)
+	}
+
+	params := hasher.params
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	hash := fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	)
+	return hash, nil
+}
+
+func (hasher *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+
+	want := hasher.params
+	return params.Memory < want.Memory ||
+		params.Iterations < want.Iterations ||
+		params.Parallelism < want.Parallelism ||
+		params.SaltLength < want.SaltLength ||
+		params.KeyLength < want.KeyLength
+}
+
+// BcryptHasher hashes passwords with bcrypt
+type BcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher returns a new bcrypt hasher with the cost
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{cost}
+}
+
+func (hasher *BcryptHasher) Hash(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hasher.cost)
+	if err != nil {
+		return "", fmt.Errorf("cannot hash password: %v", err)
+	}
+	return string(hashedPassword), nil
+}
+
+func (hasher *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < hasher.cost
+}
+
+// DefaultPasswordHasher returns the hasher used by NewUser
+func DefaultPasswordHasher() PasswordHasher {
+	return NewArgon2idHasher(DefaultArgon2Params)
+}
+
+// CheckPassword checks the password against a hash of any supported algorithm, whatever hasher is configured now
+func CheckPassword(hash string, password string) bool {
+	if !strings.HasPrefix(hash, argon2idPrefix) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// decodeArgon2idHash decodes a hash in the format $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+func decodeArgon2idHash(hash string) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || "$"+parts[1]+"$" != argon2idPrefix {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	params := &Argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id key: %v", err)
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
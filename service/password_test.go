@@ -0,0 +1,40 @@
+package service_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	t.Parallel()
+
+	weakParams := service.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	weakArgon2 := service.NewArgon2idHasher(weakParams)
+	argon2Hash, err := weakArgon2.Hash("secret")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(argon2Hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	bcryptHash, err := service.NewBcryptHasher(bcrypt.MinCost).Hash("secret")
+	require.NoError(t, err)
+
+	// 不管现在配置的是哪种算法，两种hash都可以验证
+	for _, hash := range []string{argon2Hash, bcryptHash} {
+		require.True(t, service.CheckPassword(hash, "secret"))
+		require.False(t, service.CheckPassword(hash, "wrong"))
+	}
+	require.False(t, service.CheckPassword("$argon2id$v=19$invalid", "secret"))
+
+	// 其他算法或者较弱参数的hash需要升级
+	require.False(t, weakArgon2.NeedsRehash(argon2Hash))
+	require.True(t, weakArgon2.NeedsRehash(bcryptHash))
+	strongerParams := weakParams
+	strongerParams.Iterations = 2
+	require.True(t, service.NewArgon2idHasher(strongerParams).NeedsRehash(argon2Hash))
+
+	require.False(t, service.NewBcryptHasher(bcrypt.MinCost).NeedsRehash(bcryptHash))
+	require.True(t, service.NewBcryptHasher(bcrypt.MinCost+1).NeedsRehash(bcryptHash))
+	require.True(t, service.NewBcryptHasher(bcrypt.MinCost).NeedsRehash(argon2Hash))
+}
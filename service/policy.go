@@ -0,0 +1,396 @@
+package service
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PolicySource provides the access policy currently in effect
+type PolicySource interface {
+	// Policy returns the current access policy
+	Policy() *Policy
+}
+
+// Policy is an access control policy that decides which roles can call each RPC method
+type Policy struct {
+	defaultDeny bool
+	roles       map[string][]string // key是角色，value是该角色拥有的所有角色（包括自己和继承的角色）
+	twoFactor   map[string]bool     // 必须使用两步验证登录的角色
+	exact       map[string]*PolicyRule
+	patterns    []*PolicyRule // 按pattern长度从长到短排序，越具体的规则优先匹配
+	clientCerts map[string]*CertIdentity // key是客户端证书subject的common name
+}
+
+// CertIdentity is the user and role of mTLS clients that present a certificate with a given subject
+type CertIdentity struct {
+	Username string `yaml:"username"`
+	Role     string `yaml:"role"`
+}
+
+// PolicyRule is the access rule of a method or a method pattern
+type PolicyRule struct {
+	Pattern    string
+	Public     bool     // 不需要登录就可以访问
+	Roles      []string // 可以访问任何资源的角色，继承了这些角色的角色也可以访问
+	OwnerRoles []string // 只能访问自己拥有的资源的角色
+}
+
+// Access is the access level of a role to the resources of a method
+type Access int
+
+const (
+	// NoAccess means the role cannot call the method
+	NoAccess Access = iota
+	// OwnerAccess means the role can call the method only on the resources it owns
+	OwnerAccess
+	// FullAccess means the role can call the method on any resource
+	FullAccess
+)
+
+// policyFile is the format of the policy file, JSON files are also accepted since JSON is a subset of YAML
+type policyFile struct {
+	Default string `yaml:"default"` // allow或者deny，没有规则的方法是否允许任何人访问
+	Roles   map[string]struct {
+		Inherits         []string `yaml:"inherits"`
+		RequireTwoFactor bool     `yaml:"require_two_factor"`
+	} `yaml:"roles"`
+	Rules []struct {
+		Methods    []string `yaml:"methods"`
+		Public     bool     `yaml:"public"`
+		Roles      []string `yaml:"roles"`
+		OwnerRoles []string `yaml:"owner_roles"`
+	} `yaml:"rules"`
+	ClientCertificates map[string]*CertIdentity `yaml:"client_certificates"`
+}
+
+// ParsePolicy parses an access policy in YAML or JSON format
+func ParsePolicy(data []byte) (*Policy, error) {
+	file := &policyFile{}
+	err := yaml.Unmarshal(data, file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode policy: %w", err)
+	}
+
+	policy := &Policy{
+		roles:       make(map[string][]string),
+		twoFactor:   make(map[string]bool),
+		exact:       make(map[string]*PolicyRule),
+		clientCerts: make(map[string]*CertIdentity),
+	}
+
+	switch file.Default {
+	case "allow":
+	case "", "deny":
+		policy.defaultDeny = true
+	default:
+		return nil, fmt.Errorf("unknown default access %q, must be allow or deny", file.Default)
+	}
+
+	inherits := make(map[string][]string)
+	for role, def := range file.Roles {
+		inherits[role] = def.Inherits
+		if def.RequireTwoFactor {
+			policy.twoFactor[role] = true
+		}
+	}
+	for role := range inherits {
+		closure, err := roleClosure(role, inherits, nil)
+		if err != nil {
+			return nil, err
+		}
+		policy.roles[role] = closure
+	}
+
+	for i, def := range file.Rules {
+		if def.Public == (len(def.Roles)+len(def.OwnerRoles) > 0) {
+			return nil, fmt.Errorf("rule %d must be either public or have roles", i)
+		}
+		for _, role := range append(def.Roles, def.OwnerRoles...) {
+			if policy.roles[role] == nil {
+				return nil, fmt.Errorf("rule %d uses undefined role %q", i, role)
+			}
+		}
+
+		for _, method := range def.Methods {
+			if _, err := path.Match(method, ""); err != nil {
+				return nil, fmt.Errorf("rule %d has invalid method pattern %q: %w", i, method, err)
+			}
+
+			rule := &PolicyRule{Pattern: method, Public: def.Public, Roles: def.Roles, OwnerRoles: def.OwnerRoles}
+			if isMethodPattern(method) {
+				policy.patterns = append(policy.patterns, rule)
+			} else if policy.exact[method] == nil {
+				policy.exact[method] = rule
+			}
+		}
+	}
+
+	sort.SliceStable(policy.patterns, func(i, j int) bool {
+		return len(policy.patterns[i].Pattern) > len(policy.patterns[j].Pattern)
+	})
+
+	for commonName, identity := range file.ClientCertificates {
+		if identity == nil || identity.Username == "" {
+			return nil, fmt.Errorf("client certificate %q has no username", commonName)
+		}
+		if policy.roles[identity.Role] == nil {
+			return nil, fmt.Errorf("client certificate %q uses undefined role %q", commonName, identity.Role)
+		}
+		policy.clientCerts[commonName] = identity
+	}
+	return policy, nil
+}
+
+// LoadPolicy loads an access policy from a YAML or JSON file
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read policy file: %w", err)
+	}
+
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", filename, err)
+	}
+	return policy, nil
+}
+
+// NewRolePolicy returns a policy that allows each method only for the listed roles, without role inheritance,
+// methods that are not listed can be accessed by everyone
+func NewRolePolicy(accessibleRoles map[string][]string) *Policy {
+	policy := &Policy{
+		roles: make(map[string][]string),
+		exact: make(map[string]*PolicyRule),
+	}
+
+	for method, roles := range accessibleRoles {
+		policy.exact[method] = &PolicyRule{Pattern: method, Roles: roles}
+		for _, role := range roles {
+			policy.roles[role] = []string{role}
+		}
+	}
+	return policy
+}
+
+// Policy returns the policy itself so that a static policy can be used as a PolicySource
+func (policy *Policy) Policy() *Policy {
+	return policy
+}
+
+// Rule returns the rule that applies to the method, or nil if no rule matches
+func (policy *Policy) Rule(method string) *PolicyRule {
+	if rule := policy.exact[method]; rule != nil {
+		return rule
+	}
+
+	for _, rule := range policy.patterns {
+		if ok, _ := path.Match(rule.Pattern, method); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ClientCertIdentity returns the identity of mTLS clients whose certificate has the common name,
+// or nil if the certificate is not mapped to a user
+func (policy *Policy) ClientCertIdentity(commonName string) *CertIdentity {
+	return policy.clientCerts[commonName]
+}
+
+// DefaultDeny returns true if methods without a rule are denied
+func (policy *Policy) DefaultDeny() bool {
+	return policy.defaultDeny
+}
+
+// Access returns the access level of the role to a method protected by the rule
+func (policy *Policy) Access(rule *PolicyRule, role string) Access {
+	switch {
+	case policy.hasRole(role, rule.Roles):
+		return FullAccess
+	case policy.hasRole(role, rule.OwnerRoles):
+		return OwnerAccess
+	default:
+		return NoAccess
+	}
+}
+
+// RequiresTwoFactor checks if users of the role must login with two-factor authentication,
+// which is the case if the role or any role it inherits requires it
+func (policy *Policy) RequiresTwoFactor(role string) bool {
+	for _, granted := range policy.roles[role] {
+		if policy.twoFactor[granted] {
+			return true
+		}
+	}
+	return false
+}
+
+// Grants checks if the role is the other role or inherits it
+func (policy *Policy) Grants(role string, other string) bool {
+	return policy.hasRole(role, []string{other})
+}
+
+// hasRole checks if the role is one of the required roles or inherits one of them
+func (policy *Policy) hasRole(role string, required []string) bool {
+	for _, granted := range policy.roles[role] {
+		for _, other := range required {
+			if granted == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateRole checks if the role is defined in the policy
+func (policy *Policy) ValidateRole(role string) error {
+	if _, ok := policy.roles[role]; !ok {
+		return fmt.Errorf("unknown role %q, the policy defines %v", role, policy.Roles())
+	}
+	return nil
+}
+
+// Roles returns all roles defined in the policy, sorted by name
+func (policy *Policy) Roles() []string {
+	roles := make([]string, 0, len(policy.roles))
+	for role := range policy.roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// AllowedRoles returns the roles that have the access level to a method protected by the rule,
+// including the inheriting roles
+func (policy *Policy) AllowedRoles(rule *PolicyRule, access Access) []string {
+	var roles []string
+	for _, role := range policy.Roles() {
+		if policy.Access(rule, role) == access {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func isMethodPattern(method string) bool {
+	for _, c := range method {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+// roleClosure returns the role with all roles it inherits directly or indirectly
+func roleClosure(role string, inherits map[string][]string, visiting []string) ([]string, error) {
+	for _, other := range visiting {
+		if other == role {
+			return nil, fmt.Errorf("role inheritance cycle: %v -> %s", visiting, role)
+		}
+	}
+	parents, ok := inherits[role]
+	if !ok {
+		return nil, fmt.Errorf("role %q is inherited but not defined", role)
+	}
+
+	closure := []string{role}
+	for _, parent := range parents {
+		parentClosure, err := roleClosure(parent, inherits, append(visiting, role))
+		if err != nil {
+			return nil, err
+		}
+		closure = append(closure, parentClosure...)
+	}
+	return closure, nil
+}
+
+// PolicyWatcher reloads the policy file when it changes
+type PolicyWatcher struct {
+	filename string
+	mutex    sync.RWMutex
+	policy   *Policy
+	modTime  time.Time
+	size     int64
+}
+
+// NewPolicyWatcher loads the policy file, call Watch to start reloading it on change
+func NewPolicyWatcher(filename string) (*PolicyWatcher, error) {
+	watcher := &PolicyWatcher{filename: filename}
+
+	_, err := watcher.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// Policy returns the policy that was last loaded successfully
+func (watcher *PolicyWatcher) Policy() *Policy {
+	watcher.mutex.RLock()
+	defer watcher.mutex.RUnlock()
+	return watcher.policy
+}
+
+// Reload loads the policy file if it has changed since the last load, and returns true if it is reloaded.
+// If the new policy is invalid, the current policy stays in effect
+func (watcher *PolicyWatcher) Reload() (bool, error) {
+	info, err := os.Stat(watcher.filename)
+	if err != nil {
+		return false, fmt.Errorf("cannot stat policy file: %w", err)
+	}
+
+	watcher.mutex.RLock()
+	unchanged := watcher.policy != nil && info.ModTime().Equal(watcher.modTime) && info.Size() == watcher.size
+	watcher.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	policy, err := LoadPolicy(watcher.filename)
+	if err != nil {
+		return false, err
+	}
+
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+
+	watcher.policy = policy
+	watcher.modTime = info.ModTime()
+	watcher.size = info.Size()
+	return true, nil
+}
+
+// Watch checks the policy file for changes every interval until stop is called
+func (watcher *PolicyWatcher) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				reloaded, err := watcher.Reload()
+				if err != nil {
+					logErrorf("cannot reload policy, keep using the current one: %v", err)
+				} else if reloaded {
+					logInfof("reloaded policy file %s", watcher.filename)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,106 @@
+package service_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+default: deny
+roles:
+  admin: {inherits: [editor]}
+  editor: {inherits: [user]}
+  user: {}
+rules:
+  - methods: [/pcbook.Service/Login]
+    public: true
+  - methods: [/pcbook.Service/*]
+    roles: [user]
+  - methods: [/pcbook.Service/Delete*]
+    roles: [editor]
+  - methods: [/pcbook.Service/DeleteAll]
+    roles: [admin]
+  - methods: [/pcbook.Service/Update]
+    roles: [admin]
+    owner_roles: [editor]
+`
+
+func TestPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := service.ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	require.True(t, policy.Rule("/pcbook.Service/Login").Public)
+	require.Nil(t, policy.Rule("/other.Service/Get"))
+	require.True(t, policy.DefaultDeny())
+
+	testCases := []struct {
+		method  string
+		allowed []string
+	}{
+		{"/pcbook.Service/Get", []string{"admin", "editor", "user"}},
+		{"/pcbook.Service/DeleteOne", []string{"admin", "editor"}},
+		{"/pcbook.Service/DeleteAll", []string{"admin"}},
+	}
+	for _, tc := range testCases {
+		rule := policy.Rule(tc.method)
+		require.NotNil(t, rule, tc.method)
+		require.Equal(t, tc.allowed, policy.AllowedRoles(rule, service.FullAccess), tc.method)
+	}
+
+	// editor只能修改自己的资源，admin继承了editor但仍然可以修改任何资源
+	rule := policy.Rule("/pcbook.Service/Update")
+	require.Equal(t, service.FullAccess, policy.Access(rule, "admin"))
+	require.Equal(t, service.OwnerAccess, policy.Access(rule, "editor"))
+	require.Equal(t, service.NoAccess, policy.Access(rule, "user"))
+
+	// 角色由策略定义，admin拥有继承的所有角色
+	require.NoError(t, policy.ValidateRole("editor"))
+	require.Error(t, policy.ValidateRole("root"))
+	require.True(t, policy.Grants("admin", "user"))
+	require.False(t, policy.Grants("user", "editor"))
+
+	_, err = service.ParsePolicy([]byte(`{"roles": {"a": {"inherits": ["b"]}, "b": {"inherits": ["a"]}}}`))
+	require.Error(t, err)
+
+	_, err = service.ParsePolicy([]byte(`{"roles": {"user": {}}, "rules": [{"methods": ["/a/b"], "roles": ["admin"]}]}`))
+	require.Error(t, err)
+}
+
+func TestPolicyWatcher(t *testing.T) {
+	t.Parallel()
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	err := ioutil.WriteFile(policyFile, []byte(`{"default": "allow"}`), 0644)
+	require.NoError(t, err)
+
+	watcher, err := service.NewPolicyWatcher(policyFile)
+	require.NoError(t, err)
+	require.False(t, watcher.Policy().DefaultDeny())
+
+	// 无效的策略不会替换当前的策略
+	err = ioutil.WriteFile(policyFile, []byte(`{"default": "maybe"}`), 0644)
+	require.NoError(t, err)
+	// 保证修改时间发生变化
+	changed := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(policyFile, changed, changed))
+	_, err = watcher.Reload()
+	require.Error(t, err)
+	require.False(t, watcher.Policy().DefaultDeny())
+
+	err = ioutil.WriteFile(policyFile, []byte(`{"default": "deny"}`), 0644)
+	require.NoError(t, err)
+	changed = changed.Add(time.Minute)
+	require.NoError(t, os.Chtimes(policyFile, changed, changed))
+
+	reloaded, err := watcher.Reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.True(t, watcher.Policy().DefaultDeny())
+}
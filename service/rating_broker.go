@@ -0,0 +1,185 @@
+package service
+
+import (
+	"errors"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"sync"
+)
+
+// ErrSlowConsumer is returned when a subscriber is disconnected because it cannot keep up with the updates
+var ErrSlowConsumer = errors.New("subscriber is too slow to receive rating updates")
+
+// ErrBrokerClosed is returned when a subscription ends because the broker is closed, such as when the server stops
+var ErrBrokerClosed = errors.New("rating broker is closed")
+
+// SlowConsumerPolicy decides what the broker does when a subscriber's buffer is full
+type SlowConsumerPolicy int
+
+const (
+	// DropUpdates drops the new update and keeps the subscriber connected
+	DropUpdates SlowConsumerPolicy = iota
+	// DisconnectSubscriber closes the subscription with ErrSlowConsumer
+	DisconnectSubscriber
+)
+
+// RatingBroker fans out rating updates to every subscriber watching the rated laptop
+type RatingBroker struct {
+	mutex       sync.RWMutex
+	bufferSize  int
+	policy      SlowConsumerPolicy
+	subscribers map[string]map[*RatingSubscription]bool // key是laptop id，value是订阅了该laptop的所有订阅者
+	closed      bool
+}
+
+// RatingSubscription receives the rating updates of a set of laptops
+type RatingSubscription struct {
+	broker    *RatingBroker
+	laptopIDs []string
+	updates   chan *pb.RateLaptopResponse
+	done      chan struct{}
+	once      sync.Once
+	mutex     sync.Mutex // 保护err和dropped
+	err       error
+	dropped   uint64
+}
+
+// NewRatingBroker returns a new RatingBroker whose subscribers buffer at most bufferSize updates
+func NewRatingBroker(bufferSize int, policy SlowConsumerPolicy) *RatingBroker {
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+
+	return &RatingBroker{
+		bufferSize:  bufferSize,
+		policy:      policy,
+		subscribers: make(map[string]map[*RatingSubscription]bool),
+	}
+}
+
+// Subscribe registers a new subscription for the rating updates of the given laptops
+func (broker *RatingBroker) Subscribe(laptopIDs []string) *RatingSubscription {
+	sub := &RatingSubscription{
+		broker:    broker,
+		laptopIDs: laptopIDs,
+		updates:   make(chan *pb.RateLaptopResponse, broker.bufferSize),
+		done:      make(chan struct{}),
+	}
+
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	if broker.closed {
+		// 不能在持有锁时关闭订阅，unsubscribe也需要锁
+		sub.err = ErrBrokerClosed
+		sub.once.Do(func() { close(sub.done) })
+		return sub
+	}
+
+	for _, laptopID := range laptopIDs {
+		subs := broker.subscribers[laptopID]
+		if subs == nil {
+			subs = make(map[*RatingSubscription]bool)
+			broker.subscribers[laptopID] = subs
+		}
+		subs[sub] = true
+	}
+
+	return sub
+}
+
+// Publish sends the rating update to every subscriber of the laptop without blocking
+func (broker *RatingBroker) Publish(update *pb.RateLaptopResponse) {
+	var slow []*RatingSubscription
+
+	broker.mutex.RLock()
+	for sub := range broker.subscribers[update.GetLaptopId()] {
+		select {
+		case sub.updates <- update:
+		default:
+			// 订阅者的缓冲区已满，不能阻塞其他订阅者和打分请求
+			if broker.policy == DisconnectSubscriber {
+				slow = append(slow, sub)
+			} else {
+				sub.mutex.Lock()
+				sub.dropped++
+				sub.mutex.Unlock()
+			}
+		}
+	}
+	broker.mutex.RUnlock()
+
+	for _, sub := range slow {
+		sub.close(ErrSlowConsumer)
+	}
+}
+
+// Close ends all the subscriptions with ErrBrokerClosed, the later subscriptions end immediately
+func (broker *RatingBroker) Close() {
+	broker.mutex.Lock()
+	broker.closed = true
+	subs := make(map[*RatingSubscription]bool)
+	for _, laptopSubs := range broker.subscribers {
+		for sub := range laptopSubs {
+			subs[sub] = true
+		}
+	}
+	broker.mutex.Unlock()
+
+	for sub := range subs {
+		sub.close(ErrBrokerClosed)
+	}
+}
+
+func (broker *RatingBroker) unsubscribe(sub *RatingSubscription) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	for _, laptopID := range sub.laptopIDs {
+		subs := broker.subscribers[laptopID]
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(broker.subscribers, laptopID)
+		}
+	}
+}
+
+// Updates returns the channel on which the rating updates are delivered
+func (sub *RatingSubscription) Updates() <-chan *pb.RateLaptopResponse {
+	return sub.updates
+}
+
+// Done returns a channel that is closed when the subscription ends
+func (sub *RatingSubscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Err returns the reason why the subscription ended, or nil if it was closed by the subscriber
+func (sub *RatingSubscription) Err() error {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return sub.err
+}
+
+// Dropped returns the number of updates dropped because the subscriber was too slow
+func (sub *RatingSubscription) Dropped() uint64 {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return sub.dropped
+}
+
+// Close ends the subscription
+func (sub *RatingSubscription) Close() {
+	sub.close(nil)
+}
+
+func (sub *RatingSubscription) close(err error) {
+	sub.once.Do(func() {
+		sub.broker.unsubscribe(sub)
+
+		sub.mutex.Lock()
+		sub.err = err
+		sub.mutex.Unlock()
+
+		close(sub.done)
+	})
+}
@@ -0,0 +1,50 @@
+package service_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRatingBrokerSlowConsumer(t *testing.T) {
+	t.Parallel()
+
+	update := &pb.RateLaptopResponse{LaptopId: "laptop", RatedCount: 1, AverageScore: 5}
+
+	dropBroker := service.NewRatingBroker(1, service.DropUpdates)
+	dropSub := dropBroker.Subscribe([]string{"laptop"})
+	for i := 0; i < 3; i++ {
+		dropBroker.Publish(update)
+	}
+	require.Len(t, dropSub.Updates(), 1)
+	require.EqualValues(t, 2, dropSub.Dropped())
+	require.NoError(t, dropSub.Err())
+
+	disconnectBroker := service.NewRatingBroker(1, service.DisconnectSubscriber)
+	slowSub := disconnectBroker.Subscribe([]string{"laptop"})
+	disconnectBroker.Publish(update)
+	disconnectBroker.Publish(update)
+	<-slowSub.Done()
+	require.ErrorIs(t, slowSub.Err(), service.ErrSlowConsumer)
+
+	// 被断开的订阅者不会再收到更新
+	disconnectBroker.Publish(update)
+	require.Len(t, slowSub.Updates(), 1)
+}
+
+func TestRatingBrokerClose(t *testing.T) {
+	t.Parallel()
+
+	broker := service.NewRatingBroker(1, service.DropUpdates)
+	sub := broker.Subscribe([]string{"laptop1", "laptop2"})
+	broker.Close()
+	<-sub.Done()
+	require.ErrorIs(t, sub.Err(), service.ErrBrokerClosed)
+
+	// 关闭之后的订阅立即结束
+	late := broker.Subscribe([]string{"laptop1"})
+	<-late.Done()
+	require.ErrorIs(t, late.Err(), service.ErrBrokerClosed)
+	late.Close()
+}
@@ -1,6 +1,11 @@
 package service
 
-import "sync"
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
 
 // Rating contains the rating information of a laptop
 type Rating struct {
@@ -8,42 +13,163 @@ type Rating struct {
 	Sum float64
 }
 
+// RatingEvent is a single score given to a laptop by a user
+type RatingEvent struct {
+	ID        string    `json:"id"`
+	LaptopID  string    `json:"laptop_id"`
+	Username  string    `json:"username"`
+	Score     float64   `json:"score"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 // RateStore is an interface to store laptop ratings
 type RatingStore interface {
-	// Add adds a new laptop score to the store and returns its rating
-	Add(laptopID string, score float64) (*Rating, error)
+	// Add adds a new laptop score given by the user to the store and returns its rating
+	Add(laptopID string, username string, score float64) (*Rating, error)
+	// Find returns the rating of a laptop, or nil if it is never rated
+	Find(laptopID string) (*Rating, error)
+	// Remove removes a rating event and returns the removed event with the recomputed rating of its laptop
+	Remove(ratingID string) (*RatingEvent, *Rating, error)
+	// History returns the rating events of a laptop created in [from, to), zero times mean no limit
+	History(laptopID string, from time.Time, to time.Time) ([]*RatingEvent, error)
 }
 
 // InMemoryRatingStore stores laptop ratings in memory
 type InMemoryRatingStore struct{
 	mutex sync.Mutex
 	rating map[string]*Rating
+	events map[string][]*RatingEvent // key是laptop id，value是按时间排序的打分记录
 }
 
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+func (store *InMemoryRatingStore) Add(laptopID string, username string, score float64) (*Rating, error) {
+	event, err := newRatingEvent(laptopID, username, score)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.addEvent(event), nil
+}
+
+func (store *InMemoryRatingStore) Find(laptopID string) (*Rating, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
 	rating := store.rating[laptopID]
 	if rating == nil {
-		rating = &Rating{
-			Count: 1,
-			Sum:   score,
+		return nil, nil
+	}
+	return &Rating{Count: rating.Count, Sum: rating.Sum}, nil
+}
+
+func (store *InMemoryRatingStore) Remove(ratingID string) (*RatingEvent, *Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.removeEvent(ratingID)
+}
+
+func (store *InMemoryRatingStore) History(laptopID string, from time.Time, to time.Time) ([]*RatingEvent, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var events []*RatingEvent
+	for _, event := range store.events[laptopID] {
+		if !from.IsZero() && event.CreatedAt.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !event.CreatedAt.Before(to) {
+			continue
+		}
+
+		other := *event
+		events = append(events, &other)
+	}
+	return events, nil
+}
+
+// addEvent appends the event to the laptop history and updates its rating, the caller must hold the mutex
+func (store *InMemoryRatingStore) addEvent(event *RatingEvent) *Rating {
+	store.events[event.LaptopID] = append(store.events[event.LaptopID], event)
+
+	rating := store.rating[event.LaptopID]
+	if rating == nil {
+		rating = &Rating{}
+		store.rating[event.LaptopID] = rating
+	}
+	rating.Count++
+	rating.Sum += event.Score
+
+	return &Rating{Count: rating.Count, Sum: rating.Sum}
+}
+
+// findEvent returns the event with the given id, the caller must hold the mutex
+func (store *InMemoryRatingStore) findEvent(ratingID string) *RatingEvent {
+	for _, events := range store.events {
+		for _, event := range events {
+			if event.ID == ratingID {
+				return event
+			}
 		}
-	}else {
+	}
+	return nil
+}
+
+// removeEvent deletes the event from its laptop history and recomputes the rating, the caller must hold the mutex
+func (store *InMemoryRatingStore) removeEvent(ratingID string) (*RatingEvent, *Rating, error) {
+	for laptopID, events := range store.events {
+		for i, event := range events {
+			if event.ID != ratingID {
+				continue
+			}
+
+			store.events[laptopID] = append(events[:i:i], events[i+1:]...)
+			return event, store.recompute(laptopID), nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("rating %s: %w", ratingID, ErrNotFound)
+}
+
+// recompute rebuilds the rating of a laptop from its history instead of trusting the running sum
+func (store *InMemoryRatingStore) recompute(laptopID string) *Rating {
+	rating := &Rating{}
+	for _, event := range store.events[laptopID] {
 		rating.Count++
-		rating.Sum += score
+		rating.Sum += event.Score
+	}
+
+	if rating.Count == 0 {
+		delete(store.rating, laptopID)
+		delete(store.events, laptopID)
+	} else {
+		store.rating[laptopID] = rating
+	}
+
+	return &Rating{Count: rating.Count, Sum: rating.Sum}
+}
+
+func newRatingEvent(laptopID string, username string, score float64) (*RatingEvent, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate rating id: %v", err)
 	}
 
-	// TODO: 这里是指针变量，需不需要在重新指回？
-	store.rating[laptopID] = rating
-	return rating, nil
+	event := &RatingEvent{
+		ID:        id.String(),
+		LaptopID:  laptopID,
+		Username:  username,
+		Score:     score,
+		CreatedAt: time.Now().UTC(),
+	}
+	return event, nil
 }
 
 func NewInMemoryRatingStore() *InMemoryRatingStore {
 	return &InMemoryRatingStore{
 		rating: make(map[string]*Rating),
+		events: make(map[string][]*RatingEvent),
 	}
 }
-
-
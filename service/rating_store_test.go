@@ -0,0 +1,98 @@
+package service_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileRatingStore(t *testing.T) {
+	t.Parallel()
+
+	ratingFile := filepath.Join(t.TempDir(), "ratings.jsonl")
+
+	store, err := service.NewFileRatingStore(ratingFile)
+	require.NoError(t, err)
+
+	_, err = store.Add("laptop1", "user1", 8)
+	require.NoError(t, err)
+	_, err = store.Add("laptop1", "user2", 2)
+	require.NoError(t, err)
+	_, err = store.Add("laptop2", "user1", 5)
+	require.NoError(t, err)
+
+	events, err := store.History("laptop1", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "user2", events[1].Username)
+
+	// 删除一条打分记录后，评分需要重新计算
+	removed, rating, err := store.Remove(events[1].ID)
+	require.NoError(t, err)
+	require.Equal(t, "laptop1", removed.LaptopID)
+	require.Equal(t, &service.Rating{Count: 1, Sum: 8}, rating)
+
+	_, _, err = store.Remove(events[1].ID)
+	require.ErrorIs(t, err, service.ErrNotFound)
+	require.NoError(t, store.Close())
+
+	// 模拟写到一半崩溃留下的不完整记录
+	file, err := os.OpenFile(ratingFile, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"add","event":{"id"`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	store, err = service.NewFileRatingStore(ratingFile)
+	require.NoError(t, err)
+	defer store.Close()
+
+	rating, err = store.Find("laptop1")
+	require.NoError(t, err)
+	require.Equal(t, &service.Rating{Count: 1, Sum: 8}, rating)
+
+	rating, err = store.Find("laptop2")
+	require.NoError(t, err)
+	require.Equal(t, &service.Rating{Count: 1, Sum: 5}, rating)
+
+	_, err = store.Add("laptop2", "user2", 7)
+	require.NoError(t, err)
+
+	events, err = store.History("laptop2", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	// 时间范围是左闭右开区间
+	events, err = store.History("laptop2", events[1].CreatedAt, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, 7.0, events[0].Score)
+
+	events, err = store.History("laptop2", time.Time{}, events[0].CreatedAt)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, 5.0, events[0].Score)
+}
+
+func TestFileRatingStoreInvalidRecord(t *testing.T) {
+	t.Parallel()
+
+	// 缺少event的记录是错误，不能在启动时panic
+	for _, line := range []string{
+		`{"op":"add"}`,
+		`{"op":"add","event":null}`,
+		`{"op":"add","event":{"laptop_id":"laptop1","score":8}}`,
+		`{"op":"add","event":{"id":"rating1","score":8}}`,
+	} {
+		ratingFile := filepath.Join(t.TempDir(), "ratings.jsonl")
+		require.NoError(t, ioutil.WriteFile(ratingFile, []byte(line+"\n"), 0644))
+
+		_, err := service.NewFileRatingStore(ratingFile)
+		require.Error(t, err, line)
+		require.Contains(t, err.Error(), "missing event", line)
+	}
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/serializer"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+)
+
+// uploadImageChunkSize is the size of the chunks sent to the gRPC server when uploading an image with multipart form
+const uploadImageChunkSize = 1024
+
+// NewRESTGateway returns an HTTP handler that translates REST/JSON requests to the gRPC server at the endpoint.
+// JSON uses the same conventions as the serializer package: original field names and enums as strings.
+// Server-streaming RPCs are sent as newline delimited JSON, and images can also be uploaded as multipart form
+// to POST /v1/laptop/{laptop_id}/image with the file in the image field, up to the max image size of the server
+func NewRESTGateway(ctx context.Context, endpoint string, dialOptions []grpc.DialOption, maxImageSize int64) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions:   serializer.JSONMarshalOptions(),
+			UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		}),
+		runtime.WithIncomingHeaderMatcher(restHeaderMatcher),
+	)
+
+	err := pb.RegisterLaptopServiceHandlerFromEndpoint(ctx, mux, endpoint, dialOptions)
+	if err != nil {
+		return nil, fmt.Errorf("cannot register laptop service handler: %w", err)
+	}
+
+	err = pb.RegisterAuthServiceHandlerFromEndpoint(ctx, mux, endpoint, dialOptions)
+	if err != nil {
+		return nil, fmt.Errorf("cannot register auth service handler: %w", err)
+	}
+
+	conn, err := grpc.DialContext(ctx, endpoint, dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot dial endpoint: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	uploader := &multipartImageUploader{mux: mux, laptopClient: pb.NewLaptopServiceClient(conn), maxImageSize: maxImageSize}
+	err = mux.HandlePath(http.MethodPost, "/v1/laptop/{laptop_id}/image", uploader.handle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot register upload image handler: %w", err)
+	}
+
+	return mux, nil
+}
+
+// restHeaderMatcher forwards the API key header to gRPC metadata in addition to the default headers,
+// the Authorization header is always forwarded
+func restHeaderMatcher(key string) (string, bool) {
+	if textproto.CanonicalMIMEHeaderKey(key) == "X-Api-Key" {
+		return "x-api-key", true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// multipartImageUploader uploads the image of a multipart form with the UploadImage RPC
+type multipartImageUploader struct {
+	mux          *runtime.ServeMux
+	laptopClient pb.LaptopServiceClient
+	maxImageSize int64
+}
+
+func (uploader *multipartImageUploader) handle(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	ctx := r.Context()
+	_, marshaler := runtime.MarshalerForRequest(uploader.mux, r)
+
+	res, err := uploader.upload(w, r, pathParams["laptop_id"])
+	if err != nil {
+		runtime.HTTPError(ctx, uploader.mux, marshaler, w, r, err)
+		return
+	}
+
+	runtime.ForwardResponseMessage(ctx, uploader.mux, marshaler, w, r, res, uploader.mux.GetForwardResponseOptions()...)
+}
+
+func (uploader *multipartImageUploader) upload(w http.ResponseWriter, r *http.Request, laptopID string) (*pb.UploadImageResponse, error) {
+	// 和gRPC服务一样限制图片大小，多出的部分留给表单的其他字段
+	r.Body = http.MaxBytesReader(w, r.Body, uploader.maxImageSize+uploadImageChunkSize)
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot read image from multipart form: %v", err)
+	}
+	defer file.Close()
+
+	ctx, err := runtime.AnnotateContext(r.Context(), uploader.mux, r, "/techschool.pcbook.LaptopService/UploadImage")
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := uploader.laptopClient.UploadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_Info{
+			Info: &pb.ImageInfo{
+				LaptopId:  laptopID,
+				ImageType: filepath.Ext(header.Filename),
+			},
+		},
+	}
+	err = stream.Send(req)
+	if err != nil {
+		return nil, sendError(stream, err)
+	}
+
+	buffer := make([]byte, uploadImageChunkSize)
+	for {
+		n, err := file.Read(buffer)
+		if n > 0 {
+			req := &pb.UploadImageRequest{
+				Data: &pb.UploadImageRequest_ChunkData{ChunkData: buffer[:n]},
+			}
+			if sendErr := stream.Send(req); sendErr != nil {
+				return nil, sendError(stream, sendErr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot read image: %v", err)
+		}
+	}
+
+	return stream.CloseAndRecv()
+}
+
+// sendError returns the error of the server, since Send only returns EOF when the server has failed the stream
+func sendError(stream pb.LaptopService_UploadImageClient, err error) error {
+	_, recvErr := stream.CloseAndRecv()
+	if recvErr != nil {
+		return recvErr
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package service_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Ruadgedy/pcbook-go/pb"
+	"github.com/Ruadgedy/pcbook-go/sample"
+	"github.com/Ruadgedy/pcbook-go/serializer"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRESTGateway(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewDiskImageStore(t.TempDir())
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	gateway, err := service.NewRESTGateway(ctx, serverAddress, []grpc.DialOption{grpc.WithInsecure()}, service.DefaultMaxImageSize)
+	require.NoError(t, err)
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	// 请求和响应都使用serializer的JSON格式：原始字段名，枚举使用字符串
+	laptop := sample.NewLaptop()
+	laptop.PriceUsd = 1500
+	body, err := serializer.ProtobufToJSON(&pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+	require.Contains(t, body, `"price_usd"`)
+
+	res, err := http.Post(server.URL+"/v1/laptop/create", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	created := &struct {
+		ID string `json:"id"`
+	}{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(created))
+	require.Equal(t, laptop.Id, created.ID)
+
+	// 搜索结果以换行分隔的JSON流返回
+	res, err = http.Get(server.URL + "/v1/laptop/search?filter.max_price_usd=2000&filter.min_ram.unit=BIT")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	scanner := bufio.NewScanner(res.Body)
+	require.True(t, scanner.Scan())
+	line := scanner.Text()
+	require.Contains(t, line, `"id":"`+laptop.Id+`"`)
+	require.Contains(t, line, `"unit":"`)
+	require.False(t, scanner.Scan())
+
+	// 使用multipart表单上传图片
+	form := &bytes.Buffer{}
+	writer := multipart.NewWriter(form)
+	part, err := writer.CreateFormFile("image", "laptop.jpg")
+	require.NoError(t, err)
+	imageData := bytes.Repeat([]byte{1}, 3000)
+	_, err = part.Write(imageData)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	res, err = http.Post(server.URL+"/v1/laptop/"+laptop.Id+"/image", writer.FormDataContentType(), form)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	uploaded := &struct {
+		ID   string `json:"id"`
+		Size int    `json:"size"`
+	}{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(uploaded))
+	require.Equal(t, len(imageData), uploaded.Size)
+
+	info, err := imageStore.Find(uploaded.ID)
+	require.NoError(t, err)
+	require.Equal(t, laptop.Id, info.LaptopID)
+	require.Equal(t, ".jpg", info.Type)
+
+	// gRPC错误转换为HTTP状态码
+	form.Reset()
+	writer = multipart.NewWriter(form)
+	part, err = writer.CreateFormFile("image", "laptop.jpg")
+	require.NoError(t, err)
+	_, err = part.Write(imageData)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	res, err = http.Post(server.URL+"/v1/laptop/unknown/image", writer.FormDataContentType(), form)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestRESTGatewayMaxImageSize(t *testing.T) {
+	t.Parallel()
+
+	// 图片大小的限制大于默认的1MiB
+	const maxImageSize = 3 << 20
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewDiskImageStore(t.TempDir())
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, nil, nil)
+	laptopServer.SetMaxImageSize(maxImageSize)
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	gateway, err := service.NewRESTGateway(ctx, listener.Addr().String(), []grpc.DialOption{grpc.WithInsecure()}, maxImageSize)
+	require.NoError(t, err)
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	res := postTestImage(t, server.URL+"/v1/laptop/"+laptop.Id+"/image", 2<<20)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	uploaded := &struct {
+		Size int `json:"size"`
+	}{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(uploaded))
+	require.Equal(t, 2<<20, uploaded.Size)
+
+	// 超过限制的图片在网关就被拒绝
+	res = postTestImage(t, server.URL+"/v1/laptop/"+laptop.Id+"/image", maxImageSize+1)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+// postTestImage uploads an image of the size with multipart form
+func postTestImage(t *testing.T, url string, size int) *http.Response {
+	form := &bytes.Buffer{}
+	writer := multipart.NewWriter(form)
+	part, err := writer.CreateFormFile("image", "laptop.jpg")
+	require.NoError(t, err)
+	_, err = part.Write(bytes.Repeat([]byte{1}, size))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	res, err := http.Post(url, writer.FormDataContentType(), form)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RefreshToken contains the information of an issued refresh token
+type RefreshToken struct {
+	ID            string // refresh token的hash值，不保存token原文
+	FamilyID      string // 同一次登录轮换出的所有refresh token属于同一个family
+	Username      string
+	AccessTokenID string // 与该refresh token一起签发的access token的jti
+	AuthMethods   []string // 登录时使用的认证方式，换取的access token保持不变
+	ExpiresAt     time.Time
+	Used          bool // 已经被用来换取过新token
+}
+
+// RefreshTokenStore is an interface to store refresh tokens
+type RefreshTokenStore interface {
+	// Save saves a new refresh token to the store
+	Save(token *RefreshToken) error
+	// Find finds a refresh token by id
+	Find(id string) (*RefreshToken, error)
+	// MarkUsed marks a refresh token as used, and returns false if it was already used
+	MarkUsed(id string) (bool, error)
+	// RemoveFamily removes all refresh tokens of the family and returns them
+	RemoveFamily(familyID string) ([]*RefreshToken, error)
+	// RemoveUser removes all refresh tokens of the user and returns them
+	RemoveUser(username string) ([]*RefreshToken, error)
+}
+
+// RevokedTokenStore is an interface to store the ids of revoked access tokens
+type RevokedTokenStore interface {
+	// Revoke revokes the token until it expires
+	Revoke(tokenID string, expiresAt time.Time) error
+	// IsRevoked checks if the token is revoked
+	IsRevoked(tokenID string) (bool, error)
+}
+
+// InMemoryRefreshTokenStore stores refresh tokens in memory
+type InMemoryRefreshTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]*RefreshToken
+}
+
+// NewInMemoryRefreshTokenStore returns a new InMemoryRefreshTokenStore
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{
+		tokens: make(map[string]*RefreshToken),
+	}
+}
+
+func (store *InMemoryRefreshTokenStore) Save(token *RefreshToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.tokens[token.ID] != nil {
+		return ErrAlreadyExists
+	}
+
+	store.removeExpired()
+
+	other := *token
+	store.tokens[token.ID] = &other
+	return nil
+}
+
+func (store *InMemoryRefreshTokenStore) Find(id string) (*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	token := store.tokens[id]
+	if token == nil {
+		return nil, nil
+	}
+
+	other := *token
+	return &other, nil
+}
+
+func (store *InMemoryRefreshTokenStore) MarkUsed(id string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	token := store.tokens[id]
+	if token == nil {
+		return false, fmt.Errorf("refresh token: %w", ErrNotFound)
+	}
+	if token.Used {
+		return false, nil
+	}
+
+	token.Used = true
+	return true, nil
+}
+
+func (store *InMemoryRefreshTokenStore) RemoveFamily(familyID string) ([]*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var removed []*RefreshToken
+	for id, token := range store.tokens {
+		if token.FamilyID == familyID {
+			removed = append(removed, token)
+			delete(store.tokens, id)
+		}
+	}
+	return removed, nil
+}
+
+func (store *InMemoryRefreshTokenStore) RemoveUser(username string) ([]*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var removed []*RefreshToken
+	for id, token := range store.tokens {
+		if token.Username == username {
+			removed = append(removed, token)
+			delete(store.tokens, id)
+		}
+	}
+	return removed, nil
+}
+
+// removeExpired removes the expired tokens, the caller must hold the mutex
+func (store *InMemoryRefreshTokenStore) removeExpired() {
+	now := time.Now()
+	for id, token := range store.tokens {
+		if now.After(token.ExpiresAt) {
+			delete(store.tokens, id)
+		}
+	}
+}
+
+// InMemoryRevokedTokenStore stores revoked token ids in memory until the tokens expire
+type InMemoryRevokedTokenStore struct {
+	mutex  sync.RWMutex
+	tokens map[string]time.Time // key是token的jti，value是token的过期时间
+}
+
+// NewInMemoryRevokedTokenStore returns a new InMemoryRevokedTokenStore
+func NewInMemoryRevokedTokenStore() *InMemoryRevokedTokenStore {
+	return &InMemoryRevokedTokenStore{
+		tokens: make(map[string]time.Time),
+	}
+}
+
+func (store *InMemoryRevokedTokenStore) Revoke(tokenID string, expiresAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// 已经过期的token不可能再通过验证，不需要继续保存
+	now := time.Now()
+	for id, expiry := range store.tokens {
+		if now.After(expiry) {
+			delete(store.tokens, id)
+		}
+	}
+
+	store.tokens[tokenID] = expiresAt
+	return nil
+}
+
+func (store *InMemoryRevokedTokenStore) IsRevoked(tokenID string) (bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	_, ok := store.tokens[tokenID]
+	return ok, nil
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod     = 30 * time.Second // RFC 6238推荐的时间窗口
+	totpDigits     = 6
+	totpSkew       = 1         // 前后各容忍一个时间窗口的时钟误差
+	totpSecretSize = 20        // RFC 4226推荐的160位secret
+	totpIssuer     = "PC Book" // 认证器应用中显示的服务名
+
+	// RecoveryCodeCount is the number of recovery codes generated when two-factor authentication is enabled
+	RecoveryCodeCount = 10
+	recoveryCodeSize  = 10 // 80位随机数，编码为16个字符
+)
+
+// totpEncoding encodes TOTP secrets without padding, which is the format authenticator apps expect
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret generates a random base32 encoded secret for RFC 6238 TOTP
+func GenerateTOTPSecret() (string, error) {
+	data := make([]byte, totpSecretSize)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate totp secret: %v", err)
+	}
+	return totpEncoding.EncodeToString(data), nil
+}
+
+// TOTPProvisioningURI returns the otpauth URI of the secret, authenticator apps can scan it as a QR code
+func TOTPProvisioningURI(issuer string, username string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// GenerateTOTPCode returns the TOTP code of the secret at time t
+func GenerateTOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, totpCounter(t)), nil
+}
+
+// ValidateTOTPCode checks the code of the secret at time t, and returns the time step of the code.
+// Codes of the adjacent time steps are also accepted to tolerate clock drift
+func ValidateTOTPCode(secret string, code string, t time.Time) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	counter := totpCounter(t)
+	for step := counter - totpSkew; step <= counter+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// VerifyTOTPCode checks the TOTP code of the user at time t, each code can only be used once
+func (user *User) VerifyTOTPCode(code string, t time.Time) bool {
+	counter, ok := ValidateTOTPCode(user.TOTPSecret, code, t)
+	if !ok || counter <= user.TOTPLastCounter {
+		return false
+	}
+
+	user.TOTPLastCounter = counter
+	return true
+}
+
+// UseRecoveryCode checks the recovery code of the user and removes it, each code can only be used once
+func (user *User) UseRecoveryCode(code string) bool {
+	hash := HashRecoveryCode(code)
+	for i, other := range user.RecoveryCodeHashes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(other)) == 1 {
+			user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i:i], user.RecoveryCodeHashes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateRecoveryCodes generates n one-time codes to login when the TOTP device is lost,
+// and returns the codes with their hashes, only the hashes should be stored
+func GenerateRecoveryCodes(n int) ([]string, []string, error) {
+	codes := make([]string, n)
+	hashes := make([]string, n)
+	for i := range codes {
+		data := make([]byte, recoveryCodeSize)
+		_, err := rand.Read(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot generate recovery code: %v", err)
+		}
+
+		// 分成4个字符一组，方便用户抄写
+		encoded := strings.ToLower(totpEncoding.EncodeToString(data))
+		var groups []string
+		for len(encoded) > 0 {
+			groups = append(groups, encoded[:4])
+			encoded = encoded[4:]
+		}
+
+		codes[i] = strings.Join(groups, "-")
+		hashes[i] = HashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the hash under which a recovery code is stored, ignoring case and separators
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid totp secret: %v", err)
+	}
+	return key, nil
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// totpCode computes the HOTP code of RFC 4226 for the counter
+func totpCode(key []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation：用最后一个字节的低4位作为偏移量取出31位整数
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
@@ -0,0 +1,64 @@
+package service_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	t.Parallel()
+
+	// RFC 6238附录B中SHA1的测试向量，secret是"12345678901234567890"，取验证码的后6位
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := service.GenerateTOTPCode(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		require.Equal(t, expected, code)
+	}
+
+	// 前后一个时间窗口的验证码也有效
+	now := time.Unix(1111111111, 0)
+	_, ok := service.ValidateTOTPCode(secret, "081804", now)
+	require.True(t, ok)
+	_, ok = service.ValidateTOTPCode(secret, "287082", now)
+	require.False(t, ok)
+	_, ok = service.ValidateTOTPCode(secret, "", now)
+	require.False(t, ok)
+
+	// 同一个验证码只能使用一次
+	user := &service.User{TOTPSecret: strings.ToLower(secret)}
+	require.True(t, user.VerifyTOTPCode("050471", now))
+	require.False(t, user.VerifyTOTPCode("050471", now))
+	require.False(t, user.VerifyTOTPCode("081804", now))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	t.Parallel()
+
+	codes, hashes, err := service.GenerateRecoveryCodes(service.RecoveryCodeCount)
+	require.NoError(t, err)
+	require.Len(t, codes, service.RecoveryCodeCount)
+	require.Len(t, hashes, service.RecoveryCodeCount)
+	require.Len(t, codes[0], 19)
+	require.NotEqual(t, codes[0], codes[1])
+
+	user := &service.User{RecoveryCodeHashes: hashes}
+	require.False(t, user.UseRecoveryCode("not-a-code"))
+
+	// 大小写和分隔符不影响恢复码的比较，每个恢复码只能使用一次
+	code := strings.ToUpper(strings.ReplaceAll(codes[3], "-", " "))
+	require.True(t, user.UseRecoveryCode(code))
+	require.False(t, user.UseRecoveryCode(codes[3]))
+	require.Len(t, user.RecoveryCodeHashes, service.RecoveryCodeCount-1)
+	require.Equal(t, hashes[:3], user.RecoveryCodeHashes[:3])
+}
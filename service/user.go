@@ -1,42 +1,80 @@
 package service
 
 import (
-	"fmt"
-	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleUser   = "user"
 )
 
 // User contains user's information
 type User struct {
-	Username string
-	HashedPassword string
-	Role string
+	Username string `json:"username"`
+	HashedPassword string `json:"hashed_password"` // 包含算法和参数，见PasswordHasher
+	Role string `json:"role"`
+	Disabled bool `json:"disabled,omitempty"` // 被禁用的用户不能登录
+	TOTPSecret string `json:"totp_secret,omitempty"` // base32编码的TOTP secret，确认之前是待启用的secret
+	TOTPEnabled bool `json:"totp_enabled,omitempty"` // 启用后登录需要输入TOTP验证码
+	TOTPLastCounter int64 `json:"totp_last_counter,omitempty"` // 最近一次使用的验证码的时间窗口，防止同一个验证码被重复使用
+	RecoveryCodeHashes []string `json:"recovery_code_hashes,omitempty"` // 未使用的恢复码的hash值
+	OIDCSubject string `json:"oidc_subject,omitempty"` // OpenID Connect provider的issuer和sub，不为空时没有本地密码
+	CreatedAt time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"` // 从未登录过时为零值
 }
 
+// NewUser returns a new user with the password hashed by the default hasher
 func NewUser(username string, password string, role string) (*User,error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return NewUserWithHasher(DefaultPasswordHasher(), username, password, role)
+}
+
+// NewUserWithHasher returns a new user with the password hashed by the hasher
+func NewUserWithHasher(hasher PasswordHasher, username string, password string, role string) (*User, error) {
+	hashedPassword, err := hasher.Hash(password)
 	if err != nil {
-		return nil, fmt.Errorf("cannot hash password: %v", err)
+		return nil, err
 	}
 
 	user := &User{
 		Username:       username,
-		HashedPassword: string(hashedPassword),
+		HashedPassword: hashedPassword,
 		Role:           role,
+		CreatedAt:      time.Now(),
 	}
 	return user, nil
 }
 
 // IsCorrectPassword checks if the password is correct or not
 func (user *User) IsCorrectPassword(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(password))
-	return err == nil
+	return CheckPassword(user.HashedPassword, password)
+}
+
+// SetPassword replaces the password of the user with a hash of the hasher
+func (user *User) SetPassword(hasher PasswordHasher, password string) error {
+	hashedPassword, err := hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	user.HashedPassword = hashedPassword
+	return nil
 }
 
 // Clone returns a clone of user
 func (user *User) Clone() *User{
 	return &User{
-		Username:       user.Username,
-		HashedPassword: user.HashedPassword,
-		Role:           user.Role,
+		Username:           user.Username,
+		HashedPassword:     user.HashedPassword,
+		Role:               user.Role,
+		Disabled:           user.Disabled,
+		TOTPSecret:         user.TOTPSecret,
+		TOTPEnabled:        user.TOTPEnabled,
+		TOTPLastCounter:    user.TOTPLastCounter,
+		RecoveryCodeHashes: append([]string(nil), user.RecoveryCodeHashes...),
+		OIDCSubject:        user.OIDCSubject,
+		CreatedAt:          user.CreatedAt,
+		LastLoginAt:        user.LastLoginAt,
 	}
 }
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt只使用密码的前72个字节
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z][a-z0-9_.-]*$`)
+
+// ValidateUsername checks if the username satisfies the username policy
+func ValidateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return fmt.Errorf("username must have %d to %d characters", minUsernameLength, maxUsernameLength)
+	}
+
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("username must start with a lowercase letter and contain only lowercase letters, digits, '_', '.' or '-'")
+	}
+	return nil
+}
+
+// ValidatePassword checks if the password of the user satisfies the password policy
+func ValidatePassword(username string, password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("password must have %d to %d bytes", minPasswordLength, maxPasswordLength)
+	}
+
+	hasLetter, hasDigit := false, false
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return fmt.Errorf("password must contain at least one letter and one digit")
+	}
+
+	if strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return fmt.Errorf("password must not contain the username")
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package service
 
-import "sync"
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
 
 // UserStore is an interface to store user
 type UserStore interface{
@@ -8,6 +12,12 @@ type UserStore interface{
 	Save(user *User) error
 	// Find finds a user by username
 	Find(username string) (*User,error)
+	// Update changes an existing user with the update function while holding the lock of the store, so that the
+	// changes of concurrent updates are never lost. The function receives a copy of the current user, which is
+	// saved only if the function returns nil. Update returns the updated user, or the error of the function
+	Update(username string, update func(user *User) error) (*User, error)
+	// List returns all users sorted by username
+	List() ([]*User, error)
 }
 
 // InMemoryUserStore stores user in memory
@@ -28,7 +38,7 @@ func (store *InMemoryUserStore) Save(user *User) error {
 	return nil
 }
 
-func (store InMemoryUserStore) Find(username string) (*User, error) {
+func (store *InMemoryUserStore) Find(username string) (*User, error) {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
@@ -40,6 +50,51 @@ func (store InMemoryUserStore) Find(username string) (*User, error) {
 
 }
 
+func (store *InMemoryUserStore) Update(username string, update func(user *User) error) (*User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, err := store.update(username, update)
+	if err != nil {
+		return nil, err
+	}
+
+	store.users[username] = user
+	return user.Clone(), nil
+}
+
+// update returns an updated copy of the current user without saving it, the caller must hold the mutex
+func (store *InMemoryUserStore) update(username string, update func(user *User) error) (*User, error) {
+	current := store.users[username]
+	if current == nil {
+		return nil, fmt.Errorf("user %s: %w", username, ErrNotFound)
+	}
+
+	user := current.Clone()
+	err := update(user)
+	if err != nil {
+		return nil, err
+	}
+	// 用户名是存储的key，不能修改
+	user.Username = username
+	return user, nil
+}
+
+func (store *InMemoryUserStore) List() ([]*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	users := make([]*User, 0, len(store.users))
+	for _, user := range store.users {
+		users = append(users, user.Clone())
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
 func NewInMemoryUserStore() *InMemoryUserStore{
 	return &InMemoryUserStore{
 		users: make(map[string]*User),
@@ -0,0 +1,147 @@
+package service_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Ruadgedy/pcbook-go/service"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileUserStore(t *testing.T) {
+	t.Parallel()
+
+	userFile := filepath.Join(t.TempDir(), "users.jsonl")
+
+	store, err := service.NewFileUserStore(userFile)
+	require.NoError(t, err)
+
+	user1, err := service.NewUser("user1", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, store.Save(user1))
+	require.ErrorIs(t, store.Save(user1), service.ErrAlreadyExists)
+
+	user2, err := service.NewUser("user2", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, store.Save(user2))
+
+	user1.LastLoginAt = time.Now()
+	updated, err := store.Update("user1", func(user *service.User) error {
+		user.Role = service.RoleEditor
+		user.LastLoginAt = user1.LastLoginAt
+		user.RecoveryCodeHashes = []string{"hash1", "hash2"}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, service.RoleEditor, updated.Role)
+
+	// update函数返回错误时不保存修改
+	_, err = store.Update("user1", func(user *service.User) error {
+		user.Disabled = true
+		return errors.New("rejected")
+	})
+	require.EqualError(t, err, "rejected")
+
+	_, err = store.Update("unknown", func(user *service.User) error { return nil })
+	require.ErrorIs(t, err, service.ErrNotFound)
+	require.NoError(t, store.Close())
+
+	info, err := os.Stat(userFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// 模拟写到一半崩溃留下的不完整记录
+	file, err := os.OpenFile(userFile, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"username":"user3"`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	store, err = service.NewFileUserStore(userFile)
+	require.NoError(t, err)
+	defer store.Close()
+
+	users, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+
+	found, err := store.Find("user1")
+	require.NoError(t, err)
+	require.Equal(t, service.RoleEditor, found.Role)
+	require.False(t, found.Disabled)
+	require.Equal(t, []string{"hash1", "hash2"}, found.RecoveryCodeHashes)
+	require.True(t, found.CreatedAt.Equal(user1.CreatedAt))
+	require.True(t, found.LastLoginAt.Equal(user1.LastLoginAt))
+	require.True(t, found.IsCorrectPassword("secret"))
+
+	// 打开时压缩为每个用户一行
+	data, err := ioutil.ReadFile(userFile)
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(data), "\n"))
+
+	user3, err := service.NewUser("user3", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, store.Save(user3))
+
+	found, err = store.Find("user3")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+}
+
+func TestUserStoreConcurrentUpdates(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryUserStore()
+	user, err := service.NewUser("user1", "secret", service.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, store.Save(user))
+
+	// 并发修改不同的字段，任何一个修改都不会被覆盖
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := store.Update("user1", func(user *service.User) error {
+				user.LastLoginAt = time.Now()
+				return nil
+			})
+			require.NoError(t, err)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.Update("user1", func(user *service.User) error {
+				user.RecoveryCodeHashes = append(user.RecoveryCodeHashes, fmt.Sprintf("hash%d", i))
+				return nil
+			})
+			require.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	found, err := store.Find("user1")
+	require.NoError(t, err)
+	require.Len(t, found.RecoveryCodeHashes, 20)
+}
+
+func TestFileUserStoreMode(t *testing.T) {
+	t.Parallel()
+
+	// 已经存在的文件的权限也会被改为只有所有者可读写
+	userFile := filepath.Join(t.TempDir(), "users.jsonl")
+	require.NoError(t, ioutil.WriteFile(userFile, nil, 0644))
+
+	store, err := service.NewFileUserStore(userFile)
+	require.NoError(t, err)
+	defer store.Close()
+
+	info, err := os.Stat(userFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
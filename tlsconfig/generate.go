@@ -0,0 +1,130 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Certificate is a generated certificate with its private key, it is meant for local development only
+type Certificate struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// GenerateCA generates a self-signed CA certificate
+func GenerateCA(commonName string, validFor time.Duration) (*Certificate, error) {
+	template, err := newTemplate(commonName, validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	return sign(template, nil)
+}
+
+// GenerateServerCertificate generates a server certificate signed by the CA for the hosts,
+// each host is either a DNS name or an IP address
+func GenerateServerCertificate(ca *Certificate, commonName string, hosts []string, validFor time.Duration) (*Certificate, error) {
+	template, err := newTemplate(commonName, validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return sign(template, ca)
+}
+
+// GenerateClientCertificate generates a client certificate signed by the CA,
+// the common name identifies the client to the server
+func GenerateClientCertificate(ca *Certificate, commonName string, validFor time.Duration) (*Certificate, error) {
+	template, err := newTemplate(commonName, validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return sign(template, ca)
+}
+
+// WriteFiles writes the certificate and the private key to PEM files, the key file is only readable by the owner
+func (cert *Certificate) WriteFiles(certFile string, keyFile string) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Cert.Raw})
+	err := ioutil.WriteFile(certFile, certPEM, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write certificate file: %w", err)
+	}
+
+	keyData, err := x509.MarshalPKCS8PrivateKey(cert.Key)
+	if err != nil {
+		return fmt.Errorf("cannot encode private key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyData})
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write key file: %w", err)
+	}
+	return nil
+}
+
+func newTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate serial number: %v", err)
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"PC Book"},
+			CommonName:   commonName,
+		},
+		NotBefore: now.Add(-time.Minute), // 容忍少量的时钟误差
+		NotAfter:  now.Add(validFor),
+	}, nil
+}
+
+// sign signs the certificate with the CA, or self-signs it if ca is nil
+func sign(template *x509.Certificate, ca *Certificate) (*Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate private key: %v", err)
+	}
+
+	parent, parentKey := template, key
+	if ca != nil {
+		parent, parentKey = ca.Cert, ca.Key
+	}
+
+	data, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate: %v", err)
+	}
+	return &Certificate{Cert: cert, Key: key}, nil
+}
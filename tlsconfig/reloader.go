@@ -0,0 +1,202 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader loads a CA certificate and a certificate key pair from PEM files,
+// and reloads them when the files change so that certificates can be renewed without restart
+type Reloader struct {
+	caFile   string
+	certFile string
+	keyFile  string
+
+	mutex    sync.RWMutex
+	caPool   *x509.CertPool
+	cert     *tls.Certificate
+	modTimes map[string]time.Time // 每个文件上次加载时的修改时间
+}
+
+// NewReloader loads the files, caFile or the key pair may be empty if they are not needed
+func NewReloader(caFile string, certFile string, keyFile string) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("certificate and key files must be set together")
+	}
+
+	reloader := &Reloader{
+		caFile:   caFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	_, err := reloader.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload loads the files if any of them has changed since the last load, and returns true if they are reloaded.
+// If the new files are invalid, the current certificates stay in effect
+func (reloader *Reloader) Reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	for _, filename := range []string{reloader.caFile, reloader.certFile, reloader.keyFile} {
+		if filename == "" {
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false, fmt.Errorf("cannot stat certificate file: %w", err)
+		}
+		modTimes[filename] = info.ModTime()
+	}
+
+	reloader.mutex.RLock()
+	unchanged := reloader.modTimes != nil && sameModTimes(reloader.modTimes, modTimes)
+	reloader.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var caPool *x509.CertPool
+	if reloader.caFile != "" {
+		pemCA, err := ioutil.ReadFile(reloader.caFile)
+		if err != nil {
+			return false, fmt.Errorf("cannot read CA certificate: %w", err)
+		}
+
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pemCA) {
+			return false, fmt.Errorf("no valid CA certificate in %s", reloader.caFile)
+		}
+	}
+
+	var cert *tls.Certificate
+	if reloader.certFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("cannot load certificate key pair: %w", err)
+		}
+		cert = &keyPair
+	}
+
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	reloader.caPool = caPool
+	reloader.cert = cert
+	reloader.modTimes = modTimes
+	return true, nil
+}
+
+func sameModTimes(times map[string]time.Time, other map[string]time.Time) bool {
+	for filename, modTime := range other {
+		if !times[filename].Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// Watch checks the files for changes every interval until stop is called
+func (reloader *Reloader) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				reloaded, err := reloader.Reload()
+				if err != nil {
+					log.Printf("cannot reload certificates, keep using the current ones: %v", err)
+				} else if reloaded {
+					log.Printf("reloaded certificate %s", reloader.certFile)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// CAPool returns the CA certificates that were last loaded, or nil if there is no CA file
+func (reloader *Reloader) CAPool() *x509.CertPool {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.caPool
+}
+
+// Certificate returns the key pair that was last loaded, or nil if there is no key pair
+func (reloader *Reloader) Certificate() *tls.Certificate {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.cert
+}
+
+// ServerConfig returns the TLS config of a server that always uses the current certificates,
+// clientAuth decides whether clients must present a certificate signed by the CA
+func (reloader *Reloader) ServerConfig(clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	if reloader.Certificate() == nil {
+		return nil, fmt.Errorf("server certificate is required")
+	}
+	if clientAuth >= tls.VerifyClientCertIfGiven && reloader.CAPool() == nil {
+		return nil, fmt.Errorf("CA certificate is required to verify client certificates")
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	// 每次握手都使用最新加载的证书和CA
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*reloader.Certificate()},
+			ClientAuth:   clientAuth,
+			ClientCAs:    reloader.CAPool(),
+		}, nil
+	}
+	return config, nil
+}
+
+// ClientConfig returns the TLS config of a client, the client certificate is only sent if there is a key pair.
+// The CA is read when the config is created, the client certificate is reloaded on each handshake
+func (reloader *Reloader) ClientConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    reloader.CAPool(), // 为nil时使用系统的CA
+	}
+	if reloader.Certificate() != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.Certificate(), nil
+		}
+	}
+	return config
+}
+
+// ParseClientAuth parses the client authentication mode: none, verify-if-given or require
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q, must be none, verify-if-given or require", mode)
+	}
+}
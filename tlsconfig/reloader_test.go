@@ -0,0 +1,59 @@
+package tlsconfig_test
+
+import (
+	"github.com/Ruadgedy/pcbook-go/tlsconfig"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloader(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca-cert.pem")
+	certFile := filepath.Join(dir, "server-cert.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+
+	ca, err := tlsconfig.GenerateCA("test CA", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, ca.WriteFiles(caFile, filepath.Join(dir, "ca-key.pem")))
+
+	writeServerCert := func(modTime time.Time) *tlsconfig.Certificate {
+		cert, err := tlsconfig.GenerateServerCertificate(ca, "server", []string{"localhost", "127.0.0.1"}, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, cert.WriteFiles(certFile, keyFile))
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+		return cert
+	}
+
+	now := time.Now()
+	first := writeServerCert(now.Add(-time.Minute))
+	reloader, err := tlsconfig.NewReloader(caFile, certFile, keyFile)
+	require.NoError(t, err)
+	require.NotNil(t, reloader.CAPool())
+	require.Equal(t, first.Cert.Raw, reloader.Certificate().Certificate[0])
+
+	reloaded, err := reloader.Reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	second := writeServerCert(now)
+	reloaded, err = reloader.Reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Equal(t, second.Cert.Raw, reloader.Certificate().Certificate[0])
+
+	// 无效的证书不会替换当前的证书
+	require.NoError(t, os.WriteFile(certFile, []byte("invalid"), 0644))
+	require.NoError(t, os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute)))
+	_, err = reloader.Reload()
+	require.Error(t, err)
+	require.Equal(t, second.Cert.Raw, reloader.Certificate().Certificate[0])
+
+	_, err = tlsconfig.NewReloader("", certFile, "")
+	require.Error(t, err)
+}